@@ -10,7 +10,8 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
-func DataGeneratorMain() {
+// inserts a row every second until ctx is cancelled
+func DataGeneratorMain(ctx context.Context) {
 	// Seed the random number generator
 	rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -18,17 +19,19 @@ func DataGeneratorMain() {
 	// Config loader will look in current or parent directory for "Docker_Connections"
 	primaryConfig, err := LoadDockerEnvConfig("Primary.env")
 	if err != nil {
-		log.Fatalf("Failed to load Primary config: %v", err)
+		log.Printf("Data generator: failed to load Primary config: %v", err)
+		return
 	}
 
 	log.Printf("Connecting to Primary at %s:%d...", primaryConfig.Host, primaryConfig.Port)
 
-	ctx := context.Background()
 	conn, err := pgx.Connect(ctx, primaryConfig.Dsn)
 	if err != nil {
-		log.Fatalf("Unable to connect to database: %v", err)
+		log.Printf("Data generator: unable to connect to database: %v", err)
+		return
 	}
-	defer conn.Close(ctx)
+	// ctx is already cancelled when we get here on shutdown
+	defer conn.Close(context.Background())
 
 	log.Println("Connected. Starting data generation loop (every 1 second)...")
 
@@ -36,11 +39,22 @@ func DataGeneratorMain() {
 	defer ticker.Stop()
 
 	counter := 1
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			// an insert cut off by the cancel is rolled back by the server, nothing half written
+			log.Printf("Data generator stopped after %d rows.", counter-1)
+			return
+		case <-ticker.C:
+		}
+
 		msg := fmt.Sprintf("Auto-generated entry %d", counter)
 		val := rand.Float64() * 1000
 
 		_, err := conn.Exec(ctx, "INSERT INTO test_data (counter, message, value) VALUES ($1, $2, $3)", counter, msg, val)
+		if err != nil && ctx.Err() != nil {
+			continue
+		}
 		if err != nil {
 			log.Printf("Error inserting row %d: %v", counter, err)
 		} else {
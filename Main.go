@@ -1,13 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -53,7 +56,6 @@ func PerformStartupChecks(primary_config *PgConnInfo, standby_config *PgConnInfo
 	// 2. Database Tables (Test Data)
 	CheckTestDataTable(primary_config.Dsn, "primary") // Database Tables
 	CheckTestDataTable(standby_config.Dsn, "standby") // Database Tables
-	CheckMetaDataTable(primary_config.Dsn)            // wal metadata table
 
 	// 3. plysical replication slots
 	CheckPhysicalReplicationSlots(primary_config.Dsn)
@@ -127,22 +129,6 @@ func CheckTestDataTable(dsn string, serverName string) {
 	}
 }
 
-func CheckMetaDataTable(dsn string) {
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, dsn)
-	if err != nil {
-		log.Printf("Failed to connect to Primary for metadata check: %v", err)
-		return
-	}
-	defer conn.Close(ctx)
-
-	sqlCommand := Create_Wal_Metadata_Table()
-	if _, err := conn.Exec(ctx, sqlCommand); err != nil {
-		log.Fatalf("Error creating wal_metadata table: %v", err)
-	}
-	fmt.Println("Checked/Created wal_metadata table on Primary.")
-}
-
 func CheckPhysicalReplicationSlots(dsn string) {
 	ctx := context.Background()
 	conn, err := pgx.Connect(ctx, dsn)
@@ -166,9 +152,188 @@ func CheckPhysicalReplicationSlots(dsn string) {
 	}
 }
 
+// streams WAL into the archive until a signal, nothing else runs
+func RunCaptureOnly(ctx context.Context, walArchiveDir string) {
+	primaryConfig, err := LoadDockerEnvConfig("Primary.env")
+	if err != nil {
+		log.Fatalf("Failed to load Primary config: %v", err)
+	}
+	appConfig, err := LoadAppEnvConfig("app.env", primaryConfig)
+	if err != nil {
+		log.Fatalf("Failed to load App config: %v", err)
+	}
+	if err := os.MkdirAll(walArchiveDir, 0755); err != nil {
+		log.Fatalf("Failed to create WAL archive dir: %v", err)
+	}
+
+	receiver := NewWalReceiver(appConfig, walArchiveDir)
+	receiver.Run(ctx)
+	receiver.Stats().Print()
+}
+
+// compares the catalog with the archive, shows the diff and applies it once the user agrees
+func ReconcileCatalog(ctx context.Context, console *Console, wm *WalManager) {
+	confirm := func(question string) bool {
+		fmt.Printf("%s (y/N): ", question)
+		answer, ok := console.ReadLine(ctx)
+		return ok && strings.EqualFold(answer, "y")
+	}
+
+	fmt.Println("Scanning the archive, every segment is re-read and re-hashed...")
+	diff, err := wm.DiffCatalog()
+	if err != nil {
+		fmt.Printf("Reconcile Error: %v\n", err)
+		return
+	}
+	diff.Print()
+	if diff.Empty() {
+		fmt.Println("Catalog matches the archive.")
+		return
+	}
+	if !confirm("Apply these changes?") {
+		fmt.Println("Nothing changed.")
+		return
+	}
+
+	replaceChecksums := false
+	if n := diff.ChecksumMismatches(); n > 0 {
+		fmt.Printf("%d segments no longer match their stored checksum. Only replace the checksums if the files were replaced on purpose,\n", n)
+		fmt.Println("otherwise the files are corrupt and restores through them should keep failing.")
+		replaceChecksums = confirm("Replace the stored checksums?")
+	}
+
+	applied, skipped, err := wm.ApplyCatalogDiff(diff, replaceChecksums)
+	if err != nil {
+		fmt.Printf("Reconcile Error: %v\n", err)
+	}
+	fmt.Printf("Applied %d changes, skipped %d.\n", applied, skipped)
+
+	if _, err := wm.RefreshContinuity(); err != nil {
+		fmt.Printf("Could not check WAL continuity: %v\n", err)
+	}
+}
+
+// asks the user what kind of restore they want and builds a validated target for it
+func PromptRecoveryTarget(ctx context.Context, console *Console, wm *WalManager) (RecoveryTarget, error) {
+	readLine := func() string {
+		fmt.Print("> ")
+		line, _ := console.ReadLine(ctx)
+		return line
+	}
+
+	fmt.Println("")
+	fmt.Println("Choose Restore Type:")
+	fmt.Println("1. Full Restore (Latest State)")
+	fmt.Println("2. Point-in-Time Recovery (LSN)")
+	fmt.Println("3. Point-in-Time Recovery (Timestamp)")
+	fmt.Println("4. Point-in-Time Recovery (Transaction ID)")
+	fmt.Println("5. Point-in-Time Recovery (Named Restore Point)")
+	fmt.Println("6. End of Base Backup (Immediate)")
+
+	fmt.Print("Enter choice (1-6): ")
+	choice, _ := console.ReadLine(ctx)
+
+	target, err := promptTargetKind(choice, readLine, wm)
+	if err != nil {
+		return target, err
+	}
+
+	// with more than one timeline in the archive, ask which one to follow
+	timelines, err := wm.GetTimelines()
+	if err != nil {
+		fmt.Printf("Could not read timelines: %v\n", err)
+		return target, nil
+	}
+	if len(timelines) > 1 {
+		fmt.Println("\nTimelines in the archive:")
+		PrintTimelineTree(timelines)
+		fmt.Println("\nTarget timeline: Enter for latest, 'current' for the base backup's timeline, or a timeline id:")
+		target.Timeline = strings.ToLower(readLine())
+		if err := target.Validate(); err != nil {
+			return RecoveryTarget{}, err
+		}
+	}
+	return target, nil
+}
+
+// builds the target for a restore type picked from the menu
+func promptTargetKind(choice string, readLine func() string, wm *WalManager) (RecoveryTarget, error) {
+	switch choice {
+	case "1":
+		return NewLatestTarget(), nil
+
+	case "2":
+		// Show available LSNs
+		lsns, err := wm.GetAvailableLSNs()
+		if err != nil {
+			return RecoveryTarget{}, fmt.Errorf("error getting WAL LSNs: %w", err)
+		}
+		fmt.Println("\nAvailable WAL Segments and LSN ranges:")
+		currentTli := ""
+		for _, l := range lsns {
+			// sorted by file name, so each timeline's segments come together
+			if l.FileName[:8] != currentTli {
+				currentTli = l.FileName[:8]
+				tli, _ := strconv.ParseUint(currentTli, 16, 32)
+				fmt.Printf(" Timeline %d:\n", tli)
+			}
+			fmt.Printf("  %s -> Start LSN: %s, End LSN: %s\n", l.FileName, l.StartLSN, l.EndLSN)
+			if l.ValidationError != "" {
+				fmt.Printf("      INVALID: %s\n", l.ValidationError)
+			}
+		}
+		if continuity, err := wm.CheckContinuity(); err != nil {
+			fmt.Printf("Could not check WAL continuity: %v\n", err)
+		} else {
+			fmt.Println("\nRestorable LSN ranges (no missing segments):")
+			for _, tli := range continuity.Timelines {
+				for _, r := range continuity.Ranges[tli] {
+					fmt.Printf("  timeline %d: %s - %s\n", tli, FormatLsn(r.StartLsn), FormatLsn(r.EndLsn))
+				}
+			}
+			for _, g := range continuity.Gaps {
+				fmt.Printf("  GAP %s\n", g)
+			}
+		}
+		fmt.Println("\nEnter target LSN (e.g., 0/1000000):")
+		return NewLsnTarget(readLine())
+
+	case "3":
+		fmt.Println("\nEnter target time. Without a timezone it's read as local time (" + time.Now().Format("MST -07:00") + ")")
+		fmt.Println("e.g., 2024-05-01 14:32:00, 2024-05-01T14:32:00Z or 14:32 for today:")
+		target, err := NewTimeTarget(readLine())
+		if err == nil {
+			fmt.Printf("Restoring to just before %s (%s)\n", target.Time.Format(time.RFC3339), FormatRecoveryTargetTime(target.Time))
+		}
+		return target, err
+
+	case "4":
+		fmt.Println("\nEnter target transaction ID (e.g., from SELECT txid_current()):")
+		return NewXidTarget(readLine())
+
+	case "5":
+		fmt.Println("\nEnter restore point name (created with SELECT pg_create_restore_point('name')):")
+		return NewNamedTarget(readLine())
+
+	case "6":
+		return NewImmediateTarget(), nil
+	}
+
+	return RecoveryTarget{}, fmt.Errorf("invalid choice %q", choice)
+}
+
 func main() {
+	// SIGINT (ctrl+c) and SIGTERM (docker stop, systemd) cancel ctx, everything long running watches it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	walArchiveDir := filepath.Join("Docker_Connections", "wal_archive")
-	do_we_have_backup := CheckForExistingBackup()
+
+	// `go run . capture` only streams WAL, in place of the wal_capturer container
+	if len(os.Args) > 1 && os.Args[1] == "capture" {
+		RunCaptureOnly(ctx, walArchiveDir)
+		return
+	}
 
 	// 1 load configs
 	primaryConfig, standbyConfig, walCaptureConfig, restoreTargetConfig, appConfig := LoadAllConfigs()
@@ -177,39 +342,89 @@ func main() {
 	PerformStartupChecks(primaryConfig, standbyConfig, walCaptureConfig, restoreTargetConfig, appConfig)
 
 	// 3. Start WAL Manager (Continuous Monitoring) in a goroutine
-	wm, err := NewWalManager(walArchiveDir, primaryConfig.Dsn)
+	catalog, err := OpenCatalogStore(ctx, appConfig, walArchiveDir)
+	if err != nil {
+		log.Fatalf("Failed to open WAL catalog: %v", err)
+	}
+	keys, err := LoadKeyRing(appConfig)
 	if err != nil {
+		catalog.Close()
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+	store, err := OpenArchiveStore(ctx, appConfig)
+	if err != nil {
+		catalog.Close()
+		log.Fatalf("Failed to open the archive store: %v", err)
+	}
+	wm, err := NewWalManager(walArchiveDir, primaryConfig.Dsn, catalog, store, keys)
+	if err != nil {
+		catalog.Close()
 		log.Fatalf("Failed to initialize WAL Manager: %v", err)
 	}
-	defer wm.Close()
+	do_we_have_backup := CheckForExistingBackup(wm.Backups)
+	if err := ValidateCompression(appConfig.WalCompression); err != nil {
+		wm.Close()
+		log.Fatalf("Invalid app config: %v", err)
+	}
+	if err := ValidateWalCapture(appConfig.WalCapture); err != nil {
+		wm.Close()
+		log.Fatalf("Invalid app config: %v", err)
+	}
+	wm.Compression = appConfig.WalCompression
 
 	// Run the WAL monitor in a separate goroutine
-	go wm.RunMonitor(5 * time.Second)
+	// background work is tracked so shutdown can wait for it before the catalog is closed
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		wm.RunMonitor(ctx)
+	}()
+
+	// with wal_capture=go WAL is streamed by this program instead of pg_receivewal
+	var receiver *WalReceiver
+	if appConfig.WalCapture == WalCaptureGo {
+		receiver = NewWalReceiver(appConfig, walArchiveDir)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			receiver.Run(ctx)
+		}()
+	}
 
 	// 4. Interactive CLI Loop
-	scanner := bufio.NewScanner(os.Stdin)
+	console := NewConsole(os.Stdin)
 	fmt.Println("\n--- PG Restore System Running ---")
 	fmt.Println("Commands:")
 	fmt.Println("  backup  - Trigger a new Base Backup on Primary (save a snapshot of the db at this point in time)")
 	fmt.Println("  restore - Trigger a Full Restore to Restore Target")
 	fmt.Println("  generate - Run Data Generator")
+	fmt.Println("  timelines - Show the timeline tree of the WAL archive")
+	fmt.Println("  reconcile - Rebuild the WAL catalog from the archive (shows the changes first)")
+	fmt.Println("  capture - Show the WAL receiver's progress (wal_capture=go)")
+	fmt.Println("  rotate-keys - Re-wrap every encrypted file with the active encryption key")
 	fmt.Println("  q       - Quit")
 
+loop:
 	for {
 		fmt.Print("> ")
-		if !scanner.Scan() {
+		input, ok := console.ReadLine(ctx)
+		if !ok {
 			break
 		}
-		input := strings.TrimSpace(scanner.Text())
 
 		switch input {
 		case "generate":
-			go DataGeneratorMain()
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				DataGeneratorMain(ctx)
+			}()
 			fmt.Println("Data Generator started in background...")
 
 		case "backup":
 			fmt.Println("")
-			err := TriggerBaseBackup("pg_primary")
+			err := TriggerBaseBackup(ctx, "pg_primary", wm.Backups, keys)
 			if err != nil {
 				fmt.Printf("Backup Error: %v\n", err)
 			} else {
@@ -218,57 +433,72 @@ func main() {
 
 		case "restore":
 			if do_we_have_backup {
-				fmt.Println("")
-				fmt.Println("Choose Restore Type:")
-				fmt.Println("1. Full Restore (Latest State)")
-				fmt.Println("2. Point-in-Time Recovery (LSN)")
-				// fmt.Println("3. Point-in-Time Recovery (Timestamp) - TODO")
-
-				fmt.Print("Enter choice (1 or 2): ")
-				var choice string
-				if scanner.Scan() {
-					choice = strings.TrimSpace(scanner.Text())
+				target, err := PromptRecoveryTarget(ctx, console, wm)
+				if err != nil {
+					fmt.Printf("Invalid restore target: %v\n", err)
+					continue
 				}
 
-				var targetLSN string
-				if choice == "2" {
-					// Show available LSNs
-					lsns, err := wm.GetAvailableLSNs()
-					if err != nil {
-						fmt.Printf("Error getting WAL LSNs: %v\n", err)
-					} else {
-						fmt.Println("\nAvailable WAL Segments and Start LSNs:")
-						for _, l := range lsns {
-							fmt.Printf("  %s -> Start LSN: %s\n", l.FileName, l.StartLSN)
-						}
-						fmt.Println("\nEnter target LSN (e.g., 0/1000000):")
-						fmt.Print("> ")
-						if scanner.Scan() {
-							targetLSN = strings.TrimSpace(scanner.Text())
-						}
-					}
-				}
-
-				if choice == "1" || (choice == "2" && targetLSN != "") {
-					err := PerformRestore("restore_target", walArchiveDir, targetLSN)
-					if err != nil {
-						fmt.Printf("Restore Error: %v\n", err)
-					}
-				} else {
-					fmt.Println("Invalid choice or empty LSN.")
+				restoreDsn := RestoreTargetDsn(restoreTargetConfig, primaryConfig)
+				result, err := PerformRestore(ctx, "restore_target", wm, restoreDsn, target)
+				if err != nil {
+					fmt.Printf("Restore Error: %v\n", err)
+				} else if !result.Success {
+					fmt.Printf("Restore Error: %s\n", result.Reason)
 				}
 
 			} else {
 				fmt.Printf("Restore Error: you have to do at least 1 backup before restoring")
 			}
 
+		case "timelines":
+			timelines, err := wm.GetTimelines()
+			if err != nil {
+				fmt.Printf("Timeline Error: %v\n", err)
+			} else {
+				PrintTimelineTree(timelines)
+			}
+
+		case "reconcile":
+			ReconcileCatalog(ctx, console, wm)
+
+		case "capture":
+			if receiver == nil {
+				fmt.Println("WAL is captured by pg_receivewal in the wal_capturer container, set wal_capture=go in app.env to stream it from here")
+			} else {
+				receiver.Stats().Print()
+			}
+
+		case "rotate-keys":
+			if keys == nil {
+				fmt.Println("Encryption is off, set wal_encryption_key_file in app.env")
+				continue
+			}
+			fmt.Printf("Re-wrapping encrypted files with key %s...\n", keys.Active.ID)
+			count, err := wm.RotateEncryptionKeys()
+			fmt.Printf("Re-wrapped %d files.\n", count)
+			if err != nil {
+				fmt.Printf("Rotate Error: %v\n", err)
+			}
+
 		case "q", "quit", "exit":
-			fmt.Println("")
-			fmt.Println("Shutting down...")
-			return
+			break loop
 
 		default:
-			fmt.Printf("Unknown command: %q. Available: backup, restore, q\n", input)
+			fmt.Printf("Unknown command: %q. Available: backup, restore, generate, timelines, reconcile, capture, rotate-keys, q\n", input)
 		}
 	}
+
+	// 5. Shutdown: stop the background work, let the pass in flight wind down (catalog and store retries
+	// give up as soon as ctx is cancelled, the next start picks up what it missed), then close the catalog
+	fmt.Println("")
+	if ctx.Err() != nil {
+		fmt.Println("Signal received, shutting down...")
+	} else {
+		fmt.Println("Shutting down...")
+	}
+	stop()
+	background.Wait()
+	wm.Close()
+	fmt.Println("Shutdown complete.")
 }
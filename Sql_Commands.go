@@ -21,20 +21,126 @@ func Create_Wal_Metadata_Table() string {
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			processed BOOLEAN DEFAULT FALSE
 		);
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS segment_size_bytes BIGINT;
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS start_lsn PG_LSN;
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS end_lsn PG_LSN;
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS header_valid BOOLEAN;
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS validation_error TEXT;
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS sha256 TEXT;
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS missing BOOLEAN DEFAULT FALSE;
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS logical_size_bytes BIGINT;
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS compression TEXT;
+		ALTER TABLE wal_metadata ADD COLUMN IF NOT EXISTS key_id TEXT;
+		CREATE TABLE IF NOT EXISTS wal_gaps (
+			timeline_id INTEGER,
+			start_lsn PG_LSN,
+			end_lsn PG_LSN,
+			first_missing_file TEXT,
+			last_missing_file TEXT,
+			detected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (timeline_id, start_lsn)
+		);
+		CREATE TABLE IF NOT EXISTS timelines (
+			timeline_id INTEGER PRIMARY KEY,
+			parent_timeline_id INTEGER,
+			switch_lsn PG_LSN,
+			reason TEXT,
+			history_file TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
 	`
 }
 
+func Upsert_Timeline() string {
+	return `
+			INSERT INTO timelines (timeline_id, parent_timeline_id, switch_lsn, reason, history_file)
+			VALUES ($1, $2, $3::pg_lsn, $4, $5)
+			ON CONFLICT (timeline_id) DO UPDATE
+			SET parent_timeline_id = EXCLUDED.parent_timeline_id,
+			    switch_lsn = EXCLUDED.switch_lsn,
+			    reason = EXCLUDED.reason,
+			    history_file = EXCLUDED.history_file
+			WHERE
+			    (timelines.parent_timeline_id IS DISTINCT FROM EXCLUDED.parent_timeline_id)
+			    OR
+			    (timelines.switch_lsn IS DISTINCT FROM EXCLUDED.switch_lsn)
+			    OR
+			    (timelines.reason IS DISTINCT FROM EXCLUDED.reason);
+		    `
+}
+
+func Insert_Wal_Gap() string {
+	return `
+			INSERT INTO wal_gaps (timeline_id, start_lsn, end_lsn, first_missing_file, last_missing_file)
+			VALUES ($1, $2::pg_lsn, $3::pg_lsn, $4, $5)
+		    `
+}
+
 func Update_Wal_MetaData_Table() string {
 	return `
-			INSERT INTO wal_metadata (file_name, timeline_id, segment_number, is_partial, file_size_bytes, processed)
-			VALUES ($1, $2, $3, $4, $5, FALSE)
+			INSERT INTO wal_metadata (file_name, timeline_id, segment_number, is_partial, file_size_bytes, processed,
+			                          segment_size_bytes, start_lsn, end_lsn, header_valid, validation_error, sha256,
+			                          logical_size_bytes, compression, key_id)
+			VALUES ($1, $2, $3, $4, $5, FALSE, $6, $7::pg_lsn, $8::pg_lsn, $9, $10, $11, $12, $13, $14)
 			ON CONFLICT (file_name) DO UPDATE 
 			SET is_partial = EXCLUDED.is_partial,
 			    file_size_bytes = EXCLUDED.file_size_bytes,
-                segment_number = EXCLUDED.segment_number
+			    logical_size_bytes = EXCLUDED.logical_size_bytes,
+			    compression = EXCLUDED.compression,
+			    key_id = EXCLUDED.key_id,
+                segment_number = EXCLUDED.segment_number,
+                segment_size_bytes = EXCLUDED.segment_size_bytes,
+                start_lsn = EXCLUDED.start_lsn,
+                end_lsn = EXCLUDED.end_lsn,
+                header_valid = EXCLUDED.header_valid,
+                validation_error = EXCLUDED.validation_error,
+                -- the first checksum of a finished segment is the reference, it's never overwritten
+                sha256 = COALESCE(wal_metadata.sha256, EXCLUDED.sha256),
+                missing = FALSE
 			WHERE 
                 (wal_metadata.is_partial = TRUE AND EXCLUDED.is_partial = FALSE) 
                 OR 
-                (wal_metadata.file_size_bytes != EXCLUDED.file_size_bytes);
+                (wal_metadata.file_size_bytes != EXCLUDED.file_size_bytes)
+                OR
+                (wal_metadata.logical_size_bytes IS DISTINCT FROM EXCLUDED.logical_size_bytes)
+                OR
+                (wal_metadata.compression IS DISTINCT FROM EXCLUDED.compression)
+                OR
+                (wal_metadata.key_id IS DISTINCT FROM EXCLUDED.key_id)
+                OR
+                (wal_metadata.start_lsn IS DISTINCT FROM EXCLUDED.start_lsn)
+                OR
+                (wal_metadata.header_valid IS DISTINCT FROM EXCLUDED.header_valid)
+                OR
+                (wal_metadata.validation_error IS DISTINCT FROM EXCLUDED.validation_error)
+                OR
+                (wal_metadata.sha256 IS NULL AND EXCLUDED.sha256 IS NOT NULL)
+                OR
+                (wal_metadata.missing = TRUE);
+		    `
+}
+
+// overwrites a row completely, checksum included. used by the catalog reconcile
+func Put_Wal_MetaData() string {
+	return `
+			INSERT INTO wal_metadata (file_name, timeline_id, segment_number, is_partial, file_size_bytes, processed,
+			                          segment_size_bytes, start_lsn, end_lsn, header_valid, validation_error, sha256, missing,
+			                          logical_size_bytes, compression, key_id)
+			VALUES ($1, $2, $3, $4, $5, FALSE, $6, $7::pg_lsn, $8::pg_lsn, $9, $10, $11, $12, $13, $14, $15)
+			ON CONFLICT (file_name) DO UPDATE
+			SET timeline_id = EXCLUDED.timeline_id,
+			    segment_number = EXCLUDED.segment_number,
+			    is_partial = EXCLUDED.is_partial,
+			    file_size_bytes = EXCLUDED.file_size_bytes,
+			    segment_size_bytes = EXCLUDED.segment_size_bytes,
+			    start_lsn = EXCLUDED.start_lsn,
+			    end_lsn = EXCLUDED.end_lsn,
+			    header_valid = EXCLUDED.header_valid,
+			    validation_error = EXCLUDED.validation_error,
+			    sha256 = EXCLUDED.sha256,
+			    missing = EXCLUDED.missing,
+			    logical_size_bytes = EXCLUDED.logical_size_bytes,
+			    compression = EXCLUDED.compression,
+			    key_id = EXCLUDED.key_id;
 		    `
 }
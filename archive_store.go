@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+/*
+- where the archive lives: WAL segments, timeline history files and base backups
+- everything that reads or writes the archive goes through ArchiveStore, a new storage target is one more implementation
+- the local store (default) is Docker_Connections itself, which the containers mount as /wal_archive and /backups,
+  s3 and azure keep it in a bucket / blob container (archive_store_s3.go, archive_store_azure.go),
+  the tests use a memory store (archive_store_memory_test.go)
+- WAL is always captured into the local archive dir first (pg_receivewal or the go receiver write it there).
+  with a store that isn't that dir, finished segments are compressed/encrypted and moved into the store (see ingestSpool)
+- names are "/" separated keys, e.g. wal_archive/000000010000000000000001.gz
+*/
+
+const (
+	ArchiveBackendLocal = "local"
+
+	// top level "directories" of the store
+	walArchivePrefix = "wal_archive"
+	backupsPrefix    = "backups"
+)
+
+// one object in the store
+type ArchiveObject struct {
+	Name    string // key relative to the store it was listed or stat'ed in
+	Size    int64
+	ModTime time.Time
+}
+
+// a streaming upload. nothing is visible until Commit, Abort (or a crash) leaves what was there before
+type ArchiveWriter interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+// archive storage. missing objects are reported with an error wrapping os.ErrNotExist
+type ArchiveStore interface {
+	// modTime is kept as the object's modification time, zero means now.
+	// GetBackupEndTime goes by it, so rewritten objects keep their original one
+	// (object stores can't, they use the upload time)
+	Put(name string, modTime time.Time) (ArchiveWriter, error)
+	Get(name string) (io.ReadCloser, error)
+	List(dir string) ([]ArchiveObject, error) // objects directly under dir ("" is the top), ordered by name
+	Stat(name string) (ArchiveObject, error)
+	Delete(name string) error // deleting a missing object isn't an error
+}
+
+// implemented by stores whose objects are plain files the containers can see (the local store)
+// restore_command then reads segments in place instead of from restore_staging
+type mountedArchiveStore interface {
+	LocalPath(name string) (string, bool)
+}
+
+// opens the archive backend picked in app.env (archive_backend, archive_path). the remote stores
+// run their requests under ctx
+func OpenArchiveStore(ctx context.Context, appConfig *AppConfig) (ArchiveStore, error) {
+	switch appConfig.ArchiveBackend {
+	case "", ArchiveBackendLocal:
+		root := appConfig.ArchivePath
+		if root == "" {
+			root = "Docker_Connections"
+		}
+		return NewLocalArchiveStore(root)
+	case ArchiveBackendS3:
+		return NewS3ArchiveStore(ctx, S3ConfigFromApp(appConfig), NewRetryPolicy(appConfig))
+	case ArchiveBackendAzure:
+		return NewAzureArchiveStore(ctx, AzureConfigFromApp(appConfig), NewRetryPolicy(appConfig))
+	}
+	return nil, fmt.Errorf("unknown archive_backend %q: must be %s, %s or %s", appConfig.ArchiveBackend,
+		ArchiveBackendLocal, ArchiveBackendS3, ArchiveBackendAzure)
+}
+
+// the local path of an object, false if the store isn't on this machine
+func localPath(store ArchiveStore, name string) (string, bool) {
+	if m, ok := store.(mountedArchiveStore); ok {
+		return m.LocalPath(name)
+	}
+	return "", false
+}
+
+// a view of store under prefix, names are relative to it
+type subStore struct {
+	store  ArchiveStore
+	prefix string
+}
+
+func SubStore(store ArchiveStore, prefix string) ArchiveStore {
+	return &subStore{store: store, prefix: prefix}
+}
+
+func (s *subStore) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *subStore) strip(obj ArchiveObject) ArchiveObject {
+	obj.Name = strings.TrimPrefix(strings.TrimPrefix(obj.Name, s.prefix), "/")
+	return obj
+}
+
+func (s *subStore) Put(name string, modTime time.Time) (ArchiveWriter, error) {
+	return s.store.Put(s.key(name), modTime)
+}
+
+func (s *subStore) Get(name string) (io.ReadCloser, error) {
+	return s.store.Get(s.key(name))
+}
+
+func (s *subStore) List(dir string) ([]ArchiveObject, error) {
+	objs, err := s.store.List(s.key(dir))
+	for i := range objs {
+		objs[i] = s.strip(objs[i])
+	}
+	return objs, err
+}
+
+func (s *subStore) Stat(name string) (ArchiveObject, error) {
+	obj, err := s.store.Stat(s.key(name))
+	return s.strip(obj), err
+}
+
+func (s *subStore) Delete(name string) error {
+	return s.store.Delete(s.key(name))
+}
+
+func (s *subStore) LocalPath(name string) (string, bool) {
+	return localPath(s.store, s.key(name))
+}
+
+// replaces the first len(header) bytes of an object by putting a copy with the new header over it.
+// never in place: an encrypted object's header holds the only copy of its data key, a torn write would lose it
+// for good, a put leaves either the old object or the new one
+func rewriteObjectHeader(store ArchiveStore, name string, header []byte) error {
+	obj, err := store.Stat(name)
+	if err != nil {
+		return err
+	}
+	r, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.CopyN(io.Discard, r, int64(len(header))); err != nil {
+		return err
+	}
+	return putObject(store, name, obj.ModTime, io.MultiReader(bytes.NewReader(header), r))
+}
+
+// uploads everything from r as one object
+func putObject(store ArchiveStore, name string, modTime time.Time, r io.Reader) error {
+	w, err := store.Put(name, modTime)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+func readObject(store ArchiveStore, name string) ([]byte, error) {
+	r, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+- the archive in an Azure Blob Storage container, as block blobs
+- plain net/http like the s3 store: put blob, put block + put block list, get, head, list, delete
+- small objects are one Put Blob, bigger ones are uploaded block by block (azure_block_size_mb, default 8MB) and
+  only exist once the block list is committed. uncommitted blocks of a failed upload are dropped by azure after a week
+- every request body goes with its Content-MD5, and the whole blob's MD5 is stored with it. Get checks it again
+  while reading, so a blob that got damaged at rest fails the read instead of feeding bad WAL to a restore
+- auth with the account key (Shared Key) or a SAS token (needs read, write, list and delete on the container)
+- 5xx, 429 and network errors are retried with the max_retries / backoff_seconds policy from app.env, with the
+  same connect and response timeouts as the s3 store (archiveHTTPClient) and under the ctx the store was opened with
+- Azurite works as is: azure_endpoint=http://127.0.0.1:10000/devstoreaccount1, azure_account=devstoreaccount1 and its
+  well known key
+- app.env: archive_backend=azure, azure_account, azure_container, azure_prefix, azure_endpoint,
+  azure_account_key or azure_sas_token (else AZURE_STORAGE_ACCOUNT / AZURE_STORAGE_KEY / AZURE_STORAGE_SAS_TOKEN)
+*/
+
+const (
+	ArchiveBackendAzure = "azure"
+
+	azureAPIVersion       = "2021-08-06"
+	defaultAzureBlockSize = 8 << 20
+	maxAzureBlockSize     = 4000 << 20
+)
+
+type AzureConfig struct {
+	Account   string
+	Key       string // base64 account key, for Shared Key auth
+	SASToken  string // used instead of Key when set, with or without the leading ?
+	Container string
+	Prefix    string // blob names go under <prefix>/, empty is the container root
+	Endpoint  string // empty means https://<account>.blob.core.windows.net
+	BlockSize int64
+}
+
+// the azure settings from app.env, credentials fall back to the usual azure environment variables
+func AzureConfigFromApp(appConfig *AppConfig) AzureConfig {
+	cfg := AzureConfig{
+		Account:   appConfig.AzureAccount,
+		Key:       appConfig.AzureAccountKey,
+		SASToken:  appConfig.AzureSASToken,
+		Container: appConfig.AzureContainer,
+		Prefix:    appConfig.AzurePrefix,
+		Endpoint:  appConfig.AzureEndpoint,
+		BlockSize: int64(appConfig.AzureBlockSizeMB) << 20,
+	}
+	if cfg.Account == "" {
+		cfg.Account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if cfg.Key == "" && cfg.SASToken == "" {
+		cfg.Key = os.Getenv("AZURE_STORAGE_KEY")
+		cfg.SASToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	return cfg
+}
+
+type AzureArchiveStore struct {
+	cfg    AzureConfig
+	key    []byte     // decoded account key, nil with a SAS token
+	sas    url.Values // parsed SAS token
+	base   *url.URL   // account endpoint, Azurite has the account in the path
+	client *http.Client
+	retry  RetryPolicy
+	ctx    context.Context // cancelling it aborts requests and retries in flight
+}
+
+func NewAzureArchiveStore(ctx context.Context, cfg AzureConfig, retry RetryPolicy) (*AzureArchiveStore, error) {
+	if cfg.Account == "" || cfg.Container == "" {
+		return nil, fmt.Errorf("archive_backend=azure needs azure_account and azure_container")
+	}
+	s := &AzureArchiveStore{client: archiveHTTPClient(), retry: retry, ctx: ctx}
+	switch {
+	case cfg.SASToken != "":
+		sas, err := url.ParseQuery(strings.TrimPrefix(cfg.SASToken, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid azure_sas_token: %w", err)
+		}
+		s.sas = sas
+	case cfg.Key != "":
+		key, err := base64.StdEncoding.DecodeString(cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid azure_account_key: %w", err)
+		}
+		s.key = key
+	default:
+		return nil, fmt.Errorf("archive_backend=azure needs azure_account_key or azure_sas_token")
+	}
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = defaultAzureBlockSize
+	}
+	if cfg.BlockSize < 0 || cfg.BlockSize > maxAzureBlockSize {
+		return nil, fmt.Errorf("azure_block_size_mb must be between 1 and %d", maxAzureBlockSize>>20)
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + cfg.Account + ".blob.core.windows.net"
+	}
+	base, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid azure_endpoint %q", cfg.Endpoint)
+	}
+	s.cfg, s.base = cfg, base
+	return s, nil
+}
+
+// the blob name of a store name
+func (s *AzureArchiveStore) blobName(name string) string {
+	return strings.TrimPrefix(path.Join(s.cfg.Prefix, name), "/")
+}
+
+// an error response from azure
+type azureError struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *azureError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("azure: HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("azure: %s: %s (HTTP %d)", e.Code, strings.SplitN(e.Message, "\n", 2)[0], e.Status)
+}
+
+// server errors, throttling and dropped connections are worth another try, anything else the request itself is wrong
+func retryableAzureError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false // shutting down
+	}
+	var azErr *azureError
+	if errors.As(err, &azErr) {
+		return azErr.Status >= 500 || azErr.Status == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// HEAD responses have no body, the code is in a header then
+func readAzureError(resp *http.Response) error {
+	e := &azureError{Status: resp.StatusCode, Code: resp.Header.Get("X-Ms-Error-Code")}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, e)
+	return e
+}
+
+// one signed request, retried as the policy says. a 2xx response is returned with its body open,
+// 404 becomes an error wrapping os.ErrNotExist. blob "" addresses the container itself
+func (s *AzureArchiveStore) do(method string, blob string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var resp *http.Response
+	op := fmt.Sprintf("azure %s %s", method, blob)
+	err := s.retry.DoWhen(s.ctx, op, retryableAzureError, func() error {
+		req, err := s.newRequest(s.ctx, method, blob, query, header, body)
+		if err != nil {
+			return err
+		}
+		r, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		if r.StatusCode/100 == 2 {
+			resp = r
+			return nil
+		}
+		defer r.Body.Close()
+		if r.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s: %w", blob, os.ErrNotExist)
+		}
+		return readAzureError(r)
+	})
+	return resp, err
+}
+
+func (s *AzureArchiveStore) newRequest(ctx context.Context, method string, blob string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u := *s.base
+	resourcePath := u.Path + "/" + s.cfg.Container
+	if blob != "" {
+		resourcePath += "/" + blob
+	}
+	u.Path = resourcePath
+	u.RawPath = uriEscape(resourcePath, false)
+	params := url.Values{}
+	maps.Copy(params, query)
+	maps.Copy(params, s.sas)
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	} else {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	if s.key != nil {
+		s.sign(req)
+	}
+	return req, nil
+}
+
+// Shared Key auth, https://learn.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (s *AzureArchiveStore) sign(req *http.Request) {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = fmt.Sprint(req.ContentLength)
+	}
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	for _, h := range []string{"Content-Encoding", "Content-Language"} {
+		b.WriteString(req.Header.Get(h) + "\n")
+	}
+	b.WriteString(contentLength + "\n")
+	for _, h := range []string{"Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		b.WriteString(req.Header.Get(h) + "\n")
+	}
+
+	msHeaders := map[string]string{}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			msHeaders[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(msHeaders)) {
+		b.WriteString(k + ":" + msHeaders[k] + "\n")
+	}
+
+	b.WriteString("/" + s.cfg.Account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := map[string][]string{}
+	for k, v := range query {
+		params[strings.ToLower(k)] = append(params[strings.ToLower(k)], v...)
+	}
+	for _, k := range slices.Sorted(maps.Keys(params)) {
+		values := slices.Sorted(slices.Values(params[k]))
+		b.WriteString("\n" + k + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(b.String()))
+	req.Header.Set("Authorization", "SharedKey "+s.cfg.Account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// uploads one block at a time, the upload only turns into a block list once there's more than a block
+type azureArchiveWriter struct {
+	s      *AzureArchiveStore
+	blob   string
+	buf    []byte
+	blocks []string
+	sum    hash.Hash // MD5 of the whole blob
+	err    error     // first failure, everything after it fails too
+	done   bool
+}
+
+// modTime can't be kept, blobs carry the time they were uploaded
+func (s *AzureArchiveStore) Put(name string, modTime time.Time) (ArchiveWriter, error) {
+	return &azureArchiveWriter{s: s, blob: s.blobName(name), buf: []byte{}, sum: md5.New()}, nil
+}
+
+func (w *azureArchiveWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, fmt.Errorf("%s: write after commit or abort", w.blob)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.sum.Write(p)
+	w.buf = append(w.buf, p...)
+	for int64(len(w.buf)) >= w.s.cfg.BlockSize {
+		if w.err = w.putBlock(w.buf[:w.s.cfg.BlockSize]); w.err != nil {
+			return 0, w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[w.s.cfg.BlockSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *azureArchiveWriter) putBlock(data []byte) error {
+	// block ids all have to be the same length
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(w.blocks))))
+	resp, err := w.s.do(http.MethodPut, w.blob, url.Values{"comp": {"block"}, "blockid": {id}}, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.blocks = append(w.blocks, id)
+	return nil
+}
+
+func (w *azureArchiveWriter) Commit() error {
+	if w.done {
+		return fmt.Errorf("%s: already committed or aborted", w.blob)
+	}
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	w.done = true
+
+	header := http.Header{}
+	header.Set("X-Ms-Blob-Content-Type", "application/octet-stream")
+	if w.blocks == nil {
+		// Put Blob stores the request's Content-MD5 as the blob's
+		header.Set("X-Ms-Blob-Type", "BlockBlob")
+		resp, err := w.s.do(http.MethodPut, w.blob, nil, header, w.buf)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.putBlock(w.buf); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: w.blocks})
+	if err != nil {
+		return err
+	}
+	header.Set("X-Ms-Blob-Content-Md5", base64.StdEncoding.EncodeToString(w.sum.Sum(nil)))
+	resp, err := w.s.do(http.MethodPut, w.blob, url.Values{"comp": {"blocklist"}}, header, append([]byte(xml.Header), body...))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// nothing to clean up, uncommitted blocks never become visible
+func (w *azureArchiveWriter) Abort() {
+	w.done = true
+	w.buf = nil
+}
+
+// checks the blob's MD5 once the whole body was read
+type md5CheckingReader struct {
+	r    io.ReadCloser
+	name string
+	want []byte
+	sum  hash.Hash
+}
+
+func (m *md5CheckingReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.sum.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(m.sum.Sum(nil), m.want) {
+		return n, fmt.Errorf("%s: content MD5 mismatch, the blob is damaged", m.name)
+	}
+	return n, err
+}
+
+func (m *md5CheckingReader) Close() error {
+	return m.r.Close()
+}
+
+func (s *AzureArchiveStore) Get(name string) (io.ReadCloser, error) {
+	blob := s.blobName(name)
+	resp, err := s.do(http.MethodGet, blob, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	want, err := base64.StdEncoding.DecodeString(resp.Header.Get("Content-MD5"))
+	if err != nil || len(want) != md5.Size {
+		return resp.Body, nil // uploaded by something else without an MD5
+	}
+	return &md5CheckingReader{r: resp.Body, name: blob, want: want, sum: md5.New()}, nil
+}
+
+func (s *AzureArchiveStore) List(dir string) ([]ArchiveObject, error) {
+	prefix := s.blobName(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var objs []ArchiveObject
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Blobs []struct {
+				Name       string `xml:"Name"`
+				Properties struct {
+					LastModified  string `xml:"Last-Modified"`
+					ContentLength int64  `xml:"Content-Length"`
+				} `xml:"Properties"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("azure: listing %s: %w", prefix, err)
+		}
+
+		for _, b := range page.Blobs {
+			modTime, _ := http.ParseTime(b.Properties.LastModified)
+			name := path.Join(dir, strings.TrimPrefix(b.Name, prefix))
+			objs = append(objs, ArchiveObject{Name: name, Size: b.Properties.ContentLength, ModTime: modTime})
+		}
+		if page.NextMarker == "" {
+			break
+		}
+		marker = page.NextMarker
+	}
+	return objs, nil
+}
+
+func (s *AzureArchiveStore) Stat(name string) (ArchiveObject, error) {
+	resp, err := s.do(http.MethodHead, s.blobName(name), nil, nil, nil)
+	if err != nil {
+		return ArchiveObject{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ArchiveObject{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *AzureArchiveStore) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, s.blobName(name), nil, nil, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
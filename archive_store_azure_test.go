@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Azurite's well known development account
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+type fakeBlob struct {
+	data []byte
+	md5  string // the blob's Content-MD5, empty if it was stored without one
+}
+
+// a blob container in memory behind an Azurite style endpoint (/<account>/<container>/<blob>),
+// requests are checked against the Shared Key signature worked out from what arrived
+type fakeAzure struct {
+	mu       sync.Mutex
+	key      []byte // nil: SAS token auth, every request needs sig in the query
+	blobs    map[string]fakeBlob
+	blocks   map[string][]byte // uncommitted, by blob + "/" + block id
+	requests []string          // "METHOD blob?comp"
+	md5s     map[string]string // x-ms-blob-content-md5 of each Put Block List
+
+	failNext int // answer this many requests with a 503 first
+	pageSize int // blobs per list page, 0 is 5000
+}
+
+func newFakeAzure(t *testing.T) (*fakeAzure, *httptest.Server) {
+	key, _ := base64.StdEncoding.DecodeString(azuriteKey)
+	f := &fakeAzure{key: key, blobs: map[string]fakeBlob{}, blocks: map[string][]byte{}, md5s: map[string]string{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func newTestAzureStore(t *testing.T, endpoint string, blockSize int64) *AzureArchiveStore {
+	s, err := NewAzureArchiveStore(context.Background(), AzureConfig{
+		Account:   azuriteAccount,
+		Key:       azuriteKey,
+		Container: "wal",
+		Prefix:    "pfx",
+		Endpoint:  endpoint + "/" + azuriteAccount,
+		BlockSize: blockSize,
+	}, RetryPolicy{MaxRetries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func azureErrorResponse(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("X-Ms-Error-Code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>fake\nRequestId:1</Message></Error>", code)
+}
+
+// the Shared Key string-to-sign of a request as the server sees it
+func serverStringToSign(r *http.Request) string {
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+	lines := []string{r.Method, r.Header.Get("Content-Encoding"), r.Header.Get("Content-Language"), contentLength}
+	for _, h := range []string{"Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		lines = append(lines, r.Header.Get(h))
+	}
+	var ms []string
+	for k, v := range r.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			ms = append(ms, k+":"+strings.Join(v, ","))
+		}
+	}
+	slices.Sort(ms)
+	resource := "/" + azuriteAccount + r.URL.EscapedPath()
+	query := r.URL.Query()
+	for _, k := range slices.Sorted(maps.Keys(query)) {
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(slices.Sorted(slices.Values(query[k])), ",")
+	}
+	return strings.Join(lines, "\n") + "\n" + strings.Join(ms, "\n") + "\n" + resource
+}
+
+func (f *fakeAzure) authorized(r *http.Request) bool {
+	if f.key == nil {
+		return r.Header.Get("Authorization") == "" && r.URL.Query().Get("sig") != ""
+	}
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(serverStringToSign(r)))
+	return r.Header.Get("Authorization") == "SharedKey "+azuriteAccount+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failNext > 0 {
+		f.failNext--
+		azureErrorResponse(w, http.StatusServiceUnavailable, "ServerBusy")
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/"+azuriteAccount+"/wal")
+	if !ok {
+		azureErrorResponse(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	blob := strings.TrimPrefix(rest, "/")
+	q := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+blob+"?"+q.Get("comp"))
+
+	body, _ := io.ReadAll(r.Body)
+	if !f.authorized(r) {
+		azureErrorResponse(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+	if r.Header.Get("X-Ms-Version") != azureAPIVersion {
+		azureErrorResponse(w, http.StatusBadRequest, "InvalidHeaderValue")
+		return
+	}
+	bodyMD5 := ""
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		bodyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+		if r.Header.Get("Content-MD5") != bodyMD5 {
+			azureErrorResponse(w, http.StatusBadRequest, "Md5Mismatch")
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && blob == "" && q.Get("comp") == "list":
+		f.list(w, q)
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		f.blocks[blob+"/"+q.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			azureErrorResponse(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := f.blocks[blob+"/"+id]
+			if !ok {
+				azureErrorResponse(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		for k := range f.blocks {
+			if strings.HasPrefix(k, blob+"/") {
+				delete(f.blocks, k)
+			}
+		}
+		f.md5s[blob] = r.Header.Get("X-Ms-Blob-Content-Md5")
+		f.blobs[blob] = fakeBlob{data: data, md5: r.Header.Get("X-Ms-Blob-Content-Md5")}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+			azureErrorResponse(w, http.StatusBadRequest, "MissingRequiredHeader")
+			return
+		}
+		f.blobs[blob] = fakeBlob{data: body, md5: bodyMD5}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		b, ok := f.blobs[blob]
+		if !ok {
+			azureErrorResponse(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if b.md5 != "" {
+			w.Header().Set("Content-MD5", b.md5)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Write(b.data)
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[blob]; !ok {
+			azureErrorResponse(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, blob)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		azureErrorResponse(w, http.StatusMethodNotAllowed, "UnsupportedHttpVerb")
+	}
+}
+
+func (f *fakeAzure) list(w http.ResponseWriter, q url.Values) {
+	prefix := q.Get("prefix")
+	var names []string
+	for name := range f.blobs {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if ok && !strings.Contains(rest, "/") {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	pageSize := f.pageSize
+	if pageSize == 0 {
+		pageSize = 5000
+	}
+	start := 0
+	if marker := q.Get("marker"); marker != "" {
+		start, _ = strconv.Atoi(marker)
+	}
+	end := min(start+pageSize, len(names))
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for _, name := range names[start:end] {
+		fmt.Fprintf(&b, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>",
+			name, time.Now().UTC().Format(http.TimeFormat), len(f.blobs[name].data))
+	}
+	b.WriteString("</Blobs><NextMarker>")
+	if end < len(names) {
+		fmt.Fprint(&b, end)
+	}
+	b.WriteString("</NextMarker></EnumerationResults>")
+	io.WriteString(w, b.String())
+}
+
+func (f *fakeAzure) count(request string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+// the string-to-sign written out by hand for an Azurite Put Block. the account is in the endpoint path,
+// so it shows up twice in the canonicalized resource
+func TestAzureSignSharedKey(t *testing.T) {
+	s, err := NewAzureArchiveStore(context.Background(), AzureConfig{
+		Account:   azuriteAccount,
+		Key:       azuriteKey,
+		Container: "wal",
+		Endpoint:  "http://127.0.0.1:10000/" + azuriteAccount,
+	}, RetryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"comp": {"block"}, "blockid": {"YmxvY2stMDAwMDAwMDA="}}
+	req, err := s.newRequest(context.Background(), http.MethodPut, "wal_archive/000000010000000000000001", query, nil, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Ms-Date", "Wed, 01 May 2024 12:00:00 GMT")
+	s.sign(req)
+
+	stringToSign := "PUT\n" +
+		"\n" + // Content-Encoding
+		"\n" + // Content-Language
+		"5\n" +
+		"XUFAKrxLKna5cZ2REBfFkg==\n" + // Content-MD5 of "hello"
+		"\n\n\n\n\n\n\n" + // Content-Type, Date, If-*, Range
+		"x-ms-date:Wed, 01 May 2024 12:00:00 GMT\n" +
+		"x-ms-version:" + azureAPIVersion + "\n" +
+		"/devstoreaccount1/devstoreaccount1/wal/wal_archive/000000010000000000000001\n" +
+		"blockid:YmxvY2stMDAwMDAwMDA=\n" +
+		"comp:block"
+	key, _ := base64.StdEncoding.DecodeString(azuriteKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	want := "SharedKey devstoreaccount1:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %s, want %s", got, want)
+	}
+	if !strings.HasSuffix(req.URL.RawQuery, "comp=block") || !strings.Contains(req.URL.Path, "/devstoreaccount1/wal/") {
+		t.Errorf("request URL %s", req.URL)
+	}
+}
+
+func TestAzurePutGetStatDelete(t *testing.T) {
+	f, srv := newFakeAzure(t)
+	s := newTestAzureStore(t, srv.URL, 0)
+
+	data := []byte("segment contents")
+	if err := putObject(s, "wal_archive/000000010000000000000001", time.Time{}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("PUT pfx/wal_archive/000000010000000000000001?"); n != 1 || len(f.requests) != 1 {
+		t.Errorf("small blob not stored with one Put Blob: %v", f.requests)
+	}
+	if f.blobs["pfx/wal_archive/000000010000000000000001"].md5 == "" {
+		t.Error("blob stored without its MD5")
+	}
+
+	got, err := readObject(s, "wal_archive/000000010000000000000001")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	obj, err := s.Stat("wal_archive/000000010000000000000001")
+	if err != nil || obj.Size != int64(len(data)) || obj.ModTime.IsZero() {
+		t.Fatalf("Stat = %+v, %v", obj, err)
+	}
+
+	if err := s.Delete("wal_archive/000000010000000000000001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("wal_archive/000000010000000000000001"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get after Delete: %v, want os.ErrNotExist", err)
+	}
+	if _, err := s.Stat("wal_archive/000000010000000000000001"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Delete: %v, want os.ErrNotExist", err)
+	}
+	if err := s.Delete("wal_archive/000000010000000000000001"); err != nil {
+		t.Errorf("deleting a missing blob: %v", err)
+	}
+}
+
+func TestAzureBlockUpload(t *testing.T) {
+	f, srv := newFakeAzure(t)
+	s := newTestAzureStore(t, srv.URL, 64<<10)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (3*64<<10+1000)/16)
+	w, err := s.Put("backups/base.tar", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 10007)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if _, ok := f.blobs["pfx/backups/base.tar"]; ok {
+		t.Fatal("blob visible before Commit")
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(f.blobs["pfx/backups/base.tar"].data, data) {
+		t.Errorf("committed blob differs, %d bytes, want %d", len(f.blobs["pfx/backups/base.tar"].data), len(data))
+	}
+	if n := f.count("PUT pfx/backups/base.tar?block"); n != 4 || f.count("PUT pfx/backups/base.tar?blocklist") != 1 {
+		t.Errorf("%d blocks, want 4 and one block list: %v", n, f.requests)
+	}
+	sum := md5.Sum(data)
+	if got := f.md5s["pfx/backups/base.tar"]; got != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("x-ms-blob-content-md5 = %q, want the MD5 of the whole blob", got)
+	}
+
+	// and Get checks it
+	got, err := readObject(s, "backups/base.tar")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get = %d bytes, %v", len(got), err)
+	}
+
+	// exactly one block's worth is still a single Put Blob
+	f.requests = nil
+	if err := putObject(s, "one", time.Time{}, bytes.NewReader(make([]byte, 64<<10-1))); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.requests) != 1 || f.count("PUT pfx/one?") != 1 {
+		t.Errorf("requests for a small blob: %v", f.requests)
+	}
+}
+
+func TestAzureAbortLeavesNothing(t *testing.T) {
+	f, srv := newFakeAzure(t)
+	s := newTestAzureStore(t, srv.URL, 64<<10)
+
+	w, _ := s.Put("backups/base.tar", time.Time{})
+	if _, err := w.Write(make([]byte, 100<<10)); err != nil {
+		t.Fatal(err)
+	}
+	w.Abort()
+	if err := w.Commit(); err == nil {
+		t.Error("Commit after Abort succeeded")
+	}
+	if len(f.blobs) != 0 {
+		t.Errorf("aborted upload visible: %v", slices.Collect(maps.Keys(f.blobs)))
+	}
+}
+
+func TestAzureGetDetectsDamagedBlob(t *testing.T) {
+	f, srv := newFakeAzure(t)
+	s := newTestAzureStore(t, srv.URL, 0)
+
+	if err := putObject(s, "a", time.Time{}, strings.NewReader("good data")); err != nil {
+		t.Fatal(err)
+	}
+	b := f.blobs["pfx/a"]
+	b.data = []byte("bad! data")
+	f.blobs["pfx/a"] = b
+
+	r, err := s.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	r.Close()
+	if err == nil || !strings.Contains(err.Error(), "content MD5 mismatch") {
+		t.Errorf("reading a damaged blob = %v, want an MD5 mismatch", err)
+	}
+
+	// blobs uploaded by something else without an MD5 aren't checked
+	f.blobs["pfx/b"] = fakeBlob{data: []byte("no md5")}
+	if data, err := readObject(s, "b"); err != nil || string(data) != "no md5" {
+		t.Errorf("Get of a blob without MD5 = %q, %v", data, err)
+	}
+}
+
+func TestAzureListPaginates(t *testing.T) {
+	f, srv := newFakeAzure(t)
+	s := newTestAzureStore(t, srv.URL, 0)
+	f.pageSize = 2
+
+	var want []string
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("wal_archive/%024X", i)
+		f.blobs["pfx/"+name] = fakeBlob{data: []byte(name)}
+		want = append(want, name)
+	}
+	f.blobs["pfx/wal_archive/sub/nested"] = fakeBlob{data: []byte("x")}
+	f.blobs["pfx/backups/base_x.tar"] = fakeBlob{data: []byte("x")}
+
+	objs, err := s.List("wal_archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, o := range objs {
+		got = append(got, o.Name)
+		if o.Size != int64(len(o.Name)) || o.ModTime.IsZero() {
+			t.Errorf("%+v: wrong size or no modtime", o)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+	if n := f.count("GET ?list"); n != 3 {
+		t.Errorf("%d list requests, want 3", n)
+	}
+}
+
+func TestAzureRetriesServerErrors(t *testing.T) {
+	f, srv := newFakeAzure(t)
+	s := newTestAzureStore(t, srv.URL, 0)
+
+	f.failNext = 2
+	if err := putObject(s, "a", time.Time{}, strings.NewReader("a")); err != nil {
+		t.Fatalf("put after two 503s: %v", err)
+	}
+
+	f.failNext = 10
+	_, err := s.Get("a")
+	var azErr *azureError
+	if !errors.As(err, &azErr) || azErr.Code != "ServerBusy" {
+		t.Errorf("Get with the server down = %v, want ServerBusy after the retries", err)
+	}
+	if f.failNext != 10-4 {
+		t.Errorf("%d attempts, want 4 (max_retries 3)", 10-f.failNext)
+	}
+
+	// a bad signature isn't retried
+	f.failNext = 0
+	bad := newTestAzureStore(t, srv.URL, 0)
+	bad.key = []byte("wrong")
+	before := len(f.requests)
+	if _, err := bad.Get("a"); !errors.As(err, &azErr) || azErr.Code != "AuthenticationFailed" {
+		t.Errorf("Get with the wrong key = %v, want AuthenticationFailed", err)
+	}
+	if len(f.requests) != before+1 {
+		t.Errorf("rejected request sent %d times", len(f.requests)-before)
+	}
+}
+
+func TestAzureSASToken(t *testing.T) {
+	f, srv := newFakeAzure(t)
+	f.key = nil
+	s, err := NewAzureArchiveStore(context.Background(), AzureConfig{
+		Account:   azuriteAccount,
+		SASToken:  "?sv=2021-08-06&sp=rwdl&sig=c2lnbmF0dXJl%2Bx",
+		Container: "wal",
+		Endpoint:  srv.URL + "/" + azuriteAccount,
+	}, RetryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := putObject(s, "a", time.Time{}, strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readObject(s, "a"); err != nil || string(data) != "a" {
+		t.Errorf("Get = %q, %v", data, err)
+	}
+}
+
+func TestAzureCancelledContext(t *testing.T) {
+	f, srv := newFakeAzure(t)
+	s := newTestAzureStore(t, srv.URL, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	cancel()
+
+	f.failNext = 10
+	if _, err := s.Get("a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get = %v, want context.Canceled", err)
+	}
+	if f.failNext != 10 {
+		t.Error("request sent with a cancelled context")
+	}
+}
+
+// against a real Azurite: AZURITE_BLOB_ENDPOINT=http://127.0.0.1:10000/devstoreaccount1 go test -run Azurite
+func TestAzuriteRoundTrip(t *testing.T) {
+	endpoint := os.Getenv("AZURITE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("AZURITE_BLOB_ENDPOINT not set")
+	}
+	container := fmt.Sprintf("pgrestore-test-%d", time.Now().UnixNano())
+	s, err := NewAzureArchiveStore(context.Background(), AzureConfig{
+		Account:   azuriteAccount,
+		Key:       azuriteKey,
+		Container: container,
+		Endpoint:  endpoint,
+		BlockSize: 64 << 10,
+	}, RetryPolicy{MaxRetries: 1, Backoff: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.do(http.MethodPut, "", url.Values{"restype": {"container"}}, nil, nil)
+	if err != nil {
+		t.Fatalf("creating container %s: %v", container, err)
+	}
+	resp.Body.Close()
+	t.Cleanup(func() {
+		if resp, err := s.do(http.MethodDelete, "", url.Values{"restype": {"container"}}, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+	})
+
+	small := []byte("small blob")
+	large := bytes.Repeat([]byte("block data "), 20000) // 220KB, 4 blocks
+	if err := putObject(s, "wal_archive/small", time.Time{}, bytes.NewReader(small)); err != nil {
+		t.Fatal(err)
+	}
+	if err := putObject(s, "wal_archive/large", time.Time{}, bytes.NewReader(large)); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]byte{"wal_archive/small": small, "wal_archive/large": large} {
+		got, err := readObject(s, name)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: read %d bytes, %v", name, len(got), err)
+		}
+		obj, err := s.Stat(name)
+		if err != nil || obj.Size != int64(len(want)) {
+			t.Errorf("Stat %s = %+v, %v", name, obj, err)
+		}
+	}
+	objs, err := s.List("wal_archive")
+	if err != nil || len(objs) != 2 || objs[0].Name != "wal_archive/large" {
+		t.Errorf("List = %v, %v", objs, err)
+	}
+	if err := s.Delete("wal_archive/small"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("wal_archive/small"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Delete = %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+- the archive as plain files under one directory (Docker_Connections by default)
+- a put goes to <name>.tmp, is fsynced, gets its mtime and is renamed into place, then the dir is fsynced.
+  a crash leaves the old object or the new one, and a stray .tmp that's never mistaken for WAL
+*/
+
+type LocalArchiveStore struct {
+	root string
+}
+
+func NewLocalArchiveStore(root string) (*LocalArchiveStore, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive dir: %w", err)
+	}
+	return &LocalArchiveStore{root: abs}, nil
+}
+
+func (s *LocalArchiveStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *LocalArchiveStore) LocalPath(name string) (string, bool) {
+	return s.path(name), true
+}
+
+type localArchiveWriter struct {
+	f       *os.File
+	path    string
+	modTime time.Time
+}
+
+func (s *LocalArchiveStore) Put(name string, modTime time.Time) (ArchiveWriter, error) {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	// 0644 so the containers' postgres user can read what restore_command copies
+	f, err := os.OpenFile(p+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &localArchiveWriter{f: f, path: p, modTime: modTime}, nil
+}
+
+func (w *localArchiveWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *localArchiveWriter) Commit() error {
+	tmpPath := w.f.Name()
+	err := w.f.Sync()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !w.modTime.IsZero() {
+		err = os.Chtimes(tmpPath, w.modTime, w.modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, w.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(w.path))
+}
+
+func (w *localArchiveWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+func (s *LocalArchiveStore) Get(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+// sub directories (restore_staging, backups/latest) and leftover .tmp files aren't objects
+func (s *LocalArchiveStore) List(dir string) ([]ArchiveObject, error) {
+	entries, err := os.ReadDir(s.path(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil // like an object store, an empty dir and a missing one are the same
+	}
+	if err != nil {
+		return nil, err
+	}
+	var objs []ArchiveObject
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue // renamed or deleted since the listing
+		}
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, ArchiveObject{Name: filepath.ToSlash(filepath.Join(dir, entry.Name())), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	slices.SortFunc(objs, func(a, b ArchiveObject) int { return strings.Compare(a.Name, b.Name) })
+	return objs, nil
+}
+
+func (s *LocalArchiveStore) Stat(name string) (ArchiveObject, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return ArchiveObject{}, err
+	}
+	if info.IsDir() {
+		return ArchiveObject{}, fmt.Errorf("%s is a directory: %w", name, os.ErrNotExist)
+	}
+	return ArchiveObject{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalArchiveStore) Delete(name string) error {
+	p := s.path(name)
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syncDir(filepath.Dir(p))
+}
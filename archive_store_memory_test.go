@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+- the archive kept in memory, for tests: same semantics as the local store (atomic puts, kept mtimes, ErrNotExist), no disk
+- not an archive_backend on purpose, ingesting into it would delete WAL from the spool that's gone on exit
+*/
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+type MemoryArchiveStore struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+func NewMemoryArchiveStore() *MemoryArchiveStore {
+	return &MemoryArchiveStore{objects: map[string]memoryObject{}}
+}
+
+type memoryArchiveWriter struct {
+	store   *MemoryArchiveStore
+	name    string
+	modTime time.Time
+	buf     bytes.Buffer
+	done    bool
+}
+
+func (s *MemoryArchiveStore) Put(name string, modTime time.Time) (ArchiveWriter, error) {
+	return &memoryArchiveWriter{store: s, name: path.Clean(name), modTime: modTime}, nil
+}
+
+func (w *memoryArchiveWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, fmt.Errorf("%s: write after commit or abort", w.name)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryArchiveWriter) Commit() error {
+	if w.done {
+		return fmt.Errorf("%s: already committed or aborted", w.name)
+	}
+	w.done = true
+	modTime := w.modTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	w.store.mu.Lock()
+	w.store.objects[w.name] = memoryObject{data: w.buf.Bytes(), modTime: modTime}
+	w.store.mu.Unlock()
+	return nil
+}
+
+func (w *memoryArchiveWriter) Abort() {
+	w.done = true
+	w.buf.Reset()
+}
+
+func (s *MemoryArchiveStore) get(name string) (memoryObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[path.Clean(name)]
+	if !ok {
+		return obj, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return obj, nil
+}
+
+// the data is never changed after a put, so readers can share it
+func (s *MemoryArchiveStore) Get(name string) (io.ReadCloser, error) {
+	obj, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (s *MemoryArchiveStore) List(dir string) ([]ArchiveObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir = path.Clean(dir)
+	if dir == "." {
+		dir = ""
+	}
+
+	var objs []ArchiveObject
+	for _, name := range slices.Sorted(maps.Keys(s.objects)) {
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		if parent == dir {
+			objs = append(objs, ArchiveObject{Name: name, Size: int64(len(s.objects[name].data)), ModTime: s.objects[name].modTime})
+		}
+	}
+	return objs, nil
+}
+
+func (s *MemoryArchiveStore) Stat(name string) (ArchiveObject, error) {
+	obj, err := s.get(name)
+	if err != nil {
+		return ArchiveObject{}, err
+	}
+	return ArchiveObject{Name: name, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (s *MemoryArchiveStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, path.Clean(name))
+	return nil
+}
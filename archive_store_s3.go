@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+- the archive in an S3 compatible bucket (AWS, MinIO, ...), so losing the host disk doesn't lose the recovery history
+- plain net/http with SigV4 signing, only the handful of calls we need: put, multipart upload, get, head, list, delete
+- every request body is signed with its SHA-256 and sent with a Content-MD5, S3 rejects anything that arrived damaged
+- uploads are buffered in parts of s3_part_size_mb (default 8MB): smaller objects are one PUT, bigger ones a
+  multipart upload that's aborted on failure. nothing is visible before Commit either way
+- 5xx, 429 and network errors are retried with the max_retries / backoff_seconds policy from app.env. connecting
+  and waiting for a response are bounded (archiveHTTPClient), and every request runs under the ctx the store was
+  opened with, so shutdown doesn't sit behind a dead endpoint while the monitor holds syncMu
+- S3 can't set an object's modification time, objects carry the time they were uploaded instead
+- app.env: archive_backend=s3, s3_bucket, s3_region, s3_endpoint (MinIO: http://localhost:9000), s3_prefix,
+  s3_access_key / s3_secret_key (else AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY / AWS_SESSION_TOKEN),
+  s3_storage_class, s3_path_style=true (MinIO and most non-AWS servers)
+*/
+
+const (
+	ArchiveBackendS3 = "s3"
+
+	defaultS3Region   = "us-east-1"
+	defaultS3PartSize = 8 << 20
+	minS3PartSize     = 5 << 20 // smallest part S3 accepts, except for the last one
+	emptyPayloadHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	archiveDialTimeout     = 10 * time.Second
+	archiveResponseTimeout = 60 * time.Second // until the response headers, bodies can take as long as they need
+)
+
+// the http client of the object stores. no overall timeout, a big GET may rightly take minutes,
+// but a host that doesn't answer or never sends headers fails and gets retried
+func archiveHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: archiveDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = archiveDialTimeout
+	transport.ResponseHeaderTimeout = archiveResponseTimeout
+	return &http.Client{Transport: transport}
+}
+
+type S3Config struct {
+	Endpoint     string // empty means AWS: https://s3.<region>.amazonaws.com
+	Region       string
+	Bucket       string
+	Prefix       string // keys go under <prefix>/, empty is the bucket root
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	StorageClass string // e.g. STANDARD_IA, empty is the bucket's default
+	PathStyle    bool   // <endpoint>/<bucket>/<key> instead of <bucket>.<endpoint>/<key>
+	PartSize     int64
+}
+
+// the s3 settings from app.env, credentials fall back to the usual AWS environment variables
+func S3ConfigFromApp(appConfig *AppConfig) S3Config {
+	cfg := S3Config{
+		Endpoint:     appConfig.S3Endpoint,
+		Region:       appConfig.S3Region,
+		Bucket:       appConfig.S3Bucket,
+		Prefix:       appConfig.S3Prefix,
+		AccessKey:    appConfig.S3AccessKey,
+		SecretKey:    appConfig.S3SecretKey,
+		StorageClass: appConfig.S3StorageClass,
+		PathStyle:    appConfig.S3PathStyle,
+		PartSize:     int64(appConfig.S3PartSizeMB) << 20,
+	}
+	if cfg.AccessKey == "" && cfg.SecretKey == "" {
+		cfg.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		cfg.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		cfg.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_REGION")
+	}
+	return cfg
+}
+
+type S3ArchiveStore struct {
+	cfg    S3Config
+	base   *url.URL // scheme and host requests go to
+	client *http.Client
+	retry  RetryPolicy
+	ctx    context.Context // cancelling it aborts requests and retries in flight
+}
+
+func NewS3ArchiveStore(ctx context.Context, cfg S3Config, retry RetryPolicy) (*S3ArchiveStore, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("archive_backend=s3 needs s3_bucket")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("archive_backend=s3 needs s3_access_key and s3_secret_key (or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultS3Region
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = defaultS3PartSize
+	}
+	if cfg.PartSize < minS3PartSize {
+		return nil, fmt.Errorf("s3_part_size_mb must be at least %d", minS3PartSize>>20)
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid s3_endpoint %q", cfg.Endpoint)
+	}
+	if !cfg.PathStyle {
+		base.Host = cfg.Bucket + "." + base.Host
+	}
+	return &S3ArchiveStore{cfg: cfg, base: base, client: archiveHTTPClient(), retry: retry, ctx: ctx}, nil
+}
+
+// the object key of a store name
+func (s *S3ArchiveStore) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.cfg.Prefix, name), "/")
+}
+
+// an error response from S3
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("s3: %s: %s (HTTP %d)", e.Code, e.Message, e.Status)
+}
+
+// server errors, throttling and dropped connections are worth another try, anything else the request itself is wrong
+func retryableS3Error(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false // shutting down
+	}
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) {
+		return s3Err.Status >= 500 || s3Err.Status == http.StatusTooManyRequests || s3Err.Code == "SlowDown"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func readS3Error(resp *http.Response) error {
+	e := &s3Error{Status: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, e)
+	return e
+}
+
+// one signed request, retried as the policy says. a 2xx response is returned with its body open,
+// 404 becomes an error wrapping os.ErrNotExist
+func (s *S3ArchiveStore) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var resp *http.Response
+	op := fmt.Sprintf("s3 %s %s", method, key)
+	err := s.retry.DoWhen(s.ctx, op, retryableS3Error, func() error {
+		req, err := s.newRequest(s.ctx, method, key, query, header, body)
+		if err != nil {
+			return err
+		}
+		r, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		if r.StatusCode/100 == 2 {
+			resp = r
+			return nil
+		}
+		defer r.Body.Close()
+		if r.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		}
+		return readS3Error(r)
+	})
+	return resp, err
+}
+
+func (s *S3ArchiveStore) newRequest(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u := *s.base
+	objectPath := "/" + key
+	if s.cfg.PathStyle {
+		objectPath = "/" + s.cfg.Bucket + objectPath
+	}
+	u.Path = objectPath
+	u.RawPath = uriEscape(objectPath, false)
+	u.RawQuery = canonicalS3Query(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	} else {
+		req.Body = http.NoBody
+	}
+	s.sign(req, payloadHash(body), time.Now())
+	return req, nil
+}
+
+func payloadHash(body []byte) string {
+	if len(body) == 0 {
+		return emptyPayloadHash
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// AWS signature version 4, every header already on the request is signed
+func (s *S3ArchiveStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), day)
+	for _, part := range []string{s.cfg.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// percent encodes everything but A-Z a-z 0-9 - _ . ~ (and / in paths), the way SigV4 wants it. azure takes it as well
+func uriEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// the query string sorted and encoded the way it's signed, it's sent exactly like that
+func canonicalS3Query(query url.Values) string {
+	var parts []string
+	for k, vs := range query {
+		for _, v := range vs {
+			parts = append(parts, uriEscape(k, true)+"="+uriEscape(v, true))
+		}
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, "&")
+}
+
+// headers every new object gets
+func (s *S3ArchiveStore) objectHeader() http.Header {
+	h := http.Header{}
+	h.Set("Content-Type", "application/octet-stream")
+	if s.cfg.StorageClass != "" {
+		h.Set("X-Amz-Storage-Class", s.cfg.StorageClass)
+	}
+	return h
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// buffers one part at a time, the upload only turns into a multipart one once there's more than a part
+type s3ArchiveWriter struct {
+	s        *S3ArchiveStore
+	key      string
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+	err      error // first failure, everything after it fails too
+	done     bool
+}
+
+// modTime can't be kept, see the header
+func (s *S3ArchiveStore) Put(name string, modTime time.Time) (ArchiveWriter, error) {
+	return &s3ArchiveWriter{s: s, key: s.key(name), buf: []byte{}}, nil
+}
+
+func (w *s3ArchiveWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, fmt.Errorf("%s: write after commit or abort", w.key)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for int64(len(w.buf)) >= w.s.cfg.PartSize {
+		if w.err = w.uploadPart(w.buf[:w.s.cfg.PartSize]); w.err != nil {
+			return 0, w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[w.s.cfg.PartSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *s3ArchiveWriter) uploadPart(data []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, w.s.objectHeader(), nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || result.UploadID == "" {
+			return fmt.Errorf("s3: starting the multipart upload of %s: no upload id (%v)", w.key, err)
+		}
+		w.uploadID = result.UploadID
+	}
+
+	number := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}
+	resp, err := w.s.do(http.MethodPut, w.key, query, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{Number: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+func (w *s3ArchiveWriter) Commit() error {
+	if w.done {
+		return fmt.Errorf("%s: already committed or aborted", w.key)
+	}
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	w.done = true
+
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPut, w.key, nil, w.s.objectHeader(), w.buf)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(w.buf); err != nil {
+			w.abortUpload()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		w.abortUpload()
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 can answer 200 and still fail the completion, the error is in the body then
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(result, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(result, e)
+		w.abortUpload()
+		return e
+	}
+	return nil
+}
+
+func (w *s3ArchiveWriter) Abort() {
+	w.done = true
+	w.buf = nil
+	w.abortUpload()
+}
+
+// best effort, a lifecycle rule for incomplete multipart uploads catches what this misses
+func (w *s3ArchiveWriter) abortUpload() {
+	if w.uploadID == "" {
+		return
+	}
+	if resp, err := w.s.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+	w.uploadID = ""
+}
+
+func (s *S3ArchiveStore) Get(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.key(name), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3ArchiveStore) List(dir string) ([]ArchiveObject, error) {
+	prefix := s.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var objs []ArchiveObject
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: listing %s: %w", prefix, err)
+		}
+
+		for _, c := range page.Contents {
+			if strings.HasSuffix(c.Key, "/") {
+				continue // "folder" placeholders some tools create
+			}
+			// HEAD only has whole seconds, Stat and List have to agree
+			name := path.Join(dir, strings.TrimPrefix(c.Key, prefix))
+			objs = append(objs, ArchiveObject{Name: name, Size: c.Size, ModTime: c.LastModified.Truncate(time.Second)})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	return objs, nil
+}
+
+func (s *S3ArchiveStore) Stat(name string) (ArchiveObject, error) {
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, nil)
+	if err != nil {
+		return ArchiveObject{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ArchiveObject{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// S3 answers 204 for missing keys as well
+func (s *S3ArchiveStore) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, s.key(name), nil, nil, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
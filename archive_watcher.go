@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+- keeps the catalog in step with the archive dir. on linux inotify reports every file pg_receivewal creates,
+  renames or finishes writing, so a finished segment (.partial renamed to its final name) is catalogued right away.
+  writes into the .partial are reported too, so the catalog follows the segment that's still being written
+- a full rescan still runs every walRescanInterval as a safety net (missed events, queue overflow, network filesystems)
+- without inotify the monitor falls back to a full scan every walPollInterval
+*/
+
+const (
+	walRescanInterval = 60 * time.Second
+	walPollInterval   = 5 * time.Second
+)
+
+// something happened to a file in the archive dir
+type ArchiveEvent struct {
+	Name     string
+	Removed  bool // deleted or renamed away
+	Overflow bool // the kernel dropped events, only a full rescan can catch up
+}
+
+// source of archive dir events, see archive_watcher_linux.go
+type archiveWatcher interface {
+	Events() <-chan ArchiveEvent
+	Close() error
+}
+
+// follows the archive dir and keeps the catalog up to date until ctx is cancelled
+// a pass that's already running finishes first, so the catalog is never left halfway through one
+func (wm *WalManager) RunMonitor(ctx context.Context) {
+	rescanInterval := walRescanInterval
+	var events <-chan ArchiveEvent
+
+	watcher, err := newArchiveWatcher(wm.ArchiveDir)
+	if err != nil {
+		log.Printf("WAL Monitor: no file events (%v), scanning every %s instead", err, walPollInterval)
+		rescanInterval = walPollInterval
+	} else {
+		defer watcher.Close()
+		events = watcher.Events()
+	}
+	fmt.Printf("Starting WAL Monitor on %s (full rescan every %s)\n", wm.ArchiveDir, rescanInterval)
+
+	wm.rescanArchive()
+
+	ticker := time.NewTicker(rescanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("WAL Monitor stopped.")
+			return
+
+		case ev, ok := <-events:
+			if !ok {
+				log.Printf("WAL Monitor: file events stopped, scanning every %s instead", walPollInterval)
+				events = nil
+				ticker.Reset(walPollInterval)
+				continue
+			}
+			if ev.Overflow {
+				log.Printf("WAL Monitor: event queue overflowed, rescanning")
+				wm.rescanArchive()
+				continue
+			}
+			if wm.SyncWalFile(ev.Name, ev.Removed) {
+				if _, err := wm.RefreshContinuity(); err != nil {
+					log.Printf("Error checking WAL continuity: %v", err)
+				}
+			}
+
+		case <-ticker.C:
+			wm.rescanArchive()
+		}
+	}
+}
+
+// full pass over the archive dir
+func (wm *WalManager) rescanArchive() {
+	count, err := wm.SyncWalFiles()
+	if err != nil {
+		log.Printf("Error syncing WAL files: %v", err)
+	} else if count > 0 {
+		log.Printf("WAL Sync: Updated/Inserted %d records", count)
+		if _, err := wm.RefreshContinuity(); err != nil {
+			log.Printf("Error checking WAL continuity: %v", err)
+		}
+	}
+}
+
+// catalogues a single file after an event, returns whether the catalog changed
+// a removed file only drops its in-memory state, marking rows missing is left to the reconcile
+func (wm *WalManager) SyncWalFile(name string, removed bool) bool {
+	wm.syncMu.Lock()
+	defer wm.syncMu.Unlock()
+
+	if tli, ok := ParseTimelineHistoryFileName(name); ok {
+		if removed {
+			return false
+		}
+		if !wm.spoolIsArchive {
+			wm.ingestHistory(name)
+		}
+		changed, err := wm.syncTimelineHistory(tli)
+		if err != nil {
+			log.Printf("Failed to ingest %s: %v", name, err)
+		}
+		return changed
+	}
+
+	if removed {
+		if file, ok := ParseArchivedWalName(name); ok && !file.Partial && !wm.spoolIsArchive {
+			return false // moved into the archive by ingestSegment, the archived copy is still there
+		}
+		delete(wm.validated, name)
+		if file, ok := ParseArchivedWalName(name); ok {
+			delete(wm.catalogued, file.Segment)
+		}
+		return false
+	}
+
+	obj, err := wm.spool.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false // already renamed or deleted again (or a directory), a later event covers it
+	}
+	if err != nil {
+		log.Printf("Error getting file info for %s: %v", name, err)
+		return false
+	}
+
+	seg, ok := wm.archivedSegmentFor(obj)
+	if !ok {
+		return false
+	}
+
+	// a finished name next to a .partial is a restore snapshot, same as in scanArchive
+	if !seg.rec.IsPartial && hasPartialSegment(wm.ArchiveDir, seg.rec.FileName) {
+		return false
+	}
+	if !seg.rec.IsPartial && !wm.spoolIsArchive {
+		if seg, ok = wm.ingestSegment(seg); !ok {
+			return false // still in the archive dir, the next rescan tries again
+		}
+	}
+
+	count, err := wm.catalogSegments(wm.rewriteSegments([]archivedSegment{seg}))
+	if err != nil {
+		log.Printf("Error syncing %s: %v", name, err)
+	}
+	changed := count > 0
+	if changed && !seg.rec.IsPartial {
+		log.Printf("WAL Sync: catalogued %s", seg.rec.FileName)
+	}
+	return changed
+}
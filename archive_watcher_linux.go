@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// inotify on the archive dir, read through the runtime poller so Close wakes up the reader
+type inotifyWatcher struct {
+	file      *os.File
+	events    chan ArchiveEvent
+	done      chan struct{} // closed by Close, a reader blocked on a full events channel gives up
+	stopped   chan struct{} // closed when readLoop has returned
+	closeOnce sync.Once
+}
+
+// the events that mean a file appeared, was renamed into place, finished writing or went away.
+// IN_MODIFY is only passed on for .partial files, pg_receivewal keeps those open and writes into them
+// for the whole segment, so there's no IN_CLOSE_WRITE until it's renamed
+const archiveWatchMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MODIFY
+
+func newArchiveWatcher(dir string) (archiveWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, archiveWatchMask); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("inotify_add_watch %s: %w", dir, err)
+	}
+
+	w := &inotifyWatcher{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		events:  make(chan ArchiveEvent, 256),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.readLoop()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Events() <-chan ArchiveEvent {
+	return w.events
+}
+
+// stops the reader even when nobody drains Events anymore, and waits for it so the fd is really gone
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+	})
+	<-w.stopped
+	return err
+}
+
+// hands an event to Events, false once the watcher is closed
+func (w *inotifyWatcher) send(ev ArchiveEvent) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// decodes struct inotify_event records until the file is closed
+func (w *inotifyWatcher) readLoop() {
+	defer close(w.stopped)
+	defer close(w.events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			nameStart := off + syscall.SizeofInotifyEvent
+			if nameStart+nameLen > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+nameLen], "\x00"))
+			off = nameStart + nameLen
+
+			sent := true
+			switch {
+			case mask&syscall.IN_Q_OVERFLOW != 0:
+				sent = w.send(ArchiveEvent{Overflow: true})
+			case name == "" || mask&syscall.IN_ISDIR != 0:
+				// events about the dir itself
+			case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+				sent = w.send(ArchiveEvent{Name: name, Removed: true})
+			case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO|syscall.IN_CLOSE_WRITE) != 0:
+				sent = w.send(ArchiveEvent{Name: name})
+			case strings.HasSuffix(name, ".partial"):
+				// one per write, dropped while the monitor is still busy with an earlier one. the next write
+				// or the rename at the end of the segment reports it again
+				select {
+				case w.events <- ArchiveEvent{Name: name}:
+				case <-w.done:
+					sent = false
+				default:
+				}
+			}
+			if !sent {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the next event for name, skipping others
+func waitForEvent(t *testing.T, events <-chan ArchiveEvent, name string, removed bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed while waiting for %s", name)
+			}
+			if ev.Name == name && ev.Removed == removed {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no event for %s (removed %v)", name, removed)
+		}
+	}
+}
+
+func TestArchiveWatcherEvents(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newArchiveWatcher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	partial := "000000010000000000000001.partial"
+	f, err := os.Create(filepath.Join(dir, partial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	waitForEvent(t, w.Events(), partial, false)
+
+	// pg_receivewal keeps the .partial open, writes are the only sign it grew
+	if _, err := f.Write(make([]byte, 8192)); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w.Events(), partial, false)
+
+	if err := os.Rename(filepath.Join(dir, partial), filepath.Join(dir, "000000010000000000000001")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w.Events(), partial, true)
+	waitForEvent(t, w.Events(), "000000010000000000000001", false)
+
+	// writes into a finished file don't matter, its IN_CLOSE_WRITE does
+	other := filepath.Join(dir, "notes")
+	if err := os.WriteFile(other, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w.Events(), "notes", false)
+	if err := os.Remove(other); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w.Events(), "notes", true)
+}
+
+func TestArchiveWatcherCloseWithoutDraining(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newArchiveWatcher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more events than the channel holds, nobody reads them
+	for i := range 400 {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() { closed <- w.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hangs while the reader is stuck on a full events channel")
+	}
+
+	// the reader is gone and closed the channel behind the buffered events
+	n := 0
+	for range w.Events() {
+		n++
+	}
+	if n > cap(w.(*inotifyWatcher).events) {
+		t.Errorf("%d events after close, more than the buffer", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// no inotify here, RunMonitor falls back to polling
+func newArchiveWatcher(dir string) (archiveWatcher, error) {
+	return nil, errors.New("file events are only supported on linux")
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+/*
+- reads, edits and rewrites postgresql.auto.conf in the restore target
+- the base backup brings over the primary's auto.conf, so we parse it, drop every recovery setting
+  and restore_command, then add ours. running the same restore twice always ends in the same file
+- the file is written next to the real one and renamed over it, so postgres never sees half a file
+*/
+
+// header postgres itself writes at the top of postgresql.auto.conf
+const autoConfHeader = "# Do not edit this file manually!\n# It will be overwritten by the ALTER SYSTEM command.\n"
+
+// a ConfigSetting is one "key = 'value'" line of postgresql.auto.conf
+type ConfigSetting struct {
+	Key   string
+	Value string
+}
+
+// one line of the file. comments, blank lines and include directives keep their raw text and have no Key.
+// settings read from the file keep theirs too, so a line nobody changed is written back exactly as it was
+type autoConfLine struct {
+	Raw       string
+	Setting   *ConfigSetting
+	noNewline bool // the last line of a file that didn't end in a newline
+}
+
+// parsed postgresql.auto.conf
+type AutoConf struct {
+	lines []autoConfLine
+}
+
+// parses the file using postgresql.conf syntax: "key = value" or "key value", # comments,
+// values either bare words or single quoted (quotes escaped by doubling them, backslash escapes like postgres:
+// \b \f \n \r \t, octal \ooo, anything else stands for itself)
+func ParseAutoConf(content string) (*AutoConf, error) {
+	ac := &AutoConf{}
+
+	for i, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			ac.lines = append(ac.lines, autoConfLine{Raw: line})
+			continue
+		}
+
+		setting, err := parseConfigLine(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("postgresql.auto.conf line %d: %w", i+1, err)
+		}
+
+		// include directives aren't settings, keep them exactly as they were
+		switch setting.Key {
+		case "include", "include_if_exists", "include_dir":
+			ac.lines = append(ac.lines, autoConfLine{Raw: line})
+			continue
+		}
+
+		ac.lines = append(ac.lines, autoConfLine{Raw: line, Setting: &setting})
+	}
+
+	// strings.Split leaves an empty last element for a trailing newline, Render adds that back
+	if n := len(ac.lines); n > 0 && ac.lines[n-1].Setting == nil && ac.lines[n-1].Raw == "" {
+		ac.lines = ac.lines[:n-1]
+	} else if n > 0 {
+		ac.lines[n-1].noNewline = true
+	}
+
+	return ac, nil
+}
+
+// splits one non-comment line into key and unquoted value
+func parseConfigLine(line string) (ConfigSetting, error) {
+	i := 0
+	for i < len(line) && isConfigNameChar(line[i], i == 0) {
+		i++
+	}
+	if i == 0 {
+		return ConfigSetting{}, fmt.Errorf("expected a setting name in %q", line)
+	}
+	key := strings.ToLower(line[:i])
+
+	rest := strings.TrimLeft(line[i:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+	rest = strings.TrimLeft(rest, " \t")
+
+	var value string
+	if strings.HasPrefix(rest, "'") {
+		var sb strings.Builder
+		j := 1
+		closed := false
+		for j < len(rest) {
+			c := rest[j]
+			if c == '\\' && j+1 < len(rest) {
+				j += 1 + unescapeConfigChar(&sb, rest[j+1:])
+				continue
+			}
+			if c == '\'' {
+				if j+1 < len(rest) && rest[j+1] == '\'' {
+					sb.WriteByte('\'')
+					j += 2
+					continue
+				}
+				closed = true
+				j++
+				break
+			}
+			sb.WriteByte(c)
+			j++
+		}
+		if !closed {
+			return ConfigSetting{}, fmt.Errorf("unterminated quoted value for %s", key)
+		}
+		value = sb.String()
+		rest = rest[j:]
+	} else {
+		end := strings.IndexAny(rest, " \t#")
+		if end == -1 {
+			end = len(rest)
+		}
+		value = rest[:end]
+		rest = rest[end:]
+		if value == "" {
+			return ConfigSetting{}, fmt.Errorf("missing value for %s", key)
+		}
+		if strings.ContainsFunc(value, isConfigControlChar) {
+			return ConfigSetting{}, fmt.Errorf("control character in the value of %s, only quoted values may have those", key)
+		}
+	}
+
+	// only whitespace or a trailing comment may follow the value
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return ConfigSetting{}, fmt.Errorf("unexpected text after value for %s: %q", key, rest)
+	}
+
+	return ConfigSetting{Key: key, Value: value}, nil
+}
+
+// writes the character a backslash escape stands for, s starts after the backslash. returns how many bytes it used
+func unescapeConfigChar(sb *strings.Builder, s string) int {
+	switch s[0] {
+	case 'b':
+		sb.WriteByte('\b')
+	case 'f':
+		sb.WriteByte('\f')
+	case 'n':
+		sb.WriteByte('\n')
+	case 'r':
+		sb.WriteByte('\r')
+	case 't':
+		sb.WriteByte('\t')
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		n, octal := 0, 0
+		for n < 3 && n < len(s) && s[n] >= '0' && s[n] <= '7' {
+			octal = octal*8 + int(s[n]-'0')
+			n++
+		}
+		sb.WriteByte(byte(octal))
+		return n
+	default:
+		sb.WriteByte(s[0])
+	}
+	return 1
+}
+
+func isConfigControlChar(c rune) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+func isConfigNameChar(c byte, first bool) bool {
+	if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' {
+		return true
+	}
+	return !first && ((c >= '0' && c <= '9') || c == '.' || c == '$')
+}
+
+// returns the effective value of a setting. like postgres, the last occurrence wins
+func (ac *AutoConf) Get(key string) (string, bool) {
+	key = strings.ToLower(key)
+	value, found := "", false
+	for _, l := range ac.lines {
+		if l.Setting != nil && l.Setting.Key == key {
+			value, found = l.Setting.Value, true
+		}
+	}
+	return value, found
+}
+
+// sets a value. the first occurrence is replaced in place, any later duplicates are dropped
+func (ac *AutoConf) Set(key string, value string) {
+	key = strings.ToLower(key)
+	replaced := false
+	kept := ac.lines[:0]
+	for _, l := range ac.lines {
+		if l.Setting != nil && l.Setting.Key == key {
+			if replaced {
+				continue
+			}
+			l = autoConfLine{Setting: &ConfigSetting{Key: key, Value: value}}
+			replaced = true
+		}
+		kept = append(kept, l)
+	}
+	ac.lines = kept
+
+	if !replaced {
+		ac.lines = append(ac.lines, autoConfLine{Setting: &ConfigSetting{Key: key, Value: value}})
+	}
+}
+
+// removes every occurrence of a setting
+func (ac *AutoConf) Delete(key string) {
+	key = strings.ToLower(key)
+	ac.deleteWhere(func(k string) bool { return k == key })
+}
+
+// removes restore_command and every recovery_* setting, whatever the backup or an earlier restore left behind
+func (ac *AutoConf) DeleteRecoverySettings() {
+	ac.deleteWhere(func(k string) bool {
+		return k == "restore_command" || strings.HasPrefix(k, "recovery_")
+	})
+}
+
+func (ac *AutoConf) deleteWhere(match func(key string) bool) {
+	kept := ac.lines[:0]
+	for _, l := range ac.lines {
+		if l.Setting != nil && match(l.Setting.Key) {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	ac.lines = kept
+}
+
+// the effective settings in file order, one per key
+func (ac *AutoConf) Settings() []ConfigSetting {
+	var settings []ConfigSetting
+	index := map[string]int{}
+	for _, l := range ac.lines {
+		if l.Setting == nil {
+			continue
+		}
+		if i, ok := index[l.Setting.Key]; ok {
+			settings[i] = *l.Setting
+			continue
+		}
+		index[l.Setting.Key] = len(settings)
+		settings = append(settings, *l.Setting)
+	}
+	return settings
+}
+
+// renders the file. lines read from it are kept as they were, settings added by Set are written as key = 'value'
+func (ac *AutoConf) Render() string {
+	var sb strings.Builder
+	if len(ac.lines) == 0 || ac.lines[0].Setting != nil && ac.lines[0].Raw == "" {
+		sb.WriteString(autoConfHeader)
+	}
+	for i, l := range ac.lines {
+		if l.Setting != nil && l.Raw == "" {
+			sb.WriteString(RenderConfigSettings([]ConfigSetting{*l.Setting}))
+			continue
+		}
+		sb.WriteString(l.Raw)
+		if !l.noNewline || i < len(ac.lines)-1 {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// quotes a value for postgresql.conf: wrapped in single quotes, embedded quotes and backslashes doubled,
+// line breaks written as \n and \r since a quoted value can't span lines
+func QuoteConfigValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `''`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, "\r", `\r`)
+	return "'" + value + "'"
+}
+
+// renders settings as postgresql.conf lines
+func RenderConfigSettings(settings []ConfigSetting) string {
+	var sb strings.Builder
+	for _, s := range settings {
+		sb.WriteString(s.Key)
+		sb.WriteString(" = ")
+		sb.WriteString(QuoteConfigValue(s.Value))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// reads postgresql.auto.conf from a container's data directory. a missing file is an empty config
+func ReadAutoConf(containerName string, dataDir string) (*AutoConf, error) {
+	confPath := path.Join(dataDir, "postgresql.auto.conf")
+
+	// test -f first so "file missing" and "docker failed" aren't confused: test exits 1 without a word,
+	// docker itself (daemon down, wrong container name) fails with a message on stderr
+	var stderr bytes.Buffer
+	testCmd := exec.Command("docker", "exec", containerName, "test", "-f", confPath)
+	testCmd.Stderr = &stderr
+	if err := testCmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && stderr.Len() == 0 {
+			return ParseAutoConf("")
+		}
+		return nil, fmt.Errorf("failed to check for %s in %s: %s: %w", confPath, containerName, strings.TrimSpace(stderr.String()), err)
+	}
+
+	out, err := exec.Command("docker", "exec", containerName, "cat", confPath).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", confPath, err)
+	}
+	return ParseAutoConf(string(out))
+}
+
+// writes postgresql.auto.conf into a container's data directory atomically:
+// the content goes to a temp file in the same directory (through stdin, no shell), then it's renamed over the real file.
+// both steps run as the postgres user so the file keeps the right owner
+func WriteAutoConf(containerName string, dataDir string, ac *AutoConf) error {
+	confPath := path.Join(dataDir, "postgresql.auto.conf")
+	tmpPath := confPath + ".tmp"
+
+	writeCmd := exec.Command("docker", "exec", "-i", "-u", "postgres", containerName, "tee", tmpPath)
+	writeCmd.Stdin = strings.NewReader(ac.Render())
+	if out, err := writeCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to write %s: %s: %w", tmpPath, string(out), err)
+	}
+
+	syncCmd := exec.Command("docker", "exec", "-u", "postgres", containerName, "sync", tmpPath)
+	if out, err := syncCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to sync %s: %s: %w", tmpPath, string(out), err)
+	}
+
+	mvCmd := exec.Command("docker", "exec", "-u", "postgres", containerName, "mv", "-f", tmpPath, confPath)
+	if out, err := mvCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to replace %s: %s: %w", confPath, string(out), err)
+	}
+
+	return nil
+}
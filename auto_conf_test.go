@@ -0,0 +1,184 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseAutoConf(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		want    []ConfigSetting
+	}{
+		{"", nil},
+		{autoConfHeader, nil},
+		{"work_mem = '4MB'\n", []ConfigSetting{{"work_mem", "4MB"}}},
+		{"work_mem='4MB'", []ConfigSetting{{"work_mem", "4MB"}}},
+		{"Work_Mem 4MB  # per sort\n", []ConfigSetting{{"work_mem", "4MB"}}},
+		{"  shared_buffers = 128MB\r\n", []ConfigSetting{{"shared_buffers", "128MB"}}},
+		{"port = 5432\nport = 5433\n", []ConfigSetting{{"port", "5433"}}},
+		{"pg_stat_statements.max = 10000\n", []ConfigSetting{{"pg_stat_statements.max", "10000"}}},
+		{"search_path = '\"$user\", public'\n", []ConfigSetting{{"search_path", `"$user", public`}}},
+		{"a = 'it''s'\n", []ConfigSetting{{"a", "it's"}}},
+		{`a = 'it\'s'`, []ConfigSetting{{"a", "it's"}}},
+		{`a = 'C:\\dir'`, []ConfigSetting{{"a", `C:\dir`}}},
+		{`a = 'two\nlines\r\tend'`, []ConfigSetting{{"a", "two\nlines\r\tend"}}},
+		{`a = '\b\f\101\0\1234\q'`, []ConfigSetting{{"a", "\b\fA\x00S4q"}}},
+		{"a = ''\n", []ConfigSetting{{"a", ""}}},
+		{"a = '# not a comment' # a comment\n", []ConfigSetting{{"a", "# not a comment"}}},
+		{"include 'other.conf'\ninclude_dir 'conf.d'\n", nil},
+	} {
+		ac, err := ParseAutoConf(tc.content)
+		if err != nil {
+			t.Errorf("%q: %v", tc.content, err)
+			continue
+		}
+		if got := ac.Settings(); !slices.Equal(got, tc.want) {
+			t.Errorf("%q: %v, want %v", tc.content, got, tc.want)
+		}
+	}
+
+	for _, content := range []string{
+		"= 'x'\n",
+		"1abc = 'x'\n",
+		"work_mem =\n",
+		"a = 'unterminated\n",
+		"a = 'two\nlines'\n",
+		"a = 'x' trailing\n",
+		"a = x y\n",
+		"a-b = 'x'\n",
+		"recovery\x01target = 'x'\n", // control characters in the name
+		"recovery_target\x7f = 'x'\n",
+		"\x1brecovery_target = 'x'\n",
+		"recovery_target \x01\n",
+		"a = 'x'\x00\n",
+	} {
+		if ac, err := ParseAutoConf(content); err == nil {
+			t.Errorf("%q: parsed as %v, want an error", content, ac.Settings())
+		}
+	}
+}
+
+func TestQuoteConfigValueRoundTrip(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"plain",
+		"it's",
+		"''",
+		`\`,
+		`C:\dir\'s`,
+		`ends with \`,
+		"two\nlines",
+		"windows\r\nline",
+		"\n\n",
+		"tab\tand \\n that isn't a newline",
+		"cp /wal_archive/%f %p 2>/dev/null || cp /wal_archive/restore_staging/%f %p",
+		"# hash",
+		"unicode ünïcødé ✓",
+	} {
+		quoted := QuoteConfigValue(value)
+		if strings.ContainsAny(quoted, "\n\r") {
+			t.Errorf("%q quoted to %q, a line break ends the line", value, quoted)
+		}
+		ac, err := ParseAutoConf("a = " + quoted + "\n")
+		if err != nil {
+			t.Errorf("%q quoted to %q doesn't parse: %v", value, quoted, err)
+			continue
+		}
+		if got, _ := ac.Get("a"); got != value {
+			t.Errorf("%q quoted to %q reads back as %q", value, quoted, got)
+		}
+	}
+}
+
+func TestAutoConfSet(t *testing.T) {
+	ac, err := ParseAutoConf(autoConfHeader + "work_mem = '4MB'\n# keep me\nport = 5432\nWORK_MEM = '8MB'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.Set("Work_Mem", "16MB")
+	ac.Set("restore_command", "cp '%f' %p")
+	ac.Delete("port")
+
+	want := autoConfHeader + "work_mem = '16MB'\n# keep me\nrestore_command = 'cp ''%f'' %p'\n"
+	if got := ac.Render(); got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+	if got, ok := ac.Get("WORK_MEM"); !ok || got != "16MB" {
+		t.Errorf("work_mem = %q, %v", got, ok)
+	}
+
+	// a file that starts with a setting gets the header postgres writes
+	ac, _ = ParseAutoConf("")
+	ac.Set("port", "5433")
+	if got := ac.Render(); got != autoConfHeader+"port = '5433'\n" {
+		t.Errorf("new file rendered as %q", got)
+	}
+}
+
+// whatever was in the file before the restore comes back unchanged once our settings are gone again
+func TestAutoConfDeleteRecoverySettingsRestoresTheFile(t *testing.T) {
+	target := RecoveryTarget{Kind: RecoveryTargetName, Name: "it's\\here", Inclusive: true, Timeline: "latest", Action: RecoveryActionPause}
+	for _, original := range []string{
+		"",
+		autoConfHeader,
+		autoConfHeader + "work_mem = '4MB'\n",
+		autoConfHeader + "work_mem='4MB'   # tuned\n\n# a comment\nshared_buffers 128MB\n",
+		autoConfHeader + "search_path = '\"$user\", public'\nlisten_addresses = '*'\ninclude_if_exists 'extra.conf'\n",
+		"work_mem = '4MB'\nport = 5433", // hand written, no header and no newline at the end
+		"\t port =   5433 \n",
+		autoConfHeader + "a = 'two\\nlines'\nb = 'C:\\\\dir'\n",
+	} {
+		ac, err := ParseAutoConf(original)
+		if err != nil {
+			t.Errorf("%q: %v", original, err)
+			continue
+		}
+		unchanged := ac.Render()
+		if original != "" && unchanged != original {
+			t.Errorf("%q renders as %q without any change", original, unchanged)
+		}
+
+		ac.DeleteRecoverySettings()
+		ac.Set("restore_command", "cp /wal_archive/%f %p")
+		for _, s := range target.Settings() {
+			ac.Set(s.Key, s.Value)
+		}
+		withRecovery := ac.Render()
+		ac.DeleteRecoverySettings()
+		if got := ac.Render(); got != unchanged {
+			t.Errorf("%q: after deleting the recovery settings again\n got %q\nwant %q", original, got, unchanged)
+		}
+
+		// the same from the file a restore wrote, which has to end the last original line to append to it
+		restored, err := ParseAutoConf(withRecovery)
+		if err != nil {
+			t.Errorf("%q with recovery settings doesn't parse: %v", original, err)
+			continue
+		}
+		if got, _ := restored.Get("recovery_target_name"); got != target.Name {
+			t.Errorf("%q: recovery_target_name reads back as %q", original, got)
+		}
+		restored.DeleteRecoverySettings()
+		if got, want := restored.Render(), strings.TrimSuffix(unchanged, "\n")+"\n"; got != want {
+			t.Errorf("%q: read back without the recovery settings\n got %q\nwant %q", original, got, want)
+		}
+	}
+}
+
+// settings an old restore or the primary left behind are all dropped, others stay
+func TestAutoConfDeleteRecoverySettings(t *testing.T) {
+	ac, err := ParseAutoConf(autoConfHeader +
+		"restore_command = 'cp /old/%f %p'\nwork_mem = '4MB'\nrecovery_target_time = '2024-05-01 12:00:00+00'\n" +
+		"Recovery_Target_Action = 'pause'\nrecovery_end_command = 'true'\nrecovery_min_apply_delay = '5min'\n" +
+		"primary_conninfo = 'host=old'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.DeleteRecoverySettings()
+	want := []ConfigSetting{{"work_mem", "4MB"}, {"primary_conninfo", "host=old"}}
+	if got := ac.Settings(); !slices.Equal(got, want) {
+		t.Errorf("left %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+- a finished base backup is streamed out of the container as one tar into the archive's backups/ as
+  base_<time>.tar (base_<time>.tar.enc with an encryption key), then /backups/latest is deleted
+- backup_label, pg_control, tablespace_map and backup_manifest also go into the small base_<time>.info(.enc),
+  so reading the backup's details doesn't mean fetching all of it
+- the info object is stored before the tar and a backup only counts once both are there, so a failed or
+  interrupted upload never replaces the last good backup. older backups are deleted after a new one is stored
+- a restore streams the tar (decrypting it on the way) straight into tar -x inside the restore target
+- a /backups/latest left from before backups were archived is still used while the archive has none
+*/
+
+const backupNamePrefix = "base_"
+
+// the files ReadBackupFile is asked for, kept in the info object
+var backupInfoFiles = map[string]bool{
+	"backup_label":      true,
+	"tablespace_map":    true,
+	"global/pg_control": true,
+	"backup_manifest":   true,
+}
+
+// one base backup in the archive
+type archivedBackup struct {
+	name      string // base_20240501T120000Z
+	encrypted bool
+}
+
+func (b archivedBackup) suffix() string {
+	if b.encrypted {
+		return encryptedSuffix
+	}
+	return ""
+}
+
+func (b archivedBackup) infoName() string { return b.name + ".info" + b.suffix() }
+func (b archivedBackup) tarName() string  { return b.name + ".tar" + b.suffix() }
+
+// takes an object name apart, kind is "info" or "tar"
+func parseBackupObjectName(name string) (b archivedBackup, kind string, ok bool) {
+	if !strings.HasPrefix(name, backupNamePrefix) || strings.Contains(name, "/") {
+		return archivedBackup{}, "", false
+	}
+	name, b.encrypted = strings.CutSuffix(name, encryptedSuffix)
+	ext := path.Ext(name)
+	if ext != ".info" && ext != ".tar" {
+		return archivedBackup{}, "", false
+	}
+	b.name = strings.TrimSuffix(name, ext)
+	return b, ext[1:], true
+}
+
+// lists the complete backups in the archive (info and tar both there), oldest first
+func listArchivedBackups(backups ArchiveStore) ([]archivedBackup, error) {
+	objs, err := backups.List("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	parts := map[archivedBackup]int{}
+	var complete []archivedBackup
+	for _, obj := range objs {
+		b, _, ok := parseBackupObjectName(obj.Name)
+		if !ok {
+			continue
+		}
+		// objects are listed by name, so the pairs come out in time order
+		if parts[b]++; parts[b] == 2 {
+			complete = append(complete, b)
+		}
+	}
+	return complete, nil
+}
+
+// the newest complete backup in the archive, false if there's none
+func latestArchivedBackup(backups ArchiveStore) (archivedBackup, bool, error) {
+	all, err := listArchivedBackups(backups)
+	if err != nil || len(all) == 0 {
+		return archivedBackup{}, false, err
+	}
+	return all[len(all)-1], true, nil
+}
+
+// streams the finished backup out of the container into the archive (encrypted when key isn't nil),
+// then deletes /backups/latest and the older archived backups
+// a failure leaves /backups/latest where it is and the last archived backup untouched
+func ArchiveLatestBackup(ctx context.Context, containerName string, backups ArchiveStore, key *EncryptionKey) error {
+	b := archivedBackup{name: backupNamePrefix + time.Now().UTC().Format("20060102T150405Z"), encrypted: key != nil}
+	if key != nil {
+		fmt.Printf("Archiving base backup as %s (encrypted with key %s)...\n", b.tarName(), key.ID)
+	} else {
+		fmt.Printf("Archiving base backup as %s...\n", b.tarName())
+	}
+
+	tarWriter, err := backups.Put(b.tarName(), time.Time{})
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "docker", "exec", containerName, "tar", "-C", "/backups/latest", "-cf", "-", ".")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		tarWriter.Abort()
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		tarWriter.Abort()
+		return err
+	}
+	wait := func() error {
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("tar of the backup failed: %s: %w", stderr.String(), err)
+		}
+		return nil
+	}
+	if err := storeBackup(backups, b, tarWriter, stdout, key, wait); err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("docker", "exec", containerName, "rm", "-rf", "/backups/latest").CombinedOutput(); err != nil {
+		return fmt.Errorf("backup archived but /backups/latest couldn't be removed: %s: %w", string(out), err)
+	}
+	pruneArchivedBackups(backups, b)
+	fmt.Printf("Backup archived: backups/%s\n", b.tarName())
+	return nil
+}
+
+// stores the backup tar read from r as b: the tar object from tarWriter (which is committed or aborted here)
+// and the info object picked out of it. wait reports whether whatever wrote r finished cleanly,
+// nothing is committed unless it did
+func storeBackup(backups ArchiveStore, b archivedBackup, tarWriter ArchiveWriter, r io.Reader, key *EncryptionKey, wait func() error) error {
+	info, streamErr := archiveBackupStream(r, tarWriter, key)
+	if streamErr != nil {
+		io.Copy(io.Discard, r) // let the writer finish so wait doesn't hang
+	}
+	if err := wait(); err != nil {
+		tarWriter.Abort()
+		return err
+	}
+	if streamErr != nil {
+		tarWriter.Abort()
+		return fmt.Errorf("archiving the backup failed: %w", streamErr)
+	}
+
+	// info first, the backup is complete once the tar is there too
+	if err := putObject(backups, b.infoName(), time.Time{}, bytes.NewReader(info)); err != nil {
+		tarWriter.Abort()
+		return fmt.Errorf("archiving the backup failed: %w", err)
+	}
+	if err := tarWriter.Commit(); err != nil {
+		backups.Delete(b.infoName())
+		return fmt.Errorf("archiving the backup failed: %w", err)
+	}
+	return nil
+}
+
+// copies the tar stream into the tar object while picking the info files out of it, returns the info object
+// nothing is committed, that's up to the caller once tar exited cleanly
+func archiveBackupStream(r io.Reader, tarWriter ArchiveWriter, key *EncryptionKey) ([]byte, error) {
+	var backupOut io.WriteCloser = nopWriteCloser{tarWriter}
+	var info bytes.Buffer
+	var infoOut io.WriteCloser = nopWriteCloser{&info}
+	if key != nil {
+		var err error
+		if backupOut, err = key.NewWriter(tarWriter); err != nil {
+			return nil, err
+		}
+		if infoOut, err = key.NewWriter(&info); err != nil {
+			return nil, err
+		}
+	}
+	infoTar := tar.NewWriter(infoOut)
+
+	// everything tar.Reader reads goes into the backup byte for byte
+	tr := tar.NewReader(io.TeeReader(r, backupOut))
+	found := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !backupInfoFiles[name] {
+			continue
+		}
+		infoHdr := *hdr
+		infoHdr.Name = name
+		if err := infoTar.WriteHeader(&infoHdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(infoTar, tr); err != nil {
+			return nil, err
+		}
+		found++
+	}
+	// the end of archive blocks aren't read by tar.Reader
+	if _, err := io.Copy(backupOut, r); err != nil {
+		return nil, err
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("no backup_label or pg_control in the backup")
+	}
+
+	for _, closer := range []io.Closer{infoTar, infoOut, backupOut} {
+		if err := closer.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return info.Bytes(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// deletes every archived backup other than keep, the tar first so a half deleted one is never complete
+func pruneArchivedBackups(backups ArchiveStore, keep archivedBackup) {
+	all, err := listArchivedBackups(backups)
+	if err != nil {
+		fmt.Printf("Warning: couldn't remove older backups: %v\n", err)
+		return
+	}
+	for _, b := range all {
+		if b == keep {
+			continue
+		}
+		for _, name := range []string{b.tarName(), b.infoName()} {
+			if err := backups.Delete(name); err != nil {
+				fmt.Printf("Warning: couldn't remove backups/%s: %v\n", name, err)
+			}
+		}
+	}
+}
+
+// opens one of a backup's objects, decrypting it if it's encrypted. returns the key ID it's encrypted with
+func openBackupObject(backups ArchiveStore, name string, encrypted bool, keys *KeyRing) (io.Reader, io.Closer, string, error) {
+	f, err := backups.Get(name)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if !encrypted {
+		return f, f, "", nil
+	}
+	if keys == nil {
+		f.Close()
+		return nil, nil, "", fmt.Errorf("%s is encrypted and no encryption key is configured", name)
+	}
+	r, keyID, err := keys.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, keyID, fmt.Errorf("%s: %w", name, err)
+	}
+	return r, f, keyID, nil
+}
+
+// reads one of the info files of an archived backup, with its modification time
+func readBackupInfo(backups ArchiveStore, b archivedBackup, name string, keys *KeyRing) ([]byte, time.Time, error) {
+	r, closer, _, err := openBackupObject(backups, b.infoName(), b.encrypted, keys)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer closer.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, time.Time{}, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("%s: %w", b.infoName(), err)
+		}
+		if hdr.Name == filepath.ToSlash(name) {
+			data, err := io.ReadAll(tr)
+			return data, hdr.ModTime, err
+		}
+	}
+}
+
+// streams an archived backup straight into the restore target's (empty) data dir
+func RestoreArchivedBackup(containerName string, backups ArchiveStore, b archivedBackup, keys *KeyRing) error {
+	return extractArchivedBackup(backups, b, keys, func(r io.Reader) ([]byte, error) {
+		cmd := exec.Command("docker", "exec", "-i", containerName, "tar", "-C", restoreDataDir, "-xf", "-")
+		cmd.Stdin = r
+		return cmd.CombinedOutput()
+	})
+}
+
+// feeds the backup's tar (decrypted) to untar, which returns its output for the error message
+func extractArchivedBackup(backups ArchiveStore, b archivedBackup, keys *KeyRing, untar func(io.Reader) ([]byte, error)) error {
+	r, closer, keyID, err := openBackupObject(backups, b.tarName(), b.encrypted, keys)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	if b.encrypted {
+		fmt.Printf("Decrypting base backup %s (key %s) into the data directory...\n", b.name, keyID)
+	} else {
+		fmt.Printf("Extracting base backup %s into the data directory...\n", b.name)
+	}
+
+	src := &errRecordingReader{r: r}
+	out, err := untar(src)
+	// a read or decryption error only shows up as tar's input ending early, so it's checked first
+	if src.err != nil {
+		return fmt.Errorf("reading the backup failed: %w", src.err)
+	}
+	if err != nil {
+		return fmt.Errorf("untar of the backup failed: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+// remembers the first error other than EOF
+type errRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errRecordingReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a base backup as pg_basebackup -Ft would leave it in /backups/latest, tarred
+var testBackupFiles = map[string]string{
+	"backup_label":      "START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\n",
+	"global/pg_control": strings.Repeat("\x01", 8192),
+	"base/1/1259":       strings.Repeat("relation data ", 1000),
+	"PG_VERSION":        "16\n",
+}
+
+func testBackupTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range slices.Sorted(maps.Keys(testBackupFiles)) {
+		data := testBackupFiles[name]
+		hdr := &tar.Header{Name: "./" + name, Mode: 0600, Size: int64(len(data)), ModTime: time.Unix(1714564800, 0)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// what extractArchivedBackup hands to tar -x, read back into a map
+func untarFiles(t *testing.T, backups ArchiveStore, b archivedBackup, keys *KeyRing) (map[string]string, error) {
+	files := map[string]string{}
+	err := extractArchivedBackup(backups, b, keys, func(r io.Reader) ([]byte, error) {
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			files[strings.TrimPrefix(hdr.Name, "./")] = string(data)
+		}
+	})
+	return files, err
+}
+
+func storeTestBackup(t *testing.T, backups ArchiveStore, b archivedBackup, key *EncryptionKey, data []byte, wait func() error) error {
+	t.Helper()
+	w, err := backups.Put(b.tarName(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storeBackup(backups, b, w, bytes.NewReader(data), key, wait)
+}
+
+func noWait() error { return nil }
+
+func TestBackupArchiveRoundTrip(t *testing.T) {
+	keys := testKeyRing(t)
+	for _, encrypted := range []bool{false, true} {
+		backups := SubStore(NewMemoryArchiveStore(), backupsPrefix)
+		b := archivedBackup{name: "base_20240501T120000Z", encrypted: encrypted}
+		var key *EncryptionKey
+		if encrypted {
+			key = keys.Active
+		}
+		tarData := testBackupTar(t)
+		if err := storeTestBackup(t, backups, b, key, tarData, noWait); err != nil {
+			t.Fatalf("encrypted %v: %v", encrypted, err)
+		}
+
+		latest, ok, err := latestArchivedBackup(backups)
+		if err != nil || !ok || latest != b {
+			t.Fatalf("encrypted %v: latest backup = %+v, %v, %v", encrypted, latest, ok, err)
+		}
+
+		// the info object only has the small files
+		label, modTime, err := readBackupInfo(backups, b, "backup_label", keys)
+		if err != nil || string(label) != testBackupFiles["backup_label"] || modTime.Unix() != 1714564800 {
+			t.Errorf("encrypted %v: backup_label from the info = %q, %v, %v", encrypted, label, modTime, err)
+		}
+		if _, _, err := readBackupInfo(backups, b, "base/1/1259", keys); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("encrypted %v: relation file in the info object: %v", encrypted, err)
+		}
+
+		// the tar object is the stream byte for byte
+		r, closer, _, err := openBackupObject(backups, b.tarName(), encrypted, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := io.ReadAll(r)
+		closer.Close()
+		if !bytes.Equal(stored, tarData) {
+			t.Errorf("encrypted %v: stored tar differs from the stream", encrypted)
+		}
+
+		files, err := untarFiles(t, backups, b, keys)
+		if err != nil || !maps.Equal(files, testBackupFiles) {
+			t.Errorf("encrypted %v: restored %v files, %v", encrypted, len(files), err)
+		}
+	}
+}
+
+func TestStoreBackupFailureKeepsLastBackup(t *testing.T) {
+	mem := NewMemoryArchiveStore()
+	backups := SubStore(mem, backupsPrefix)
+	old := archivedBackup{name: "base_20240501T120000Z"}
+	if err := storeTestBackup(t, backups, old, nil, testBackupTar(t), noWait); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := archivedBackup{name: "base_20240502T120000Z"}
+	tarFailed := func() error { return errors.New("tar exited 2") }
+	if err := storeTestBackup(t, backups, failed, nil, testBackupTar(t), tarFailed); err == nil {
+		t.Error("backup stored although tar failed")
+	}
+	// a stream that isn't a backup
+	var notBackup bytes.Buffer
+	tw := tar.NewWriter(&notBackup)
+	tw.WriteHeader(&tar.Header{Name: "README", Mode: 0600, Size: 2})
+	tw.Write([]byte("hi"))
+	tw.Close()
+	if err := storeTestBackup(t, backups, failed, nil, notBackup.Bytes(), noWait); err == nil {
+		t.Error("tar without backup_label or pg_control stored")
+	}
+
+	all, err := listArchivedBackups(backups)
+	if err != nil || !slices.Equal(all, []archivedBackup{old}) {
+		t.Errorf("backups after the failures = %v, %v", all, err)
+	}
+	if objs, _ := backups.List(""); len(objs) != 2 {
+		t.Errorf("objects left behind: %v", objs)
+	}
+}
+
+func TestPruneArchivedBackupsKeepsNewest(t *testing.T) {
+	backups := SubStore(NewMemoryArchiveStore(), backupsPrefix)
+	var names []archivedBackup
+	for _, name := range []string{"base_20240501T120000Z", "base_20240502T120000Z", "base_20240503T120000Z"} {
+		b := archivedBackup{name: name}
+		if err := storeTestBackup(t, backups, b, nil, testBackupTar(t), noWait); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, b)
+	}
+	pruneArchivedBackups(backups, names[2])
+	if objs, _ := backups.List(""); len(objs) != 2 {
+		t.Errorf("left after pruning: %v", objs)
+	}
+	if latest, ok, _ := latestArchivedBackup(backups); !ok || latest != names[2] {
+		t.Errorf("latest after pruning = %v", latest)
+	}
+}
+
+func TestExtractArchivedBackupReportsTamperedTar(t *testing.T) {
+	keys := testKeyRing(t)
+	mem := NewMemoryArchiveStore()
+	backups := SubStore(mem, backupsPrefix)
+	b := archivedBackup{name: "base_20240501T120000Z", encrypted: true}
+	if err := storeTestBackup(t, backups, b, keys.Active, testBackupTar(t), noWait); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := readObject(backups, b.tarName())
+	data[len(data)-100] ^= 1
+	if err := putObject(backups, b.tarName(), time.Time{}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := untarFiles(t, backups, b, keys)
+	if err == nil || !strings.Contains(err.Error(), "reading the backup failed") {
+		t.Errorf("extract of a tampered backup = %v, want the decryption error", err)
+	}
+}
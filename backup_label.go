@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+- parses backup_label and tablespace_map from a plain format base backup
+- together with pg_control this tells us everything about a backup: where replay starts, which
+  timeline it's on, which cluster it came from and when it was taken
+*/
+
+// where pg_basebackup leaves a backup before it's archived, the containers see it as /backups/latest
+// also still read from when the archive has no backup yet (taken before backups were archived)
+var latestBackupDir = filepath.Join("Docker_Connections", "backups", "latest")
+
+// container that mounts /backups, used when the host can't read the backup files directly
+// (pg_basebackup writes them as the container's postgres user with 0600 permissions)
+const backupMountContainer = "restore_target"
+
+// contents of backup_label
+type BackupLabel struct {
+	StartWalLocation   uint64
+	StartWalFile       string
+	CheckpointLocation uint64
+	BackupMethod       string    // streamed or pg_start_backup
+	BackupFrom         string    // primary or standby
+	StartTime          time.Time // zero when the zone abbreviation isn't one of this machine's
+	Label              string
+	StartTimeline      uint32
+
+	// only set for incremental backups (17+)
+	IncrementalFromLsn uint64
+	IncrementalFromTLI uint32
+}
+
+// one line of tablespace_map
+type TablespaceMapEntry struct {
+	Oid  uint32
+	Path string
+}
+
+// everything we know about one base backup
+type BaseBackupInfo struct {
+	Dir         string // backups/<name>.tar in the archive, or latestBackupDir
+	Control     *ControlData
+	Label       *BackupLabel
+	Tablespaces []TablespaceMapEntry
+}
+
+// reads a file from the latest backup, from its info object in the archive (keys is only needed if it's encrypted)
+// without an archived backup from /backups/latest: the host path first, then cats it out of the container
+func ReadBackupFile(backups ArchiveStore, name string, keys *KeyRing) ([]byte, error) {
+	b, ok, err := latestArchivedBackup(backups)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		data, _, err := readBackupInfo(backups, b, name, keys)
+		return data, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(latestBackupDir, name))
+	if err == nil || !os.IsPermission(err) {
+		return data, err
+	}
+
+	out, cmdErr := exec.Command("docker", "exec", backupMountContainer, "cat", path.Join("/backups/latest", filepath.ToSlash(name))).Output()
+	if exitErr, ok := cmdErr.(*exec.ExitError); ok && strings.Contains(string(exitErr.Stderr), "No such file") {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	if cmdErr != nil {
+		return nil, fmt.Errorf("%w (reading through %s also failed: %v)", err, backupMountContainer, cmdErr)
+	}
+	return out, nil
+}
+
+// loads pg_control, backup_label and tablespace_map (if there is one) of the latest base backup
+func LoadLatestBackupInfo(backups ArchiveStore, keys *KeyRing) (*BaseBackupInfo, error) {
+	info := &BaseBackupInfo{Dir: latestBackupDir}
+	if b, ok, err := latestArchivedBackup(backups); err != nil {
+		return nil, err
+	} else if ok {
+		info.Dir = path.Join(backupsPrefix, b.tarName())
+	}
+
+	controlBytes, err := ReadBackupFile(backups, filepath.Join("global", "pg_control"), keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pg_control: %w", err)
+	}
+	if info.Control, err = ParseControlFile(controlBytes); err != nil {
+		return nil, err
+	}
+
+	labelBytes, err := ReadBackupFile(backups, "backup_label", keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup_label: %w", err)
+	}
+	if info.Label, err = ParseBackupLabel(string(labelBytes)); err != nil {
+		return nil, err
+	}
+
+	mapBytes, err := ReadBackupFile(backups, "tablespace_map", keys)
+	if err == nil {
+		if info.Tablespaces, err = ParseTablespaceMap(string(mapBytes)); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read tablespace_map: %w", err)
+	}
+
+	return info, nil
+}
+
+// parses backup_label, e.g.
+//
+//	START WAL LOCATION: 0/2000028 (file 000000010000000000000002)
+//	CHECKPOINT LOCATION: 0/2000060
+//	BACKUP METHOD: streamed
+//	BACKUP FROM: primary
+//	START TIME: 2024-05-01 12:00:00 UTC
+//	LABEL: pg_basebackup base backup
+//	START TIMELINE: 1
+func ParseBackupLabel(content string) (*BackupLabel, error) {
+	bl := &BackupLabel{}
+	seen := map[string]bool{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ": ")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "START WAL LOCATION":
+			// 0/2000028 (file 000000010000000000000002)
+			lsn, file, _ := strings.Cut(value, " ")
+			bl.StartWalLocation, err = ParseLsn(lsn)
+			bl.StartWalFile = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(file), "(file "), ")")
+		case "CHECKPOINT LOCATION":
+			bl.CheckpointLocation, err = ParseLsn(value)
+		case "BACKUP METHOD":
+			bl.BackupMethod = value
+		case "BACKUP FROM":
+			bl.BackupFrom = value
+		case "START TIME":
+			// in the server's log_timezone, as an abbreviation (CEST) or an offset (+03) for zones without one.
+			// an abbreviation this machine doesn't know leaves StartTime unset instead of guessing +00:00
+			bl.StartTime, err = parseTimeWithZone(value, "2006-01-02 15:04:05")
+			if errors.Is(err, errUnknownTimeZone) {
+				err = nil
+			}
+		case "LABEL":
+			bl.Label = value
+		case "START TIMELINE":
+			var tli uint64
+			tli, err = strconv.ParseUint(value, 10, 32)
+			bl.StartTimeline = uint32(tli)
+		case "INCREMENTAL FROM LSN":
+			bl.IncrementalFromLsn, err = ParseLsn(value)
+		case "INCREMENTAL FROM TLI":
+			var tli uint64
+			tli, err = strconv.ParseUint(value, 10, 32)
+			bl.IncrementalFromTLI = uint32(tli)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("backup_label: invalid %s %q: %w", key, value, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, required := range []string{"START WAL LOCATION", "CHECKPOINT LOCATION", "START TIME"} {
+		if !seen[required] {
+			return nil, fmt.Errorf("backup_label has no %s line", required)
+		}
+	}
+
+	// labels written before START TIMELINE existed are always on the timeline in the file name
+	if bl.StartTimeline == 0 && len(bl.StartWalFile) == 24 {
+		if tli, err := strconv.ParseUint(bl.StartWalFile[:8], 16, 32); err == nil {
+			bl.StartTimeline = uint32(tli)
+		}
+	}
+
+	return bl, nil
+}
+
+// parses tablespace_map: one "<oid> <path>" per line. newlines and backslashes in paths are backslash escaped,
+// so a line only ends at an unescaped newline
+func ParseTablespaceMap(content string) ([]TablespaceMapEntry, error) {
+	var lines []string
+	var sb strings.Builder
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		if c == '\\' && i+1 < len(content) {
+			i++
+			sb.WriteByte(content[i])
+			continue
+		}
+		if c == '\n' {
+			lines = append(lines, sb.String())
+			sb.Reset()
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	if sb.Len() > 0 {
+		lines = append(lines, sb.String())
+	}
+
+	var entries []TablespaceMapEntry
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		oidStr, tsPath, found := strings.Cut(line, " ")
+		if !found {
+			return nil, fmt.Errorf("tablespace_map line %d: expected \"<oid> <path>\"", i+1)
+		}
+		oid, err := strconv.ParseUint(oidStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("tablespace_map line %d: invalid oid %q", i+1, oidStr)
+		}
+		entries = append(entries, TablespaceMapEntry{Oid: uint32(oid), Path: tsPath})
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBackupLabel(t *testing.T) {
+	bl, err := ParseBackupLabel(`START WAL LOCATION: 0/2000028 (file 000000010000000000000002)
+CHECKPOINT LOCATION: 0/2000060
+BACKUP METHOD: streamed
+BACKUP FROM: primary
+START TIME: 2024-05-01 12:00:00 UTC
+LABEL: pg_basebackup base backup
+START TIMELINE: 1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BackupLabel{
+		StartWalLocation:   0x2000028,
+		StartWalFile:       "000000010000000000000002",
+		CheckpointLocation: 0x2000060,
+		BackupMethod:       "streamed",
+		BackupFrom:         "primary",
+		StartTime:          time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Label:              "pg_basebackup base backup",
+		StartTimeline:      1,
+	}
+	if !bl.StartTime.Equal(want.StartTime) {
+		t.Errorf("start time %v, want %v", bl.StartTime, want.StartTime)
+	}
+	bl.StartTime = want.StartTime
+	if *bl != want {
+		t.Errorf("parsed\n%+v\nwant\n%+v", *bl, want)
+	}
+}
+
+func TestParseBackupLabelIncremental(t *testing.T) {
+	bl, err := ParseBackupLabel(`START WAL LOCATION: 1/A2000028 (file 0000000300000001000000A2)
+CHECKPOINT LOCATION: 1/A2000080
+BACKUP METHOD: streamed
+BACKUP FROM: standby
+START TIME: 2024-10-01 03:15:00 UTC
+LABEL: nightly: incremental
+START TIMELINE: 3
+INCREMENTAL FROM LSN: 1/90000028
+INCREMENTAL FROM TLI: 2
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bl.StartWalLocation != 0x1A2000028 || bl.StartTimeline != 3 || bl.BackupFrom != "standby" ||
+		bl.Label != "nightly: incremental" || bl.IncrementalFromLsn != 0x190000028 || bl.IncrementalFromTLI != 2 {
+		t.Errorf("parsed %+v", *bl)
+	}
+}
+
+func TestParseBackupLabelTimelineFromFileName(t *testing.T) {
+	// labels from before START TIMELINE existed
+	bl, err := ParseBackupLabel("START WAL LOCATION: 0/5000028 (file 000000040000000000000005)\n" +
+		"CHECKPOINT LOCATION: 0/5000060\nSTART TIME: 2024-05-01 12:00:00 UTC\n")
+	if err != nil || bl.StartTimeline != 4 {
+		t.Errorf("timeline %d, %v, want 4 from the WAL file name", bl.StartTimeline, err)
+	}
+}
+
+func TestParseBackupLabelStartTimeZone(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("CEST", 2*3600)
+	defer func() { time.Local = local }()
+
+	for zone, want := range map[string]time.Time{
+		"UTC":  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		"CEST": time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		"+03":  time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC),
+		"EST":  {}, // not this machine's zone, unknown rather than wrong
+	} {
+		bl, err := ParseBackupLabel("START WAL LOCATION: 0/5000028 (file 000000010000000000000005)\n" +
+			"CHECKPOINT LOCATION: 0/5000060\nSTART TIME: 2024-05-01 12:00:00 " + zone + "\n")
+		if err != nil || !bl.StartTime.Equal(want) {
+			t.Errorf("%s: start time %v, %v, want %v", zone, bl.StartTime, err, want)
+		}
+	}
+}
+
+func TestParseBackupLabelErrors(t *testing.T) {
+	for content, want := range map[string]string{
+		"CHECKPOINT LOCATION: 0/2000060\nSTART TIME: 2024-05-01 12:00:00 UTC\n":                                "no START WAL LOCATION line",
+		"START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\nSTART TIME: 2024-05-01 12:00:00 UTC\n": "no CHECKPOINT LOCATION line",
+		"START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\nCHECKPOINT LOCATION: 0/2000060\n":      "no START TIME line",
+		"START WAL LOCATION: 02000028\n": "invalid START WAL LOCATION",
+		"START TIME: yesterday\n":        "invalid START TIME",
+		"START TIMELINE: -1\n":           "invalid START TIMELINE",
+		"INCREMENTAL FROM LSN: 0/xyz\n":  "invalid INCREMENTAL FROM LSN",
+		"":                               "no START WAL LOCATION line",
+	} {
+		if _, err := ParseBackupLabel(content); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: %v, want %q", content, err, want)
+		}
+	}
+}
+
+func TestParseTablespaceMap(t *testing.T) {
+	entries, err := ParseTablespaceMap("16385 /mnt/fast\n16386 /mnt/with space\n\n16387 /mnt/new\\\nline\\\\dir\n16388 /mnt/last")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TablespaceMapEntry{
+		{16385, "/mnt/fast"},
+		{16386, "/mnt/with space"},
+		{16387, "/mnt/new\nline\\dir"},
+		{16388, "/mnt/last"},
+	}
+	if !slices.Equal(entries, want) {
+		t.Errorf("parsed %q, want %q", entries, want)
+	}
+
+	if entries, err := ParseTablespaceMap(""); err != nil || len(entries) != 0 {
+		t.Errorf("empty map: %v, %v", entries, err)
+	}
+	for content, want := range map[string]string{
+		"16385\n":            "line 1: expected",
+		"16385 /a\nabc /b\n": "line 2: invalid oid \"abc\"",
+		"99999999999 /big\n": "invalid oid",
+	} {
+		if _, err := ParseTablespaceMap(content); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: %v, want %q", content, err, want)
+		}
+	}
+}
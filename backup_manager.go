@@ -1,29 +1,91 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
 - does pg_basebackup inside the pg_primary container to get a snapshot of the db
-- Backups are stored in the shared /backups/latest directory.
+- pg_basebackup writes into the shared /backups/latest directory, the finished backup is then moved into
+  the archive store (encrypted with a key), see backup_archive.go
+- a cancelled backup (ctrl+c / SIGTERM) is stopped and its partial copy deleted
 */
 
-// checks if a backup exists in Docker_Connections/backups/latest
-func CheckForExistingBackup() bool {
+// checks if there's a backup in the archive, or one left in Docker_Connections/backups/latest
+func CheckForExistingBackup(backups ArchiveStore) bool {
+	if _, ok, err := latestArchivedBackup(backups); ok || err != nil {
+		return ok
+	}
 	// check for postgresql.conf as a sign that the backup exists and is populated
-	backupConfigPath := filepath.Join("Docker_Connections", "backups", "latest", "postgresql.conf")
-	if _, err := os.Stat(backupConfigPath); err == nil {
-		return true
+	backupConfigPath := filepath.Join(latestBackupDir, "postgresql.conf")
+	_, err := os.Stat(backupConfigPath)
+	return err == nil
+}
+
+// returns when the latest base backup finished, from the mtime of the last file pg_basebackup wrote:
+// backup_manifest is written as the very last step, backups taken with --no-manifest go by global/pg_control,
+// which the server sends after every other file of the data directory.
+// backup_label's START TIME is never used, a target between the start and the end of a backup can't be reached
+// an archived backup kept both mtimes in its info object
+func GetBackupEndTime(backups ArchiveStore, keys *KeyRing) (time.Time, error) {
+	b, archived, err := latestArchivedBackup(backups)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, name := range []string{"backup_manifest", "global/pg_control"} {
+		var modTime time.Time
+		if archived {
+			_, modTime, err = readBackupInfo(backups, b, name, keys)
+		} else {
+			modTime, err = latestBackupFileModTime(name)
+		}
+		if err == nil {
+			return modTime, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return time.Time{}, err
+		}
 	}
-	return false
+	return time.Time{}, fmt.Errorf("the latest backup has no backup_manifest or global/pg_control, can't tell when it finished")
+}
+
+// mtime of a file in /backups/latest, through the container like ReadBackupFile when the host can't see it
+func latestBackupFileModTime(name string) (time.Time, error) {
+	info, err := os.Stat(filepath.Join(latestBackupDir, filepath.FromSlash(name)))
+	if err == nil {
+		return info.ModTime(), nil
+	}
+	if !os.IsPermission(err) {
+		return time.Time{}, err
+	}
+
+	out, cmdErr := exec.Command("docker", "exec", backupMountContainer, "stat", "-c", "%Y", path.Join("/backups/latest", name)).Output()
+	if exitErr, ok := cmdErr.(*exec.ExitError); ok && strings.Contains(string(exitErr.Stderr), "No such file") {
+		return time.Time{}, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	if cmdErr != nil {
+		return time.Time{}, fmt.Errorf("%w (reading through %s also failed: %v)", err, backupMountContainer, cmdErr)
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected stat output %q for %s", out, name)
+	}
+	return time.Unix(secs, 0), nil
 }
 
 // runs pg_basebackup on primary. this will get a snapshot of the wal at this point in time
-func TriggerBaseBackup(primaryContainerName string) error {
+// cancelling ctx stops pg_basebackup and removes the half written backup, a partial copy must never look like a backup
+// the finished backup goes into backups, encrypted with keys (nil leaves it in the clear)
+func TriggerBaseBackup(ctx context.Context, primaryContainerName string, backups ArchiveStore, keys *KeyRing) error {
 	fmt.Println("Starting Base Backup...")
 
 	// command: pg_basebackup -h localhost -p 5432 -U replication_user -D /backups/latest -X stream -F p -v
@@ -39,7 +101,7 @@ func TriggerBaseBackup(primaryContainerName string) error {
 	// -X stream: stream WALs
 	// -F p: plain format (default)
 	// -c fast: fast checkpoint
-	cmd := exec.Command("docker", "exec", primaryContainerName,
+	cmd := exec.CommandContext(ctx, "docker", "exec", primaryContainerName,
 		"pg_basebackup",
 		"-h", "localhost",
 		"-U", "primary_user",
@@ -50,10 +112,23 @@ func TriggerBaseBackup(primaryContainerName string) error {
 	)
 
 	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		// killing the docker client leaves pg_basebackup running inside the container
+		exec.Command("docker", "exec", primaryContainerName, "pkill", "-x", "pg_basebackup").Run()
+		if out, err := exec.Command("docker", "exec", primaryContainerName, "rm", "-rf", "/backups/latest").CombinedOutput(); err != nil {
+			return fmt.Errorf("backup cancelled, and removing the partial backup failed: %s: %w", string(out), err)
+		}
+		return fmt.Errorf("backup cancelled, partial backup removed")
+	}
 	if err != nil {
 		return fmt.Errorf("pg_basebackup failed: %s: %w", string(output), err)
 	}
 
 	fmt.Printf("Backup completed successfully:\n%s\n", string(output))
-	return nil
+
+	var key *EncryptionKey
+	if keys != nil {
+		key = keys.Active
+	}
+	return ArchiveLatestBackup(ctx, primaryContainerName, backups, key)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+- where the go WAL receiver got to: the last flushed LSN and its timeline, so a restart resumes exactly there
+- one small json file (offsets_path in app.env, default next to the archive), written to a temp file, fsynced and
+  renamed, so a crash leaves the old state or the new one and never half of it
+- it's saved before the primary hears the flush position. the slot can only get ahead of it if WAL really went missing
+*/
+
+const captureOffsetsFile = "wal_capture_offsets.json"
+
+type CaptureOffset struct {
+	SystemIdentifier uint64    `json:"system_identifier"`
+	SlotName         string    `json:"slot_name"`
+	Timeline         uint32    `json:"timeline"`
+	FlushedLsn       uint64    `json:"flushed_lsn"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// Docker_Connections/wal_capture_offsets.json, next to the archive like the catalog
+func DefaultOffsetsPath(archiveDir string) string {
+	return filepath.Join(filepath.Dir(filepath.Clean(archiveDir)), captureOffsetsFile)
+}
+
+// a missing file returns nil and no error, capture then starts from the archive's contents
+func LoadCaptureOffset(path string) (*CaptureOffset, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	offset := &CaptureOffset{}
+	if err := json.Unmarshal(data, offset); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return offset, nil
+}
+
+// write, fsync, rename, then fsync the dir so the rename itself survives a crash
+func SaveCaptureOffset(path string, offset *CaptureOffset) error {
+	data, err := json.MarshalIndent(offset, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
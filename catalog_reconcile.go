@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+/*
+- rebuilds the WAL catalog from what's actually in the archive: re-reads every segment's header, re-hashes it,
+  recomputes LSN ranges, ingests .history files and marks rows whose file is gone as missing
+- the diff is computed without touching the catalog and printed first, it's only applied once confirmed
+- safe while RunMonitor runs: changes are applied under the same lock SyncWalFiles takes, and a file that
+  changed after the scan is left alone, the monitor picks it up on its next pass
+*/
+
+const (
+	ReconcileAdd      = "add"      // file in the archive without a catalog row
+	ReconcileMissing  = "missing"  // catalog row whose file is gone
+	ReconcileUpdate   = "update"   // size, state, LSN range or header check changed
+	ReconcileChecksum = "checksum" // stored checksum no longer matches the file
+)
+
+// one change the reconcile wants to make to a segment row
+type SegmentChange struct {
+	Action string
+	Detail string
+	Record WalSegmentRecord // what gets stored
+
+	name       string        // name in the archive, empty for missing files
+	obj        ArchiveObject // object state at scan time, checked again before applying
+	validation walValidation
+}
+
+// one change to the timelines
+type TimelineChange struct {
+	Action string // add, update or missing
+	Record TimelineRecord
+}
+
+// everything the reconcile found, nothing is written until ApplyCatalogDiff
+type CatalogDiff struct {
+	Segments  []SegmentChange
+	Timelines []TimelineChange
+	Unchanged int
+	Backup    []string // notes about the latest base backup against the archive
+}
+
+func (d *CatalogDiff) Empty() bool {
+	return len(d.Segments) == 0 && len(d.Timelines) == 0
+}
+
+// number of rows whose stored checksum would be replaced
+func (d *CatalogDiff) ChecksumMismatches() int {
+	n := 0
+	for _, c := range d.Segments {
+		if c.Action == ReconcileChecksum {
+			n++
+		}
+	}
+	return n
+}
+
+// walks the archive and compares it to the catalog
+func (wm *WalManager) DiffCatalog() (*CatalogDiff, error) {
+	archived, historyTlis, err := wm.scanArchive()
+	if err != nil {
+		return nil, err
+	}
+	records, err := wm.Catalog.Segments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	catalogued := map[string]WalSegmentRecord{}
+	for _, rec := range records {
+		catalogued[rec.FileName] = rec
+	}
+
+	diff := &CatalogDiff{}
+	seen := map[string]bool{}
+	for _, seg := range archived {
+		seen[seg.rec.FileName] = true
+
+		change := SegmentChange{Record: seg.rec, name: seg.name, obj: seg.obj}
+		if !seg.rec.IsPartial {
+			change.validation = wm.checkSegment(wm.Archive, seg.name, seg.obj)
+			change.validation.applyTo(&change.Record)
+		}
+
+		existing, ok := catalogued[seg.rec.FileName]
+		if !ok {
+			change.Action = ReconcileAdd
+			diff.Segments = append(diff.Segments, change)
+			continue
+		}
+
+		// a checksum that no longer matches is kept unless the user says otherwise, see ApplyCatalogDiff
+		if existing.Sha256 != "" && change.Record.Sha256 != "" && existing.Sha256 != change.Record.Sha256 {
+			change.Action = ReconcileChecksum
+			change.Detail = fmt.Sprintf("stored %.12s..., file now %.12s...", existing.Sha256, change.Record.Sha256)
+			diff.Segments = append(diff.Segments, change)
+			continue
+		}
+		if change.Record.Sha256 == "" {
+			change.Record.Sha256 = existing.Sha256
+		}
+
+		if details := describeSegmentChange(existing, change.Record); len(details) > 0 {
+			change.Action = ReconcileUpdate
+			change.Detail = strings.Join(details, ", ")
+			diff.Segments = append(diff.Segments, change)
+			continue
+		}
+		diff.Unchanged++
+	}
+
+	for _, rec := range records {
+		if seen[rec.FileName] || rec.Missing {
+			continue
+		}
+		rec.Missing = true
+		diff.Segments = append(diff.Segments, SegmentChange{Action: ReconcileMissing, Record: rec})
+	}
+
+	if err := wm.diffTimelines(diff, historyTlis); err != nil {
+		return nil, err
+	}
+	diff.Backup = wm.checkBackupAgainstArchive(archived)
+	return diff, nil
+}
+
+// what differs between a catalog row and the file, empty if nothing
+func describeSegmentChange(existing WalSegmentRecord, rec WalSegmentRecord) []string {
+	var details []string
+	if existing.Missing {
+		details = append(details, "file is back")
+	}
+	if existing.IsPartial != rec.IsPartial {
+		details = append(details, fmt.Sprintf("partial %t -> %t", existing.IsPartial, rec.IsPartial))
+	}
+	if existing.SizeBytes != rec.SizeBytes {
+		details = append(details, fmt.Sprintf("size %d -> %d", existing.SizeBytes, rec.SizeBytes))
+	}
+	if existing.Compression != rec.Compression {
+		details = append(details, fmt.Sprintf("compression %q -> %q", existing.Compression, rec.Compression))
+	}
+	if existing.KeyID != rec.KeyID {
+		details = append(details, fmt.Sprintf("encryption key %q -> %q", existing.KeyID, rec.KeyID))
+	}
+	if existing.SegmentSize != rec.SegmentSize || existing.StartLsn != rec.StartLsn || existing.EndLsn != rec.EndLsn {
+		details = append(details, fmt.Sprintf("LSN range %s-%s -> %s-%s",
+			FormatLsn(existing.StartLsn), FormatLsn(existing.EndLsn), FormatLsn(rec.StartLsn), FormatLsn(rec.EndLsn)))
+	}
+	if !equalBoolPtr(existing.HeaderValid, rec.HeaderValid) || existing.ValidationError != rec.ValidationError {
+		details = append(details, fmt.Sprintf("header check %q -> %q", existing.ValidationError, rec.ValidationError))
+	}
+	if existing.Sha256 == "" && rec.Sha256 != "" {
+		details = append(details, "checksum added")
+	}
+	return details
+}
+
+func (wm *WalManager) diffTimelines(diff *CatalogDiff, historyTlis []uint32) error {
+	existing, err := wm.Catalog.Timelines()
+	if err != nil {
+		return fmt.Errorf("failed to read catalog timelines: %w", err)
+	}
+	byTli := map[uint32]TimelineRecord{}
+	for _, rec := range existing {
+		byTli[rec.TLI] = rec
+	}
+
+	for _, tli := range historyTlis {
+		history, err := LoadTimelineHistory(wm.Archive, tli)
+		if err != nil || len(history) == 0 {
+			fmt.Printf("Warning: skipping %s: %v\n", TimelineHistoryFileName(tli), err)
+			continue
+		}
+		parent := history[len(history)-1]
+		rec := TimelineRecord{TLI: tli, ParentTLI: parent.ParentTLI, SwitchLsn: parent.SwitchLsn,
+			Reason: parent.Reason, HistoryFile: TimelineHistoryFileName(tli)}
+
+		old, ok := byTli[tli]
+		delete(byTli, tli)
+		switch {
+		case !ok:
+			diff.Timelines = append(diff.Timelines, TimelineChange{Action: ReconcileAdd, Record: rec})
+		case old != rec:
+			diff.Timelines = append(diff.Timelines, TimelineChange{Action: ReconcileUpdate, Record: rec})
+		}
+	}
+
+	for _, tli := range slices.Sorted(maps.Keys(byTli)) {
+		diff.Timelines = append(diff.Timelines, TimelineChange{Action: ReconcileMissing, Record: byTli[tli]})
+	}
+	return nil
+}
+
+// the latest base backup is only useful if the archive continues from it
+func (wm *WalManager) checkBackupAgainstArchive(archived []archivedSegment) []string {
+	backup, err := LoadLatestBackupInfo(wm.Backups, wm.Keys)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{"no base backup in the archive"}
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("could not read the latest base backup: %v", err)}
+	}
+
+	var notes []string
+	if backup.Control.SystemIdentifier != wm.SystemIdentifier {
+		notes = append(notes, fmt.Sprintf("base backup belongs to system %d, the archive to %d (servers rebuilt? take a new backup)",
+			backup.Control.SystemIdentifier, wm.SystemIdentifier))
+	}
+
+	redo := backup.Control.Checkpoint.RedoLsn
+	tli := backup.Label.StartTimeline
+	startSeg := redo / wm.WalSegmentSize
+	found := false
+	for _, seg := range archived {
+		_, segNo, err := ParseWalSegmentNumber(seg.rec.FileName, wm.WalSegmentSize)
+		if err == nil && seg.rec.TimelineID == tli && segNo >= startSeg && segNo <= startSeg+1 {
+			found = true
+			break
+		}
+	}
+	if !found {
+		notes = append(notes, fmt.Sprintf("no archived WAL on timeline %d around the backup's start %s (%s)",
+			tli, FormatLsn(redo), WalFileName(tli, startSeg, wm.WalSegmentSize)))
+	} else {
+		notes = append(notes, fmt.Sprintf("base backup starts at %s on timeline %d, archive has WAL from there", FormatLsn(redo), tli))
+	}
+	return notes
+}
+
+// prints the diff like a changelog, one line per row
+func (d *CatalogDiff) Print() {
+	fmt.Printf("\nCatalog reconcile: %d unchanged, %d segment changes, %d timeline changes\n", d.Unchanged, len(d.Segments), len(d.Timelines))
+	symbols := map[string]string{ReconcileAdd: "+", ReconcileMissing: "-", ReconcileUpdate: "~", ReconcileChecksum: "!"}
+
+	for _, c := range d.Segments {
+		line := fmt.Sprintf("  %s %-8s %s", symbols[c.Action], c.Action, c.Record.FileName)
+		if c.Detail != "" {
+			line += "  (" + c.Detail + ")"
+		}
+		if c.Record.ValidationError != "" && c.Action == ReconcileAdd {
+			line += "  INVALID: " + c.Record.ValidationError
+		}
+		fmt.Println(line)
+	}
+	for _, c := range d.Timelines {
+		fmt.Printf("  %s %-8s timeline %d (parent %d at %s)\n", symbols[c.Action], c.Action, c.Record.TLI, c.Record.ParentTLI, FormatLsn(c.Record.SwitchLsn))
+	}
+	for _, note := range d.Backup {
+		fmt.Println("  backup: " + note)
+	}
+}
+
+// writes the diff to the catalog
+// rows whose stored checksum no longer matches keep it unless replaceChecksums is set, the file could be the
+// corrupt one. replacing is for when the files were legitimately replaced (e.g. after rebuild_pg_servers.sh)
+// returns how many changes were applied and how many were skipped because the file changed since the scan
+func (wm *WalManager) ApplyCatalogDiff(diff *CatalogDiff, replaceChecksums bool) (int, int, error) {
+	wm.syncMu.Lock()
+	defer wm.syncMu.Unlock()
+
+	applied, skipped := 0, 0
+	for _, c := range diff.Segments {
+		if c.Action == ReconcileChecksum && !replaceChecksums {
+			skipped++
+			continue
+		}
+		if !wm.unchangedSinceScan(c) {
+			fmt.Printf("  skipped %s: changed since the scan, the monitor will pick it up\n", c.Record.FileName)
+			skipped++
+			continue
+		}
+
+		if err := wm.Catalog.PutSegment(c.Record); err != nil {
+			return applied, skipped, fmt.Errorf("failed to write %s: %w", c.Record.FileName, err)
+		}
+		delete(wm.catalogued, c.Record.FileName)
+		if c.name != "" && !c.Record.IsPartial {
+			wm.validated[c.name] = c.validation
+		} else if c.Action == ReconcileMissing {
+			delete(wm.validated, c.Record.FileName)
+		}
+		applied++
+	}
+
+	for _, c := range diff.Timelines {
+		var err error
+		if c.Action == ReconcileMissing {
+			err = wm.Catalog.DeleteTimeline(c.Record.TLI)
+		} else {
+			_, err = wm.Catalog.UpsertTimeline(c.Record)
+		}
+		if err != nil {
+			return applied, skipped, fmt.Errorf("failed to write timeline %d: %w", c.Record.TLI, err)
+		}
+		applied++
+	}
+	return applied, skipped, nil
+}
+
+// whether the file behind a change is still the way the scan saw it
+func (wm *WalManager) unchangedSinceScan(c SegmentChange) bool {
+	if c.Action == ReconcileMissing {
+		for _, name := range archivedWalNames(c.Record.FileName) {
+			if _, err := wm.storeFor(name).Stat(name); err == nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	obj, err := wm.storeFor(c.name).Stat(c.name)
+	if err != nil {
+		return false
+	}
+	return obj.Size == c.obj.Size && obj.ModTime.Equal(c.obj.ModTime)
+}
@@ -31,6 +31,31 @@ type AppConfig struct {
 	BackoffSeconds        float64
 	StatusIntervalSeconds float64
 	OffsetsPath           string
+	CatalogBackend        string // file (default) or postgres, see OpenCatalogStore
+	CatalogPath           string // dir of the file catalog, defaults to Docker_Connections/wal_catalog
+	WalCapture            string // receivewal (default, the wal_capturer container) or go, see wal_receiver.go
+	WalCompression        string // gzip, lz4 or zstd to compress finished segments, empty leaves them alone
+	EncryptionKeyFile     string // one "<key id> <base64 key>" per line, see LoadKeyRing
+	EncryptionKey         string // a single base64 key, e.g. from the environment instead of a file
+	EncryptionKeyID       string // key new files are encrypted with, defaults to the last one in the file
+	ArchiveBackend        string // local (default), s3 or azure, see OpenArchiveStore
+	ArchivePath           string // root of the local archive store, defaults to Docker_Connections
+	S3Endpoint            string // see archive_store_s3.go
+	S3Region              string
+	S3Bucket              string
+	S3Prefix              string
+	S3AccessKey           string
+	S3SecretKey           string
+	S3StorageClass        string
+	S3PathStyle           bool
+	S3PartSizeMB          int
+	AzureAccount          string // see archive_store_azure.go
+	AzureAccountKey       string
+	AzureSASToken         string
+	AzureContainer        string
+	AzurePrefix           string
+	AzureEndpoint         string
+	AzureBlockSizeMB      int
 }
 
 func MakeDsn(pg *PgConnInfo) string {
@@ -104,6 +129,9 @@ func LoadAppEnvConfig(envFile string, primaryConfig *PgConnInfo) (*AppConfig, er
 	backoffSeconds, _ := strconv.ParseFloat(os.Getenv("backoff_seconds"), 64)
 	statusInterval, _ := strconv.ParseFloat(os.Getenv("status_interval_seconds"), 64)
 	startFromBeginning := os.Getenv("start_from_beginning") == "true"
+	s3PathStyle := os.Getenv("s3_path_style") == "true"
+	s3PartSizeMB, _ := strconv.Atoi(os.Getenv("s3_part_size_mb"))
+	azureBlockSizeMB, _ := strconv.Atoi(os.Getenv("azure_block_size_mb"))
 
 	appInfo := &AppConfig{
 		Primary:               primaryConfig,
@@ -115,6 +143,31 @@ func LoadAppEnvConfig(envFile string, primaryConfig *PgConnInfo) (*AppConfig, er
 		BackoffSeconds:        backoffSeconds,
 		StatusIntervalSeconds: statusInterval,
 		OffsetsPath:           os.Getenv("offsets_path"),
+		CatalogBackend:        os.Getenv("catalog_backend"),
+		CatalogPath:           os.Getenv("catalog_path"),
+		WalCapture:            os.Getenv("wal_capture"),
+		WalCompression:        os.Getenv("wal_compression"),
+		EncryptionKeyFile:     os.Getenv("wal_encryption_key_file"),
+		EncryptionKey:         os.Getenv("wal_encryption_key"),
+		EncryptionKeyID:       os.Getenv("wal_encryption_key_id"),
+		ArchiveBackend:        os.Getenv("archive_backend"),
+		ArchivePath:           os.Getenv("archive_path"),
+		S3Endpoint:            os.Getenv("s3_endpoint"),
+		S3Region:              os.Getenv("s3_region"),
+		S3Bucket:              os.Getenv("s3_bucket"),
+		S3Prefix:              os.Getenv("s3_prefix"),
+		S3AccessKey:           os.Getenv("s3_access_key"),
+		S3SecretKey:           os.Getenv("s3_secret_key"),
+		S3StorageClass:        os.Getenv("s3_storage_class"),
+		S3PathStyle:           s3PathStyle,
+		S3PartSizeMB:          s3PartSizeMB,
+		AzureAccount:          os.Getenv("azure_account"),
+		AzureAccountKey:       os.Getenv("azure_account_key"),
+		AzureSASToken:         os.Getenv("azure_sas_token"),
+		AzureContainer:        os.Getenv("azure_container"),
+		AzurePrefix:           os.Getenv("azure_prefix"),
+		AzureEndpoint:         os.Getenv("azure_endpoint"),
+		AzureBlockSizeMB:      azureBlockSizeMB,
 	}
 
 	return appInfo, nil
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+)
+
+// reads stdin on its own goroutine, so whoever waits for input can also notice a shutdown
+type Console struct {
+	lines chan string
+}
+
+func NewConsole(r io.Reader) *Console {
+	c := &Console{lines: make(chan string)}
+	go func() {
+		defer close(c.lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			c.lines <- strings.TrimSpace(scanner.Text())
+		}
+	}()
+	return c
+}
+
+// next line of input. false once stdin is closed or ctx is cancelled
+func (c *Console) ReadLine(ctx context.Context) (string, bool) {
+	select {
+	case <-ctx.Done():
+		return "", false
+	case line, ok := <-c.lines:
+		return line, ok
+	}
+}
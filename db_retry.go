@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+/*
+- retries database calls that failed because the server went away (restart, failover, network blip),
+  and object store requests that failed the same way (see DoWhen)
+- exponential backoff from app.env: max_retries attempts after the first, starting at backoff_seconds and doubling
+- anything that isn't a connection problem (bad SQL, constraint errors) fails straight away
+*/
+
+const (
+	defaultMaxRetries = 5
+	defaultBackoff    = time.Second
+	maxBackoff        = 30 * time.Second
+)
+
+type RetryPolicy struct {
+	MaxRetries int
+	Backoff    time.Duration // wait before the first retry, doubles after each one
+}
+
+// the retry settings from app.env, with defaults when they're missing
+func NewRetryPolicy(appConfig *AppConfig) RetryPolicy {
+	policy := RetryPolicy{MaxRetries: defaultMaxRetries, Backoff: defaultBackoff}
+	if appConfig == nil {
+		return policy
+	}
+	if appConfig.MaxRetries > 0 {
+		policy.MaxRetries = appConfig.MaxRetries
+	}
+	if appConfig.BackoffSeconds > 0 {
+		policy.Backoff = time.Duration(appConfig.BackoffSeconds * float64(time.Second))
+	}
+	return policy
+}
+
+// wait before retry number attempt (0 based)
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff << attempt
+	if d <= 0 || d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+// runs fn, retrying connection errors with backoff. op names the call in logs and the final error
+func (p RetryPolicy) Do(ctx context.Context, op string, fn func() error) error {
+	return p.DoWhen(ctx, op, IsConnectionError, fn)
+}
+
+// like Do, with retryable deciding which errors are worth another try (the object stores use it)
+func (p RetryPolicy) DoWhen(ctx context.Context, op string, retryable func(error) bool, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil || !retryable(err) {
+			return err
+		}
+		if attempt >= p.MaxRetries {
+			return fmt.Errorf("%s failed after %d retries: %w", op, attempt, err)
+		}
+
+		wait := p.delay(attempt)
+		log.Printf("%s: unavailable (%v), retry %d/%d in %s", op, err, attempt+1, p.MaxRetries, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// whether err means the server couldn't be reached or dropped the connection, rather than rejecting the query
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// class 08 is connection exceptions, 57P01-57P03 are shutdowns and "starting up"
+		switch {
+		case len(pgErr.Code) == 5 && pgErr.Code[:2] == "08":
+			return true
+		case pgErr.Code == "57P01", pgErr.Code == "57P02", pgErr.Code == "57P03":
+			return true
+		}
+		return false
+	}
+
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	return errors.As(err, &connectErr) || errors.As(err, &netErr) || pgconn.SafeToRetry(err) || pgconn.Timeout(err) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
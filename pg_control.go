@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/*
+- decodes global/pg_control straight from a data directory or base backup, no pg_controldata needed
+- supports PostgreSQL 13-17 on 64 bit little or big endian builds, the file's CRC-32C is always checked
+- recovery refuses to run when the restore target has lower max_* settings than the primary had,
+  so the restore takes those values from the backup's control file instead of hardcoding the primary's config
+*/
+
+// pg_control_version for the layouts we understand
+// 13-16 all share 1300, 17 added wal_level to the checkpoint copy (it fits in existing padding)
+const (
+	pgControlVersion13 = 1300
+	pgControlVersion17 = 1700
+)
+
+// ControlFileData is padded to this size on disk, the struct itself is much smaller
+const pgControlFileSize = 8192
+
+// byte offsets into ControlFileData for the 64 bit layout used by 13-17
+const (
+	ctlSystemIdentifier   = 0
+	ctlControlVersion     = 8
+	ctlCatalogVersion     = 12
+	ctlState              = 16
+	ctlTime               = 24
+	ctlCheckPoint         = 32
+	ctlCheckPointCopy     = 40 // CheckPoint struct, 88 bytes
+	ctlMinRecoveryPoint   = 136
+	ctlMinRecoveryTLI     = 144
+	ctlBackupStartPoint   = 152
+	ctlBackupEndPoint     = 160
+	ctlBackupEndRequired  = 168
+	ctlWalLevel           = 172
+	ctlWalLogHints        = 176
+	ctlMaxConnections     = 180
+	ctlMaxWorkerProcesses = 184
+	ctlMaxWalSenders      = 188
+	ctlMaxPreparedXacts   = 192
+	ctlMaxLocksPerXact    = 196
+	ctlTrackCommitTs      = 200
+	ctlMaxAlign           = 204
+	ctlBlockSize          = 216
+	ctlWalBlockSize       = 224
+	ctlWalSegSize         = 228
+	ctlDataChecksumVer    = 252
+	ctlCrc                = 288
+
+	// inside CheckPoint
+	cpRedo            = 0
+	cpTimeline        = 8
+	cpPrevTimeline    = 12
+	cpFullPageWrites  = 16
+	cpNextXid         = 24
+	cpNextOid         = 32
+	cpTime            = 64
+	cpOldestActiveXid = 80
+)
+
+// catalog versions of the final 13-16 releases. control version 1300 is shared by all of them,
+// so the catalog version is how we tell them apart
+var catalogVersionMajors = []struct {
+	lastCatalogVersion uint32
+	major              int
+}{
+	{202007201, 13},
+	{202107181, 14},
+	{202209061, 15},
+	{202307071, 16},
+}
+
+// cluster state as stored in pg_control (DBState)
+type DBState uint32
+
+var dbStateNames = []string{
+	"starting up",
+	"shut down",
+	"shut down in recovery",
+	"shutting down",
+	"in crash recovery",
+	"in archive recovery",
+	"in production",
+}
+
+func (s DBState) String() string {
+	if int(s) < len(dbStateNames) {
+		return dbStateNames[s]
+	}
+	return "unrecognized status code " + strconv.Itoa(int(s))
+}
+
+var walLevelNames = []string{"minimal", "replica", "logical"}
+
+// copy of the latest checkpoint record kept in pg_control
+type CheckpointInfo struct {
+	RedoLsn         uint64 // where replay has to start
+	TimelineID      uint32
+	PrevTimelineID  uint32
+	FullPageWrites  bool
+	NextXid         uint64 // epoch << 32 | xid
+	NextOid         uint32
+	Time            time.Time
+	OldestActiveXid uint32
+}
+
+// the decoded control file
+type ControlData struct {
+	SystemIdentifier uint64
+	ControlVersion   uint32
+	CatalogVersion   uint32
+	State            DBState
+	Time             time.Time // last update of pg_control
+
+	CheckpointLsn uint64
+	Checkpoint    CheckpointInfo
+
+	MinRecoveryPoint    uint64
+	MinRecoveryPointTLI uint32
+	BackupStartPoint    uint64
+	BackupEndPoint      uint64
+	BackupEndRequired   bool
+
+	WalLevel             string
+	WalLogHints          bool
+	TrackCommitTimestamp bool
+
+	// settings that must be >= the primary's for recovery / hot standby to run
+	MaxConnections          int
+	MaxWorkerProcesses      int
+	MaxWalSenders           int
+	MaxPreparedTransactions int
+	MaxLocksPerTransaction  int
+
+	BlockSize           uint32
+	WalBlockSize        uint32
+	WalSegmentSize      uint64
+	DataChecksumVersion uint32
+}
+
+// reads <dataDir>/global/pg_control
+func ReadControlFile(dataDir string) (*ControlData, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, "global", "pg_control"))
+	if err != nil {
+		return nil, err
+	}
+	return ParseControlFile(data)
+}
+
+// decodes the raw bytes of a pg_control file
+func ParseControlFile(data []byte) (*ControlData, error) {
+	if len(data) < ctlCrc+4 {
+		return nil, fmt.Errorf("pg_control is only %d bytes, expected %d", len(data), pgControlFileSize)
+	}
+
+	// pg_control is written in the server's native byte order. the control version tells us which one it is
+	var order binary.ByteOrder = binary.LittleEndian
+	version := order.Uint32(data[ctlControlVersion:])
+	if version != pgControlVersion13 && version != pgControlVersion17 {
+		if be := binary.BigEndian.Uint32(data[ctlControlVersion:]); be == pgControlVersion13 || be == pgControlVersion17 {
+			order, version = binary.BigEndian, be
+		} else {
+			return nil, fmt.Errorf("unsupported pg_control version %d (supported: PostgreSQL 13-17)", version)
+		}
+	}
+
+	// CRC-32C over everything before the crc field
+	stored := order.Uint32(data[ctlCrc:])
+	computed := crc32.Checksum(data[:ctlCrc], crc32.MakeTable(crc32.Castagnoli))
+	if stored != computed {
+		return nil, fmt.Errorf("pg_control CRC mismatch (stored %08X, computed %08X): file is corrupt or from an unsupported build", stored, computed)
+	}
+
+	u32 := func(off int) uint32 { return order.Uint32(data[off:]) }
+	u64 := func(off int) uint64 { return order.Uint64(data[off:]) }
+	i64time := func(off int) time.Time { return time.Unix(int64(u64(off)), 0) }
+	b := func(off int) bool { return data[off] != 0 }
+
+	if maxAlign := u32(ctlMaxAlign); maxAlign != 8 {
+		return nil, fmt.Errorf("pg_control has maxalign %d, only 64 bit builds (8) are supported", maxAlign)
+	}
+
+	cd := &ControlData{
+		SystemIdentifier: u64(ctlSystemIdentifier),
+		ControlVersion:   version,
+		CatalogVersion:   u32(ctlCatalogVersion),
+		State:            DBState(u32(ctlState)),
+		Time:             i64time(ctlTime),
+		CheckpointLsn:    u64(ctlCheckPoint),
+		Checkpoint: CheckpointInfo{
+			RedoLsn:         u64(ctlCheckPointCopy + cpRedo),
+			TimelineID:      u32(ctlCheckPointCopy + cpTimeline),
+			PrevTimelineID:  u32(ctlCheckPointCopy + cpPrevTimeline),
+			FullPageWrites:  b(ctlCheckPointCopy + cpFullPageWrites),
+			NextXid:         u64(ctlCheckPointCopy + cpNextXid),
+			NextOid:         u32(ctlCheckPointCopy + cpNextOid),
+			Time:            i64time(ctlCheckPointCopy + cpTime),
+			OldestActiveXid: u32(ctlCheckPointCopy + cpOldestActiveXid),
+		},
+		MinRecoveryPoint:        u64(ctlMinRecoveryPoint),
+		MinRecoveryPointTLI:     u32(ctlMinRecoveryTLI),
+		BackupStartPoint:        u64(ctlBackupStartPoint),
+		BackupEndPoint:          u64(ctlBackupEndPoint),
+		BackupEndRequired:       b(ctlBackupEndRequired),
+		WalLogHints:             b(ctlWalLogHints),
+		TrackCommitTimestamp:    b(ctlTrackCommitTs),
+		MaxConnections:          int(int32(u32(ctlMaxConnections))),
+		MaxWorkerProcesses:      int(int32(u32(ctlMaxWorkerProcesses))),
+		MaxWalSenders:           int(int32(u32(ctlMaxWalSenders))),
+		MaxPreparedTransactions: int(int32(u32(ctlMaxPreparedXacts))),
+		MaxLocksPerTransaction:  int(int32(u32(ctlMaxLocksPerXact))),
+		BlockSize:               u32(ctlBlockSize),
+		WalBlockSize:            u32(ctlWalBlockSize),
+		WalSegmentSize:          uint64(u32(ctlWalSegSize)),
+		DataChecksumVersion:     u32(ctlDataChecksumVer),
+	}
+
+	if level := int(u32(ctlWalLevel)); level < len(walLevelNames) {
+		cd.WalLevel = walLevelNames[level]
+	} else {
+		cd.WalLevel = "unknown (" + strconv.Itoa(level) + ")"
+	}
+
+	return cd, nil
+}
+
+// postgres major version that wrote the file
+func (cd *ControlData) MajorVersion() int {
+	if cd.ControlVersion == pgControlVersion17 {
+		return 17
+	}
+	for _, v := range catalogVersionMajors {
+		if cd.CatalogVersion <= v.lastCatalogVersion {
+			return v.major
+		}
+	}
+	return 16
+}
+
+// server settings the restore target has to start with so recovery accepts it
+func (cd *ControlData) RecoveryParameters() []ConfigSetting {
+	return []ConfigSetting{
+		{"max_connections", strconv.Itoa(cd.MaxConnections)},
+		{"max_worker_processes", strconv.Itoa(cd.MaxWorkerProcesses)},
+		{"max_wal_senders", strconv.Itoa(cd.MaxWalSenders)},
+		{"max_prepared_transactions", strconv.Itoa(cd.MaxPreparedTransactions)},
+		{"max_locks_per_transaction", strconv.Itoa(cd.MaxLocksPerTransaction)},
+	}
+}
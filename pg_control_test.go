@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testdata/pg_control_* are 8192 byte control files laid out like pg_control.h's ControlFileData for each version
+// (16 and 17 little endian, 15 big endian as on s390x), with real CRC-32Cs
+
+func readTestControlFile(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseControlFile16(t *testing.T) {
+	cd, err := ParseControlFile(readTestControlFile(t, "pg_control_16"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ControlData{
+		SystemIdentifier: 7312345678901234567,
+		ControlVersion:   1300,
+		CatalogVersion:   202307071,
+		State:            6,
+		Time:             time.Unix(1714564860, 0),
+		CheckpointLsn:    0x3000060,
+		Checkpoint: CheckpointInfo{
+			RedoLsn:         0x3000028,
+			TimelineID:      2,
+			PrevTimelineID:  1,
+			FullPageWrites:  true,
+			NextXid:         1<<32 | 742,
+			NextOid:         24576,
+			Time:            time.Unix(1714564800, 0),
+			OldestActiveXid: 742,
+		},
+		MinRecoveryPoint:        0x3000100,
+		MinRecoveryPointTLI:     2,
+		BackupStartPoint:        0x3000028,
+		BackupEndRequired:       true,
+		WalLevel:                "replica",
+		WalLogHints:             true,
+		MaxConnections:          200,
+		MaxWorkerProcesses:      16,
+		MaxWalSenders:           10,
+		MaxPreparedTransactions: 5,
+		MaxLocksPerTransaction:  128,
+		BlockSize:               8192,
+		WalBlockSize:            8192,
+		WalSegmentSize:          16 << 20,
+		DataChecksumVersion:     1,
+	}
+	if *cd != want {
+		t.Errorf("parsed\n%+v\nwant\n%+v", *cd, want)
+	}
+	if cd.MajorVersion() != 16 || cd.State.String() != "in production" {
+		t.Errorf("major %d, state %q", cd.MajorVersion(), cd.State)
+	}
+	params := cd.RecoveryParameters()
+	if len(params) != 5 || params[0] != (ConfigSetting{"max_connections", "200"}) || params[4] != (ConfigSetting{"max_locks_per_transaction", "128"}) {
+		t.Errorf("recovery parameters: %v", params)
+	}
+}
+
+func TestParseControlFileOtherVersions(t *testing.T) {
+	for _, tc := range []struct {
+		file     string
+		major    int
+		sysid    uint64
+		state    string
+		walLevel string
+	}{
+		{"pg_control_17", 17, 7398765432109876543, "shut down", "replica"},
+		{"pg_control_15_be", 15, 7212345678901234567, "in archive recovery", "replica"},
+	} {
+		cd, err := ParseControlFile(readTestControlFile(t, tc.file))
+		if err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+			continue
+		}
+		if cd.MajorVersion() != tc.major || cd.SystemIdentifier != tc.sysid || cd.State.String() != tc.state || cd.WalLevel != tc.walLevel {
+			t.Errorf("%s: major %d, system id %d, state %q, wal_level %q", tc.file, cd.MajorVersion(), cd.SystemIdentifier, cd.State, cd.WalLevel)
+		}
+		// 17 keeps wal_level in the checkpoint copy's padding, it must not leak into the fields around it
+		if cd.Checkpoint.TimelineID != 2 || !cd.Checkpoint.FullPageWrites || cd.Checkpoint.NextXid != 1<<32|742 ||
+			cd.WalSegmentSize != 16<<20 || cd.MaxConnections != 200 {
+			t.Errorf("%s: %+v", tc.file, cd)
+		}
+	}
+}
+
+func TestParseControlFileChecksCrc(t *testing.T) {
+	for _, file := range []string{"pg_control_16", "pg_control_17", "pg_control_15_be"} {
+		data := readTestControlFile(t, file)
+		for _, off := range []int{ctlSystemIdentifier, ctlCheckPointCopy + cpTimeline, ctlMaxConnections, ctlCrc - 1, ctlCrc} {
+			corrupt := bytes.Clone(data)
+			corrupt[off] ^= 0x10
+			if _, err := ParseControlFile(corrupt); err == nil || !strings.Contains(err.Error(), "CRC mismatch") {
+				t.Errorf("%s with byte %d flipped: %v, want a CRC mismatch", file, off, err)
+			}
+		}
+		// bytes past the CRC are padding
+		padded := bytes.Clone(data)
+		padded[ctlCrc+100] = 0xff
+		if _, err := ParseControlFile(padded); err != nil {
+			t.Errorf("%s with changed padding: %v", file, err)
+		}
+	}
+}
+
+func TestParseControlFileRejects(t *testing.T) {
+	data := readTestControlFile(t, "pg_control_16")
+	if _, err := ParseControlFile(data[:ctlCrc]); err == nil {
+		t.Error("truncated pg_control accepted")
+	}
+	old := bytes.Clone(data)
+	old[ctlControlVersion], old[ctlControlVersion+1] = 0xb0, 0x04 // 1200, PostgreSQL 12
+	if _, err := ParseControlFile(old); err == nil || !strings.Contains(err.Error(), "unsupported pg_control version 1200") {
+		t.Errorf("version 1200: %v", err)
+	}
+}
+
+func TestReadControlFile(t *testing.T) {
+	dataDir := t.TempDir()
+	os.Mkdir(filepath.Join(dataDir, "global"), 0700)
+	if err := os.WriteFile(filepath.Join(dataDir, "global", "pg_control"), readTestControlFile(t, "pg_control_17"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cd, err := ReadControlFile(dataDir)
+	if err != nil || cd.ControlVersion != 1700 {
+		t.Errorf("ReadControlFile = %+v, %v", cd, err)
+	}
+}
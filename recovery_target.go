@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+- one validated model for "where should the restore stop"
+- every restore entry point builds a RecoveryTarget, it's checked once, then rendered into
+  postgresql.auto.conf settings. nothing the operator types ever reaches a shell
+*/
+
+// what kind of stop point a restore uses. the values match the recovery_target_* setting suffix
+type RecoveryTargetKind string
+
+const (
+	RecoveryTargetLatest    RecoveryTargetKind = ""          // full restore, replay everything we have
+	RecoveryTargetLsn       RecoveryTargetKind = "lsn"       // recovery_target_lsn
+	RecoveryTargetTime      RecoveryTargetKind = "time"      // recovery_target_time
+	RecoveryTargetXid       RecoveryTargetKind = "xid"       // recovery_target_xid
+	RecoveryTargetName      RecoveryTargetKind = "name"      // recovery_target_name (pg_create_restore_point)
+	RecoveryTargetImmediate RecoveryTargetKind = "immediate" // recovery_target = 'immediate', stop once consistent
+)
+
+// what postgres does once it reaches the target
+const (
+	RecoveryActionPause    = "pause"
+	RecoveryActionPromote  = "promote"
+	RecoveryActionShutdown = "shutdown"
+)
+
+// postgres caps restore point names at MAXFNAMELEN - 1
+const maxRestorePointNameLen = 63
+
+// first xid that belongs to a real transaction (0-2 are reserved)
+const firstNormalXid = 3
+
+// where the restore should stop and what to do once it gets there
+type RecoveryTarget struct {
+	Kind      RecoveryTargetKind
+	Lsn       uint64    // Kind == lsn
+	Time      time.Time // Kind == time
+	Xid       uint64    // Kind == xid
+	Name      string    // Kind == name
+	Inclusive bool      // stop just after (true) or just before (false) the target. ignored for immediate/latest
+	Timeline  string    // "", "current", "latest" or a timeline id. "" leaves the postgres default (latest)
+	Action    string    // pause, promote or shutdown
+}
+
+// full restore: replay all WAL then promote
+func NewLatestTarget() RecoveryTarget {
+	return RecoveryTarget{Kind: RecoveryTargetLatest, Action: RecoveryActionPromote}
+}
+
+// parses an X/Y hex LSN like 0/1A2B3C0
+func NewLsnTarget(input string) (RecoveryTarget, error) {
+	lsn, err := ParseLsn(input)
+	if err != nil {
+		return RecoveryTarget{}, err
+	}
+	return RecoveryTarget{Kind: RecoveryTargetLsn, Lsn: lsn, Inclusive: true, Action: RecoveryActionPromote}, nil
+}
+
+// parses a target time (see ParseRecoveryTargetTime). stops just before the first commit at or after the time
+func NewTimeTarget(input string) (RecoveryTarget, error) {
+	t, err := ParseRecoveryTargetTime(input)
+	if err != nil {
+		return RecoveryTarget{}, err
+	}
+	return RecoveryTarget{Kind: RecoveryTargetTime, Time: t, Inclusive: false, Action: RecoveryActionPromote}, nil
+}
+
+// parses a transaction id. plain 32 bit xids and epoch qualified 64 bit xids (txid_current()) are both fine
+func NewXidTarget(input string) (RecoveryTarget, error) {
+	xid, err := strconv.ParseUint(strings.TrimSpace(input), 10, 64)
+	if err != nil {
+		return RecoveryTarget{}, fmt.Errorf("invalid transaction id %q: must be a positive integer", input)
+	}
+	target := RecoveryTarget{Kind: RecoveryTargetXid, Xid: xid, Inclusive: true, Action: RecoveryActionPromote}
+	return target, target.Validate()
+}
+
+// a restore point created on the primary with SELECT pg_create_restore_point('name')
+func NewNamedTarget(input string) (RecoveryTarget, error) {
+	target := RecoveryTarget{Kind: RecoveryTargetName, Name: strings.TrimSpace(input), Action: RecoveryActionPromote}
+	return target, target.Validate()
+}
+
+// stop as soon as the base backup is consistent, no WAL past the backup is replayed
+func NewImmediateTarget() RecoveryTarget {
+	return RecoveryTarget{Kind: RecoveryTargetImmediate, Action: RecoveryActionPromote}
+}
+
+// parses an LSN in postgres' X/Y notation (two hex numbers of up to 8 digits)
+func ParseLsn(input string) (uint64, error) {
+	input = strings.TrimSpace(input)
+	hi, lo, found := strings.Cut(input, "/")
+	if !found || !isLsnHalf(hi) || !isLsnHalf(lo) {
+		return 0, fmt.Errorf("invalid LSN %q: expected X/Y in hex, e.g. 0/1A2B3C0", input)
+	}
+
+	hiVal, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", input, err)
+	}
+	loVal, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", input, err)
+	}
+
+	return hiVal<<32 | loVal, nil
+}
+
+// formats an LSN as X/Y the same way postgres does
+func FormatLsn(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
+
+func isLsnHalf(s string) bool {
+	if len(s) == 0 || len(s) > 8 {
+		return false
+	}
+	for _, c := range s {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
+			return false
+		}
+	}
+	return true
+}
+
+// checks the whole target, including the fields the constructors default
+func (rt RecoveryTarget) Validate() error {
+	switch rt.Kind {
+	case RecoveryTargetLatest, RecoveryTargetImmediate:
+	case RecoveryTargetLsn:
+		if rt.Lsn == 0 {
+			return fmt.Errorf("target LSN can't be 0/0")
+		}
+	case RecoveryTargetTime:
+		if rt.Time.IsZero() {
+			return fmt.Errorf("target time is not set")
+		}
+	case RecoveryTargetXid:
+		if rt.Xid < firstNormalXid {
+			return fmt.Errorf("invalid transaction id %d: ids below %d are reserved", rt.Xid, firstNormalXid)
+		}
+	case RecoveryTargetName:
+		if rt.Name == "" {
+			return fmt.Errorf("restore point name is empty")
+		}
+		if len(rt.Name) > maxRestorePointNameLen {
+			return fmt.Errorf("restore point name is %d bytes, postgres allows at most %d", len(rt.Name), maxRestorePointNameLen)
+		}
+		for _, c := range rt.Name {
+			if c < 0x20 || c == 0x7f {
+				return fmt.Errorf("restore point name contains control characters")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown recovery target kind %q", rt.Kind)
+	}
+
+	switch rt.Action {
+	case RecoveryActionPause, RecoveryActionPromote, RecoveryActionShutdown:
+	default:
+		return fmt.Errorf("invalid recovery target action %q: must be pause, promote or shutdown", rt.Action)
+	}
+
+	switch rt.Timeline {
+	case "", "current", "latest":
+	default:
+		tli, err := strconv.ParseUint(rt.Timeline, 10, 32)
+		if err != nil || tli == 0 {
+			return fmt.Errorf("invalid recovery target timeline %q: must be current, latest or a timeline id", rt.Timeline)
+		}
+	}
+
+	return nil
+}
+
+// human readable version for menus and logs
+func (rt RecoveryTarget) String() string {
+	if rt.Timeline != "" {
+		return rt.kindString() + ", timeline " + rt.Timeline
+	}
+	return rt.kindString()
+}
+
+func (rt RecoveryTarget) kindString() string {
+	switch rt.Kind {
+	case RecoveryTargetLatest:
+		return "latest (full restore)"
+	case RecoveryTargetLsn:
+		return "LSN " + FormatLsn(rt.Lsn)
+	case RecoveryTargetTime:
+		return "time " + rt.Time.Format(time.RFC3339)
+	case RecoveryTargetXid:
+		return "xid " + strconv.FormatUint(rt.Xid, 10)
+	case RecoveryTargetName:
+		return "restore point " + strconv.Quote(rt.Name)
+	case RecoveryTargetImmediate:
+		return "immediate (end of base backup)"
+	}
+	return string(rt.Kind)
+}
+
+// the recovery settings this target needs, in the order they should be written
+// values are raw, QuoteConfigValue handles quoting when they're written out
+func (rt RecoveryTarget) Settings() []ConfigSetting {
+	settings := []ConfigSetting{}
+
+	switch rt.Kind {
+	case RecoveryTargetLsn:
+		settings = append(settings, ConfigSetting{"recovery_target_lsn", FormatLsn(rt.Lsn)})
+	case RecoveryTargetTime:
+		settings = append(settings, ConfigSetting{"recovery_target_time", FormatRecoveryTargetTime(rt.Time)})
+	case RecoveryTargetXid:
+		settings = append(settings, ConfigSetting{"recovery_target_xid", strconv.FormatUint(rt.Xid, 10)})
+	case RecoveryTargetName:
+		settings = append(settings, ConfigSetting{"recovery_target_name", rt.Name})
+	case RecoveryTargetImmediate:
+		settings = append(settings, ConfigSetting{"recovery_target", "immediate"})
+	}
+
+	// inclusive only means something for the targets that stop around a specific record
+	switch rt.Kind {
+	case RecoveryTargetLsn, RecoveryTargetTime, RecoveryTargetXid:
+		settings = append(settings, ConfigSetting{"recovery_target_inclusive", strconv.FormatBool(rt.Inclusive)})
+	}
+
+	if rt.Timeline != "" {
+		settings = append(settings, ConfigSetting{"recovery_target_timeline", rt.Timeline})
+	}
+	settings = append(settings, ConfigSetting{"recovery_target_action", rt.Action})
+
+	return settings
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLsn(t *testing.T) {
+	for input, want := range map[string]uint64{
+		"0/0":               0,
+		"0/1A2B3C0":         0x1A2B3C0,
+		"16/B374D848":       0x16B374D848,
+		"  a/ff  ":          0xA000000FF,
+		"FFFFFFFF/FFFFFFFF": 1<<64 - 1,
+		"00000001/00000002": 0x100000002,
+	} {
+		if got, err := ParseLsn(input); err != nil || got != want {
+			t.Errorf("%q: %X, %v, want %X", input, got, err, want)
+		}
+	}
+
+	for _, input := range []string{
+		"",
+		"/",
+		"0/",
+		"/1A2B3C0",
+		"123456789/0",        // 9 digit high half
+		"0/123456789",        // 9 digit low half
+		"000000001/00000002", // leading zeros still count
+		"0/1A2B3C0/0",
+		"0x0/1A2B3C0",
+		"-1/0",
+		"+1/0",
+		"0 / 1A2B3C0",
+		"0/1A2B3G0",
+		"1A2B3C0",
+		"0/1A2B\n3C0",
+	} {
+		if got, err := ParseLsn(input); err == nil {
+			t.Errorf("%q: parsed as %X, want an error", input, got)
+		}
+	}
+
+	for _, lsn := range []uint64{0, 0x1A2B3C0, 0x16B374D848, 1<<64 - 1} {
+		if got, err := ParseLsn(FormatLsn(lsn)); err != nil || got != lsn {
+			t.Errorf("%X doesn't round trip through %q: %X, %v", lsn, FormatLsn(lsn), got, err)
+		}
+	}
+}
+
+func TestRecoveryTargetValidate(t *testing.T) {
+	valid := func(rt RecoveryTarget) RecoveryTarget {
+		if rt.Action == "" {
+			rt.Action = RecoveryActionPromote
+		}
+		return rt
+	}
+	for _, tc := range []struct {
+		rt      RecoveryTarget
+		wantErr string
+	}{
+		{valid(RecoveryTarget{}), ""},
+		{valid(RecoveryTarget{Kind: RecoveryTargetImmediate}), ""},
+		{valid(RecoveryTarget{Kind: RecoveryTargetLsn, Lsn: 1}), ""},
+		{valid(RecoveryTarget{Kind: RecoveryTargetLsn}), "can't be 0/0"},
+		{valid(RecoveryTarget{Kind: RecoveryTargetTime, Time: time.Now()}), ""},
+		{valid(RecoveryTarget{Kind: RecoveryTargetTime}), "not set"},
+		{valid(RecoveryTarget{Kind: RecoveryTargetXid, Xid: 3}), ""},
+		{valid(RecoveryTarget{Kind: RecoveryTargetXid, Xid: 2}), "reserved"},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName, Name: "before migration"}), ""},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName, Name: "it's a \\ name"}), ""},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName, Name: strings.Repeat("n", 63)}), ""},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName, Name: strings.Repeat("n", 64)}), "at most 63"},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName}), "empty"},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName, Name: "line\nbreak"}), "control characters"},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName, Name: "carriage\rreturn"}), "control characters"},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName, Name: "nul\x00"}), "control characters"},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName, Name: "tab\there"}), "control characters"},
+		{valid(RecoveryTarget{Kind: RecoveryTargetName, Name: "del\x7f"}), "control characters"},
+		{valid(RecoveryTarget{Kind: "later"}), "unknown recovery target kind"},
+		{RecoveryTarget{}, "invalid recovery target action"},
+		{valid(RecoveryTarget{Action: "resume"}), "invalid recovery target action"},
+		{valid(RecoveryTarget{Timeline: "current"}), ""},
+		{valid(RecoveryTarget{Timeline: "latest"}), ""},
+		{valid(RecoveryTarget{Timeline: "3"}), ""},
+		{valid(RecoveryTarget{Timeline: "0"}), "invalid recovery target timeline"},
+		{valid(RecoveryTarget{Timeline: "-1"}), "invalid recovery target timeline"},
+		{valid(RecoveryTarget{Timeline: "4294967296"}), "invalid recovery target timeline"},
+		{valid(RecoveryTarget{Timeline: "0x3"}), "invalid recovery target timeline"},
+	} {
+		err := tc.rt.Validate()
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%+v: %v, want %q", tc.rt, err, tc.wantErr)
+		}
+	}
+}
+
+func TestNewRecoveryTargets(t *testing.T) {
+	if rt, err := NewLsnTarget(" 0/1A2B3C0 "); err != nil || rt.Lsn != 0x1A2B3C0 || !rt.Inclusive || rt.Validate() != nil {
+		t.Errorf("NewLsnTarget: %+v, %v", rt, err)
+	}
+	if _, err := NewLsnTarget("0/123456789"); err == nil {
+		t.Error("NewLsnTarget took a 9 digit half")
+	}
+	if rt, err := NewXidTarget(" 8589934597 "); err != nil || rt.Xid != 8589934597 || !rt.Inclusive {
+		t.Errorf("NewXidTarget: %+v, %v", rt, err)
+	}
+	for _, input := range []string{"", "-5", "2", "1e3", "18446744073709551616"} {
+		if _, err := NewXidTarget(input); err == nil {
+			t.Errorf("NewXidTarget(%q) took it", input)
+		}
+	}
+	if rt, err := NewNamedTarget("  before migration\n"); err != nil || rt.Name != "before migration" {
+		t.Errorf("NewNamedTarget: %+v, %v", rt, err)
+	}
+	if _, err := NewNamedTarget("before\nmigration"); err == nil {
+		t.Error("NewNamedTarget took a line break")
+	}
+}
+
+func TestRecoveryTargetSettings(t *testing.T) {
+	at := time.Date(2024, 5, 1, 14, 32, 0, 500000000, time.FixedZone("CEST", 2*3600))
+	for _, tc := range []struct {
+		rt   RecoveryTarget
+		want []ConfigSetting
+	}{
+		{NewLatestTarget(), []ConfigSetting{{"recovery_target_action", "promote"}}},
+		{NewImmediateTarget(), []ConfigSetting{{"recovery_target", "immediate"}, {"recovery_target_action", "promote"}}},
+		{
+			RecoveryTarget{Kind: RecoveryTargetLsn, Lsn: 0x16B374D848, Inclusive: true, Timeline: "latest", Action: RecoveryActionPause},
+			[]ConfigSetting{{"recovery_target_lsn", "16/B374D848"}, {"recovery_target_inclusive", "true"},
+				{"recovery_target_timeline", "latest"}, {"recovery_target_action", "pause"}},
+		},
+		{
+			RecoveryTarget{Kind: RecoveryTargetTime, Time: at, Action: RecoveryActionShutdown},
+			[]ConfigSetting{{"recovery_target_time", "2024-05-01 12:32:00.500000+00"}, {"recovery_target_inclusive", "false"},
+				{"recovery_target_action", "shutdown"}},
+		},
+		{
+			RecoveryTarget{Kind: RecoveryTargetXid, Xid: 8589934597, Inclusive: true, Timeline: "2", Action: RecoveryActionPromote},
+			[]ConfigSetting{{"recovery_target_xid", "8589934597"}, {"recovery_target_inclusive", "true"},
+				{"recovery_target_timeline", "2"}, {"recovery_target_action", "promote"}},
+		},
+		{
+			// inclusive is meaningless for a restore point and isn't written
+			RecoveryTarget{Kind: RecoveryTargetName, Name: `it's a \ name`, Inclusive: true, Action: RecoveryActionPromote},
+			[]ConfigSetting{{"recovery_target_name", `it's a \ name`}, {"recovery_target_action", "promote"}},
+		},
+	} {
+		got := tc.rt.Settings()
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s:\n got %v\nwant %v", tc.rt, got, tc.want)
+		}
+
+		// what postgres reads back is what the target asked for
+		ac, err := ParseAutoConf(RenderConfigSettings(got))
+		if err != nil {
+			t.Errorf("%s: rendered settings don't parse: %v", tc.rt, err)
+			continue
+		}
+		if back := ac.Settings(); !slices.Equal(back, tc.want) {
+			t.Errorf("%s: read back as %v", tc.rt, back)
+		}
+	}
+}
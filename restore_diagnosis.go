@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+- every restore is a job with its own folder in Docker_Connections/restore_jobs/<job id>/
+	- job.json: target, result and diagnosis
+	- server.log: the restore target's postgres log for this run
+- the log is matched against known recovery failure signatures so the operator gets a cause and a fix
+  instead of digging through docker logs
+*/
+
+// where postgres writes its log inside the restore target, relative to the data dir
+// the data dir is wiped at the start of every restore, so the log only ever holds the current job
+const (
+	restoreLogDir  = "log"
+	restoreLogFile = "restore.log"
+)
+
+// one known way recovery can fail
+type failureSignature struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Cause   string
+	Fix     string
+	// matched against LOG lines too. the WAL reader reports bad records at LOG, the FATAL that follows only
+	// says which record it needed
+	AnyLevel bool
+}
+
+// what we found in the log
+type Diagnosis struct {
+	Name    string `json:"name"`
+	Cause   string `json:"cause"`
+	Fix     string `json:"fix"`
+	LogLine string `json:"log_line"`
+}
+
+// the record saved for every restore
+type RestoreJob struct {
+	ID        string         `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Target    RecoveryTarget `json:"target"`
+	Result    *RestoreResult `json:"result"`
+	Diagnoses []Diagnosis    `json:"diagnoses"`
+	LogFile   string         `json:"log_file"`
+}
+
+// ordered most specific first. signatures sharing a Name are alternatives, only the first match of each is reported
+var failureSignatures = []failureSignature{
+	{
+		Name:    "parameter_mismatch",
+		Pattern: regexp.MustCompile(`(\w+) = (\d+) is a lower setting than on the primary server, where its value was (\d+)`),
+		Cause:   "the restore target was started with a lower setting than the primary had when the backup/WAL was written",
+		Fix:     "start the restore target with %[1]s >= %[3]s (it was %[2]s)",
+	},
+	{
+		Name:    "parameter_mismatch",
+		Pattern: regexp.MustCompile(`insufficient parameter settings`),
+		Cause:   "the restore target was started with lower max_* settings than the primary",
+		Fix:     "match max_connections, max_worker_processes, max_wal_senders, max_prepared_transactions and max_locks_per_transaction to the primary",
+	},
+	{
+		Name:    "target_before_consistency",
+		Pattern: regexp.MustCompile(`requested recovery stop point is before consistent recovery point`),
+		Cause:   "the recovery target is earlier than the end of the base backup, the cluster is never consistent before that point",
+		Fix:     "pick a target after the base backup finished, or restore from an older base backup",
+	},
+	{
+		Name:    "timeline_not_in_history",
+		Pattern: regexp.MustCompile(`requested timeline (\d+) is not a child of this server's history`),
+		Cause:   "timeline %[1]s did not fork from the base backup's timeline at or after the backup's checkpoint",
+		Fix:     "use recovery_target_timeline = 'current' or a timeline that descends from the backup, or take a new base backup on timeline %[1]s",
+	},
+	{
+		Name:    "timeline_not_in_history",
+		Pattern: regexp.MustCompile(`recovery target timeline (\d+) does not exist`),
+		Cause:   "the history file for timeline %[1]s is not in the archive",
+		Fix:     "check that the .history file for timeline %[1]s was archived, or target a timeline that exists",
+	},
+	{
+		Name:     "different_system",
+		Pattern:  regexp.MustCompile(`WAL file is from different database system`),
+		Cause:    "the archive contains WAL from another cluster (different system identifier)",
+		Fix:      "clear stale WAL from the archive (e.g. after rebuild_pg_servers.sh) and take a new base backup",
+		AnyLevel: true,
+	},
+	{
+		Name:    "invalid_checkpoint",
+		Pattern: regexp.MustCompile(`could not locate (?:required|a valid) checkpoint record|invalid checkpoint record|invalid (?:primary|secondary) checkpoint`),
+		Cause:   "the checkpoint the base backup starts from could not be read, the WAL segment holding it is missing or damaged",
+		Fix:     "make sure the segment named in backup_label (START WAL LOCATION) is in the archive or the backup's pg_wal, otherwise take a new base backup",
+	},
+	{
+		Name:    "missing_wal",
+		Pattern: regexp.MustCompile(`recovery ended before configured recovery target was reached`),
+		Cause:   "replay ran out of WAL before reaching the recovery target, a segment is missing or the target is past the end of the archive",
+		Fix:     "check the archive for gaps between the backup and the target, or choose an earlier target",
+	},
+	{
+		Name:    "missing_wal",
+		Pattern: regexp.MustCompile(`could not open file "[^"]*(\w{24})": No such file`),
+		Cause:   "a WAL segment needed for recovery is not available",
+		Fix:     "restore the missing segment into the archive (pg_receivewal may have been down or the slot dropped)",
+	},
+}
+
+// matches the log against every signature. only FATAL/PANIC lines and the DETAIL/HINT lines right after them count,
+// plenty of harmless LOG lines (cp: cannot stat at the end of the archive...) look scary otherwise.
+// AnyLevel signatures are the exception, they look at every line
+func DiagnoseRecoveryLog(log string) []Diagnosis {
+	var relevant []string
+	inError := false
+	lines := strings.Split(log, "\n")
+	for _, line := range lines {
+		switch {
+		case strings.Contains(line, "FATAL:") || strings.Contains(line, "PANIC:"):
+			inError = true
+		case strings.Contains(line, "DETAIL:") || strings.Contains(line, "HINT:") || strings.Contains(line, "CONTEXT:"):
+			// keep inError as it was, these belong to the previous message
+		default:
+			inError = false
+		}
+		if inError {
+			relevant = append(relevant, line)
+		}
+	}
+
+	// signatures are checked in order, so for each kind of failure the most specific one wins
+	var diagnoses []Diagnosis
+	seen := map[string]bool{}
+	for _, sig := range failureSignatures {
+		if seen[sig.Name] {
+			continue
+		}
+		candidates := relevant
+		if sig.AnyLevel {
+			candidates = lines
+		}
+		for _, line := range candidates {
+			match := sig.Pattern.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			seen[sig.Name] = true
+
+			args := make([]any, len(match)-1)
+			for i, group := range match[1:] {
+				args[i] = group
+			}
+			diagnoses = append(diagnoses, Diagnosis{
+				Name:    sig.Name,
+				Cause:   formatSignature(sig.Cause, args),
+				Fix:     formatSignature(sig.Fix, args),
+				LogLine: strings.TrimSpace(line),
+			})
+			break
+		}
+	}
+	return diagnoses
+}
+
+// fills the regexp groups into a message. messages without placeholders are returned as they are
+func formatSignature(msg string, args []any) string {
+	if !strings.Contains(msg, "%") {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// copies the restore target's postgres log out of the container
+func CollectRestoreLog(containerName string) (string, error) {
+	logPath := restoreDataDir + "/" + restoreLogDir + "/" + restoreLogFile
+	out, err := exec.Command("docker", "exec", containerName, "cat", logPath).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", logPath, err)
+	}
+	return string(out), nil
+}
+
+// collects the log, diagnoses it and saves the job record. failures here are reported but never hide the result
+func RecordRestoreJob(containerName string, target RecoveryTarget, result *RestoreResult) *RestoreJob {
+	job := &RestoreJob{
+		ID:        result.StartedAt.Format("20060102-150405"),
+		CreatedAt: result.StartedAt,
+		Target:    target,
+		Result:    result,
+	}
+
+	jobDir := filepath.Join("Docker_Connections", "restore_jobs", job.ID)
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		fmt.Printf("Warning: could not create restore job folder: %v\n", err)
+		return job
+	}
+
+	serverLog, err := CollectRestoreLog(containerName)
+	if err != nil {
+		fmt.Printf("Warning: could not collect restore target log: %v\n", err)
+	} else {
+		job.LogFile = filepath.Join(jobDir, "server.log")
+		if err := os.WriteFile(job.LogFile, []byte(serverLog), 0644); err != nil {
+			fmt.Printf("Warning: could not save restore target log: %v\n", err)
+			job.LogFile = ""
+		}
+		job.Diagnoses = DiagnoseRecoveryLog(serverLog)
+	}
+
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(jobDir, "job.json"), data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Warning: could not save restore job record: %v\n", err)
+	}
+
+	return job
+}
+
+// prints the diagnosis for a failed restore
+func (job *RestoreJob) PrintDiagnosis() {
+	if len(job.Diagnoses) == 0 {
+		if job.Result != nil && !job.Result.Success {
+			fmt.Println("No known failure signature found in the server log.")
+		}
+	}
+	for i, d := range job.Diagnoses {
+		if i == 0 {
+			fmt.Println("\nDiagnosis:")
+		}
+		fmt.Printf("  [%s] %s\n", d.Name, d.Cause)
+		fmt.Printf("    fix: %s\n", d.Fix)
+		fmt.Printf("    log: %s\n", d.LogLine)
+	}
+	if job.LogFile != "" {
+		fmt.Printf("Server log saved to %s\n", job.LogFile)
+	}
+}
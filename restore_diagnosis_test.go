@@ -0,0 +1,163 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// prefixes lines the way the restore target logs them (log_line_prefix '%m [%p] ')
+func testServerLog(lines ...string) string {
+	var sb strings.Builder
+	for _, line := range lines {
+		if strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "cp:") {
+			sb.WriteString(line) // continuation lines and restore_command's stderr have no prefix
+		} else {
+			sb.WriteString("2024-05-01 12:00:00.123 UTC [42] " + line)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// the start and end of a normal archive recovery, around the lines a test is about
+func testRecoveryLog(lines ...string) string {
+	all := []string{
+		"LOG:  starting PostgreSQL 16.2 on x86_64-pc-linux-gnu",
+		"LOG:  database system was interrupted; last known up at 2024-05-01 11:58:00 UTC",
+		"LOG:  starting point-in-time recovery to 2024-05-01 12:30:00+00",
+		"cp: cannot stat '/wal_archive/restore_staging/00000002.history': No such file or directory",
+		"LOG:  restored log file \"000000010000000000000002\" from archive",
+		"LOG:  redo starts at 0/2000028",
+	}
+	return testServerLog(append(all, lines...)...)
+}
+
+func TestDiagnoseRecoveryLog(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		log   string
+		want  string // diagnosis name, "" for none
+		cause string // in the cause or fix
+	}{
+		{"clean", testRecoveryLog(
+			"LOG:  recovery stopping before commit of transaction 745, time 2024-05-01 12:30:01.5+00",
+			"LOG:  redo done at 0/3000148",
+			"LOG:  selected new timeline ID: 2",
+			"LOG:  database system is ready to accept connections",
+		), "", ""},
+		{"parameter in the DETAIL", testRecoveryLog(
+			"WARNING:  hot standby is not possible because of insufficient parameter settings",
+			"DETAIL:  max_connections = 50 is a lower setting than on the primary server, where its value was 100.",
+			"LOG:  recovery has paused",
+			"FATAL:  recovery aborted because of insufficient parameter settings",
+			"DETAIL:  max_connections = 50 is a lower setting than on the primary server, where its value was 100.",
+			"HINT:  You can restart the server after making the necessary configuration changes.",
+		), "parameter_mismatch", "max_connections >= 100 (it was 50)"},
+		{"parameter without DETAIL", testRecoveryLog(
+			"FATAL:  recovery aborted because of insufficient parameter settings",
+		), "parameter_mismatch", "max_worker_processes"},
+		{"target before consistency", testRecoveryLog(
+			"LOG:  recovery stopping before commit of transaction 731, time 2024-05-01 11:57:30+00",
+			"FATAL:  requested recovery stop point is before consistent recovery point",
+		), "target_before_consistency", "after the base backup finished"},
+		{"timeline not a child", testServerLog(
+			"LOG:  restored log file \"00000003.history\" from archive",
+			"FATAL:  requested timeline 3 is not a child of this server's history",
+			"DETAIL:  Latest checkpoint is at 0/3000060 on timeline 1, but in the history of the requested timeline, the server forked off from that timeline at 0/2000000.",
+		), "timeline_not_in_history", "timeline 3 did not fork"},
+		{"timeline missing", testServerLog(
+			"FATAL:  recovery target timeline 5 does not exist",
+		), "timeline_not_in_history", "history file for timeline 5"},
+		{"checkpoint missing (16)", testServerLog(
+			"LOG:  invalid checkpoint record",
+			"FATAL:  could not locate required checkpoint record",
+			"HINT:  If you are restoring from a backup, touch \"/var/lib/postgresql/data/recovery.signal\" and add required recovery options.",
+		), "invalid_checkpoint", "START WAL LOCATION"},
+		{"checkpoint missing (17)", testServerLog(
+			"FATAL:  could not locate required checkpoint record at 0/2000060",
+		), "invalid_checkpoint", "START WAL LOCATION"},
+		{"different system at LOG", testServerLog(
+			"LOG:  WAL file is from different database system: WAL file database system identifier is 7312345678901234567, pg_control database system identifier is 7398765432109876543",
+			"FATAL:  could not locate required checkpoint record",
+		), "different_system", "another cluster"}, // and invalid_checkpoint after it
+		{"ran out of WAL", testRecoveryLog(
+			"cp: cannot stat '/wal_archive/000000010000000000000004': No such file or directory",
+			"LOG:  redo done at 0/3FFFF60",
+			"FATAL:  recovery ended before configured recovery target was reached",
+		), "missing_wal", "gaps between the backup and the target"},
+		{"segment file missing", testServerLog(
+			"PANIC:  could not open file \"pg_wal/000000010000000000000003\": No such file or directory",
+		), "missing_wal", "not available"},
+
+		// the same messages in places that don't mean the restore failed
+		{"DETAIL after a LOG", testRecoveryLog(
+			"LOG:  recovery restart point at 0/3000060",
+			"DETAIL:  max_connections = 50 is a lower setting than on the primary server, where its value was 100.",
+		), "", ""},
+		{"FATAL from a client", testRecoveryLog(
+			"FATAL:  the database system is starting up",
+			"LOG:  requested recovery stop point is before consistent recovery point",
+		), "", ""},
+		{"walsender slot error", testRecoveryLog(
+			"ERROR:  requested WAL segment 000000010000000000000001 has already been removed",
+			"FATAL:  terminating connection due to administrator command",
+		), "", ""},
+		{"FATAL ends at the next LOG", testRecoveryLog(
+			"FATAL:  role \"app\" does not exist",
+			"LOG:  recovery ended before configured recovery target was reached",
+		), "", ""},
+	} {
+		got := DiagnoseRecoveryLog(tc.log)
+		if tc.want == "" {
+			if len(got) != 0 {
+				t.Errorf("%s: %+v, want nothing", tc.name, got)
+			}
+			continue
+		}
+		if len(got) == 0 || got[0].Name != tc.want || !strings.Contains(got[0].Cause+" "+got[0].Fix, tc.cause) {
+			t.Errorf("%s: %+v, want %s first, mentioning %q", tc.name, got, tc.want, tc.cause)
+		}
+	}
+}
+
+// the DETAIL with the numbers wins over the generic message, and a second failure is reported too
+func TestDiagnoseRecoveryLogMostSpecificFirst(t *testing.T) {
+	got := DiagnoseRecoveryLog(testRecoveryLog(
+		"FATAL:  recovery aborted because of insufficient parameter settings",
+		"DETAIL:  max_wal_senders = 5 is a lower setting than on the primary server, where its value was 10.",
+		"LOG:  startup process (PID 43) exited with exit code 1",
+		"LOG:  WAL file is from different database system: WAL file database system identifier is 1, pg_control database system identifier is 2",
+	))
+	var names []string
+	for _, d := range got {
+		names = append(names, d.Name)
+	}
+	if !slices.Equal(names, []string{"parameter_mismatch", "different_system"}) {
+		t.Fatalf("diagnoses %v", names)
+	}
+	if got[0].Fix != "start the restore target with max_wal_senders >= 10 (it was 5)" || !strings.HasPrefix(got[0].LogLine, "2024-05-01") ||
+		!strings.Contains(got[0].LogLine, "DETAIL:") {
+		t.Errorf("%+v", got[0])
+	}
+}
+
+// every signature is reachable, a pattern typo would leave one that never matches
+func TestFailureSignaturesAllMatchSomething(t *testing.T) {
+	samples := []string{
+		"DETAIL:  max_connections = 50 is a lower setting than on the primary server, where its value was 100.",
+		"FATAL:  recovery aborted because of insufficient parameter settings",
+		"FATAL:  requested recovery stop point is before consistent recovery point",
+		"FATAL:  requested timeline 3 is not a child of this server's history",
+		"FATAL:  recovery target timeline 5 does not exist",
+		"FATAL:  could not locate required checkpoint record",
+		"LOG:  WAL file is from different database system: WAL file database system identifier is 1",
+		"FATAL:  recovery ended before configured recovery target was reached",
+		"FATAL:  could not open file \"pg_wal/000000010000000000000003\": No such file or directory",
+	}
+	for i, sig := range failureSignatures {
+		if !slices.ContainsFunc(samples, sig.Pattern.MatchString) {
+			t.Errorf("signature %d (%s) matches none of the sample messages", i, sig.Name)
+		}
+	}
+}
@@ -1,25 +1,50 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 /*
 - Copies the current .partial WAL file so the restore includes the latest data
+- Decrypts and decompresses the segments the restore needs into /wal_archive/restore_staging
+- Refuses targets past a hole in the WAL archive or on a timeline the backup can't reach
+- Verifies the checksum of every archived WAL segment the restore needs
 - Cleans the restore_target data directory (docker)
-- Copies the base backup from /backups/latest
+- Streams the base backup from the archive store into the data dir (decrypting it), or copies an old /backups/latest
 - Creates recovery.signal and sets restore_command to replay WALs from /wal_archive
+- Optionally stops replay at a target LSN or a target timestamp
 - Launches the Postgres process inside the restore_target container
+- Follows replay until the server is promoted (or fails) and reports the result
+- Saves the server log with a job record and diagnoses known failures
+- Stops between steps on shutdown, a restore target postgres that was already started is stopped again
+- Deletes the staged WAL once replay is over when the archive is encrypted or not in a local directory
 */
 
+// data directory of the postgres server inside the restore_target container
+const restoreDataDir = "/var/lib/postgresql/data"
+
 // restore process controller
-func PerformRestore(restoreContainerName string, walArchiveDir string, targetLSN string) error {
+// target says where replay stops, NewLatestTarget() replays everything we have
+// restoreDsn is used to follow recovery once postgres is started (see RestoreTargetDsn)
+// the error is only for problems setting the restore up, how recovery itself went is in the result
+// cancelling ctx stops the restore before the next step, the data dir is only touched again by the next restore
+func PerformRestore(ctx context.Context, restoreContainerName string, wm *WalManager, restoreDsn string, target RecoveryTarget) (*RestoreResult, error) {
 	fmt.Println("Starting Restore Process...")
+	walArchiveDir := wm.ArchiveDir
+
+	if err := target.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid recovery target: %w", err)
+	}
+	fmt.Printf("Recovery target: %s\n", target)
 
 	// 0. Stop any running Postgres process in the restore_target container
 	// This prevents memory leaks
@@ -28,47 +53,135 @@ func PerformRestore(restoreContainerName string, walArchiveDir string, targetLSN
 		fmt.Printf("Note: StopPostgres reported: %v\n", err)
 	}
 
+	// segments can't be swapped for compressed or encrypted copies while this restore reads them
+	resumeRewrites := wm.PauseSegmentRewrites()
+	defer resumeRewrites()
+	if err := ResetRestoreStaging(walArchiveDir); err != nil {
+		return nil, fmt.Errorf("failed to reset %s: %w", restoreStagingDir, err)
+	}
+
 	// 1. Snapshot the current .partial WAL file
-	if err := SnapshotWal(walArchiveDir); err != nil {
-		return fmt.Errorf("failed to snapshot WAL: %w", err)
+	if err := SnapshotWal(walArchiveDir, wm.WalSegmentSize); err != nil {
+		return nil, fmt.Errorf("failed to snapshot WAL: %w", err)
 	}
 
-	// 2. Prepare the data directory (Wipe & Restore Base Backup)
-	if err := PrepareDataDir(restoreContainerName); err != nil {
-		return fmt.Errorf("failed to prepare data directory: %w", err)
+	if ctx.Err() != nil {
+		return nil, errRestoreCancelled
 	}
 
-	// 3. Configure Recovery settings
-	if err := ConfigureRecovery(restoreContainerName, targetLSN); err != nil {
-		return fmt.Errorf("failed to configure recovery: %w", err)
+	// 1.5 a time target has to sit between the end of the base backup and the newest transaction in the WAL we have
+	// this is checked after the snapshot so the .partial counts as archived WAL
+	if target.Kind == RecoveryTargetTime {
+		if err := ValidateRecoveryTargetTime(target, wm); err != nil {
+			return nil, err
+		}
+	}
+
+	// 2. Read the backup's control file, the restore target has to start with the primary's max_* settings
+	backupInfo, err := LoadLatestBackupInfo(wm.Backups, wm.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base backup control data: %w", err)
+	}
+	controlData := backupInfo.Control
+	fmt.Printf("Base backup: PostgreSQL %d, system identifier %d, timeline %d, redo LSN %s, WAL segment size %d MB\n",
+		controlData.MajorVersion(), controlData.SystemIdentifier, backupInfo.Label.StartTimeline,
+		FormatLsn(controlData.Checkpoint.RedoLsn), controlData.WalSegmentSize/(1024*1024))
+
+	// 2.4 the WAL between the backup and the target has to be there without holes
+	warning, err := wm.CheckRestoreContinuity(target, backupInfo.Label.StartTimeline, controlData.Checkpoint.RedoLsn)
+	if err != nil {
+		return nil, fmt.Errorf("WAL continuity check failed: %w", err)
+	}
+	if warning != "" {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+
+	// 2.5 Every segment from the backup's redo point to the target must match its catalogued checksum,
+	// compressed and encrypted ones get written out plain for postgres on the way
+	var verifyUpTo uint64
+	if target.Kind == RecoveryTargetLsn {
+		verifyUpTo = target.Lsn
+	}
+	if err := wm.PrepareRestoreWal(controlData.Checkpoint.RedoLsn, verifyUpTo); err != nil {
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		return nil, errRestoreCancelled
+	}
+
+	// 3. Prepare the data directory (Wipe & Restore Base Backup)
+	if err := PrepareDataDir(restoreContainerName, wm.Backups, wm.Keys); err != nil {
+		return nil, fmt.Errorf("failed to prepare data directory: %w", err)
+	}
+
+	// 3.5 Configure Recovery settings
+	if err := ConfigureRecovery(restoreContainerName, target); err != nil {
+		return nil, fmt.Errorf("failed to configure recovery: %w", err)
+	}
+
+	if ctx.Err() != nil {
+		return nil, errRestoreCancelled
 	}
 
 	// 4. Start Postgres inside the container
-	if err := StartPostgres(restoreContainerName); err != nil {
-		return fmt.Errorf("failed to start postgres: %w", err)
+	startedAt := time.Now()
+	if err := StartPostgres(restoreContainerName, controlData); err != nil {
+		return nil, fmt.Errorf("failed to start postgres: %w", err)
 	}
 
-	fmt.Println("Restore initiated successfully. Check container logs.")
-	return nil
+	// 5. Follow recovery until it ends one way or the other
+	result := WaitForRestore(ctx, restoreContainerName, restoreDsn, target, startedAt)
+	result.Print()
+
+	// a half replayed server shouldn't be left running, the log is still collected below
+	if ctx.Err() != nil {
+		StopPostgres(restoreContainerName)
+	}
+
+	// replay is over either way, decrypted WAL shouldn't sit next to the encrypted archive,
+	// and a copy of a remote archive is only needed for the restore
+	if wm.Keys != nil || !wm.spoolIsArchive {
+		if err := os.RemoveAll(filepath.Join(walArchiveDir, restoreStagingDir)); err != nil {
+			fmt.Printf("Warning: failed to remove decrypted WAL in %s: %v\n", restoreStagingDir, err)
+		}
+	}
+
+	// 6. Save the server log with the job and explain what went wrong
+	job := RecordRestoreJob(restoreContainerName, target, result)
+	job.PrintDiagnosis()
+
+	return result, nil
 }
 
+var errRestoreCancelled = errors.New("restore cancelled")
+
 // Finds any .partial file and copies it to a 'ready' file
-func SnapshotWal(archiveDir string) error {
+// a compressed .partial is decompressed into the staging dir instead, postgres can't read it either way
+func SnapshotWal(archiveDir string, segSize uint64) error {
 	entries, err := os.ReadDir(archiveDir)
 	if err != nil {
 		return err
 	}
 
 	for _, entry := range entries {
-		if strings.HasSuffix(entry.Name(), ".partial") {
-			srcPath := filepath.Join(archiveDir, entry.Name())
-			destName := strings.TrimSuffix(entry.Name(), ".partial")
-			destPath := filepath.Join(archiveDir, destName)
+		file, ok := ParseArchivedWalName(entry.Name())
+		if !ok || !file.Partial {
+			continue
+		}
+		segName := file.Segment
 
-			fmt.Printf("Snapshotting WAL: %s -> %s\n", entry.Name(), destName)
-			if err := copyFile(srcPath, destPath); err != nil {
+		if file.Codec != "" {
+			fmt.Printf("Snapshotting WAL: %s -> %s/%s\n", entry.Name(), restoreStagingDir, segName)
+			if err := snapshotCompressedPartial(archiveDir, entry.Name(), segName, segSize); err != nil {
 				return err
 			}
+			continue
+		}
+
+		fmt.Printf("Snapshotting WAL: %s -> %s\n", entry.Name(), segName)
+		if err := copyFile(filepath.Join(archiveDir, entry.Name()), filepath.Join(archiveDir, segName)); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -91,8 +204,8 @@ func copyFile(src, dst string) error {
 	return err
 }
 
-// Wipes the data directory and copies the base backup
-func PrepareDataDir(containerName string) error {
+// Wipes the data directory and streams in the latest base backup, an encrypted one is decrypted on the way in
+func PrepareDataDir(containerName string, backups ArchiveStore, keys *KeyRing) error {
 	// 1. Wipe Data Dir
 	// We use "bash -c" to handle glob expansion (*)
 	fmt.Println("Wiping restore target data directory...")
@@ -102,11 +215,21 @@ func PrepareDataDir(containerName string) error {
 	}
 
 	// 2. Copy Base Backup
-	// Copy content from /backups/latest to /var/lib/postgresql/data/
-	fmt.Println("Copying base backup to data directory...")
-	copyCmd := exec.Command("docker", "exec", containerName, "bash", "-c", "cp -r /backups/latest/* /var/lib/postgresql/data/")
-	if out, err := copyCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("copy backup failed: %s: %w", string(out), err)
+	// from the archive, or from /backups/latest to /var/lib/postgresql/data/ if it has none
+	b, archived, err := latestArchivedBackup(backups)
+	if err != nil {
+		return err
+	}
+	if archived {
+		if err := RestoreArchivedBackup(containerName, backups, b, keys); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("Copying base backup to data directory...")
+		copyCmd := exec.Command("docker", "exec", containerName, "bash", "-c", "cp -r /backups/latest/* /var/lib/postgresql/data/")
+		if out, err := copyCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("copy backup failed: %s: %w", string(out), err)
+		}
 	}
 
 	// Ensure correct permissions (postgres user is usually uid 999, but inside container 'postgres' user is best)
@@ -121,33 +244,35 @@ func PrepareDataDir(containerName string) error {
 }
 
 // Writes recovery.signal and postgresql.auto.conf
-func ConfigureRecovery(containerName string, targetLSN string) error {
+func ConfigureRecovery(containerName string, target RecoveryTarget) error {
 	fmt.Println("Configuring recovery parameters...")
 
 	// 1. Create recovery.signal
-	touchCmd := exec.Command("docker", "exec", containerName, "touch", "/var/lib/postgresql/data/recovery.signal")
+	touchCmd := exec.Command("docker", "exec", containerName, "touch", restoreDataDir+"/recovery.signal")
 	if err := touchCmd.Run(); err != nil {
 		return err
 	}
 
-	// 2. Set restore_command and recovery_target_action
-	// Escape quotes for bash execution
-	configCmds := []string{
-		"echo \"restore_command = 'cp /wal_archive/%f %p'\" >> /var/lib/postgresql/data/postgresql.auto.conf",
-		"echo \"recovery_target_action = 'promote'\" >> /var/lib/postgresql/data/postgresql.auto.conf",
+	// 2. Load the auto.conf that came with the base backup and replace any recovery settings in it
+	autoConf, err := ReadAutoConf(containerName, restoreDataDir)
+	if err != nil {
+		return err
 	}
-
-	if targetLSN != "" {
-		configCmds = append(configCmds, fmt.Sprintf("echo \"recovery_target_lsn = '%s'\" >> /var/lib/postgresql/data/postgresql.auto.conf", targetLSN))
-		configCmds = append(configCmds, "echo \"recovery_target_inclusive = 'true'\" >> /var/lib/postgresql/data/postgresql.auto.conf")
+	autoConf.DeleteRecoverySettings()
+	// decompressed segments are staged, everything else is read from the archive as is
+	autoConf.Set("restore_command", "cp /wal_archive/"+restoreStagingDir+"/%f %p 2>/dev/null || cp /wal_archive/%f %p")
+	for _, setting := range target.Settings() {
+		autoConf.Set(setting.Key, setting.Value)
 	}
 
-	// Executing those shell commands on the container
-	for _, cmdStr := range configCmds {
-		cmd := exec.Command("docker", "exec", containerName, "bash", "-c", cmdStr)
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("config failed: %s: %w", string(out), err)
-		}
+	// 3. Show exactly what postgres will start with, then write it
+	fmt.Println("postgresql.auto.conf for this restore:")
+	fmt.Println("----------------------------------------")
+	fmt.Print(autoConf.Render())
+	fmt.Println("----------------------------------------")
+
+	if err := WriteAutoConf(containerName, restoreDataDir, autoConf); err != nil {
+		return fmt.Errorf("config failed: %w", err)
 	}
 
 	return nil
@@ -167,22 +292,164 @@ func StopPostgres(containerName string) error {
 }
 
 // Starts the postgres process in the background
-func StartPostgres(containerName string) error {
+// the max_* settings come from the base backup's pg_control, recovery fails with
+// "insufficient parameter settings" if any of them is lower than on the primary
+func StartPostgres(containerName string, controlData *ControlData) error {
 	fmt.Println("Starting Postgres...")
-	// We use -d to run in detached mode
-	// We run the 'postgres' command.
-	// We MUST match the Primary's configuration (especially max_connections=200)
-	// or the restore will fail with "insufficient parameter settings"
-	cmd := exec.Command("docker", "exec", "-d", containerName, "docker-entrypoint.sh", "postgres",
+	args := []string{"exec", "-d", containerName, "docker-entrypoint.sh", "postgres",
 		"-c", "wal_level=replica",
-		"-c", "max_wal_senders=10",
 		"-c", "max_replication_slots=5",
-		"-c", "max_connections=200",
 		"-c", "archive_mode=off",
 		"-c", "listen_addresses=*",
-	)
+		// keep the server log in the data dir so RecordRestoreJob can collect it for this job
+		"-c", "logging_collector=on",
+		"-c", "log_directory=" + restoreLogDir,
+		"-c", "log_filename=" + restoreLogFile,
+	}
+	for _, setting := range controlData.RecoveryParameters() {
+		fmt.Printf("  %s = %s (from pg_control)\n", setting.Key, setting.Value)
+		args = append(args, "-c", setting.Key+"="+setting.Value)
+	}
+
+	// We use -d to run in detached mode
+	cmd := exec.Command("docker", args...)
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to start postgres: %s: %w", string(out), err)
 	}
 	return nil
 }
+
+// accepted layouts for a target time typed at the restore prompt
+// layouts without a zone are read in the local timezone of this machine, a zone after a space is
+// resolved by parseTimeWithZone
+var recoveryTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+var errUnknownTimeZone = errors.New("unknown time zone")
+
+// parses "<layout> <zone>", the zone being UTC/GMT, an offset like +02, -0330 or +05:30, or an abbreviation
+// of this machine's zone (CET/CEST on a Berlin host). time.Parse would read any other abbreviation as +00:00,
+// which silently shifts the time by the zone's offset, so those are an errUnknownTimeZone instead
+func parseTimeWithZone(value string, layout string) (time.Time, error) {
+	i := strings.LastIndexByte(value, ' ')
+	if i < 0 {
+		return time.Time{}, fmt.Errorf("%q has no time zone", value)
+	}
+	clock, zone := value[:i], value[i+1:]
+	if _, err := time.Parse(layout, clock); err != nil {
+		return time.Time{}, err
+	}
+
+	switch {
+	case zone == "UTC" || zone == "GMT" || zone == "UCT" || zone == "Z":
+		return time.ParseInLocation(layout, clock, time.UTC)
+	case zone[0] == '+' || zone[0] == '-':
+		digits := strings.ReplaceAll(zone[1:], ":", "")
+		hours, minutes := digits, "0"
+		if len(digits) == 4 {
+			hours, minutes = digits[:2], digits[2:]
+		}
+		h, hErr := strconv.Atoi(hours)
+		m, mErr := strconv.Atoi(minutes)
+		if (len(digits) != 2 && len(digits) != 4) || hErr != nil || mErr != nil || h > 15 || m > 59 {
+			return time.Time{}, fmt.Errorf("invalid UTC offset %q", zone)
+		}
+		offset := h*3600 + m*60
+		if zone[0] == '-' {
+			offset = -offset
+		}
+		return time.ParseInLocation(layout, clock, time.FixedZone(zone, offset))
+	}
+
+	// an abbreviation only has an offset in a zone that uses it. ParseInLocation resolves the ones time.Local
+	// knows and makes up a +00:00 zone for the rest
+	t, err := time.ParseInLocation(layout+" MST", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w %q", errUnknownTimeZone, zone)
+	}
+	if t.Location() != time.Local {
+		return time.Time{}, fmt.Errorf("%w %q: it's not this machine's zone, give UTC or an offset like +02 instead", errUnknownTimeZone, zone)
+	}
+	return t, nil
+}
+
+// time only layouts, these mean "today"
+var recoveryClockLayouts = []string{
+	"15:04:05",
+	"15:04",
+}
+
+// turns operator input like "2024-05-01 14:32" or "14:32" into an absolute time
+func ParseRecoveryTargetTime(input string) (time.Time, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return time.Time{}, fmt.Errorf("empty target time")
+	}
+
+	for _, layout := range recoveryTimeLayouts {
+		if t, err := time.ParseInLocation(layout, input, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		t, err := parseTimeWithZone(input, layout)
+		if err == nil || errors.Is(err, errUnknownTimeZone) {
+			return t, err
+		}
+	}
+
+	for _, layout := range recoveryClockLayouts {
+		if clock, err := time.ParseInLocation(layout, input, time.Local); err == nil {
+			now := time.Now()
+			return time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, time.Local), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("could not parse target time %q (expected e.g. 2006-01-02 15:04:05, 2006-01-02T15:04:05-07:00 or 15:04)", input)
+}
+
+// renders a time the way postgres expects recovery_target_time. we always send UTC with an explicit offset
+// so the restore target's timezone setting can't shift the target
+func FormatRecoveryTargetTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000000") + "+00"
+}
+
+// makes sure the target time is somewhere we can actually replay to
+//   - before the base backup finished the cluster isn't consistent yet, so postgres would refuse it
+//   - postgres only stops at a transaction that committed (or aborted) after the target (at or after it when
+//     the target isn't inclusive). without one in the archived WAL it replays everything and fails with
+//     "recovery ended before configured recovery target was reached"
+func ValidateRecoveryTargetTime(target RecoveryTarget, wm *WalManager) error {
+	backupEnd, err := GetBackupEndTime(wm.Backups, wm.Keys)
+	if err != nil {
+		return fmt.Errorf("could not determine base backup end time: %w", err)
+	}
+	if target.Time.Before(backupEnd) {
+		return fmt.Errorf("target time %s is before the base backup finished (%s), take an older backup or pick a later time",
+			target.Time.Format(time.RFC3339), backupEnd.Local().Format(time.RFC3339))
+	}
+
+	labelBytes, err := ReadBackupFile(wm.Backups, "backup_label", wm.Keys)
+	if err != nil {
+		return fmt.Errorf("could not read backup_label: %w", err)
+	}
+	label, err := ParseBackupLabel(string(labelBytes))
+	if err != nil {
+		return err
+	}
+	lastXact, lastLsn, err := wm.LastTransactionTime(label.StartWalLocation)
+	if err != nil {
+		return fmt.Errorf("could not determine the newest archived transaction: %w", err)
+	}
+	if target.Time.After(lastXact) || (target.Inclusive && target.Time.Equal(lastXact)) {
+		return fmt.Errorf("target time %s is after the newest archived transaction (%s at %s), use a full restore instead",
+			target.Time.Format(time.RFC3339), lastXact.Local().Format(time.RFC3339Nano), FormatLsn(lastLsn))
+	}
+
+	return nil
+}
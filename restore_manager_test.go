@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecoveryTargetTime(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("CEST", 2*3600)
+	defer func() { time.Local = local }()
+
+	at := func(hour, min, sec int, loc *time.Location) time.Time {
+		return time.Date(2024, 5, 1, hour, min, sec, 0, loc)
+	}
+	now := time.Now().In(time.Local)
+	for _, tc := range []struct {
+		input string
+		want  time.Time // zero: must fail
+	}{
+		{"2024-05-01T14:32:00Z", at(14, 32, 0, time.UTC)},
+		{"2024-05-01T14:32:00.5+03:00", at(14, 32, 0, time.FixedZone("", 3*3600)).Add(500 * time.Millisecond)},
+		{"2024-05-01 14:32:00+02:00", at(12, 32, 0, time.UTC)},
+		{"  2024-05-01 14:32:07  ", at(14, 32, 7, time.Local)},
+		{"2024-05-01 14:32", at(14, 32, 0, time.Local)},
+		{"2024-05-01 14:32:00 UTC", at(14, 32, 0, time.UTC)},
+		{"2024-05-01 14:32 GMT", at(14, 32, 0, time.UTC)},
+		{"2024-05-01 14:32:00 +03", at(11, 32, 0, time.UTC)},
+		{"2024-05-01 14:32:00 -0330", at(18, 2, 0, time.UTC)},
+		{"2024-05-01 14:32:00 +05:30", at(9, 2, 0, time.UTC)},
+		{"2024-05-01 14:32:00 CEST", at(12, 32, 0, time.UTC)},
+		{"14:32", time.Date(now.Year(), now.Month(), now.Day(), 14, 32, 0, 0, time.Local)},
+		{"14:32:09", time.Date(now.Year(), now.Month(), now.Day(), 14, 32, 9, 0, time.Local)},
+
+		// EST would silently be read as +00:00
+		{"2024-05-01 14:32:00 EST", time.Time{}},
+		{"2024-05-01 14:32:00 +25", time.Time{}},
+		{"2024-05-01 14:32:00 +1", time.Time{}},
+		{"2024-05-01 14:32:00 +02:75", time.Time{}},
+		{"", time.Time{}},
+		{"yesterday", time.Time{}},
+		{"2024-13-01 14:32", time.Time{}},
+	} {
+		got, err := ParseRecoveryTargetTime(tc.input)
+		if tc.want.IsZero() {
+			if err == nil {
+				t.Errorf("%q: parsed as %v, want an error", tc.input, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tc.want) {
+			t.Errorf("%q: %v, %v, want %v", tc.input, got, err, tc.want)
+		}
+	}
+}
+
+// a base backup whose manifest (or pg_control) is dated backupEnd, started in segment 1 (1MB segments)
+func storeBackupEndingAt(t *testing.T, wm *WalManager, backupEnd time.Time, withManifest bool) {
+	t.Helper()
+	files := map[string]string{
+		"backup_label":      "START WAL LOCATION: 0/100028 (file 000000010000000000000001)\nCHECKPOINT LOCATION: 0/100060\nSTART TIME: 2024-05-01 11:58:00 UTC\n",
+		"global/pg_control": strings.Repeat("\x01", 8192),
+	}
+	if withManifest {
+		files["backup_manifest"] = "{}"
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"backup_label", "global/pg_control", "backup_manifest"} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		modTime := backupEnd.Add(-time.Minute)
+		if name == "backup_manifest" || !withManifest {
+			modTime = backupEnd
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + name, Mode: 0600, Size: int64(len(data)), ModTime: modTime}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(data))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeTestBackup(t, wm.Backups, archivedBackup{name: "base_20240501T120000Z"}, nil, buf.Bytes(), noWait); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateRecoveryTargetTime(t *testing.T) {
+	backupEnd := testCommitBase
+	for _, withManifest := range []bool{true, false} {
+		wm := newTestWalManager(t, NewMemoryArchiveStore(), testKeyRing(t))
+		storeBackupEndingAt(t, wm, backupEnd, withManifest)
+
+		// a commit before the backup started doesn't count, the newest one is at +5m
+		b := newTestWalBuilder(1, 0)
+		b.commit(backupEnd.Add(time.Hour), 0)
+		b.switchSegment()
+		b.commit(backupEnd.Add(time.Minute), 0)
+		b.commit(backupEnd.Add(5*time.Minute), 0)
+		b.switchSegment()
+		writeTestWal(t, wm, b, "")
+
+		for _, tc := range []struct {
+			target    time.Time
+			inclusive bool
+			wantErr   string
+		}{
+			{backupEnd.Add(-time.Minute), false, "before the base backup finished"},
+			{backupEnd, false, ""},
+			{backupEnd.Add(2 * time.Minute), false, ""},
+			{backupEnd.Add(2 * time.Minute), true, ""},
+			{backupEnd.Add(5 * time.Minute), false, ""},
+			{backupEnd.Add(5 * time.Minute), true, "after the newest archived transaction"},
+			{backupEnd.Add(10 * time.Minute), false, "after the newest archived transaction"},
+		} {
+			err := ValidateRecoveryTargetTime(RecoveryTarget{Kind: RecoveryTargetTime, Time: tc.target, Inclusive: tc.inclusive}, wm)
+			if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("manifest %v, target %s inclusive %v: %v, want %q", withManifest, tc.target.Sub(backupEnd), tc.inclusive, err, tc.wantErr)
+			}
+		}
+	}
+}
+
+func TestValidateRecoveryTargetTimeNeedsATransaction(t *testing.T) {
+	wm := newTestWalManager(t, NewMemoryArchiveStore(), testKeyRing(t))
+	storeBackupEndingAt(t, wm, testCommitBase, true)
+	b := newTestWalBuilder(1, 1)
+	b.other(100)
+	b.switchSegment()
+	writeTestWal(t, wm, b, "")
+
+	err := ValidateRecoveryTargetTime(RecoveryTarget{Kind: RecoveryTargetTime, Time: testCommitBase.Add(time.Minute)}, wm)
+	if err == nil || !strings.Contains(err.Error(), "no transaction committed") {
+		t.Errorf("no commit archived: %v", err)
+	}
+}
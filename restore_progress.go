@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+- watches a restore after postgres has been started in the restore target
+- waits until the server accepts connections (that's when it reached a consistent state)
+- polls pg_is_in_recovery(), pg_last_wal_replay_lsn() and pg_last_xact_replay_timestamp() and prints progress
+- ends with a definite success or failure, so automation can chain verification steps after it
+- a shutdown ends the wait as a failure, "cancelled" is reported separately from running out of time
+*/
+
+const (
+	restorePollInterval = 1 * time.Second
+	restoreStallTimeout = 2 * time.Minute  // no replay progress for this long while in recovery = stuck
+	restoreTimeout      = 60 * time.Minute // hard limit for the whole restore
+	restoreStartGrace   = 10 * time.Second // docker-entrypoint.sh needs a moment before the postgres process exists
+)
+
+// outcome of one restore
+type RestoreResult struct {
+	Success bool
+	Reason  string // why it failed, or how it ended if it succeeded
+	Target  RecoveryTarget
+
+	StartedAt    time.Time // postgres was started
+	ConsistentAt time.Time // first accepted connection
+	FinishedAt   time.Time // promoted, paused at the target, shut down or failed
+
+	FinalReplayLsn  uint64
+	FinalReplayTime time.Time // commit time of the last replayed transaction
+	Promoted        bool
+}
+
+// time from starting postgres until it accepted connections
+func (r *RestoreResult) TimeToConsistent() time.Duration {
+	if r.ConsistentAt.IsZero() {
+		return 0
+	}
+	return r.ConsistentAt.Sub(r.StartedAt)
+}
+
+// total restore time
+func (r *RestoreResult) Duration() time.Duration {
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
+func (r *RestoreResult) Print() {
+	status := "SUCCESS"
+	if !r.Success {
+		status = "FAILED"
+	}
+	fmt.Println("")
+	fmt.Printf("Restore %s: %s\n", status, r.Reason)
+	fmt.Printf("  Target:             %s\n", r.Target)
+	fmt.Printf("  Total time:         %s\n", r.Duration().Round(time.Millisecond))
+	if !r.ConsistentAt.IsZero() {
+		fmt.Printf("  Time to consistent: %s\n", r.TimeToConsistent().Round(time.Millisecond))
+	}
+	if r.FinalReplayLsn != 0 {
+		fmt.Printf("  Last replayed LSN:  %s\n", FormatLsn(r.FinalReplayLsn))
+	}
+	if !r.FinalReplayTime.IsZero() {
+		fmt.Printf("  Last replayed xact: %s\n", r.FinalReplayTime.Local().Format(time.RFC3339))
+	}
+	fmt.Printf("  Promoted:           %t\n", r.Promoted)
+}
+
+// one poll of the restore target
+type recoveryStatus struct {
+	InRecovery bool
+	Paused     bool
+	ReplayLsn  uint64
+	ReplayTime time.Time
+}
+
+// waits for the restore started in containerName to finish and reports how it went
+// dsn points at the restore target. remember a physical restore keeps the primary's users and passwords
+func WaitForRestore(parent context.Context, containerName string, dsn string, target RecoveryTarget, startedAt time.Time) *RestoreResult {
+	result := &RestoreResult{Target: target, StartedAt: startedAt}
+	fail := func(format string, args ...any) *RestoreResult {
+		result.Success = false
+		result.Reason = fmt.Sprintf(format, args...)
+		result.FinishedAt = time.Now()
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(parent, restoreTimeout)
+	defer cancel()
+
+	// 1. wait for the server to accept connections
+	fmt.Println("Waiting for restore target to reach a consistent state...")
+	conn, err := waitForConnection(ctx, containerName, dsn, startedAt)
+	if err != nil {
+		return fail("%v", err)
+	}
+	defer conn.Close(context.Background())
+	result.ConsistentAt = time.Now()
+	fmt.Printf("Restore target is accepting connections (after %s)\n", result.TimeToConsistent().Round(time.Millisecond))
+
+	// 2. follow replay until recovery ends
+	var startLsn uint64
+	lastLsn := uint64(0)
+	lastProgress := time.Now()
+	ticker := time.NewTicker(restorePollInterval)
+	defer ticker.Stop()
+	statusQuery := recoveryStatusQuery(conn.PgConn().ParameterStatus("server_version"))
+
+	for {
+		status, err := queryRecoveryStatus(ctx, conn, statusQuery)
+		if err != nil && parent.Err() != nil {
+			return fail("%v", errWaitCancelled)
+		}
+		if err != nil {
+			// the server going away is expected for recovery_target_action = shutdown
+			if !IsPostgresRunning(containerName) {
+				if target.Action == RecoveryActionShutdown && lastLsn != 0 {
+					result.Success = true
+					result.Reason = "server shut down after reaching the recovery target"
+					result.FinishedAt = time.Now()
+					return result
+				}
+				return fail("postgres exited during recovery at %s, check the server log", FormatLsn(lastLsn))
+			}
+			return fail("lost connection to restore target: %v", err)
+		}
+
+		if status.ReplayLsn != 0 {
+			result.FinalReplayLsn = status.ReplayLsn
+		}
+		if !status.ReplayTime.IsZero() {
+			result.FinalReplayTime = status.ReplayTime
+		}
+		if startLsn == 0 {
+			startLsn = status.ReplayLsn
+		}
+
+		if !status.InRecovery {
+			result.Success = true
+			result.Promoted = true
+			result.Reason = "recovery finished and the server was promoted"
+			result.FinishedAt = time.Now()
+			return result
+		}
+
+		if status.Paused {
+			result.Success = true
+			result.Reason = "recovery paused at the target (recovery_target_action = pause)"
+			result.FinishedAt = time.Now()
+			return result
+		}
+
+		printRecoveryProgress(target, startLsn, status)
+
+		if status.ReplayLsn != lastLsn {
+			lastLsn = status.ReplayLsn
+			lastProgress = time.Now()
+		} else if time.Since(lastProgress) > restoreStallTimeout {
+			return fail("replay stuck at %s for %s, the next WAL segment is probably missing", FormatLsn(lastLsn), restoreStallTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			if parent.Err() != nil {
+				return fail("%v", errWaitCancelled)
+			}
+			return fail("restore did not finish within %s", restoreTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+var errWaitCancelled = errors.New("restore cancelled (shutdown)")
+
+// retries until the server accepts a connection, it refuses them until recovery is consistent
+func waitForConnection(ctx context.Context, containerName string, dsn string, startedAt time.Time) (*pgx.Conn, error) {
+	ticker := time.NewTicker(restorePollInterval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		connCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		conn, err := pgx.Connect(connCtx, dsn)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+
+		// postgres gives up on fatal recovery errors (missing WAL for the target, bad settings...)
+		if time.Since(startedAt) > restoreStartGrace && !IsPostgresRunning(containerName) {
+			return nil, fmt.Errorf("postgres exited before reaching a consistent state (last connection error: %v)", lastErr)
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return nil, errWaitCancelled
+			}
+			return nil, fmt.Errorf("restore target never accepted connections within %s: %v", restoreTimeout, lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// pg_get_wal_replay_pause_state() (14+) only says 'paused' once the pause actually took effect,
+// 13 only has pg_is_wal_replay_paused() which is already true when the pause was requested.
+// both error once the server is promoted, AND doesn't promise to check pg_is_in_recovery() first, CASE does
+func recoveryStatusQuery(serverVersion string) string {
+	paused := "pg_is_wal_replay_paused()"
+	if major, _ := strconv.Atoi(strings.SplitN(serverVersion, ".", 2)[0]); major >= 14 {
+		paused = "pg_get_wal_replay_pause_state() = 'paused'"
+	}
+	return `
+		SELECT pg_is_in_recovery(),
+		       pg_last_wal_replay_lsn()::text,
+		       pg_last_xact_replay_timestamp(),
+		       CASE WHEN pg_is_in_recovery() THEN ` + paused + ` ELSE false END`
+}
+
+func queryRecoveryStatus(ctx context.Context, conn *pgx.Conn, query string) (recoveryStatus, error) {
+	var status recoveryStatus
+	var replayLsn *string
+	var replayTime *time.Time
+
+	err := conn.QueryRow(ctx, query).Scan(&status.InRecovery, &replayLsn, &replayTime, &status.Paused)
+	if err != nil {
+		return status, err
+	}
+
+	if replayLsn != nil {
+		if lsn, err := ParseLsn(*replayLsn); err == nil {
+			status.ReplayLsn = lsn
+		}
+	}
+	if replayTime != nil {
+		status.ReplayTime = *replayTime
+	}
+	return status, nil
+}
+
+// one progress line, measured against the target when it's an LSN or a time
+func printRecoveryProgress(target RecoveryTarget, startLsn uint64, status recoveryStatus) {
+	line := fmt.Sprintf("Replaying: LSN %s", FormatLsn(status.ReplayLsn))
+	if !status.ReplayTime.IsZero() {
+		line += fmt.Sprintf(", last xact %s", status.ReplayTime.Local().Format("2006-01-02 15:04:05"))
+	}
+
+	switch target.Kind {
+	case RecoveryTargetLsn:
+		if target.Lsn > startLsn && status.ReplayLsn >= startLsn {
+			pct := float64(status.ReplayLsn-startLsn) / float64(target.Lsn-startLsn) * 100
+			line += fmt.Sprintf(" -> target %s (%.1f%%)", FormatLsn(target.Lsn), min(pct, 100))
+		}
+	case RecoveryTargetTime:
+		if !status.ReplayTime.IsZero() {
+			line += fmt.Sprintf(" -> target %s (%s to go)", target.Time.Local().Format("2006-01-02 15:04:05"),
+				max(target.Time.Sub(status.ReplayTime), 0).Round(time.Second))
+		}
+	}
+	fmt.Println(line)
+}
+
+// checks whether a postgres process is alive inside the container
+func IsPostgresRunning(containerName string) bool {
+	out, err := exec.Command("docker", "exec", containerName, "pgrep", "-x", "postgres").Output()
+	return err == nil && strings.TrimSpace(string(out)) != ""
+}
+
+// the restore target inherits the primary's roles, so we connect to its port with the primary's credentials
+func RestoreTargetDsn(restoreTarget *PgConnInfo, primary *PgConnInfo) string {
+	return MakeDsn(&PgConnInfo{
+		Host:     restoreTarget.Host,
+		Port:     restoreTarget.Port,
+		User:     primary.User,
+		Password: primary.Password,
+		DbName:   primary.DbName,
+	})
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecoveryStatusQueryMatchesServerVersion(t *testing.T) {
+	for version, pauseState := range map[string]bool{
+		"13.14 (Debian 13.14-1.pgdg120+2)": false,
+		"14.0":                             true,
+		"16.4":                             true,
+		"17.2":                             true,
+		"":                                 false, // unknown, use what every version has
+	} {
+		query := recoveryStatusQuery(version)
+		if got := strings.Contains(query, "pg_get_wal_replay_pause_state()"); got != pauseState {
+			t.Errorf("%q: pause state query %v, want %v", version, got, pauseState)
+		}
+		if !strings.Contains(query, "CASE WHEN pg_is_in_recovery()") {
+			t.Errorf("%q: pause check not guarded by pg_is_in_recovery()", version)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+- a timeline's NNNNNNNN.history file lists every timeline it descends from and the LSN where each one was left
+- WAL before a switch point lives in the parent's segments, WAL after it in the child's
+*/
+
+// one line of a .history file: timeline ParentTLI ended at SwitchLsn
+type TimelineHistoryEntry struct {
+	ParentTLI uint32
+	SwitchLsn uint64
+	Reason    string
+}
+
+// name of the history file for a timeline, e.g. 00000002.history
+func TimelineHistoryFileName(tli uint32) string {
+	return fmt.Sprintf("%08X.history", tli)
+}
+
+// parses a .history file. lines are "<parent tli>\t<switch lsn>\t<reason>", # starts a comment.
+// both timelines and switch points have to increase from line to line
+func ParseTimelineHistory(content string) ([]TimelineHistoryEntry, error) {
+	var entries []TimelineHistoryEntry
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tliField, rest := cutHistoryField(line)
+		lsnField, rest := cutHistoryField(rest)
+		if lsnField == "" {
+			return nil, fmt.Errorf("history line %d: expected \"<timeline> <switch lsn> <reason>\"", i+1)
+		}
+		tli, err := strconv.ParseUint(tliField, 10, 32)
+		if err != nil || tli == 0 {
+			return nil, fmt.Errorf("history line %d: invalid timeline %q", i+1, tliField)
+		}
+		lsn, err := ParseLsn(lsnField)
+		if err != nil {
+			return nil, fmt.Errorf("history line %d: %w", i+1, err)
+		}
+
+		if n := len(entries); n > 0 && (uint32(tli) <= entries[n-1].ParentTLI || lsn <= entries[n-1].SwitchLsn) {
+			return nil, fmt.Errorf("history line %d: timelines and switch points must increase", i+1)
+		}
+		// the reason is free text (a restore point name, a target time), kept as written
+		entries = append(entries, TimelineHistoryEntry{ParentTLI: uint32(tli), SwitchLsn: lsn, Reason: strings.TrimSpace(rest)})
+	}
+	return entries, nil
+}
+
+// splits off the first tab or space separated field
+func cutHistoryField(s string) (string, string) {
+	s = strings.TrimLeft(s, " \t")
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], s[i:]
+	}
+	return s, ""
+}
+
+// reads a timeline's history from the archive. timeline 1 has no history file and no ancestors
+func LoadTimelineHistory(archive ArchiveStore, tli uint32) ([]TimelineHistoryEntry, error) {
+	if tli <= 1 {
+		return nil, nil
+	}
+	data, err := readObject(archive, TimelineHistoryFileName(tli))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("history file %s for timeline %d is not in the archive", TimelineHistoryFileName(tli), tli)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseTimelineHistory(string(data))
+}
+
+// the pieces of WAL a timeline is made of: each ancestor from its start up to where it was left, then the timeline itself
+type TimelineSpan struct {
+	TLI      uint32
+	StartLsn uint64
+	EndLsn   uint64 // 0 = open ended (the timeline itself)
+}
+
+// turns a history into spans, oldest first
+func TimelineLineage(tli uint32, history []TimelineHistoryEntry) []TimelineSpan {
+	var spans []TimelineSpan
+	var start uint64
+	for _, h := range history {
+		spans = append(spans, TimelineSpan{TLI: h.ParentTLI, StartLsn: start, EndLsn: h.SwitchLsn})
+		start = h.SwitchLsn
+	}
+	return append(spans, TimelineSpan{TLI: tli, StartLsn: start})
+}
+
+// checks that restoring the backup and following timeline tli is possible:
+// tli has to be the backup's timeline or have left it after the backup's redo point
+func CheckTimelineReachable(tli uint32, history []TimelineHistoryEntry, backupTli uint32, redoLsn uint64) error {
+	if tli == backupTli {
+		return nil
+	}
+	for _, h := range history {
+		if h.ParentTLI != backupTli {
+			continue
+		}
+		if h.SwitchLsn < redoLsn {
+			return fmt.Errorf("timeline %d left the backup's timeline %d at %s, before the backup's redo point %s",
+				tli, backupTli, FormatLsn(h.SwitchLsn), FormatLsn(redoLsn))
+		}
+		return nil
+	}
+	return fmt.Errorf("timeline %d does not descend from the backup's timeline %d", tli, backupTli)
+}
+
+// parses a history file name back into its timeline
+func ParseTimelineHistoryFileName(name string) (uint32, bool) {
+	hex, found := strings.CutSuffix(name, ".history")
+	if !found || len(hex) != 8 {
+		return 0, false
+	}
+	tli, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || tli == 0 {
+		return 0, false
+	}
+	return uint32(tli), true
+}
+
+// one node of the timeline tree
+type TimelineInfo struct {
+	TLI        uint32
+	ParentTLI  uint32 // 0 for the root (timeline 1) or when the history file is missing
+	SwitchLsn  uint64 // where the parent was left
+	Reason     string
+	HasHistory bool
+
+	FirstSegment string
+	LastSegment  string
+	Segments     int
+}
+
+// prints timelines as a tree, children indented under the timeline they forked from
+func PrintTimelineTree(timelines []TimelineInfo) {
+	children := map[uint32][]TimelineInfo{}
+	known := map[uint32]bool{}
+	for _, t := range timelines {
+		known[t.TLI] = true
+	}
+	var roots []TimelineInfo
+	for _, t := range timelines {
+		if t.ParentTLI == 0 || !known[t.ParentTLI] {
+			roots = append(roots, t)
+		} else {
+			children[t.ParentTLI] = append(children[t.ParentTLI], t)
+		}
+	}
+
+	var printNode func(t TimelineInfo, indent string, last bool, root bool)
+	printNode = func(t TimelineInfo, indent string, last bool, root bool) {
+		branch, childIndent := "", indent
+		if !root {
+			branch = "├─ "
+			childIndent = indent + "│  "
+			if last {
+				branch = "└─ "
+				childIndent = indent + "   "
+			}
+		}
+
+		line := fmt.Sprintf("%s%stimeline %d", indent, branch, t.TLI)
+		switch {
+		case t.ParentTLI != 0:
+			line += fmt.Sprintf(", forked from %d at %s", t.ParentTLI, FormatLsn(t.SwitchLsn))
+			if t.Reason != "" {
+				line += " (" + t.Reason + ")"
+			}
+		case t.TLI > 1 && !t.HasHistory:
+			line += ", history file missing"
+		}
+		if t.Segments > 0 {
+			line += fmt.Sprintf(": %d segments, %s .. %s", t.Segments, t.FirstSegment, t.LastSegment)
+		} else {
+			line += ": no segments"
+		}
+		fmt.Println(line)
+
+		kids := children[t.TLI]
+		for i, c := range kids {
+			printNode(c, childIndent, i == len(kids)-1, false)
+		}
+	}
+
+	for _, r := range roots {
+		printNode(r, "  ", true, true)
+	}
+}
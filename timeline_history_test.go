@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// 00000004.history the way postgres writes it: the parent's file, a blank line, then the new entry
+const testHistory4 = "1\t0/3000158\tno recovery target specified\n" +
+	"\n" +
+	"2\t0/5000000\tbefore 2024-05-01 12:30:00.000000+00\n" +
+	"\n" +
+	"3\t1/7000A28\tat restore point \"before  migration\"\n"
+
+func TestParseTimelineHistory(t *testing.T) {
+	want := []TimelineHistoryEntry{
+		{1, 0x3000158, "no recovery target specified"},
+		{2, 0x5000000, "before 2024-05-01 12:30:00.000000+00"},
+		{3, 0x107000A28, "at restore point \"before  migration\""},
+	}
+	for name, content := range map[string]string{
+		"postgres":                  testHistory4,
+		"comments":                  "# written by hand\n" + strings.ReplaceAll(testHistory4, "\n\n", "\n  # between entries\n"),
+		"no final newline and CRLF": strings.TrimSuffix(strings.ReplaceAll(testHistory4, "\n", "\r\n"), "\r\n"),
+		"spaces instead of tabs":    strings.ReplaceAll(strings.ReplaceAll(testHistory4, "1\t0/3000158\t", "1 0/3000158   "), "2\t0/5000000\t", "  2  0/5000000 "),
+	} {
+		got, err := ParseTimelineHistory(content)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("%s: %+v, %v", name, got, err)
+		}
+	}
+
+	if got, err := ParseTimelineHistory("2\t0/5000000\n"); err != nil || !slices.Equal(got, []TimelineHistoryEntry{{2, 0x5000000, ""}}) {
+		t.Errorf("no reason: %+v, %v", got, err)
+	}
+	if got, err := ParseTimelineHistory("# nothing yet\n\n"); err != nil || len(got) != 0 {
+		t.Errorf("only comments: %+v, %v", got, err)
+	}
+}
+
+func TestParseTimelineHistoryErrors(t *testing.T) {
+	for content, wantErr := range map[string]string{
+		"1\n":                            "expected",
+		"x\t0/3000158\treason\n":         "invalid timeline",
+		"0\t0/3000158\treason\n":         "invalid timeline",
+		"-1\t0/3000158\treason\n":        "invalid timeline",
+		"1\t3000158\treason\n":           "invalid LSN",
+		"1\t0/123456789\treason\n":       "invalid LSN",
+		"2\t0/3000158\n1\t0/5000000\n":   "must increase", // timeline goes back
+		"2\t0/3000158\n2\t0/5000000\n":   "must increase", // timeline repeats
+		"1\t0/5000000\n2\t0/3000158\n":   "must increase", // switch point goes back
+		"1\t0/5000000\n2\t0/5000000\n":   "must increase", // switch point repeats
+		"1\t0/3000158\n\n3\t0/2000000\n": "line 3",
+	} {
+		_, err := ParseTimelineHistory(content)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%q: %v, want %q", content, err, wantErr)
+		}
+	}
+}
+
+func TestTimelineLineage(t *testing.T) {
+	history, err := ParseTimelineHistory(testHistory4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TimelineSpan{
+		{1, 0, 0x3000158},
+		{2, 0x3000158, 0x5000000},
+		{3, 0x5000000, 0x107000A28},
+		{4, 0x107000A28, 0},
+	}
+	if got := TimelineLineage(4, history); !slices.Equal(got, want) {
+		t.Errorf("lineage %v, want %v", got, want)
+	}
+	if got := TimelineLineage(1, nil); !slices.Equal(got, []TimelineSpan{{1, 0, 0}}) {
+		t.Errorf("timeline 1: %v", got)
+	}
+}
+
+func TestCheckTimelineReachable(t *testing.T) {
+	history4, err := ParseTimelineHistory(testHistory4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// timeline 5 forked from 2 as well, after 3 did
+	history5, err := ParseTimelineHistory("1\t0/3000158\tno recovery target specified\n\n2\t0/6000000\tno recovery target specified\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		tli       uint32
+		history   []TimelineHistoryEntry
+		backupTli uint32
+		redo      uint64
+		wantErr   string
+	}{
+		{"same timeline", 1, nil, 1, 0x2000028, ""},
+		{"forked after the redo point", 4, history4, 1, 0x2000028, ""},
+		{"forked exactly at the redo point", 4, history4, 1, 0x3000158, ""},
+		{"forked before the redo point", 4, history4, 1, 0x3000160, "left the backup's timeline 1 at 0/3000158, before the backup's redo point 0/3000160"},
+		{"backup on a middle timeline", 4, history4, 2, 0x4000028, ""},
+		{"middle timeline left before the redo point", 4, history4, 2, 0x5000028, "before the backup's redo point"},
+		{"backup on the direct parent", 4, history4, 3, 0x6000028, ""},
+		{"sibling", 5, history5, 3, 0x5800000, "does not descend from the backup's timeline 3"},
+		{"sibling's parent", 5, history5, 2, 0x5800000, ""},
+		{"newer backup timeline", 4, history4, 5, 0x8000000, "does not descend"},
+		{"no history", 4, nil, 1, 0x2000028, "does not descend"},
+	} {
+		err := CheckTimelineReachable(tc.tli, tc.history, tc.backupTli, tc.redo)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestParseTimelineHistoryFileName(t *testing.T) {
+	for name, want := range map[string]uint32{
+		"00000002.history":         2,
+		"0000000A.history":         10,
+		"FFFFFFFF.history":         0xFFFFFFFF,
+		"00000000.history":         0,
+		"0000002.history":          0,
+		"00000002.History":         0,
+		"0000000G.history":         0,
+		"00000002":                 0,
+		"00000002.history.partial": 0,
+	} {
+		got, ok := ParseTimelineHistoryFileName(name)
+		if got != want || ok != (want != 0) {
+			t.Errorf("%s: %d, %v", name, got, ok)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+/*
+- the WAL catalog: what's in the archive, each segment's checksum and header check, timelines and gaps
+- it's needed most when the primary is gone, so by default it lives in a file store next to the archive
+- the old layout (tables on the primary) is still available with catalog_backend=postgres in app.env,
+  keep in mind every write there makes WAL that ends up in the archive it describes
+*/
+
+const (
+	CatalogBackendFile     = "file"
+	CatalogBackendPostgres = "postgres"
+)
+
+// one archived segment as the catalog knows it
+type WalSegmentRecord struct {
+	FileName        string    `json:"file_name"`
+	TimelineID      uint32    `json:"timeline_id"`
+	SegmentNumber   string    `json:"segment_number"` // last 16 hex chars of the file name
+	IsPartial       bool      `json:"is_partial"`
+	SizeBytes       int64     `json:"file_size_bytes"`              // on disk, compressed if the segment is
+	LogicalSize     int64     `json:"logical_size_bytes,omitempty"` // decompressed, 0 until a compressed segment has been read
+	Compression     string    `json:"compression,omitempty"`        // gzip, lz4, zstd or empty, see wal_compression.go
+	KeyID           string    `json:"key_id,omitempty"`             // master key the segment is encrypted with, see wal_encryption.go
+	SegmentSize     uint64    `json:"segment_size_bytes"`
+	StartLsn        uint64    `json:"start_lsn"`
+	EndLsn          uint64    `json:"end_lsn"`
+	HeaderValid     *bool     `json:"header_valid,omitempty"` // nil while the segment is .partial
+	ValidationError string    `json:"validation_error,omitempty"`
+	Sha256          string    `json:"sha256,omitempty"`  // set once, the first checksum of a finished segment is the reference
+	Missing         bool      `json:"missing,omitempty"` // the file is gone from the archive, set by a reconcile
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// one timeline's fork point, from its .history file
+type TimelineRecord struct {
+	TLI         uint32 `json:"timeline_id"`
+	ParentTLI   uint32 `json:"parent_timeline_id"`
+	SwitchLsn   uint64 `json:"switch_lsn"`
+	Reason      string `json:"reason,omitempty"`
+	HistoryFile string `json:"history_file"`
+}
+
+// outcome of one record in a batched upsert
+type SegmentUpsertResult struct {
+	FileName string
+	Changed  bool
+	Err      error
+}
+
+// set on every record of a batch that was rolled back because another record in it failed
+var errCatalogBatchRolledBack = errors.New("not written, the batch was rolled back")
+
+// where the WAL catalog is kept
+// the upserts report whether anything changed so SyncWalFiles can count updates
+type CatalogStore interface {
+	// writes all records or none. results come back in the order of recs, and the error is set
+	// when the batch was rolled back (the failing record's result says why)
+	UpsertSegments(recs []WalSegmentRecord) ([]SegmentUpsertResult, error)
+	PutSegment(rec WalSegmentRecord) error // stores rec as is, checksum included. only for reconciling
+	Segments() ([]WalSegmentRecord, error) // ordered by file name
+	UpsertTimeline(rec TimelineRecord) (bool, error)
+	DeleteTimeline(tli uint32) error
+	Timelines() ([]TimelineRecord, error) // ordered by timeline id
+	ReplaceGaps(gaps []WalGap) error
+	Close() error
+}
+
+// what an upsert should store given the existing record, and whether that's a change worth counting
+// mirrors the WHERE clause of Update_Wal_MetaData_Table so both backends report the same updates
+func mergeSegmentRecord(existing WalSegmentRecord, rec WalSegmentRecord) (WalSegmentRecord, bool) {
+	changed := (existing.IsPartial && !rec.IsPartial) ||
+		existing.SizeBytes != rec.SizeBytes ||
+		existing.LogicalSize != rec.LogicalSize ||
+		existing.Compression != rec.Compression ||
+		existing.KeyID != rec.KeyID ||
+		existing.StartLsn != rec.StartLsn ||
+		!equalBoolPtr(existing.HeaderValid, rec.HeaderValid) ||
+		existing.ValidationError != rec.ValidationError ||
+		(existing.Sha256 == "" && rec.Sha256 != "") ||
+		existing.Missing != rec.Missing
+	if !changed {
+		return existing, false
+	}
+
+	rec.CreatedAt = existing.CreatedAt
+	if existing.Sha256 != "" {
+		rec.Sha256 = existing.Sha256
+	}
+	return rec, true
+}
+
+func equalBoolPtr(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// default location of the file catalog: a wal_catalog dir beside the archive dir, not inside it,
+// so nothing in there is mistaken for WAL and the containers mounting the archive never see it
+func DefaultCatalogPath(archiveDir string) string {
+	return filepath.Join(filepath.Dir(archiveDir), "wal_catalog")
+}
+
+// opens the catalog backend picked in app.env (catalog_backend, catalog_path). cancelling ctx aborts
+// whatever the postgres backend is retrying
+func OpenCatalogStore(ctx context.Context, appConfig *AppConfig, archiveDir string) (CatalogStore, error) {
+	switch appConfig.CatalogBackend {
+	case "", CatalogBackendFile:
+		path := appConfig.CatalogPath
+		if path == "" {
+			path = DefaultCatalogPath(archiveDir)
+		}
+		return OpenFileCatalogStore(path)
+	case CatalogBackendPostgres:
+		return OpenPostgresCatalogStore(ctx, appConfig.Primary.Dsn, NewRetryPolicy(appConfig))
+	}
+	return nil, fmt.Errorf("unknown catalog_backend %q: must be %s or %s", appConfig.CatalogBackend, CatalogBackendFile, CatalogBackendPostgres)
+}
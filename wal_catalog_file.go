@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+- file backed catalog. the whole catalog is kept in memory and every change is appended to a journal
+  (one JSON line per change, fsynced), so a crash loses at most the change being written
+- on open the journal is replayed and rewritten as a compact snapshot (temp file, fsync, rename),
+  the same happens while running once the journal has grown well past the live records
+*/
+
+const (
+	catalogJournalFile = "catalog.jsonl"
+
+	// compact once the journal holds this many times more lines than live records
+	catalogCompactFactor = 4
+	catalogCompactMin    = 1000
+)
+
+// one journal line
+type catalogJournalEntry struct {
+	Segment  *WalSegmentRecord  `json:"segment,omitempty"`
+	Segments []WalSegmentRecord `json:"segments,omitempty"` // one sync pass
+	Timeline *TimelineRecord    `json:"timeline,omitempty"`
+	Gaps     *[]WalGap          `json:"gaps,omitempty"` // replaces all gaps
+
+	DeleteTimeline uint32 `json:"delete_timeline,omitempty"`
+}
+
+type FileCatalogStore struct {
+	dir string
+
+	mu        sync.Mutex
+	journal   *os.File
+	lines     int  // lines in the journal since the last compaction
+	torn      bool // a failed append couldn't be cut off again, the journal gets rewritten before the next one
+	segments  map[string]WalSegmentRecord
+	timelines map[uint32]TimelineRecord
+	gaps      []WalGap
+}
+
+// opens (or creates) the catalog in dir
+func OpenFileCatalogStore(dir string) (*FileCatalogStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create catalog dir: %w", err)
+	}
+
+	s := &FileCatalogStore{
+		dir:       dir,
+		segments:  map[string]WalSegmentRecord{},
+		timelines: map[uint32]TimelineRecord{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, fmt.Errorf("failed to compact WAL catalog: %w", err)
+	}
+	fmt.Printf("WAL catalog: %s (%d segments, %d timelines)\n", s.path(), len(s.segments), len(s.timelines))
+	return s, nil
+}
+
+func (s *FileCatalogStore) path() string {
+	return filepath.Join(s.dir, catalogJournalFile)
+}
+
+// replays the journal. a torn last line (crash mid write) is dropped, anything else unreadable is an error
+func (s *FileCatalogStore) load() error {
+	data, err := os.ReadFile(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var entry catalogJournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if lineNo == bytes.Count(data, []byte("\n"))+1 {
+				log.Printf("WAL catalog: dropping incomplete last line %d of %s", lineNo, s.path())
+				break
+			}
+			return fmt.Errorf("WAL catalog %s line %d is corrupt: %w", s.path(), lineNo, err)
+		}
+		s.apply(entry)
+	}
+	return scanner.Err()
+}
+
+func (s *FileCatalogStore) apply(entry catalogJournalEntry) {
+	if entry.Segment != nil {
+		s.segments[entry.Segment.FileName] = *entry.Segment
+	}
+	for _, rec := range entry.Segments {
+		s.segments[rec.FileName] = rec
+	}
+	if entry.Timeline != nil {
+		s.timelines[entry.Timeline.TLI] = *entry.Timeline
+	}
+	if entry.Gaps != nil {
+		s.gaps = *entry.Gaps
+	}
+	if entry.DeleteTimeline != 0 {
+		delete(s.timelines, entry.DeleteTimeline)
+	}
+}
+
+// appends one change to the journal and fsyncs it, then applies it in memory
+// a failed write is cut off again: left there, the next append would put it in the middle of the journal
+// where load() can't tell it from corruption. if even that fails the journal is rewritten from memory
+func (s *FileCatalogStore) append(entry catalogJournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if s.torn {
+		if err := s.compact(); err != nil {
+			return fmt.Errorf("failed to rewrite WAL catalog after a failed write: %w", err)
+		}
+	}
+	info, err := s.journal.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to write WAL catalog: %w", err)
+	}
+	if _, err = s.journal.Write(append(line, '\n')); err != nil {
+		err = fmt.Errorf("failed to write WAL catalog: %w", err)
+	} else if err = s.journal.Sync(); err != nil {
+		err = fmt.Errorf("failed to sync WAL catalog: %w", err)
+	}
+	if err != nil {
+		if truncErr := s.journal.Truncate(info.Size()); truncErr != nil {
+			log.Printf("WAL catalog: can't cut off the failed write, rewriting the journal next time: %v", truncErr)
+			s.torn = true
+		}
+		return err
+	}
+	s.apply(entry)
+	s.lines++
+
+	live := len(s.segments) + len(s.timelines) + 1
+	if s.lines > catalogCompactMin && s.lines > live*catalogCompactFactor {
+		if err := s.compact(); err != nil {
+			log.Printf("WAL catalog: compaction failed, keeping the journal: %v", err)
+		}
+	}
+	return nil
+}
+
+// rewrites the journal as one line per live record and reopens it for appending
+func (s *FileCatalogStore) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, name := range slices.Sorted(maps.Keys(s.segments)) {
+		rec := s.segments[name]
+		if err := enc.Encode(catalogJournalEntry{Segment: &rec}); err != nil {
+			return err
+		}
+	}
+	for _, tli := range slices.Sorted(maps.Keys(s.timelines)) {
+		rec := s.timelines[tli]
+		if err := enc.Encode(catalogJournalEntry{Timeline: &rec}); err != nil {
+			return err
+		}
+	}
+	gaps := s.gaps
+	if err := enc.Encode(catalogJournalEntry{Gaps: &gaps}); err != nil {
+		return err
+	}
+
+	// the old journal stays open (and usable) until the snapshot has replaced it
+	if err := writeFileAtomic(s.path(), buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	s.journal = f
+	s.lines = len(s.segments) + len(s.timelines) + 1
+	s.torn = false
+	return nil
+}
+
+// fsyncs a directory so a rename in it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// the whole batch is one journal line, so a crash mid write drops all of it and never half of it
+func (s *FileCatalogStore) UpsertSegments(recs []WalSegmentRecord) ([]SegmentUpsertResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]SegmentUpsertResult, len(recs))
+	var changed []WalSegmentRecord
+	for i, rec := range recs {
+		results[i].FileName = rec.FileName
+		if existing, ok := s.segments[rec.FileName]; ok {
+			merged, isChanged := mergeSegmentRecord(existing, rec)
+			if !isChanged {
+				continue
+			}
+			rec = merged
+		} else {
+			rec.CreatedAt = time.Now().UTC()
+		}
+		results[i].Changed = true
+		changed = append(changed, rec)
+	}
+	if len(changed) == 0 {
+		return results, nil
+	}
+
+	if err := s.append(catalogJournalEntry{Segments: changed}); err != nil {
+		for i := range results {
+			results[i].Changed = false
+			results[i].Err = err
+		}
+		return results, err
+	}
+	return results, nil
+}
+
+func (s *FileCatalogStore) PutSegment(rec WalSegmentRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.segments[rec.FileName]; ok {
+		rec.CreatedAt = existing.CreatedAt
+	} else {
+		rec.CreatedAt = time.Now().UTC()
+	}
+	return s.append(catalogJournalEntry{Segment: &rec})
+}
+
+func (s *FileCatalogStore) Segments() ([]WalSegmentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]WalSegmentRecord, 0, len(s.segments))
+	for _, name := range slices.Sorted(maps.Keys(s.segments)) {
+		records = append(records, s.segments[name])
+	}
+	return records, nil
+}
+
+func (s *FileCatalogStore) UpsertTimeline(rec TimelineRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.timelines[rec.TLI]; ok && existing == rec {
+		return false, nil
+	}
+	if err := s.append(catalogJournalEntry{Timeline: &rec}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *FileCatalogStore) DeleteTimeline(tli uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.timelines[tli]; !ok {
+		return nil
+	}
+	return s.append(catalogJournalEntry{DeleteTimeline: tli})
+}
+
+func (s *FileCatalogStore) Timelines() ([]TimelineRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]TimelineRecord, 0, len(s.timelines))
+	for _, tli := range slices.Sorted(maps.Keys(s.timelines)) {
+		records = append(records, s.timelines[tli])
+	}
+	return records, nil
+}
+
+func (s *FileCatalogStore) ReplaceGaps(gaps []WalGap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.Equal(s.gaps, gaps) {
+		return nil
+	}
+	gaps = slices.Clone(gaps)
+	return s.append(catalogJournalEntry{Gaps: &gaps})
+}
+
+func (s *FileCatalogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.Close()
+	s.journal = nil
+	return err
+}
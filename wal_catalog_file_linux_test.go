@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// a write that fails halfway (RLIMIT_FSIZE cuts it off like a full disk would) is cut off again,
+// so the next append doesn't leave a corrupt line in the middle of the journal
+func TestFileCatalogCutsOffTornAppend(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestCatalog(t, dir)
+	s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(1, 100)})
+	info, _ := os.Stat(s.path())
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Skip(err)
+	}
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+	small := limit
+	small.Cur = uint64(info.Size()) + 20
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &small); err != nil {
+		t.Skip(err)
+	}
+	_, err := s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(2, 200)})
+	syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit)
+	if !errors.Is(err, syscall.EFBIG) {
+		t.Fatalf("append over the file size limit: %v", err)
+	}
+	if after, _ := os.Stat(s.path()); after.Size() != info.Size() || s.torn {
+		t.Fatalf("journal is %d bytes after the failed append, was %d", after.Size(), info.Size())
+	}
+
+	if _, err := s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(3, 300)}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	reopened, err := OpenFileCatalogStore(dir)
+	if err != nil {
+		t.Fatalf("reopen after a torn append: %v", err)
+	}
+	defer reopened.Close()
+	segs, _ := reopened.Segments()
+	if len(segs) != 2 || !strings.HasSuffix(segs[1].FileName, "3") {
+		t.Errorf("segments: %+v", segs)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestCatalog(t *testing.T, dir string) *FileCatalogStore {
+	t.Helper()
+	s, err := OpenFileCatalogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func testSegmentRecord(segNo uint64, size int64) WalSegmentRecord {
+	name := WalFileName(1, segNo, testSegmentSize)
+	valid := true
+	return WalSegmentRecord{
+		FileName:      name,
+		TimelineID:    1,
+		SegmentNumber: name[8:],
+		SizeBytes:     size,
+		SegmentSize:   testSegmentSize,
+		StartLsn:      segNo * testSegmentSize,
+		EndLsn:        (segNo + 1) * testSegmentSize,
+		HeaderValid:   &valid,
+		Sha256:        strings.Repeat("ab", 32),
+	}
+}
+
+func journalLines(t *testing.T, s *FileCatalogStore) []string {
+	t.Helper()
+	data, err := os.ReadFile(s.path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// the in memory state of two catalogs is the same
+func sameCatalog(t *testing.T, got, want *FileCatalogStore) {
+	t.Helper()
+	gotSegs, _ := got.Segments()
+	wantSegs, _ := want.Segments()
+	if len(gotSegs) != len(wantSegs) {
+		t.Fatalf("%d segments, want %d", len(gotSegs), len(wantSegs))
+	}
+	for i := range gotSegs {
+		if g, w := gotSegs[i], wantSegs[i]; g.FileName != w.FileName || g.SizeBytes != w.SizeBytes || !g.CreatedAt.Equal(w.CreatedAt) || g.Sha256 != w.Sha256 {
+			t.Errorf("segment %d: %+v, want %+v", i, g, w)
+		}
+	}
+	gotTlis, _ := got.Timelines()
+	wantTlis, _ := want.Timelines()
+	if len(gotTlis) != len(wantTlis) {
+		t.Errorf("timelines %+v, want %+v", gotTlis, wantTlis)
+	}
+	for i := range min(len(gotTlis), len(wantTlis)) {
+		if gotTlis[i] != wantTlis[i] {
+			t.Errorf("timeline %+v, want %+v", gotTlis[i], wantTlis[i])
+		}
+	}
+	if len(got.gaps) != len(want.gaps) {
+		t.Errorf("gaps %+v, want %+v", got.gaps, want.gaps)
+	}
+}
+
+func TestFileCatalogReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestCatalog(t, dir)
+
+	if _, err := s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(1, 100), testSegmentRecord(2, 200)}); err != nil {
+		t.Fatal(err)
+	}
+	// an unchanged record isn't written again, a changed one keeps its created_at
+	results, err := s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(1, 100), testSegmentRecord(2, 250)})
+	if err != nil || results[0].Changed || !results[1].Changed {
+		t.Errorf("second upsert: %+v, %v", results, err)
+	}
+	for _, tl := range []TimelineRecord{
+		{TLI: 2, ParentTLI: 1, SwitchLsn: 0x3000000, Reason: "no recovery target specified", HistoryFile: "00000002.history"},
+		{TLI: 3, ParentTLI: 2, SwitchLsn: 0x5000000, HistoryFile: "00000003.history"},
+	} {
+		if _, err := s.UpsertTimeline(tl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteTimeline(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReplaceGaps([]WalGap{{Timeline: 1, FirstMissing: WalFileName(1, 3, testSegmentSize), LastMissing: WalFileName(1, 4, testSegmentSize), StartLsn: 3 * testSegmentSize, EndLsn: 5 * testSegmentSize}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(journalLines(t, s)); n != 1+2+2+1+1 {
+		t.Errorf("%d journal lines, want one per change after the initial snapshot", n)
+	}
+	s.Close()
+
+	reopened := openTestCatalog(t, dir)
+	sameCatalog(t, reopened, s)
+	segs, _ := reopened.Segments()
+	if len(segs) != 2 || segs[1].SizeBytes != 250 || segs[0].CreatedAt.IsZero() {
+		t.Errorf("replayed segments: %+v", segs)
+	}
+	if tlis, _ := reopened.Timelines(); len(tlis) != 1 || tlis[0].Reason != "no recovery target specified" {
+		t.Errorf("replayed timelines: %+v", tlis)
+	}
+}
+
+func TestFileCatalogCompacts(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestCatalog(t, dir)
+	lastSize := map[uint64]int64{}
+	for i := range catalogCompactMin + 10 {
+		if err := s.PutSegment(testSegmentRecord(uint64(i%3), int64(i))); err != nil {
+			t.Fatal(err)
+		}
+		lastSize[uint64(i%3)] = int64(i)
+	}
+	// compacted while running: one line per live record and the gaps, plus what came after
+	if n := len(journalLines(t, s)); n > catalogCompactMin/2 {
+		t.Errorf("%d journal lines for 3 segments", n)
+	}
+	s.Close()
+
+	// and on open
+	reopened := openTestCatalog(t, dir)
+	sameCatalog(t, reopened, s)
+	if lines := journalLines(t, reopened); len(lines) != 3+1 {
+		t.Errorf("journal after open: %q", lines)
+	}
+	for _, seg := range reopened.segments {
+		if seg.SizeBytes != lastSize[seg.StartLsn/testSegmentSize] {
+			t.Errorf("%s has size %d after compaction", seg.FileName, seg.SizeBytes)
+		}
+	}
+}
+
+func TestFileCatalogDropsTornLastLine(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestCatalog(t, dir)
+	s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(1, 100)})
+	s.Close()
+
+	// a crash in the middle of the next append
+	f, _ := os.OpenFile(s.path(), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"segments":[{"file_name":"000000010000000000000002","timel`)
+	f.Close()
+
+	reopened := openTestCatalog(t, dir)
+	sameCatalog(t, reopened, s)
+	for _, line := range journalLines(t, reopened) {
+		if strings.Contains(line, "timel\"") || !strings.HasSuffix(line, "}") {
+			t.Errorf("torn line survived the compaction: %q", line)
+		}
+	}
+	// appends after it work and replay
+	if _, err := reopened.UpsertSegments([]WalSegmentRecord{testSegmentRecord(2, 200)}); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	if segs, _ := openTestCatalog(t, dir).Segments(); len(segs) != 2 {
+		t.Errorf("segments after the repair: %+v", segs)
+	}
+}
+
+func TestFileCatalogRejectsCorruptMiddleLine(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestCatalog(t, dir)
+	s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(1, 100)})
+	s.Close()
+
+	data, _ := os.ReadFile(s.path())
+	data = append([]byte("{not json\n"), data...)
+	os.WriteFile(s.path(), data, 0644)
+	if _, err := OpenFileCatalogStore(dir); err == nil || !strings.Contains(err.Error(), "line 1 is corrupt") {
+		t.Errorf("open with a corrupt first line: %v", err)
+	}
+}
+
+func TestFileCatalogRewritesJournalAfterFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestCatalog(t, dir)
+	s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(1, 100)})
+
+	// a journal that can't be written or truncated
+	ro, err := os.Open(s.path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.journal.Close()
+	s.journal = ro
+	if _, err := s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(2, 200)}); err == nil {
+		t.Fatal("append to a read only journal succeeded")
+	}
+	if !s.torn {
+		t.Error("journal not marked for a rewrite")
+	}
+	if segs, _ := s.Segments(); len(segs) != 1 {
+		t.Errorf("failed append applied in memory: %+v", segs)
+	}
+
+	if _, err := s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(3, 300)}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if segs, _ := openTestCatalog(t, dir).Segments(); len(segs) != 2 || segs[1].FileName != WalFileName(1, 3, testSegmentSize) {
+		t.Errorf("segments after the rewrite: %+v", segs)
+	}
+}
+
+func TestFileCatalogCompactKeepsOldJournalOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestCatalog(t, dir)
+	s.UpsertSegments([]WalSegmentRecord{testSegmentRecord(1, 100)})
+	before, _ := os.ReadFile(s.path())
+
+	// the snapshot can't be written next to the journal
+	os.Mkdir(filepath.Join(dir, catalogJournalFile+".tmp"), 0755)
+	os.WriteFile(filepath.Join(dir, catalogJournalFile+".tmp", "x"), nil, 0644)
+	if err := s.compact(); err == nil {
+		t.Fatal("compaction succeeded without a temp file")
+	}
+	after, _ := os.ReadFile(s.path())
+	if !bytes.Equal(before, after) {
+		t.Error("journal changed by a failed compaction")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+- the catalog as tables on the primary (wal_metadata, timelines, wal_gaps), the original layout
+- goes down with the primary and every write is WAL of its own, so it's only used with catalog_backend=postgres
+- runs on a pgxpool, so the monitor and the CLI can use it at the same time. broken connections are dropped by
+  the pool's health checks and every call is retried with backoff (RetryPolicy), so the catalog picks up
+  again on its own once the primary is back
+- every call runs under the store's ctx, derived from the one passed to Open and cancelled by Close, so a
+  SIGTERM during a long backoff returns right away instead of waiting out the retries
+*/
+
+const catalogHealthCheckPeriod = 10 * time.Second
+
+type PostgresCatalogStore struct {
+	pool   *pgxpool.Pool
+	retry  RetryPolicy
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// connects to the database and creates the catalog tables if needed
+func OpenPostgresCatalogStore(parent context.Context, dsn string, retry RetryPolicy) (*PostgresCatalogStore, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid catalog database dsn: %w", err)
+	}
+	cfg.MaxConns = 4
+	cfg.HealthCheckPeriod = catalogHealthCheckPeriod
+
+	ctx, cancel := context.WithCancel(parent)
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("unable to create catalog pool: %w", err)
+	}
+	s := &PostgresCatalogStore{pool: pool, retry: retry, ctx: ctx, cancel: cancel}
+
+	err = retry.Do(ctx, "creating wal_metadata table", func() error {
+		_, err := pool.Exec(ctx, Create_Wal_Metadata_Table())
+		return err
+	})
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error creating wal_metadata table: %w", err)
+	}
+	fmt.Println("WAL catalog: wal_metadata table on Primary.")
+	return s, nil
+}
+
+// one transaction, all upserts sent as a single pgx.Batch. a dropped connection retries the whole batch
+func (s *PostgresCatalogStore) UpsertSegments(recs []WalSegmentRecord) ([]SegmentUpsertResult, error) {
+	results := make([]SegmentUpsertResult, len(recs))
+	if len(recs) == 0 {
+		return results, nil
+	}
+
+	ctx := s.ctx
+	err := s.retry.Do(ctx, "catalog batch", func() error {
+		for i, rec := range recs {
+			results[i] = SegmentUpsertResult{FileName: rec.FileName}
+		}
+		return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+			batch := &pgx.Batch{}
+			for _, rec := range recs {
+				validationError, checksum := nullableSegmentFields(rec)
+				batch.Queue(Update_Wal_MetaData_Table(), rec.FileName, int64(rec.TimelineID), rec.SegmentNumber,
+					rec.IsPartial, rec.SizeBytes, int64(rec.SegmentSize), FormatLsn(rec.StartLsn), FormatLsn(rec.EndLsn),
+					rec.HeaderValid, validationError, checksum, nullableLogicalSize(rec), nullableCompression(rec), nullableKeyID(rec))
+			}
+
+			br := tx.SendBatch(ctx, batch)
+			for i := range recs {
+				tag, err := br.Exec()
+				if err != nil {
+					results[i].Err = err
+					br.Close()
+					return fmt.Errorf("%s: %w", recs[i].FileName, err)
+				}
+				results[i].Changed = tag.RowsAffected() > 0
+			}
+			return br.Close()
+		})
+	})
+
+	if err != nil {
+		for i := range results {
+			results[i].Changed = false
+			if results[i].Err == nil {
+				results[i].Err = errCatalogBatchRolledBack
+			}
+		}
+		return results, err
+	}
+	return results, nil
+}
+
+// empty strings are stored as NULL
+func nullableSegmentFields(rec WalSegmentRecord) (*string, *string) {
+	var validationError, checksum *string
+	if rec.ValidationError != "" {
+		validationError = &rec.ValidationError
+	}
+	if rec.Sha256 != "" {
+		checksum = &rec.Sha256
+	}
+	return validationError, checksum
+}
+
+func nullableLogicalSize(rec WalSegmentRecord) *int64 {
+	if rec.LogicalSize == 0 {
+		return nil
+	}
+	return &rec.LogicalSize
+}
+
+func nullableCompression(rec WalSegmentRecord) *string {
+	if rec.Compression == "" {
+		return nil
+	}
+	return &rec.Compression
+}
+
+func nullableKeyID(rec WalSegmentRecord) *string {
+	if rec.KeyID == "" {
+		return nil
+	}
+	return &rec.KeyID
+}
+
+func (s *PostgresCatalogStore) PutSegment(rec WalSegmentRecord) error {
+	ctx := s.ctx
+	validationError, checksum := nullableSegmentFields(rec)
+	return s.retry.Do(ctx, "catalog write", func() error {
+		_, err := s.pool.Exec(ctx, Put_Wal_MetaData(), rec.FileName, int64(rec.TimelineID), rec.SegmentNumber,
+			rec.IsPartial, rec.SizeBytes, int64(rec.SegmentSize), FormatLsn(rec.StartLsn), FormatLsn(rec.EndLsn),
+			rec.HeaderValid, validationError, checksum, rec.Missing, nullableLogicalSize(rec), nullableCompression(rec), nullableKeyID(rec))
+		return err
+	})
+}
+
+func (s *PostgresCatalogStore) Segments() ([]WalSegmentRecord, error) {
+	ctx := s.ctx
+	var records []WalSegmentRecord
+	err := s.retry.Do(ctx, "catalog read", func() error {
+		rows, err := s.pool.Query(ctx, `
+			SELECT file_name, timeline_id, segment_number, is_partial, file_size_bytes, COALESCE(segment_size_bytes, 0),
+			       COALESCE(start_lsn, '0/0')::text, COALESCE(end_lsn, '0/0')::text, header_valid,
+			       COALESCE(validation_error, ''), COALESCE(sha256, ''), COALESCE(missing, FALSE), created_at,
+			       COALESCE(logical_size_bytes, 0), COALESCE(compression, ''), COALESCE(key_id, '')
+			FROM wal_metadata
+			ORDER BY file_name ASC`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		records = records[:0]
+		for rows.Next() {
+			var rec WalSegmentRecord
+			var tli, segSize int64
+			var startLsn, endLsn string
+			err := rows.Scan(&rec.FileName, &tli, &rec.SegmentNumber, &rec.IsPartial, &rec.SizeBytes, &segSize,
+				&startLsn, &endLsn, &rec.HeaderValid, &rec.ValidationError, &rec.Sha256, &rec.Missing, &rec.CreatedAt,
+				&rec.LogicalSize, &rec.Compression, &rec.KeyID)
+			if err != nil {
+				return err
+			}
+			rec.TimelineID, rec.SegmentSize = uint32(tli), uint64(segSize)
+			if rec.StartLsn, err = ParseLsn(startLsn); err != nil {
+				return err
+			}
+			if rec.EndLsn, err = ParseLsn(endLsn); err != nil {
+				return err
+			}
+			records = append(records, rec)
+		}
+		return rows.Err()
+	})
+	return records, err
+}
+
+func (s *PostgresCatalogStore) UpsertTimeline(rec TimelineRecord) (bool, error) {
+	ctx := s.ctx
+	changed := false
+	err := s.retry.Do(ctx, "catalog timeline write", func() error {
+		result, err := s.pool.Exec(ctx, Upsert_Timeline(), int64(rec.TLI), int64(rec.ParentTLI),
+			FormatLsn(rec.SwitchLsn), rec.Reason, rec.HistoryFile)
+		changed = err == nil && result.RowsAffected() > 0
+		return err
+	})
+	return changed, err
+}
+
+func (s *PostgresCatalogStore) DeleteTimeline(tli uint32) error {
+	ctx := s.ctx
+	return s.retry.Do(ctx, "catalog timeline delete", func() error {
+		_, err := s.pool.Exec(ctx, "DELETE FROM timelines WHERE timeline_id = $1", int64(tli))
+		return err
+	})
+}
+
+func (s *PostgresCatalogStore) Timelines() ([]TimelineRecord, error) {
+	ctx := s.ctx
+	var records []TimelineRecord
+	err := s.retry.Do(ctx, "catalog timeline read", func() error {
+		rows, err := s.pool.Query(ctx, `
+			SELECT timeline_id, COALESCE(parent_timeline_id, 0), COALESCE(switch_lsn, '0/0')::text,
+			       COALESCE(reason, ''), COALESCE(history_file, '')
+			FROM timelines
+			ORDER BY timeline_id`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		records = records[:0]
+		for rows.Next() {
+			var rec TimelineRecord
+			var tli, parent int64
+			var switchLsn string
+			if err := rows.Scan(&tli, &parent, &switchLsn, &rec.Reason, &rec.HistoryFile); err != nil {
+				return err
+			}
+			rec.TLI, rec.ParentTLI = uint32(tli), uint32(parent)
+			if rec.SwitchLsn, err = ParseLsn(switchLsn); err != nil {
+				return err
+			}
+			records = append(records, rec)
+		}
+		return rows.Err()
+	})
+	return records, err
+}
+
+// swaps the whole gap list in one transaction
+func (s *PostgresCatalogStore) ReplaceGaps(gaps []WalGap) error {
+	ctx := s.ctx
+	return s.retry.Do(ctx, "catalog gap write", func() error {
+		return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, "DELETE FROM wal_gaps"); err != nil {
+				return err
+			}
+			for _, g := range gaps {
+				_, err := tx.Exec(ctx, Insert_Wal_Gap(), int64(g.Timeline), FormatLsn(g.StartLsn), FormatLsn(g.EndLsn), g.FirstMissing, g.LastMissing)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (s *PostgresCatalogStore) Close() error {
+	s.cancel()
+	s.pool.Close()
+	return nil
+}
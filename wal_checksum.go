@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+/*
+- every finished segment gets a SHA-256 in the catalog when SyncWalFiles first sees it
+- before a restore hands the archive to postgres, every segment the restore needs is hashed again and
+  compared, so a bit flip or a partly overwritten file fails the restore up front and names the file
+- the same pass decrypts and decompresses segments into restore_staging, postgres only reads plain files.
+  with an archive store that isn't the local archive dir every segment (and history file) is staged,
+  restore_command can only read what's on this machine
+*/
+
+// where a restore finds decompressed segments, inside the archive so the restore target sees it as /wal_archive/restore_staging
+const restoreStagingDir = "restore_staging"
+
+// empties the staging dir, it only ever holds the current restore's segments
+func ResetRestoreStaging(archiveDir string) error {
+	dir := filepath.Join(archiveDir, restoreStagingDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// re-hashes every segment in the archive that overlaps [fromLsn, toLsn) and compares it to the stored checksum,
+// compressed and encrypted ones are written out plain to the staging dir along the way
+// toLsn 0 means up to the end of the archive. segments without a stored checksum (.partial, snapshots, not yet catalogued) aren't verified
+func (wm *WalManager) PrepareRestoreWal(fromLsn uint64, toLsn uint64) error {
+	records, err := wm.Catalog.Segments()
+	if err != nil {
+		return fmt.Errorf("failed to load checksums: %w", err)
+	}
+	archived, historyTlis, err := wm.scanArchive()
+	if err != nil {
+		return err
+	}
+
+	inRange := func(rec WalSegmentRecord) bool {
+		return rec.EndLsn > fromLsn && (toLsn == 0 || rec.StartLsn <= toLsn)
+	}
+	sums := map[string]string{}
+	for _, rec := range records {
+		if rec.Sha256 != "" && !rec.Missing && inRange(rec) {
+			sums[rec.FileName] = rec.Sha256
+		}
+	}
+
+	fmt.Printf("Verifying checksums of %d WAL segments...\n", len(sums))
+	staged := 0
+	for _, seg := range archived {
+		if seg.rec.IsPartial || !inRange(seg.rec) {
+			continue
+		}
+		want, verify := sums[seg.rec.FileName]
+		delete(sums, seg.rec.FileName)
+		if !verify && !wm.needsStaging(seg) {
+			continue
+		}
+
+		content, err := wm.readForRestore(seg)
+		if err != nil {
+			return fmt.Errorf("WAL segment %s can't be read: %w", seg.name, err)
+		}
+		if verify && content.Sha256 != want {
+			return fmt.Errorf("WAL segment %s is corrupt: checksum %s does not match catalogued %s", seg.name, content.Sha256, want)
+		}
+		if wm.needsStaging(seg) {
+			staged++
+		}
+	}
+	if !wm.spoolIsArchive {
+		for _, tli := range historyTlis {
+			if err := wm.stageHistory(tli); err != nil {
+				return fmt.Errorf("timeline history %s can't be read: %w", TimelineHistoryFileName(tli), err)
+			}
+		}
+	}
+
+	// anything left was catalogued but isn't in the archive anymore
+	if missing := slices.Sorted(maps.Keys(sums)); len(missing) > 0 {
+		return fmt.Errorf("WAL segment %s is catalogued but can't be read: not in the archive", missing[0])
+	}
+
+	fmt.Println("All WAL checksums match.")
+	if staged > 0 {
+		fmt.Printf("Staged %d WAL segments into %s\n", staged, restoreStagingDir)
+	}
+	return nil
+}
+
+// whether postgres can only get a segment from the staging dir
+func (wm *WalManager) needsStaging(seg archivedSegment) bool {
+	return seg.file.needsStaging() || !wm.spoolIsArchive
+}
+
+// hashes one segment, a staged one is written out plain to the staging dir at the same time
+func (wm *WalManager) readForRestore(seg archivedSegment) (WalSegmentContent, error) {
+	if !wm.needsStaging(seg) {
+		return ReadWalSegment(wm.Archive, seg.name, nil, nil)
+	}
+
+	stagedPath := filepath.Join(wm.ArchiveDir, restoreStagingDir, seg.rec.FileName)
+	f, err := os.Create(stagedPath)
+	if err != nil {
+		return WalSegmentContent{}, err
+	}
+	content, err := ReadWalSegment(wm.Archive, seg.name, wm.Keys, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return content, err
+}
+
+// copies a timeline history file into the staging dir, postgres asks for them while it picks the timeline
+func (wm *WalManager) stageHistory(tli uint32) error {
+	data, err := readObject(wm.Archive, TimelineHistoryFileName(tli))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(wm.ArchiveDir, restoreStagingDir, TimelineHistoryFileName(tli)), data, 0644)
+}
+
+// decompresses what there is of a compressed .partial into the staging dir, zero padded to a full segment
+// like pg_receivewal pads plain ones. the compressed stream ends mid block, whatever was flushed is kept
+// (.partial files are never encrypted)
+func snapshotCompressedPartial(archiveDir string, name string, segName string, segSize uint64) error {
+	spool, err := NewLocalArchiveStore(archiveDir)
+	if err != nil {
+		return err
+	}
+	r, err := OpenWalSegment(spool, name, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.Create(filepath.Join(archiveDir, restoreStagingDir, segName))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, r)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	if uint64(n) > segSize {
+		return fmt.Errorf("%s decompresses to %d bytes, more than a segment", name, n)
+	}
+	return out.Truncate(int64(segSize))
+}
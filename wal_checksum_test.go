@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// an archive in the memory store with segments 1-3 of timeline 1 (gzip, encrypted) and a history file, catalogued
+func newSyncedTestArchive(t *testing.T) (*WalManager, *MemoryArchiveStore, map[string][]byte) {
+	t.Helper()
+	mem := NewMemoryArchiveStore()
+	wm := newTestWalManager(t, mem, testKeyRing(t))
+	wm.Compression = CompressionGzip
+
+	segments := map[string][]byte{}
+	for segNo := uint64(1); segNo <= 3; segNo++ {
+		name, data := testSegment(1, segNo)
+		writeSpoolFile(t, wm, name, data)
+		segments[name] = data
+	}
+	writeSpoolFile(t, wm, "00000002.history", []byte("1\t0/4000000\tno recovery target specified\n"))
+	if _, err := wm.SyncWalFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResetRestoreStaging(wm.ArchiveDir); err != nil {
+		t.Fatal(err)
+	}
+	return wm, mem, segments
+}
+
+func TestPrepareRestoreWalStagesFromStore(t *testing.T) {
+	wm, _, segments := newSyncedTestArchive(t)
+
+	if err := wm.PrepareRestoreWal(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	staging := filepath.Join(wm.ArchiveDir, restoreStagingDir)
+	for name, want := range segments {
+		got, err := os.ReadFile(filepath.Join(staging, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s not staged plain: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(staging, "00000002.history")); err != nil {
+		t.Errorf("history file not staged: %v", err)
+	}
+}
+
+func TestPrepareRestoreWalOnlyReadsTheRange(t *testing.T) {
+	wm, _, _ := newSyncedTestArchive(t)
+	first, _ := testSegment(1, 1)
+	second, _ := testSegment(1, 2)
+	third, _ := testSegment(1, 3)
+
+	// from inside segment 2 to the start of segment 3
+	if err := wm.PrepareRestoreWal(2*testSegmentSize+100, 3*testSegmentSize); err != nil {
+		t.Fatal(err)
+	}
+	staging := filepath.Join(wm.ArchiveDir, restoreStagingDir)
+	for name, want := range map[string]bool{first: false, second: true, third: true} {
+		if _, err := os.Stat(filepath.Join(staging, name)); (err == nil) != want {
+			t.Errorf("%s staged: %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+func TestPrepareRestoreWalCatchesCorruptSegment(t *testing.T) {
+	wm, mem, segments := newSyncedTestArchive(t)
+	name, _ := testSegment(1, 2)
+
+	// swap the segment for a plain copy with one byte changed
+	data := bytes.Clone(segments[name])
+	data[len(data)/2] ^= 0xff
+	if err := mem.Delete("wal_archive/" + name + ".gz.enc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := putObject(mem, "wal_archive/"+name, time.Time{}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := wm.PrepareRestoreWal(0, 0)
+	if err == nil || !strings.Contains(err.Error(), name+" is corrupt") {
+		t.Errorf("PrepareRestoreWal = %v, want %s reported corrupt", err, name)
+	}
+}
+
+func TestPrepareRestoreWalCatchesMissingSegment(t *testing.T) {
+	wm, mem, _ := newSyncedTestArchive(t)
+	name, _ := testSegment(1, 3)
+	if err := mem.Delete("wal_archive/" + name + ".gz.enc"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := wm.PrepareRestoreWal(0, 0)
+	if err == nil || !strings.Contains(err.Error(), name+" is catalogued but can't be read") {
+		t.Errorf("PrepareRestoreWal = %v, want %s reported missing", err, name)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+/*
+- pg_receivewal --compress leaves segments as <name>.gz, .lz4 or .zst (<name>.gz.partial while it's writing),
+  the catalog keys them by the plain segment name and records the codec
+- with wal_compression=gzip|lz4|zstd in app.env the monitor compresses finished plain segments itself:
+  the compressed copy is committed to the archive store, then the plain one is deleted (see transcodeSegment)
+- header checks and checksums always run on the decompressed content, so a segment keeps its checksum when it gets compressed
+- postgres can't read compressed segments, a restore decompresses the ones it needs into restore_staging (see PrepareRestoreWal)
+*/
+
+const (
+	CompressionGzip = "gzip"
+	CompressionLz4  = "lz4"
+	CompressionZstd = "zstd"
+)
+
+// file name suffix per codec, same ones pg_receivewal uses
+var compressionSuffixes = map[string]string{
+	CompressionGzip: ".gz",
+	CompressionLz4:  ".lz4",
+	CompressionZstd: ".zst",
+}
+
+// wal_compression from app.env, empty means segments are left as they are
+func ValidateCompression(codec string) error {
+	if _, ok := compressionSuffixes[codec]; codec != "" && !ok {
+		return fmt.Errorf("unknown wal_compression %q: must be %s, %s or %s", codec, CompressionGzip, CompressionLz4, CompressionZstd)
+	}
+	return nil
+}
+
+// an archive file name taken apart: <segment>[.gz|.lz4|.zst][.enc][.partial]
+type ArchivedWalFile struct {
+	Segment   string // plain segment name, what the catalog is keyed by
+	Codec     string // "" for plain
+	Encrypted bool   // see wal_encryption.go
+	Partial   bool   // still being written
+}
+
+// ok is false for anything that isn't a WAL segment
+func ParseArchivedWalName(name string) (ArchivedWalFile, bool) {
+	var file ArchivedWalFile
+	rest, partial := strings.CutSuffix(name, ".partial")
+	rest, encrypted := strings.CutSuffix(rest, encryptedSuffix)
+	for c, suffix := range compressionSuffixes {
+		if trimmed, found := strings.CutSuffix(rest, suffix); found {
+			rest, file.Codec = trimmed, c
+			break
+		}
+	}
+	if _, _, valid := ParseWalFilename(rest); !valid {
+		return ArchivedWalFile{}, false
+	}
+	file.Segment, file.Encrypted, file.Partial = rest, encrypted, partial
+	return file, true
+}
+
+// the name the file has on disk
+func (f ArchivedWalFile) Name() string {
+	name := f.Segment + compressionSuffixes[f.Codec]
+	if f.Encrypted {
+		name += encryptedSuffix
+	}
+	if f.Partial {
+		name += ".partial"
+	}
+	return name
+}
+
+// postgres can only read plain files, everything else goes through restore_staging
+func (f ArchivedWalFile) needsStaging() bool {
+	return f.Codec != "" || f.Encrypted
+}
+
+// how far a finished file got through compression and encryption, of two copies of a segment the higher one
+// was complete first and the other is left over from transcodeSegment
+func (f ArchivedWalFile) rewriteStage() int {
+	stage := 0
+	if f.Codec != "" {
+		stage++
+	}
+	if f.Encrypted {
+		stage += 2
+	}
+	return stage
+}
+
+// every name a segment could have on disk: plain, compressed or encrypted, finished or not
+// (only pg_receivewal writes .partial files and it doesn't encrypt)
+func archivedWalNames(segName string) []string {
+	var names []string
+	for _, codec := range []string{"", CompressionGzip, CompressionLz4, CompressionZstd} {
+		names = append(names,
+			ArchivedWalFile{Segment: segName, Codec: codec}.Name(),
+			ArchivedWalFile{Segment: segName, Codec: codec, Partial: true}.Name(),
+			ArchivedWalFile{Segment: segName, Codec: codec, Encrypted: true}.Name())
+	}
+	return names
+}
+
+// whether the segment is still being written, under any codec
+func hasPartialSegment(archiveDir string, segName string) bool {
+	for _, codec := range []string{"", CompressionGzip, CompressionLz4, CompressionZstd} {
+		name := ArchivedWalFile{Segment: segName, Codec: codec, Partial: true}.Name()
+		if _, err := os.Stat(filepath.Join(archiveDir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
+
+// opens a segment in the store and decrypts and decompresses it on the fly, what to do comes from the name
+// keys can be nil when the segment isn't encrypted
+func OpenWalSegment(store ArchiveStore, name string, keys *KeyRing) (io.ReadCloser, error) {
+	r, _, err := openWalSegment(store, name, keys)
+	return r, err
+}
+
+// also returns the id of the key an encrypted segment was encrypted with
+func openWalSegment(store ArchiveStore, name string, keys *KeyRing) (io.ReadCloser, string, error) {
+	f, err := store.Get(name)
+	if err != nil {
+		return nil, "", err
+	}
+	file, _ := ParseArchivedWalName(path.Base(name))
+
+	var src io.Reader = f
+	keyID := ""
+	if file.Encrypted {
+		if src, keyID, err = keys.NewReader(f); err != nil {
+			f.Close()
+			return nil, keyID, err
+		}
+	}
+
+	switch file.Codec {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			f.Close()
+			return nil, keyID, err
+		}
+		return readCloser{gz, func() error { gz.Close(); return f.Close() }}, keyID, nil
+	case CompressionLz4:
+		return readCloser{lz4.NewReader(src), f.Close}, keyID, nil
+	case CompressionZstd:
+		dec, err := zstd.NewReader(src)
+		if err != nil {
+			f.Close()
+			return nil, keyID, err
+		}
+		return readCloser{dec, func() error { dec.Close(); return f.Close() }}, keyID, nil
+	}
+	return readCloser{src, f.Close}, keyID, nil
+}
+
+func newCompressor(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionLz4:
+		return lz4.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q", codec)
+}
+
+// a finished segment's content, read once
+type WalSegmentContent struct {
+	Header []byte // first page header, shorter if the file is
+	Size   int64  // decompressed size
+	Sha256 string // hex SHA-256 of the decompressed content
+	KeyID  string // master key of an encrypted segment
+}
+
+// keeps the first n bytes written to it
+type headWriter struct {
+	buf []byte
+	n   int
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if missing := h.n - len(h.buf); missing > 0 {
+		h.buf = append(h.buf, p[:min(missing, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// decrypts and decompresses a segment once for its header, size and checksum. dst gets a copy of the content when it's not nil
+func ReadWalSegment(store ArchiveStore, name string, keys *KeyRing, dst io.Writer) (WalSegmentContent, error) {
+	var content WalSegmentContent
+	r, keyID, err := openWalSegment(store, name, keys)
+	content.KeyID = keyID
+	if err != nil {
+		return content, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	head := &headWriter{n: xlpLongHdrSize}
+	writers := []io.Writer{h, head}
+	if dst != nil {
+		writers = append(writers, dst)
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return content, err
+	}
+
+	content.Header = head.buf
+	content.Size = n
+	content.Sha256 = hex.EncodeToString(h.Sum(nil))
+	return content, nil
+}
+
+// copies a finished segment from src into dst as target and deletes it from src, src and dst can be the same store.
+// it's compressed with target.Codec if it's plain and encrypted with key if target says so and it isn't already.
+// the copy is committed before the original goes, a crash leaves one or both but never a half segment.
+// the mtime is kept
+func transcodeSegment(src ArchiveStore, dst ArchiveStore, name string, target ArchivedWalFile, key *EncryptionKey) error {
+	file, _ := ParseArchivedWalName(name)
+	obj, err := src.Stat(name)
+	if err != nil {
+		return err
+	}
+	r, err := src.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := dst.Put(target.Name(), obj.ModTime)
+	if err != nil {
+		return err
+	}
+	// data goes through the compressor, then the encryption, then into the store. they're closed in that order
+	var out io.Writer = w
+	var closers []io.Closer
+	if target.Encrypted && !file.Encrypted {
+		enc, err := key.NewWriter(out)
+		if err != nil {
+			w.Abort()
+			return err
+		}
+		out, closers = enc, append(closers, enc)
+	}
+	if target.Codec != file.Codec {
+		zw, err := newCompressor(target.Codec, out)
+		if err != nil {
+			w.Abort()
+			return err
+		}
+		out, closers = zw, append(closers, zw)
+	}
+
+	_, err = io.Copy(out, r)
+	for i := len(closers) - 1; i >= 0 && err == nil; i-- {
+		err = closers[i].Close()
+	}
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("writing %s: %w", target.Name(), err)
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	if src == dst && target.Name() == name {
+		return nil
+	}
+	return src.Delete(name)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseArchivedWalName(t *testing.T) {
+	const seg = "000000010000000A000000FF"
+	for _, codec := range []string{"", "gzip", "lz4", "zstd"} {
+		for _, encrypted := range []bool{false, true} {
+			for _, partial := range []bool{false, true} {
+				name := seg + compressionSuffixes[codec]
+				if encrypted {
+					name += ".enc"
+				}
+				if partial {
+					name += ".partial"
+				}
+				want := ArchivedWalFile{Segment: seg, Codec: codec, Encrypted: encrypted, Partial: partial}
+				got, ok := ParseArchivedWalName(name)
+				if !ok || got != want {
+					t.Errorf("%s: %+v, %v", name, got, ok)
+				}
+				if got.Name() != name {
+					t.Errorf("%s comes back as %s", name, got.Name())
+				}
+			}
+		}
+	}
+
+	for _, name := range []string{
+		"",
+		".gz",
+		"00000002.history",
+		"00000002.history.gz",
+		"000000010000000000000001.bz2",
+		"000000010000000000000001.gz.gz",
+		"000000010000000000000001.partial.gz", // the suffixes only come in one order
+		"000000010000000000000001.enc.gz",
+		"000000010000000000000001.partial.enc",
+		"00000001000000000000001.gz",
+		"00000001000000000000000G",
+		"000000010000000000000001.00000028.backup",
+		"archive_status",
+	} {
+		if got, ok := ParseArchivedWalName(name); ok {
+			t.Errorf("%q parsed as %+v", name, got)
+		}
+	}
+}
+
+// every codec, with and without encryption, reads back as the segment that went in
+func TestTranscodeSegmentRoundTrip(t *testing.T) {
+	keys := testKeyRing(t)
+	name, data := testSegment(1, 5)
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, codec := range []string{"", "gzip", "lz4", "zstd"} {
+		for _, encrypted := range []bool{false, true} {
+			if codec == "" && !encrypted {
+				continue // nothing to do
+			}
+			store := NewMemoryArchiveStore()
+			if err := putObject(store, name, modTime, bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			target := ArchivedWalFile{Segment: name, Codec: codec, Encrypted: encrypted}
+			if err := transcodeSegment(store, store, name, target, keys.Active); err != nil {
+				t.Errorf("%s: %v", target.Name(), err)
+				continue
+			}
+			checkTranscoded(t, store, name, target, data, modTime, keys)
+		}
+	}
+
+	// a compressed segment only gets encrypted, into another store
+	for _, codec := range []string{"gzip", "lz4", "zstd"} {
+		src, dst := NewMemoryArchiveStore(), NewMemoryArchiveStore()
+		if err := putObject(src, name, modTime, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		compressed := ArchivedWalFile{Segment: name, Codec: codec}
+		if err := transcodeSegment(src, src, name, compressed, nil); err != nil {
+			t.Fatalf("%s: %v", compressed.Name(), err)
+		}
+		target := ArchivedWalFile{Segment: name, Codec: codec, Encrypted: true}
+		if err := transcodeSegment(src, dst, compressed.Name(), target, keys.Active); err != nil {
+			t.Errorf("%s: %v", target.Name(), err)
+			continue
+		}
+		if _, err := src.Stat(compressed.Name()); err == nil {
+			t.Errorf("%s still in the source store", compressed.Name())
+		}
+		checkTranscoded(t, dst, name, target, data, modTime, keys)
+	}
+}
+
+func checkTranscoded(t *testing.T, store ArchiveStore, name string, target ArchivedWalFile, data []byte, modTime time.Time, keys *KeyRing) {
+	t.Helper()
+	if _, err := store.Stat(name); err == nil {
+		t.Errorf("%s: plain %s left behind", target.Name(), name)
+	}
+	obj, err := store.Stat(target.Name())
+	if err != nil {
+		t.Errorf("%s: %v", target.Name(), err)
+		return
+	}
+	if !obj.ModTime.Equal(modTime) {
+		t.Errorf("%s: mtime %v, want %v", target.Name(), obj.ModTime, modTime)
+	}
+
+	var copied bytes.Buffer
+	content, err := ReadWalSegment(store, target.Name(), keys, &copied)
+	if err != nil {
+		t.Errorf("%s: %v", target.Name(), err)
+		return
+	}
+	if content.Sha256 != sha256Hex(data) || content.Size != int64(len(data)) || !bytes.Equal(copied.Bytes(), data) {
+		t.Errorf("%s: reads back as %d bytes with sha256 %s", target.Name(), content.Size, content.Sha256)
+	}
+	if !bytes.Equal(content.Header, data[:xlpLongHdrSize]) {
+		t.Errorf("%s: header %x", target.Name(), content.Header)
+	}
+	if wantKey := map[bool]string{true: "k1"}[target.Encrypted]; content.KeyID != wantKey {
+		t.Errorf("%s: key %q, want %q", target.Name(), content.KeyID, wantKey)
+	}
+}
+
+// a store that records commits, aborts and deletes in the order they happen
+type orderedStore struct {
+	ArchiveStore
+	calls *[]string
+}
+
+type orderedWriter struct {
+	ArchiveWriter
+	name  string
+	calls *[]string
+}
+
+func (s orderedStore) Put(name string, modTime time.Time) (ArchiveWriter, error) {
+	w, err := s.ArchiveStore.Put(name, modTime)
+	return &orderedWriter{ArchiveWriter: w, name: name, calls: s.calls}, err
+}
+
+func (s orderedStore) Delete(name string) error {
+	*s.calls = append(*s.calls, "delete "+name)
+	return s.ArchiveStore.Delete(name)
+}
+
+func (w *orderedWriter) Commit() error {
+	*w.calls = append(*w.calls, "commit "+w.name)
+	return w.ArchiveWriter.Commit()
+}
+
+func (w *orderedWriter) Abort() {
+	*w.calls = append(*w.calls, "abort "+w.name)
+	w.ArchiveWriter.Abort()
+}
+
+func TestTranscodeSegmentDeletesTheSourceLast(t *testing.T) {
+	keys := testKeyRing(t)
+	name, data := testSegment(1, 2)
+	var calls []string
+	store := orderedStore{NewMemoryArchiveStore(), &calls}
+	if err := putObject(store, name, time.Time{}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	calls = nil
+
+	target := ArchivedWalFile{Segment: name, Codec: "zstd", Encrypted: true}
+	if err := transcodeSegment(store, store, name, target, keys.Active); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"commit " + target.Name(), "delete " + name}; !slices.Equal(calls, want) {
+		t.Errorf("calls %q, want %q", calls, want)
+	}
+}
+
+// a copy that can't be written leaves the source where it was and no half segment
+func TestTranscodeSegmentKeepsTheSourceOnFailure(t *testing.T) {
+	keys := testKeyRing(t)
+	name, data := testSegment(1, 3)
+	src := NewMemoryArchiveStore()
+	if err := putObject(src, name, time.Time{}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	dst := NewMemoryArchiveStore()
+	var calls []string
+	failing := orderedStore{failingPutStore{ArchiveStore: dst, after: 64}, &calls}
+
+	for _, target := range []ArchivedWalFile{
+		{Segment: name, Encrypted: true},
+		{Segment: name, Codec: "gzip"},
+		{Segment: name, Codec: "lz4", Encrypted: true},
+	} {
+		calls = nil
+		if err := transcodeSegment(src, failing, name, target, keys.Active); err == nil {
+			t.Errorf("%s: written to a full store", target.Name())
+		}
+		if want := []string{"abort " + target.Name()}; !slices.Equal(calls, want) {
+			t.Errorf("%s: calls %q, want %q", target.Name(), calls, want)
+		}
+		if _, err := dst.Stat(target.Name()); err == nil {
+			t.Errorf("%s: half written copy left behind", target.Name())
+		}
+		if got, err := readObject(src, name); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: source gone or changed: %v", target.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+)
+
+/*
+- checks that the archive holds an unbroken run of segments per timeline
+- if pg_receivewal was down or the slot got dropped there's a hole, and replay would stop right there
+- gaps are recorded in the catalog, and restorable ranges follow each timeline's history
+  (WAL before a switch point comes from the parent timeline's segments)
+*/
+
+// a run of missing segments on one timeline
+type WalGap struct {
+	Timeline     uint32
+	FirstMissing string // first missing file name
+	LastMissing  string // last missing file name
+	StartLsn     uint64 // first missing LSN
+	EndLsn       uint64 // first LSN present again
+}
+
+// an LSN range a restore on Timeline can replay without hitting a hole
+type RestorableRange struct {
+	Timeline uint32
+	StartLsn uint64
+	EndLsn   uint64 // exclusive
+}
+
+// result of a continuity check over the whole archive
+type ArchiveContinuity struct {
+	Timelines []uint32 // every timeline with segments, ascending
+	Gaps      []WalGap
+	Ranges    map[uint32][]RestorableRange // per timeline, following its history
+}
+
+func (g WalGap) String() string {
+	if g.FirstMissing == g.LastMissing {
+		return fmt.Sprintf("timeline %d: missing %s (%s - %s)", g.Timeline, g.FirstMissing, FormatLsn(g.StartLsn), FormatLsn(g.EndLsn))
+	}
+	return fmt.Sprintf("timeline %d: missing %s .. %s (%s - %s)", g.Timeline, g.FirstMissing, g.LastMissing, FormatLsn(g.StartLsn), FormatLsn(g.EndLsn))
+}
+
+// loads every catalogued segment as timeline -> set of segment numbers
+func (wm *WalManager) loadCatalogSegments() (map[uint32]map[uint64]bool, error) {
+	records, err := wm.Catalog.Segments()
+	if err != nil {
+		return nil, err
+	}
+
+	segments := map[uint32]map[uint64]bool{}
+	for _, rec := range records {
+		if rec.Missing {
+			continue
+		}
+		tli, segNo, err := ParseWalSegmentNumber(rec.FileName, wm.WalSegmentSize)
+		if err != nil {
+			continue
+		}
+		if segments[tli] == nil {
+			segments[tli] = map[uint64]bool{}
+		}
+		segments[tli][segNo] = true
+	}
+	return segments, nil
+}
+
+// finds gaps per timeline and the restorable LSN ranges of every timeline
+func (wm *WalManager) CheckContinuity() (*ArchiveContinuity, error) {
+	segments, err := wm.loadCatalogSegments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load WAL catalog: %w", err)
+	}
+
+	result := &ArchiveContinuity{Ranges: map[uint32][]RestorableRange{}}
+	for tli := range segments {
+		result.Timelines = append(result.Timelines, tli)
+	}
+	slices.Sort(result.Timelines)
+
+	// 1. holes between the first and last segment of each timeline
+	for _, tli := range result.Timelines {
+		segNos := sortedSegments(segments[tli])
+		for i := 1; i < len(segNos); i++ {
+			if segNos[i] == segNos[i-1]+1 {
+				continue
+			}
+			first, last := segNos[i-1]+1, segNos[i]-1
+			result.Gaps = append(result.Gaps, WalGap{
+				Timeline:     tli,
+				FirstMissing: WalFileName(tli, first, wm.WalSegmentSize),
+				LastMissing:  WalFileName(tli, last, wm.WalSegmentSize),
+				StartLsn:     first * wm.WalSegmentSize,
+				EndLsn:       segNos[i] * wm.WalSegmentSize,
+			})
+		}
+	}
+
+	// 2. restorable ranges, walking each timeline's ancestors
+	for _, tli := range result.Timelines {
+		history, err := LoadTimelineHistory(wm.Archive, tli)
+		if err != nil {
+			log.Printf("Continuity: %v, treating timeline %d as having no ancestors", err, tli)
+			history = nil
+		}
+		result.Ranges[tli] = wm.restorableRanges(tli, history, segments)
+	}
+
+	return result, nil
+}
+
+// builds the runs of present segments along a timeline's lineage
+// a parent contributes the segments before the one holding the switch point, the child's first segment
+// is a copy of that segment up to the switch, so it takes over from there
+func (wm *WalManager) restorableRanges(tli uint32, history []TimelineHistoryEntry, segments map[uint32]map[uint64]bool) []RestorableRange {
+	type expected struct {
+		tli   uint32
+		segNo uint64
+	}
+
+	var want []expected
+	for _, span := range TimelineLineage(tli, history) {
+		from := span.StartLsn / wm.WalSegmentSize
+		var to uint64 // exclusive
+		if span.EndLsn != 0 {
+			to = span.EndLsn / wm.WalSegmentSize
+		} else {
+			own := sortedSegments(segments[span.TLI])
+			if len(own) == 0 {
+				continue
+			}
+			to = own[len(own)-1] + 1
+		}
+
+		// the parent may have been archived from much later on, no need to walk from 0
+		if own := sortedSegments(segments[span.TLI]); len(own) > 0 && own[0] > from && len(want) == 0 {
+			from = own[0]
+		}
+		for segNo := from; segNo < to; segNo++ {
+			want = append(want, expected{span.TLI, segNo})
+		}
+	}
+
+	var ranges []RestorableRange
+	inRun := false
+	for _, w := range want {
+		if !segments[w.tli][w.segNo] {
+			inRun = false
+			continue
+		}
+		start := w.segNo * wm.WalSegmentSize
+		if !inRun {
+			ranges = append(ranges, RestorableRange{Timeline: tli, StartLsn: start})
+			inRun = true
+		}
+		ranges[len(ranges)-1].EndLsn = start + wm.WalSegmentSize
+	}
+	return ranges
+}
+
+func sortedSegments(set map[uint64]bool) []uint64 {
+	segNos := make([]uint64, 0, len(set))
+	for segNo := range set {
+		segNos = append(segNos, segNo)
+	}
+	slices.Sort(segNos)
+	return segNos
+}
+
+// runs the continuity check, records the gaps and logs them if they changed since last time
+func (wm *WalManager) RefreshContinuity() (*ArchiveContinuity, error) {
+	wm.syncMu.Lock()
+	defer wm.syncMu.Unlock()
+
+	continuity, err := wm.CheckContinuity()
+	if err != nil {
+		return nil, err
+	}
+	if err := wm.Catalog.ReplaceGaps(continuity.Gaps); err != nil {
+		return nil, fmt.Errorf("failed to record WAL gaps: %w", err)
+	}
+
+	if len(continuity.Gaps) != wm.lastGapCount {
+		for _, g := range continuity.Gaps {
+			log.Printf("WAL GAP: %s", g)
+		}
+		if len(continuity.Gaps) == 0 {
+			log.Printf("WAL archive is continuous again")
+		}
+		wm.lastGapCount = len(continuity.Gaps)
+	}
+	return continuity, nil
+}
+
+// which timeline a recovery_target_timeline setting ends up on for this archive
+func resolveTargetTimeline(setting string, backupTli uint32, archiveTimelines []uint32) (uint32, error) {
+	switch setting {
+	case "current":
+		return backupTli, nil
+	case "", "latest":
+		if len(archiveTimelines) == 0 {
+			return backupTli, nil
+		}
+		return max(archiveTimelines[len(archiveTimelines)-1], backupTli), nil
+	}
+	tli, err := strconv.ParseUint(setting, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid recovery target timeline %q", setting)
+	}
+	return uint32(tli), nil
+}
+
+// checks the target against the archive's holes before a restore starts
+// an LSN target past a gap is refused, for other targets a gap after the backup only produces a warning
+// because we can't tell in advance whether the target sits before or after it
+func (wm *WalManager) CheckRestoreContinuity(target RecoveryTarget, backupTli uint32, redoLsn uint64) (string, error) {
+	continuity, err := wm.CheckContinuity()
+	if err != nil {
+		return "", err
+	}
+
+	tli, err := resolveTargetTimeline(target.Timeline, backupTli, continuity.Timelines)
+	if err != nil {
+		return "", err
+	}
+	if tli != backupTli {
+		history, err := LoadTimelineHistory(wm.Archive, tli)
+		if err != nil {
+			return "", err
+		}
+		if err := CheckTimelineReachable(tli, history, backupTli, redoLsn); err != nil {
+			return "", err
+		}
+	}
+	if target.Kind == RecoveryTargetLsn && target.Lsn < redoLsn {
+		return "", fmt.Errorf("target LSN %s is before the backup's redo point %s, it can't be reached from this backup",
+			FormatLsn(target.Lsn), FormatLsn(redoLsn))
+	}
+	ranges := continuity.Ranges[tli]
+
+	// the range replay continues in after the backup's own WAL
+	idx := -1
+	warning := ""
+	for i, r := range ranges {
+		if r.EndLsn > redoLsn {
+			idx = i
+			if r.StartLsn > redoLsn {
+				warning = fmt.Sprintf("archived WAL on timeline %d only starts at %s, after the backup's redo point %s; replay relies on the WAL inside the base backup until then",
+					tli, FormatLsn(r.StartLsn), FormatLsn(redoLsn))
+			}
+			break
+		}
+	}
+	if idx == -1 {
+		if target.Kind == RecoveryTargetLsn {
+			return "", fmt.Errorf("no archived WAL on timeline %d after the backup's redo point %s", tli, FormatLsn(redoLsn))
+		}
+		return "no archived WAL after the base backup, the restore can only reach the end of the backup", nil
+	}
+
+	continuousTo := ranges[idx].EndLsn
+	hasGapAfter := idx < len(ranges)-1
+
+	if target.Kind == RecoveryTargetLsn && target.Lsn >= continuousTo {
+		if hasGapAfter {
+			return "", fmt.Errorf("target LSN %s is past a gap: WAL on timeline %d is only continuous up to %s (next WAL starts at %s)",
+				FormatLsn(target.Lsn), tli, FormatLsn(continuousTo), FormatLsn(ranges[idx+1].StartLsn))
+		}
+		return "", fmt.Errorf("target LSN %s is past the end of the archive on timeline %d (%s)", FormatLsn(target.Lsn), tli, FormatLsn(continuousTo))
+	}
+
+	if hasGapAfter && target.Kind != RecoveryTargetLsn && target.Kind != RecoveryTargetImmediate {
+		gapWarning := fmt.Sprintf("the archive has a gap at %s on timeline %d, replay will stop there if the target is later",
+			FormatLsn(continuousTo), tli)
+		if warning != "" {
+			warning += "\n" + gapWarning
+		} else {
+			warning = gapWarning
+		}
+	}
+	return warning, nil
+}
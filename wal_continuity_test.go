@@ -0,0 +1,196 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a WalManager whose catalog holds exactly the named segments, histories maps timelines to .history content
+func newContinuityTestManager(t *testing.T, segSize uint64, histories map[uint32]string, files ...string) *WalManager {
+	t.Helper()
+	wm := newTestWalManager(t, NewMemoryArchiveStore(), testKeyRing(t))
+	wm.WalSegmentSize = segSize
+	for _, name := range files {
+		rec := WalSegmentRecord{FileName: name, SegmentSize: segSize}
+		if missing, ok := strings.CutSuffix(name, " missing"); ok {
+			rec.FileName, rec.Missing = missing, true
+		}
+		if err := wm.Catalog.PutSegment(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for tli, content := range histories {
+		if err := putObject(wm.Archive, TimelineHistoryFileName(tli), time.Now(), strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return wm
+}
+
+const (
+	mb16 = 16 << 20
+	gb1  = 1 << 30
+)
+
+func TestCheckContinuityFindsGaps(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		segSize uint64
+		files   []string
+		gaps    []string
+		ranges  []RestorableRange
+	}{
+		{
+			"continuous across a log id", mb16,
+			[]string{"0000000100000000000000FE", "0000000100000000000000FF", "000000010000000100000000"},
+			nil,
+			[]RestorableRange{{1, 0xFE * mb16, 0x101 * mb16}},
+		},
+		{
+			"one segment missing", mb16,
+			[]string{"0000000100000000000000FE", "0000000100000000000000FF", "000000010000000100000000", "000000010000000100000002"},
+			[]string{"timeline 1: missing 000000010000000100000001 (1/1000000 - 1/2000000)"},
+			[]RestorableRange{{1, 0xFE * mb16, 0x101 * mb16}, {1, 0x102 * mb16, 0x103 * mb16}},
+		},
+		{
+			"catalogued but gone from the archive", mb16,
+			[]string{"000000010000000000000002", "000000010000000000000003 missing", "000000010000000000000004 missing", "000000010000000000000005"},
+			[]string{"timeline 1: missing 000000010000000000000003 .. 000000010000000000000004 (0/3000000 - 0/5000000)"},
+			[]RestorableRange{{1, 2 * mb16, 3 * mb16}, {1, 5 * mb16, 6 * mb16}},
+		},
+		{
+			// four 1GB segments per log id, 00000003 is the last one before 1/0
+			"1GB continuous across a log id", gb1,
+			[]string{"000000010000000000000002", "000000010000000000000003", "000000010000000100000000"},
+			nil,
+			[]RestorableRange{{1, 2 * gb1, 5 * gb1}},
+		},
+		{
+			"1GB gap", gb1,
+			[]string{"000000010000000000000003", "000000010000000100000000", "000000010000000100000002"},
+			[]string{"timeline 1: missing 000000010000000100000001 (1/40000000 - 1/80000000)"},
+			[]RestorableRange{{1, 3 * gb1, 5 * gb1}, {1, 6 * gb1, 7 * gb1}},
+		},
+		{
+			// a 16MB name that doesn't exist with 1GB segments is no segment at all
+			"1GB ignores names of other sizes", gb1,
+			[]string{"000000010000000000000002", "000000010000000000000010", "000000010000000000000003"},
+			nil,
+			[]RestorableRange{{1, 2 * gb1, 4 * gb1}},
+		},
+		{
+			"timelines are separate", mb16,
+			[]string{"000000010000000000000002", "000000010000000000000004", "000000020000000000000003"},
+			[]string{"timeline 1: missing 000000010000000000000003 (0/3000000 - 0/4000000)"},
+			[]RestorableRange{{1, 2 * mb16, 3 * mb16}, {1, 4 * mb16, 5 * mb16}},
+		},
+	} {
+		wm := newContinuityTestManager(t, tc.segSize, nil, tc.files...)
+		c, err := wm.CheckContinuity()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var gaps []string
+		for _, g := range c.Gaps {
+			gaps = append(gaps, g.String())
+		}
+		if !slices.Equal(gaps, tc.gaps) {
+			t.Errorf("%s: gaps %q, want %q", tc.name, gaps, tc.gaps)
+		}
+		if !slices.Equal(c.Ranges[1], tc.ranges) {
+			t.Errorf("%s: ranges %v, want %v", tc.name, c.Ranges[1], tc.ranges)
+		}
+	}
+}
+
+func TestRestorableRangesFollowHistory(t *testing.T) {
+	history := map[uint32]string{2: "1\t0/3000100\tno recovery target specified\n"}
+
+	// timeline 1 up to the switch, timeline 2 from the segment holding it
+	wm := newContinuityTestManager(t, mb16, history,
+		"000000010000000000000001", "000000010000000000000002", "000000010000000000000003", "000000010000000000000004",
+		"000000020000000000000003", "000000020000000000000004", "000000020000000000000005")
+	c, err := wm.CheckContinuity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []RestorableRange{{2, 1 * mb16, 6 * mb16}}; !slices.Equal(c.Ranges[2], want) {
+		t.Errorf("timeline 2: %v, want %v", c.Ranges[2], want)
+	}
+	if want := []RestorableRange{{1, 1 * mb16, 5 * mb16}}; !slices.Equal(c.Ranges[1], want) {
+		t.Errorf("timeline 1: %v, want %v", c.Ranges[1], want)
+	}
+
+	// timeline 2 doesn't need the parent's copy of the switch segment, but a hole before it splits the range
+	wm = newContinuityTestManager(t, mb16, history,
+		"000000010000000000000001", "000000010000000000000003",
+		"000000020000000000000003", "000000020000000000000004")
+	if c, err = wm.CheckContinuity(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []RestorableRange{{2, 1 * mb16, 2 * mb16}, {2, 3 * mb16, 5 * mb16}}; !slices.Equal(c.Ranges[2], want) {
+		t.Errorf("timeline 2 with a hole on 1: %v, want %v", c.Ranges[2], want)
+	}
+}
+
+func TestCheckRestoreContinuity(t *testing.T) {
+	histories := map[uint32]string{
+		2: "1\t0/3000100\tno recovery target specified\n",
+		3: "1\t0/1800000\tbefore the backup\n",
+	}
+	wm := newContinuityTestManager(t, mb16, histories,
+		"000000010000000000000002", "000000010000000000000003", "000000010000000000000004",
+		"000000010000000000000006", "000000010000000000000007",
+		"000000020000000000000003", "000000030000000000000001")
+	redo := uint64(0x2000028)
+
+	lsnTarget := func(lsn uint64) RecoveryTarget {
+		return RecoveryTarget{Kind: RecoveryTargetLsn, Lsn: lsn, Inclusive: true, Timeline: "current", Action: RecoveryActionPromote}
+	}
+	for _, tc := range []struct {
+		name    string
+		target  RecoveryTarget
+		warning string
+		err     string
+	}{
+		{"inside the range", lsnTarget(0x3000000), "", ""},
+		{"last LSN of the range", lsnTarget(5*mb16 - 1), "", ""},
+		{"start of the gap", lsnTarget(5 * mb16), "", "past a gap"},
+		{"past the gap", lsnTarget(0x6000100), "", "only continuous up to 0/5000000 (next WAL starts at 0/6000000)"},
+		{"before the redo point", lsnTarget(0x1000000), "", "before the backup's redo point"},
+		{"time target", RecoveryTarget{Kind: RecoveryTargetTime, Time: time.Now(), Timeline: "current"}, "gap at 0/5000000 on timeline 1", ""},
+		{"immediate", RecoveryTarget{Kind: RecoveryTargetImmediate, Timeline: "current"}, "", ""},
+		{"forked after the redo point", RecoveryTarget{Kind: RecoveryTargetLatest, Timeline: "2"}, "", ""},
+		{"forked before the redo point", RecoveryTarget{Kind: RecoveryTargetLatest, Timeline: "3"}, "", "before the backup's redo point"},
+		{"timeline 2 ends at 0/4000000", RecoveryTarget{Kind: RecoveryTargetLsn, Lsn: 0x4000000, Timeline: "2"}, "", "past the end of the archive on timeline 2"},
+		{"no history", RecoveryTarget{Kind: RecoveryTargetLatest, Timeline: "4"}, "", "00000004.history"},
+	} {
+		warning, err := wm.CheckRestoreContinuity(tc.target, 1, redo)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: %v, want error %q", tc.name, err, tc.err)
+		}
+		if tc.warning == "" && warning != "" || !strings.Contains(warning, tc.warning) {
+			t.Errorf("%s: warning %q, want %q", tc.name, warning, tc.warning)
+		}
+	}
+}
+
+// 1GB segments: a target in the last segment before a missing one is fine, one in the missing one isn't
+func TestCheckRestoreContinuityLargeSegments(t *testing.T) {
+	wm := newContinuityTestManager(t, gb1, nil,
+		"000000010000000000000003", "000000010000000100000000", "000000010000000100000002")
+	target := RecoveryTarget{Kind: RecoveryTargetLsn, Inclusive: true, Action: RecoveryActionPromote}
+	for lsn, wantErr := range map[uint64]bool{
+		3*gb1 + 0x28: false,
+		0x13FFFFFFF:  false, // last byte of 000000010000000100000000
+		0x140000000:  true,
+		0x180000028:  true,
+	} {
+		target.Lsn = lsn
+		if _, err := wm.CheckRestoreContinuity(target, 1, 3*gb1+0x28); (err != nil) != wantErr {
+			t.Errorf("target %s: %v", FormatLsn(lsn), err)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+/*
+- client side encryption of finished segments and base backups, so the archive can leave this machine
+- envelope encryption: every file gets its own random AES-256 data key, the data is AES-256-GCM in 64 KiB chunks
+  and the data key is stored in the file's header wrapped (AES-256-GCM again) by a master key
+- master keys come from wal_encryption_key_file (one "<key id> <base64 key>" per line) or wal_encryption_key (base64),
+  wal_encryption_key_id picks the one new files are encrypted with, by default the last line of the file
+- the header names the master key, so old files keep decrypting as long as their key is still in the key file
+- rotating a key only changes the header of each file (the wrapped data key), the data itself isn't re-encrypted.
+  the object is copied with the new header and put over the old one, never overwritten in place
+  (the header is the only copy of the data key, a torn write would make the file undecryptable with any key)
+- each chunk's nonce carries its number and a last chunk flag, so reordered, dropped or cut off chunks fail to decrypt
+*/
+
+const (
+	encryptedSuffix = ".enc"
+
+	envelopeMagic   = "PGWE"
+	envelopeVersion = 1
+	maxKeyIDLen     = 64
+	masterKeySize   = 32
+	encChunkSize    = 64 << 10
+	noncePrefixSize = 7 // + 4 byte chunk counter + 1 byte last chunk flag = the 12 byte GCM nonce
+
+	// magic, version, key id length, key id (padded), wrap nonce, wrapped data key, nonce prefix
+	envelopeHeaderSize = len(envelopeMagic) + 1 + 1 + maxKeyIDLen + 12 + masterKeySize + 16 + noncePrefixSize
+)
+
+// one master key
+type EncryptionKey struct {
+	ID   string
+	aead cipher.AEAD
+}
+
+// every master key we know, Active is the one new files are encrypted with
+type KeyRing struct {
+	Active *EncryptionKey
+	keys   map[string]*EncryptionKey
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (kr *KeyRing) add(id string, encoded string) error {
+	if id == "" || len(id) > maxKeyIDLen {
+		return fmt.Errorf("key id %q must be 1 to %d characters", id, maxKeyIDLen)
+	}
+	if _, dup := kr.keys[id]; dup {
+		return fmt.Errorf("key id %q is there twice", id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("key %q isn't valid base64: %w", id, err)
+	}
+	if len(raw) != masterKeySize {
+		return fmt.Errorf("key %q is %d bytes, it has to be %d (openssl rand -base64 32)", id, len(raw), masterKeySize)
+	}
+	aead, err := newGCM(raw)
+	if err != nil {
+		return err
+	}
+	kr.keys[id] = &EncryptionKey{ID: id, aead: aead}
+	return nil
+}
+
+// builds the key ring from app.env, nil (and no error) when no key is configured and nothing gets encrypted
+func LoadKeyRing(appConfig *AppConfig) (*KeyRing, error) {
+	if appConfig.EncryptionKeyFile == "" && appConfig.EncryptionKey == "" {
+		if appConfig.EncryptionKeyID != "" {
+			return nil, fmt.Errorf("wal_encryption_key_id is set but there's no wal_encryption_key_file or wal_encryption_key")
+		}
+		return nil, nil
+	}
+
+	kr := &KeyRing{keys: map[string]*EncryptionKey{}}
+	last := ""
+	if appConfig.EncryptionKeyFile != "" {
+		data, err := os.ReadFile(appConfig.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		if info, err := os.Stat(appConfig.EncryptionKeyFile); err == nil && info.Mode().Perm()&0077 != 0 {
+			log.Printf("Warning: key file %s can be read by other users (mode %v), chmod 600 it", appConfig.EncryptionKeyFile, info.Mode().Perm())
+		}
+
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s line %d: expected \"<key id> <base64 key>\"", appConfig.EncryptionKeyFile, i+1)
+			}
+			if err := kr.add(fields[0], fields[1]); err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", appConfig.EncryptionKeyFile, i+1, err)
+			}
+			last = fields[0]
+		}
+	}
+
+	if appConfig.EncryptionKey != "" {
+		id := appConfig.EncryptionKeyID
+		if id == "" {
+			id = "env"
+		}
+		if _, inFile := kr.keys[id]; !inFile {
+			if err := kr.add(id, appConfig.EncryptionKey); err != nil {
+				return nil, fmt.Errorf("wal_encryption_key: %w", err)
+			}
+		}
+		last = id
+	}
+
+	active := appConfig.EncryptionKeyID
+	if active == "" {
+		active = last
+	}
+	if kr.Active = kr.keys[active]; kr.Active == nil {
+		return nil, fmt.Errorf("wal_encryption_key_id %q isn't in the key file", active)
+	}
+	return kr, nil
+}
+
+// the clear text start of every encrypted file
+type envelopeHeader struct {
+	KeyID       string
+	wrapNonce   []byte
+	wrappedKey  []byte
+	noncePrefix []byte
+}
+
+func (h envelopeHeader) marshal() []byte {
+	b := make([]byte, 0, envelopeHeaderSize)
+	b = append(b, envelopeMagic...)
+	b = append(b, envelopeVersion, byte(len(h.KeyID)))
+	id := make([]byte, maxKeyIDLen)
+	copy(id, h.KeyID)
+	b = append(b, id...)
+	b = append(b, h.wrapNonce...)
+	b = append(b, h.wrappedKey...)
+	return append(b, h.noncePrefix...)
+}
+
+func parseEnvelopeHeader(b []byte) (envelopeHeader, error) {
+	var h envelopeHeader
+	if len(b) != envelopeHeaderSize || string(b[:len(envelopeMagic)]) != envelopeMagic {
+		return h, fmt.Errorf("not an encrypted file")
+	}
+	b = b[len(envelopeMagic):]
+	if b[0] != envelopeVersion {
+		return h, fmt.Errorf("unsupported encryption format version %d", b[0])
+	}
+	idLen := int(b[1])
+	if idLen == 0 || idLen > maxKeyIDLen {
+		return h, fmt.Errorf("invalid key id length %d", idLen)
+	}
+	b = b[2:]
+	h.KeyID = string(b[:idLen])
+	b = b[maxKeyIDLen:]
+	h.wrapNonce, b = b[:12], b[12:]
+	h.wrappedKey, b = b[:masterKeySize+16], b[masterKeySize+16:]
+	h.noncePrefix = b
+	return h, nil
+}
+
+func readEnvelopeHeader(r io.Reader) (envelopeHeader, error) {
+	buf := make([]byte, envelopeHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return envelopeHeader{}, fmt.Errorf("reading encryption header: %w", err)
+	}
+	return parseEnvelopeHeader(buf)
+}
+
+// the key id is the additional data, a header can't be relabelled to another key
+func (k *EncryptionKey) wrap(dataKey []byte) ([]byte, []byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, k.aead.Seal(nil, nonce, dataKey, []byte(k.ID)), nil
+}
+
+// the data cipher of a file, from the master key its header names
+func (kr *KeyRing) unwrap(h envelopeHeader) (cipher.AEAD, error) {
+	if kr == nil {
+		return nil, fmt.Errorf("encrypted with key %q but no wal_encryption_key is configured", h.KeyID)
+	}
+	k := kr.keys[h.KeyID]
+	if k == nil {
+		return nil, fmt.Errorf("encrypted with key %q which isn't in the key file", h.KeyID)
+	}
+	dataKey, err := k.aead.Open(nil, h.wrapNonce, h.wrappedKey, []byte(h.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("data key doesn't unwrap with key %q, the key or the header is wrong", h.KeyID)
+	}
+	return newGCM(dataKey)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// starts an encrypted file on w under a fresh data key. Close writes the last chunk, it doesn't close w
+func (k *EncryptionKey) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	dataKey := make([]byte, masterKeySize)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapNonce, wrapped, err := k.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := envelopeHeader{KeyID: k.ID, wrapNonce: wrapNonce, wrappedKey: wrapped, noncePrefix: prefix}
+	if _, err := w.Write(header.marshal()); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data comes, the last one has to be marked as such
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(encChunkSize-len(e.buf), len(p))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	out := e.aead.Seal(nil, chunkNonce(e.prefix, e.counter, last), e.buf, nil)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+// reads an encrypted file, returns the decrypted stream and the id of the key it was encrypted with
+// a file that was cut short or changed fails with an error instead of returning less or different data
+func (kr *KeyRing) NewReader(r io.Reader) (io.Reader, string, error) {
+	h, err := readEnvelopeHeader(r)
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := kr.unwrap(h)
+	if err != nil {
+		return nil, h.KeyID, err
+	}
+	return &decryptReader{
+		r:      bufio.NewReaderSize(r, encChunkSize+aead.Overhead()),
+		aead:   aead,
+		prefix: h.noncePrefix,
+		chunk:  make([]byte, encChunkSize+aead.Overhead()),
+	}, h.KeyID, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	last := false
+	switch {
+	case err == io.EOF:
+		return fmt.Errorf("encrypted data ends before its last chunk: %w", io.ErrUnexpectedEOF)
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, peekErr := d.r.Peek(1); peekErr == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.prefix, d.counter, last), d.chunk[:n], nil)
+	if err != nil {
+		return fmt.Errorf("chunk %d doesn't decrypt, the file is corrupt or truncated", d.counter)
+	}
+	d.counter++
+	d.plain, d.done = plain, last
+	return nil
+}
+
+// re-wraps an encrypted object's data key with the active key. only the header changes
+// returns false if the object already uses the active key
+func (kr *KeyRing) RewrapObject(store ArchiveStore, name string) (bool, error) {
+	r, err := store.Get(name)
+	if err != nil {
+		return false, err
+	}
+	h, err := readEnvelopeHeader(r)
+	r.Close()
+	if err != nil {
+		return false, err
+	}
+	if h.KeyID == kr.Active.ID {
+		return false, nil
+	}
+	old := kr.keys[h.KeyID]
+	if old == nil {
+		return false, fmt.Errorf("encrypted with key %q which isn't in the key file", h.KeyID)
+	}
+	dataKey, err := old.aead.Open(nil, h.wrapNonce, h.wrappedKey, []byte(h.KeyID))
+	if err != nil {
+		return false, fmt.Errorf("data key doesn't unwrap with key %q", h.KeyID)
+	}
+
+	h.KeyID = kr.Active.ID
+	if h.wrapNonce, h.wrappedKey, err = kr.Active.wrap(dataKey); err != nil {
+		return false, err
+	}
+	return true, rewriteObjectHeader(store, name, h.marshal())
+}
+
+// re-wraps every encrypted segment and base backup with the active key
+// the catalog picks up the new key ids on the next sync. returns how many objects were re-wrapped
+func (wm *WalManager) RotateEncryptionKeys() (int, error) {
+	if wm.Keys == nil {
+		return 0, fmt.Errorf("no wal_encryption_key_file or wal_encryption_key configured")
+	}
+	wm.syncMu.Lock()
+	defer wm.syncMu.Unlock()
+
+	objs, err := wm.Archive.List("")
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := 0
+	var errs []error
+	for _, obj := range objs {
+		file, ok := ParseArchivedWalName(obj.Name)
+		if !ok || !file.Encrypted {
+			continue
+		}
+		changed, err := wm.Keys.RewrapObject(wm.Archive, obj.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", obj.Name, err))
+			continue
+		}
+		if !changed {
+			continue
+		}
+		rewrapped++
+		// the copy kept size and mtime (where the store keeps mtimes), so the cached check stays valid but has to be catalogued again
+		if v, ok := wm.validated[obj.Name]; ok {
+			v.keyID = wm.Keys.Active.ID
+			wm.validated[obj.Name] = v
+		}
+		delete(wm.catalogued, file.Segment)
+	}
+
+	backups, err := wm.Backups.List("")
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, obj := range backups {
+		if !strings.HasSuffix(obj.Name, encryptedSuffix) {
+			continue
+		}
+		changed, err := wm.Keys.RewrapObject(wm.Backups, obj.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %w", backupsPrefix, obj.Name, err))
+		} else if changed {
+			rewrapped++
+		}
+	}
+	return rewrapped, errors.Join(errs...)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testKey(b byte, size int) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, size))
+}
+
+// a key ring from a key file with these lines, active is wal_encryption_key_id
+func testKeyFileRing(t *testing.T, active string, lines ...string) (*KeyRing, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadKeyRing(&AppConfig{EncryptionKeyFile: path, EncryptionKeyID: active})
+}
+
+func encryptBytes(t *testing.T, key *EncryptionKey, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := key.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptBytes(keys *KeyRing, data []byte) ([]byte, error) {
+	r, _, err := keys.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// offset of the n-th sealed chunk in an encrypted file
+func chunkOffset(n int) int {
+	return envelopeHeaderSize + n*(encChunkSize+16)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	keys := testKeyRing(t)
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 100} {
+		data := make([]byte, size)
+		rand.Read(data)
+		enc := encryptBytes(t, keys.Active, data)
+
+		// the last chunk is sealed even when it's empty, so every file has at least one
+		chunks := max((size+encChunkSize-1)/encChunkSize, 1)
+		if len(enc) != envelopeHeaderSize+size+chunks*16 {
+			t.Errorf("%d bytes: encrypted to %d bytes, want %d chunks", size, len(enc), chunks)
+		}
+		if size > 16 && bytes.Contains(enc, data[:16]) {
+			t.Errorf("%d bytes: plain text in the encrypted file", size)
+		}
+
+		r, keyID, err := keys.NewReader(bytes.NewReader(enc))
+		if err != nil || keyID != "k1" {
+			t.Fatalf("%d bytes: %q, %v", size, keyID, err)
+		}
+		// small reads cross the chunk boundaries
+		var got bytes.Buffer
+		if _, err := io.CopyBuffer(&got, struct{ io.Reader }{r}, make([]byte, 1000)); err != nil || !bytes.Equal(got.Bytes(), data) {
+			t.Errorf("%d bytes: decrypted %d bytes, %v", size, got.Len(), err)
+		}
+	}
+}
+
+func TestEncryptionDataKeysDiffer(t *testing.T) {
+	keys := testKeyRing(t)
+	data := bytes.Repeat([]byte("same segment "), 1000)
+	a, b := encryptBytes(t, keys.Active, data), encryptBytes(t, keys.Active, data)
+	if bytes.Equal(a[envelopeHeaderSize:], b[envelopeHeaderSize:]) {
+		t.Error("the same data encrypted twice gives the same cipher text")
+	}
+}
+
+func TestDecryptRejectsChangedData(t *testing.T) {
+	keys := testKeyRing(t)
+	data := make([]byte, 2*encChunkSize+100)
+	rand.Read(data)
+	enc := encryptBytes(t, keys.Active, data)
+
+	for what, off := range map[string]int{
+		"key id":            len(envelopeMagic) + 2,
+		"wrapped data key":  len(envelopeMagic) + 2 + maxKeyIDLen + 12 + 3,
+		"nonce prefix":      envelopeHeaderSize - 1,
+		"first chunk":       chunkOffset(0) + 10,
+		"second chunk tag":  chunkOffset(2) - 1,
+		"last chunk":        chunkOffset(2) + 50,
+		"last byte of file": len(enc) - 1,
+	} {
+		changed := bytes.Clone(enc)
+		changed[off] ^= 0x01
+		if got, err := decryptBytes(keys, changed); err == nil {
+			t.Errorf("%s changed: decrypted %d bytes without an error", what, len(got))
+		}
+	}
+}
+
+func TestDecryptRejectsTruncation(t *testing.T) {
+	keys := testKeyRing(t)
+	data := make([]byte, 3*encChunkSize+100)
+	rand.Read(data)
+	enc := encryptBytes(t, keys.Active, data)
+
+	for _, n := range []int{
+		chunkOffset(3),     // last chunk dropped, cut exactly at a chunk boundary
+		chunkOffset(1),     // only the first chunk left
+		chunkOffset(3) + 5, // last chunk cut short
+		envelopeHeaderSize, // header only
+		envelopeHeaderSize - 1,
+		len(enc) - 1,
+	} {
+		if got, err := decryptBytes(keys, enc[:n]); err == nil {
+			t.Errorf("cut to %d of %d bytes: decrypted %d bytes without an error", n, len(enc), len(got))
+		}
+	}
+
+	// the reader returns what it verified so far, then the error
+	r, _, _ := keys.NewReader(bytes.NewReader(enc[:chunkOffset(3)]))
+	got, err := io.ReadAll(r)
+	if err == nil || !strings.Contains(err.Error(), "chunk 2 doesn't decrypt") || !bytes.Equal(got, data[:2*encChunkSize]) {
+		t.Errorf("cut at the last chunk: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestDecryptRejectsReorderedChunks(t *testing.T) {
+	keys := testKeyRing(t)
+	data := make([]byte, 3*encChunkSize+100)
+	rand.Read(data)
+	enc := encryptBytes(t, keys.Active, data)
+
+	swapped := bytes.Clone(enc)
+	first, second := swapped[chunkOffset(0):chunkOffset(1)], swapped[chunkOffset(1):chunkOffset(2)]
+	tmp := bytes.Clone(first)
+	copy(first, second)
+	copy(second, tmp)
+	if _, err := decryptBytes(keys, swapped); err == nil || !strings.Contains(err.Error(), "chunk 0") {
+		t.Errorf("swapped chunks: %v", err)
+	}
+
+	// a chunk from another file encrypted with the same master key
+	other := encryptBytes(t, keys.Active, data)
+	mixed := bytes.Clone(enc)
+	copy(mixed[chunkOffset(1):chunkOffset(2)], other[chunkOffset(1):chunkOffset(2)])
+	if _, err := decryptBytes(keys, mixed); err == nil {
+		t.Error("chunk from another file accepted")
+	}
+}
+
+func TestDecryptNeedsTheRightKey(t *testing.T) {
+	keys := testKeyRing(t)
+	enc := encryptBytes(t, keys.Active, []byte("segment"))
+
+	if _, err := decryptBytes(nil, enc); err == nil || !strings.Contains(err.Error(), "no wal_encryption_key is configured") {
+		t.Errorf("no key ring: %v", err)
+	}
+	other, err := testKeyFileRing(t, "", "k2 "+testKey(2, masterKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptBytes(other, enc); err == nil || !strings.Contains(err.Error(), `key "k1" which isn't in the key file`) {
+		t.Errorf("key not in the ring: %v", err)
+	}
+	// the right id with different key material
+	wrong, _ := testKeyFileRing(t, "", "k1 "+testKey(2, masterKeySize))
+	if _, err := decryptBytes(wrong, enc); err == nil || !strings.Contains(err.Error(), "doesn't unwrap") {
+		t.Errorf("wrong key under the same id: %v", err)
+	}
+	if _, err := decryptBytes(keys, []byte("plain WAL, not encrypted at all, long enough to fill a header"+strings.Repeat(".", envelopeHeaderSize))); err == nil {
+		t.Error("plain data accepted as encrypted")
+	}
+}
+
+func TestRewrapObjectOnlyChangesTheHeader(t *testing.T) {
+	k1, k2 := "k1 "+testKey(1, masterKeySize), "k2 "+testKey(2, masterKeySize)
+	oldRing, err := testKeyFileRing(t, "k1", k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := testKeyFileRing(t, "k2", k1, k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOnly, err := testKeyFileRing(t, "", k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 2*encChunkSize+100)
+	rand.Read(data)
+	enc := encryptBytes(t, oldRing.Active, data)
+	modTime := time.Unix(1714564800, 0)
+	for _, store := range []ArchiveStore{NewMemoryArchiveStore(), newTestLocalStore(t)} {
+		if err := putObject(store, "seg.enc", modTime, bytes.NewReader(enc)); err != nil {
+			t.Fatal(err)
+		}
+
+		changed, err := rotated.RewrapObject(store, "seg.enc")
+		if err != nil || !changed {
+			t.Fatalf("%T: RewrapObject = %v, %v", store, changed, err)
+		}
+		rewrapped, _ := readObject(store, "seg.enc")
+		if len(rewrapped) != len(enc) || !bytes.Equal(rewrapped[envelopeHeaderSize-noncePrefixSize:], enc[envelopeHeaderSize-noncePrefixSize:]) {
+			t.Errorf("%T: more than the wrapped key changed", store)
+		}
+		h, _ := parseEnvelopeHeader(rewrapped[:envelopeHeaderSize])
+		if h.KeyID != "k2" {
+			t.Errorf("%T: header names key %q", store, h.KeyID)
+		}
+		if obj, err := store.Stat("seg.enc"); err != nil || !obj.ModTime.Equal(modTime) {
+			t.Errorf("%T: mtime after the rewrap %v, %v", store, obj.ModTime, err)
+		}
+
+		if got, err := decryptBytes(newOnly, rewrapped); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%T: doesn't decrypt with only the new key: %v", store, err)
+		}
+		if _, err := decryptBytes(oldRing, rewrapped); err == nil {
+			t.Errorf("%T: still decrypts with the old key only", store)
+		}
+
+		// already on the active key
+		if changed, err := rotated.RewrapObject(store, "seg.enc"); err != nil || changed {
+			t.Errorf("%T: second RewrapObject = %v, %v", store, changed, err)
+		}
+		// the old key is gone from the ring
+		putObject(store, "old.enc", modTime, bytes.NewReader(enc))
+		if _, err := newOnly.RewrapObject(store, "old.enc"); err == nil {
+			t.Errorf("%T: rewrapped without the old key", store)
+		}
+	}
+}
+
+func newTestLocalStore(t *testing.T) *LocalArchiveStore {
+	t.Helper()
+	store, err := NewLocalArchiveStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	k1, k2 := "k1 "+testKey(1, masterKeySize), "k2 "+testKey(2, masterKeySize)
+
+	kr, err := testKeyFileRing(t, "", "# rotated 2024-05", k1, "", k2)
+	if err != nil || kr.Active.ID != "k2" || len(kr.keys) != 2 {
+		t.Fatalf("two keys: %+v, %v", kr, err)
+	}
+	if kr, err := testKeyFileRing(t, "k1", k1, k2); err != nil || kr.Active.ID != "k1" {
+		t.Errorf("wal_encryption_key_id=k1: %+v, %v", kr, err)
+	}
+
+	for what, tc := range map[string]struct {
+		active string
+		lines  []string
+		want   string
+	}{
+		"short key":      {"", []string{"k1 " + testKey(1, 16)}, "is 16 bytes, it has to be 32"},
+		"long key":       {"", []string{"k1 " + testKey(1, 33)}, "is 33 bytes"},
+		"duplicate id":   {"", []string{k1, "k1 " + testKey(2, masterKeySize)}, `line 2: key id "k1" is there twice`},
+		"not base64":     {"", []string{"k1 not!base64"}, "isn't valid base64"},
+		"missing key":    {"", []string{"k1"}, "line 1: expected"},
+		"long id":        {"", []string{strings.Repeat("x", maxKeyIDLen+1) + " " + testKey(1, masterKeySize)}, "must be 1 to 64 characters"},
+		"unknown active": {"k3", []string{k1, k2}, `"k3" isn't in the key file`},
+	} {
+		if _, err := testKeyFileRing(t, tc.active, tc.lines...); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: %v, want %q", what, err, tc.want)
+		}
+	}
+
+	// a single key from the environment
+	kr, err = LoadKeyRing(&AppConfig{EncryptionKey: testKey(3, masterKeySize)})
+	if err != nil || kr.Active.ID != "env" {
+		t.Errorf("wal_encryption_key: %+v, %v", kr, err)
+	}
+	if _, err := LoadKeyRing(&AppConfig{EncryptionKey: testKey(3, 31)}); err == nil {
+		t.Error("31 byte wal_encryption_key accepted")
+	}
+	if kr, err := LoadKeyRing(&AppConfig{}); kr != nil || err != nil {
+		t.Errorf("nothing configured: %+v, %v", kr, err)
+	}
+	if _, err := LoadKeyRing(&AppConfig{EncryptionKeyID: "k1"}); err == nil {
+		t.Error("wal_encryption_key_id without a key accepted")
+	}
+}
+
+// a store whose puts fail after some bytes, like a full disk
+type failingPutStore struct {
+	ArchiveStore
+	after int
+}
+
+type failingWriter struct {
+	ArchiveWriter
+	left int
+}
+
+func (s failingPutStore) Put(name string, modTime time.Time) (ArchiveWriter, error) {
+	w, err := s.ArchiveStore.Put(name, modTime)
+	return &failingWriter{ArchiveWriter: w, left: s.after}, err
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		n, _ := w.ArchiveWriter.Write(p[:w.left])
+		w.left = 0
+		return n, syscall.ENOSPC
+	}
+	w.left -= len(p)
+	return w.ArchiveWriter.Write(p)
+}
+
+func TestRewrapObjectFailureKeepsTheOldObject(t *testing.T) {
+	k1, k2 := "k1 "+testKey(1, masterKeySize), "k2 "+testKey(2, masterKeySize)
+	oldRing, _ := testKeyFileRing(t, "k1", k1)
+	rotated, _ := testKeyFileRing(t, "k2", k1, k2)
+
+	data := make([]byte, 2*encChunkSize)
+	rand.Read(data)
+	enc := encryptBytes(t, oldRing.Active, data)
+	local := newTestLocalStore(t)
+	if err := putObject(local, "seg.enc", time.Time{}, bytes.NewReader(enc)); err != nil {
+		t.Fatal(err)
+	}
+
+	// fails in the middle of the header and in the middle of the data
+	for _, after := range []int{envelopeHeaderSize / 2, envelopeHeaderSize + 1000} {
+		if _, err := rotated.RewrapObject(failingPutStore{local, after}, "seg.enc"); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("failing after %d bytes: %v", after, err)
+		}
+		stored, _ := readObject(local, "seg.enc")
+		if !bytes.Equal(stored, enc) {
+			t.Fatalf("failing after %d bytes: object changed", after)
+		}
+		if got, err := decryptBytes(oldRing, stored); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("failing after %d bytes: no longer decrypts: %v", after, err)
+		}
+	}
+	if objs, _ := local.List(""); len(objs) != 1 {
+		t.Errorf("objects after the failed rewraps: %v", objs)
+	}
+	if entries, _ := os.ReadDir(local.root); len(entries) != 1 {
+		t.Errorf("files left behind: %v", entries)
+	}
+}
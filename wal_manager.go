@@ -4,45 +4,122 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
+	"maps"
+	"slices"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 )
 
 // handles scanning and cataloging WAL files
+// WAL is captured into ArchiveDir and kept in Archive. with the default local store they're the same directory,
+// otherwise finished segments are moved from one to the other (ingestSpool), .partial ones always stay in ArchiveDir
 type WalManager struct {
-	ArchiveDir string
-	DbConn     *pgx.Conn
+	ArchiveDir       string
+	Archive          ArchiveStore // the WAL archive, names are file names like 000000010000000000000001.gz
+	Backups          ArchiveStore // base backups, see backup_archive.go
+	Catalog          CatalogStore
+	WalSegmentSize   uint64   // bytes per segment, see ResolveArchiveInfo
+	SystemIdentifier uint64   // cluster the archive belongs to
+	ServerVersion    int      // major version of the primary
+	Compression      string   // codec finished plain segments get compressed with, empty leaves them alone
+	Keys             *KeyRing // finished segments get encrypted with its active key, nil leaves them in the clear
+
+	// held while the catalog is written from the archive (SyncWalFiles, ApplyCatalogDiff)
+	syncMu sync.Mutex
+
+	// header check results and checksums for finished segments, so each file is only read once
+	validated map[string]walValidation
+	// file state last written to the catalog per segment, so unchanged files never reach it
+	catalogued map[string]catalogState
+
+	lastGapCount int // gaps found by the last continuity check, so new ones are only logged once
+
+	spool          ArchiveStore // ArchiveDir as a store
+	spoolIsArchive bool         // ArchiveDir is where Archive keeps its objects, nothing needs moving
+
+	rewritesPaused int // restores in progress, they read segments by name (guarded by syncMu)
+}
+
+// header check result and content checksum for one finished segment
+type walValidation struct {
+	size        int64 // file size and mtime on disk, the cache key
+	modTime     time.Time
+	err         error
+	checksum    string // hex SHA-256 of the decompressed content, empty if the file couldn't be read
+	logicalSize int64  // decompressed size
+	keyID       string // master key of an encrypted segment
+}
+
+// what a segment's file looked like when it was last catalogued
+type catalogState struct {
+	size    int64
+	modTime time.Time
+	partial bool
 }
 
 // holds file and LSN info
 type WalLsnInfo struct {
-	FileName string
-	StartLSN string
+	FileName        string
+	StartLSN        string
+	EndLSN          string // first LSN of the next segment
+	ValidationError string // empty if the header checked out (or the segment is still .partial)
 }
 
 // creates & return a new manager
-// connects to primary
-func NewWalManager(archiveDir string, dsn string) (*WalManager, error) {
+// the primary is only asked about the cluster (segment size, system id, version), if it's down
+// archive_info.json and the base backup answer instead, so the catalog stays usable without it
+// store holds the archive (wal_archive/ and backups/), keys is nil without encryption
+func NewWalManager(archiveDir string, dsn string, catalog CatalogStore, store ArchiveStore, keys *KeyRing) (*WalManager, error) {
 	ctx := context.Background()
 	conn, err := pgx.Connect(ctx, dsn)
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to database: %v", err)
+		fmt.Printf("Warning: unable to connect to primary: %v\n", err)
+		conn = nil
+	} else {
+		defer conn.Close(ctx)
+	}
+
+	backups := SubStore(store, backupsPrefix)
+	archiveInfo, err := ResolveArchiveInfo(ctx, archiveDir, conn, backups, keys)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("WAL archive: PostgreSQL %d, system identifier %d, segment size %d MB\n",
+		archiveInfo.ServerVersion, archiveInfo.SystemIdentifier, archiveInfo.WalSegmentSize>>20)
+
+	spool, err := NewLocalArchiveStore(archiveDir)
+	if err != nil {
+		return nil, err
 	}
+	archive := SubStore(store, walArchivePrefix)
+	archivePath, mounted := localPath(archive, "")
+	mounted = mounted && archivePath == spool.root
 
 	return &WalManager{
-		ArchiveDir: archiveDir,
-		DbConn:     conn,
+		ArchiveDir:       archiveDir,
+		Archive:          archive,
+		Backups:          backups,
+		Catalog:          catalog,
+		WalSegmentSize:   archiveInfo.WalSegmentSize,
+		SystemIdentifier: archiveInfo.SystemIdentifier,
+		ServerVersion:    archiveInfo.ServerVersion,
+		Keys:             keys,
+		validated:        map[string]walValidation{},
+		catalogued:       map[string]catalogState{},
+		spool:            spool,
+		spoolIsArchive:   mounted,
 	}, nil
 }
 
-// Close closes the db connection
+// Close closes the catalog
 func (wm *WalManager) Close() {
-	if wm.DbConn != nil {
-		wm.DbConn.Close(context.Background())
+	if wm.Catalog != nil {
+		if err := wm.Catalog.Close(); err != nil {
+			log.Printf("Error closing WAL catalog: %v", err)
+		}
 	}
 }
 
@@ -74,134 +151,461 @@ func ParseWalFilename(filename string) (int, string, bool) {
 	return int(timeline), segmentHex, true
 }
 
-// scans the directory and updates the metadata table
-// Returns number of new/updated files
-// files ending in .partial are still being written to, we take a snapshot of these
-func (wm *WalManager) SyncWalFiles() (int, error) {
-	entries, err := os.ReadDir(wm.ArchiveDir)
+// a WAL segment found in the archive
+type archivedSegment struct {
+	name string           // name in the store, ends in .partial while pg_receivewal is still writing it
+	file ArchivedWalFile  // name taken apart
+	obj  ArchiveObject    // size and mtime when it was listed
+	rec  WalSegmentRecord // catalog record, without the header check and checksum
+}
+
+// where an archive file is read from: .partial files are always in the capture dir
+func (wm *WalManager) storeFor(name string) ArchiveStore {
+	if file, ok := ParseArchivedWalName(name); ok && file.Partial {
+		return wm.spool
+	}
+	return wm.Archive
+}
+
+// lists the WAL segments and timeline history files in the archive, and the .partial ones in the capture dir
+func (wm *WalManager) scanArchive() ([]archivedSegment, []uint32, error) {
+	entries, err := wm.Archive.List("")
 	if err != nil {
-		return 0, fmt.Errorf("failed to read archive dir: %v", err)
+		return nil, nil, fmt.Errorf("failed to list the archive: %v", err)
+	}
+	if !wm.spoolIsArchive {
+		spooled, err := wm.spool.List("")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read archive dir: %v", err)
+		}
+		for _, obj := range spooled {
+			if file, ok := ParseArchivedWalName(obj.Name); ok && file.Partial {
+				entries = append(entries, obj)
+			}
+		}
 	}
 
-	ctx := context.Background()
-	updatedCount := 0
+	// a finished name next to its .partial is a restore snapshot (SnapshotWal), not the real segment.
+	// pg_receivewal renames the .partial over it once the segment is done
+	// of two finished copies only the furthest compressed/encrypted one counts, the other is left over from the rewrite
+	partials := map[string]bool{}
+	furthest := map[string]int{}
+	for _, entry := range entries {
+		file, ok := ParseArchivedWalName(entry.Name)
+		switch {
+		case !ok:
+		case file.Partial:
+			partials[file.Segment] = true
+		default:
+			furthest[file.Segment] = max(furthest[file.Segment], file.rewriteStage())
+		}
+	}
 
+	var segments []archivedSegment
+	var historyTlis []uint32
 	for _, entry := range entries {
-		if entry.IsDir() {
+		name := entry.Name
+		if tli, ok := ParseTimelineHistoryFileName(name); ok {
+			historyTlis = append(historyTlis, tli)
 			continue
 		}
 
-		name := entry.Name()
-		isPartial := strings.HasSuffix(name, ".partial")
-		cleanName := name
-		if isPartial {
-			cleanName = strings.TrimSuffix(name, ".partial")
+		if file, ok := ParseArchivedWalName(name); ok && !file.Partial {
+			if partials[file.Segment] || file.rewriteStage() < furthest[file.Segment] {
+				continue
+			}
 		}
 
-		// Skip non-WAL files (.history, .backup, or random files)
-		// We strictly look for 24-char hex names
-		timeline, segment, valid := ParseWalFilename(cleanName)
-		if !valid {
-			continue
+		if seg, ok := wm.archivedSegmentFor(entry); ok {
+			segments = append(segments, seg)
 		}
+	}
+	return segments, historyTlis, nil
+}
 
-		info, err := entry.Info()
+// builds the catalog record for one archive file, false for anything that isn't a WAL segment
+func (wm *WalManager) archivedSegmentFor(obj ArchiveObject) (archivedSegment, bool) {
+	name := obj.Name
+	// Skip non-WAL files (.backup, or random files)
+	// We strictly look for 24-char hex names, optionally compressed and/or encrypted
+	file, valid := ParseArchivedWalName(name)
+	if !valid {
+		return archivedSegment{}, false
+	}
+	timeline, segment, _ := ParseWalFilename(file.Segment)
+
+	startLsn, endLsn, err := WalSegmentLsnRange(file.Segment, wm.WalSegmentSize)
+	if err != nil {
+		log.Printf("Skipping %s: %v", name, err)
+		return archivedSegment{}, false
+	}
+
+	rec := WalSegmentRecord{
+		FileName:      file.Segment,
+		TimelineID:    uint32(timeline),
+		SegmentNumber: segment,
+		IsPartial:     file.Partial,
+		SizeBytes:     obj.Size,
+		Compression:   file.Codec,
+		SegmentSize:   wm.WalSegmentSize,
+		StartLsn:      startLsn,
+		EndLsn:        endLsn,
+	}
+	if !file.needsStaging() {
+		rec.LogicalSize = obj.Size
+	}
+	return archivedSegment{name: name, file: file, obj: obj, rec: rec}, true
+}
+
+// scans the directory and updates the catalog
+// Returns number of new/updated files
+// files ending in .partial are still being written to, we take a snapshot of these
+func (wm *WalManager) SyncWalFiles() (int, error) {
+	// a catalog reconcile may be applying changes at the same time
+	wm.syncMu.Lock()
+	defer wm.syncMu.Unlock()
+
+	if !wm.spoolIsArchive {
+		wm.ingestSpool()
+	}
+	segments, historyTlis, err := wm.scanArchive()
+	if err != nil {
+		return 0, err
+	}
+
+	updatedCount := 0
+	for _, tli := range historyTlis {
+		changed, err := wm.syncTimelineHistory(tli)
 		if err != nil {
-			log.Printf("Error getting file info for %s: %v", name, err)
-			continue
+			log.Printf("Failed to ingest %s: %v", TimelineHistoryFileName(tli), err)
+		} else if changed {
+			updatedCount++
 		}
-		size := info.Size()
+	}
 
-		// Upsert into DB
-		query := Update_Wal_MetaData_Table()
+	count, err := wm.catalogSegments(wm.rewriteSegments(segments))
+	return updatedCount + count, err
+}
+
+// the name a finished segment should have under the current settings: compressed with wm.Compression
+// (once its header checked out, bad ones stay as they are so they can be looked at) and encrypted with wm.Keys
+// (always, nothing should stay in the clear)
+func (wm *WalManager) targetFile(file ArchivedWalFile, validation walValidation) ArchivedWalFile {
+	target := file
+	if wm.Compression != "" && !file.needsStaging() && validation.err == nil {
+		target.Codec = wm.Compression
+	}
+	if wm.Keys != nil {
+		target.Encrypted = true
+	}
+	return target
+}
+
+// moves a finished segment from src into the archive as target, the header check and checksum carry over
+// returns the segment under its new name
+func (wm *WalManager) transcode(src ArchiveStore, seg archivedSegment, target ArchivedWalFile, validation walValidation) (archivedSegment, error) {
+	var key *EncryptionKey
+	if wm.Keys != nil {
+		key = wm.Keys.Active
+	}
+	if err := transcodeSegment(src, wm.Archive, seg.name, target, key); err != nil {
+		return seg, err
+	}
+	newName := target.Name()
+	obj, err := wm.Archive.Stat(newName)
+	if err != nil {
+		return seg, err
+	}
+
+	// same content, so the header check and checksum carry over
+	validation.size, validation.modTime = obj.Size, obj.ModTime
+	if target.Encrypted && !seg.file.Encrypted {
+		validation.keyID = key.ID
+	}
+	delete(wm.validated, seg.name)
+	wm.validated[newName] = validation
+	moved, _ := wm.archivedSegmentFor(obj)
+	return moved, nil
+}
+
+// compresses and encrypts finished segments in the archive as the settings ask, returns segments with the
+// rewritten files in their place. must hold syncMu
+func (wm *WalManager) rewriteSegments(segments []archivedSegment) []archivedSegment {
+	if (wm.Compression == "" && wm.Keys == nil) || wm.rewritesPaused > 0 {
+		return segments
+	}
+
+	for i, seg := range segments {
+		if seg.rec.IsPartial {
+			continue
+		}
+		validation := wm.validateSegment(wm.Archive, seg.name, seg.obj)
+		target := wm.targetFile(seg.file, validation)
+		if target == seg.file || validation.checksum == "" {
+			continue // nothing to do, or it can't be read (logged by validateSegment)
+		}
 
-		result, err := wm.DbConn.Exec(ctx, query, cleanName, timeline, segment, isPartial, size)
+		rewritten, err := wm.transcode(wm.Archive, seg, target, validation)
 		if err != nil {
-			log.Printf("Failed to upsert WAL metadata for %s: %v", name, err)
-		} else {
-			if result.RowsAffected() > 0 {
-				updatedCount++
-			}
+			log.Printf("Failed to rewrite %s as %s: %v", seg.name, target.Name(), err)
+			continue
 		}
+		segments[i] = rewritten
+		log.Printf("WAL Sync: %s -> %s (%d -> %d bytes)", seg.name, rewritten.name, seg.obj.Size, rewritten.obj.Size)
 	}
+	return segments
+}
 
-	return updatedCount, nil
+// moves finished segments and timeline history files from the capture dir into the archive store,
+// compressed and encrypted on the way so nothing reaches the store in the clear. must hold syncMu
+// a finished name next to its .partial is a restore snapshot and stays
+func (wm *WalManager) ingestSpool() {
+	objs, err := wm.spool.List("")
+	if err != nil {
+		log.Printf("Failed to read archive dir: %v", err)
+		return
+	}
+	for _, obj := range objs {
+		if _, ok := ParseTimelineHistoryFileName(obj.Name); ok {
+			wm.ingestHistory(obj.Name)
+			continue
+		}
+		if seg, ok := wm.archivedSegmentFor(obj); ok && !seg.rec.IsPartial && !hasPartialSegment(wm.ArchiveDir, seg.rec.FileName) {
+			wm.ingestSegment(seg)
+		}
+	}
 }
 
-// returns a list of WAL files and their start LSNs
-func (wm *WalManager) GetAvailableLSNs() ([]WalLsnInfo, error) {
-	ctx := context.Background()
-	rows, err := wm.DbConn.Query(ctx, "SELECT file_name FROM wal_metadata ORDER BY file_name ASC")
+// moves one finished segment from the capture dir into the store, false if it's still in the capture dir
+func (wm *WalManager) ingestSegment(seg archivedSegment) (archivedSegment, bool) {
+	validation := wm.validateSegment(wm.spool, seg.name, seg.obj)
+	if validation.checksum == "" {
+		return seg, false // can't be read, it's logged by validateSegment and retried next pass
+	}
+	stored, err := wm.transcode(wm.spool, seg, wm.targetFile(seg.file, validation), validation)
 	if err != nil {
-		return nil, err
+		log.Printf("Failed to move %s into the archive: %v", seg.name, err)
+		return seg, false
 	}
-	defer rows.Close()
+	log.Printf("WAL Sync: archived %s as %s", seg.name, stored.name)
+	return stored, true
+}
 
-	var results []WalLsnInfo
-	for rows.Next() {
-		var filename string
-		if err := rows.Scan(&filename); err != nil {
+// history files are small and read by restores as they are, they're copied over unchanged
+func (wm *WalManager) ingestHistory(name string) {
+	obj, err := wm.spool.Stat(name)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", name, err)
+		return
+	}
+	r, err := wm.spool.Get(name)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", name, err)
+		return
+	}
+	defer r.Close()
+	if err := putObject(wm.Archive, name, obj.ModTime, r); err != nil {
+		log.Printf("Failed to move %s into the archive: %v", name, err)
+		return
+	}
+	if err := wm.spool.Delete(name); err != nil {
+		log.Printf("Failed to remove %s from the archive dir: %v", name, err)
+	}
+}
+
+// stops the monitor compressing and encrypting segments until the returned func is called
+// a restore reads segments by name, they can't be swapped for rewritten files underneath it
+// taking syncMu also waits for a pass that's rewriting right now
+func (wm *WalManager) PauseSegmentRewrites() func() {
+	wm.syncMu.Lock()
+	wm.rewritesPaused++
+	wm.syncMu.Unlock()
+
+	return func() {
+		wm.syncMu.Lock()
+		wm.rewritesPaused--
+		wm.syncMu.Unlock()
+	}
+}
+
+// writes segments to the catalog in one batch, skipping files unchanged since they were last written
+// finished segments get their header checked and a checksum, .partial ones are still being written
+// returns how many rows changed. a failed batch is all or nothing, its files are retried on the next pass
+func (wm *WalManager) catalogSegments(segments []archivedSegment) (int, error) {
+	var recs []WalSegmentRecord
+	var states []catalogState
+	for _, seg := range segments {
+		state := catalogState{size: seg.obj.Size, modTime: seg.obj.ModTime, partial: seg.rec.IsPartial}
+		if known, ok := wm.catalogued[seg.rec.FileName]; ok && known == state {
 			continue
 		}
-		lsn, err := CalculateLsnFromFilename(filename)
-		if err == nil {
-			results = append(results, WalLsnInfo{
-				FileName: filename,
-				StartLSN: lsn,
-			})
+
+		rec := seg.rec
+		if !rec.IsPartial {
+			wm.validateSegment(wm.Archive, seg.name, seg.obj).applyTo(&rec)
 		}
+		recs = append(recs, rec)
+		states = append(states, state)
 	}
-	return results, nil
+	if len(recs) == 0 {
+		return 0, nil
+	}
+
+	results, err := wm.Catalog.UpsertSegments(recs)
+	changed := 0
+	for i, result := range results {
+		switch {
+		case result.Err == errCatalogBatchRolledBack:
+			// reported once below
+		case result.Err != nil:
+			log.Printf("Failed to upsert WAL metadata for %s: %v", result.FileName, result.Err)
+		default:
+			wm.catalogued[result.FileName] = states[i]
+			if result.Changed {
+				changed++
+			}
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("catalog batch of %d segments rolled back: %w", len(recs), err)
+	}
+	return changed, nil
 }
 
-// computes the start LSN of a WAL segment
-func CalculateLsnFromFilename(filename string) (string, error) {
-	// Standard WAL file: 8 chars timeline + 16 chars segment = 24 chars
-	if len(filename) != 24 {
-		return "", fmt.Errorf("invalid filename length")
+// checks a finished segment's header and hashes its content, reusing the last result while the file is unchanged
+// a new failure is logged once, when it's first seen
+func (wm *WalManager) validateSegment(store ArchiveStore, name string, obj ArchiveObject) walValidation {
+	if cached, ok := wm.validated[name]; ok && cached.size == obj.Size && cached.modTime.Equal(obj.ModTime) {
+		return cached
 	}
-	// skip timeline (first 8)
-	segmentHex := filename[8:] // 16 chars
 
-	// Parse as uint64
-	segVal, err := strconv.ParseUint(segmentHex, 16, 64)
+	result := wm.checkSegment(store, name, obj)
+	if result.err != nil {
+		log.Printf("WAL VALIDATION FAILED for %s: %v", name, result.err)
+	}
+	wm.validated[name] = result
+	return result
+}
+
+// header check and checksum straight from the file, no caching
+// compressed and encrypted segments are decrypted and decompressed once for both
+func (wm *WalManager) checkSegment(store ArchiveStore, name string, obj ArchiveObject) walValidation {
+	result := walValidation{size: obj.Size, modTime: obj.ModTime}
+	content, err := ReadWalSegment(store, name, wm.Keys, nil)
+	result.keyID = content.KeyID
 	if err != nil {
-		return "", err
+		log.Printf("Failed to checksum %s: %v", name, err)
+		result.err = err
+		return result
 	}
 
-	logId := uint32(segVal >> 32)
-	segId := uint32(segVal & 0xFFFFFFFF)
+	file, _ := ParseArchivedWalName(name)
+	result.err = ValidateWalSegment(content, file.Segment, WalHeaderExpectation{
+		SegmentSize:      wm.WalSegmentSize,
+		SystemIdentifier: wm.SystemIdentifier,
+		ServerVersion:    wm.ServerVersion,
+	})
+	result.checksum = content.Sha256
+	result.logicalSize = content.Size
+	return result
+}
+
+// fills in the header check and checksum of a catalog record
+func (v walValidation) applyTo(rec *WalSegmentRecord) {
+	ok := v.err == nil
+	rec.HeaderValid = &ok
+	rec.ValidationError = ""
+	if v.err != nil {
+		rec.ValidationError = v.err.Error()
+	}
+	rec.Sha256 = v.checksum
+	if v.logicalSize != 0 {
+		rec.LogicalSize = v.logicalSize
+	}
+	rec.KeyID = v.keyID
+}
 
-	// Calculate LSN
-	// LSN = (logId * 4GB) + (segId * 16MB)
-	// 4GB = 0x100000000
-	// 16MB = 0x1000000
-	lsn := (uint64(logId) * 0x100000000) + (uint64(segId) * 0x1000000)
+// reads a timeline's history file and records where it forked in the catalog
+// the last line of the file is the direct parent, the lines before it are older ancestors
+func (wm *WalManager) syncTimelineHistory(tli uint32) (bool, error) {
+	history, err := LoadTimelineHistory(wm.Archive, tli)
+	if err != nil {
+		return false, err
+	}
+	if len(history) == 0 {
+		return false, fmt.Errorf("history file for timeline %d is empty", tli)
+	}
+	parent := history[len(history)-1]
 
-	// Format as X/Y (hex/hex)
-	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn&0xFFFFFFFF)), nil
+	return wm.Catalog.UpsertTimeline(TimelineRecord{
+		TLI:         tli,
+		ParentTLI:   parent.ParentTLI,
+		SwitchLsn:   parent.SwitchLsn,
+		Reason:      parent.Reason,
+		HistoryFile: TimelineHistoryFileName(tli),
+	})
 }
 
-// starts a ticker for every x seconds. it's not a stopwatch, it's a signal sender
-/*
-the loop detects that the .partial file has grown, and it updates the file_size_bytes in my database.
-When the file is eventually done (renamed), the loop detects is_partial changed from true to false and
-updates that status.
-*/
-func (wm *WalManager) RunMonitor(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// every timeline that has segments or a history file, ordered by timeline id
+func (wm *WalManager) GetTimelines() ([]TimelineInfo, error) {
+	records, err := wm.Catalog.Timelines()
+	if err != nil {
+		return nil, err
+	}
+	segments, err := wm.Catalog.Segments()
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Printf("Starting WAL Monitor on %s (Interval: %s)\n", wm.ArchiveDir, interval)
+	byTli := map[uint32]*TimelineInfo{}
+	for _, rec := range records {
+		byTli[rec.TLI] = &TimelineInfo{TLI: rec.TLI, ParentTLI: rec.ParentTLI, SwitchLsn: rec.SwitchLsn, Reason: rec.Reason, HasHistory: true}
+	}
+	// segments come sorted by file name, so the first one seen per timeline is its oldest
+	for _, seg := range segments {
+		if seg.Missing {
+			continue
+		}
+		t := byTli[seg.TimelineID]
+		if t == nil {
+			t = &TimelineInfo{TLI: seg.TimelineID}
+			byTli[seg.TimelineID] = t
+		}
+		if t.Segments == 0 {
+			t.FirstSegment = seg.FileName
+		}
+		t.LastSegment = seg.FileName
+		t.Segments++
+	}
 
-	// ticker.C is the channel the ticker uses to send the signal
-	// this means this is an infinite loop with a delay (iterval)
-	for range ticker.C {
-		count, err := wm.SyncWalFiles()
-		if err != nil {
-			log.Printf("Error syncing WAL files: %v", err)
-		} else if count > 0 {
-			log.Printf("WAL Sync: Updated/Inserted %d records", count)
+	timelines := make([]TimelineInfo, 0, len(byTli))
+	for _, tli := range slices.Sorted(maps.Keys(byTli)) {
+		timelines = append(timelines, *byTli[tli])
+	}
+	return timelines, nil
+}
+
+// returns a list of WAL files and their start/end LSNs
+func (wm *WalManager) GetAvailableLSNs() ([]WalLsnInfo, error) {
+	segments, err := wm.Catalog.Segments()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []WalLsnInfo
+	for _, seg := range segments {
+		if seg.Missing {
+			continue
+		}
+		start, end, err := WalSegmentLsnRange(seg.FileName, wm.WalSegmentSize)
+		if err == nil {
+			results = append(results, WalLsnInfo{
+				FileName:        seg.FileName,
+				StartLSN:        FormatLsn(start),
+				EndLSN:          FormatLsn(end),
+				ValidationError: seg.ValidationError,
+			})
 		}
 	}
+	return results, nil
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testSegmentSize = 1 << 20
+	testSystemID    = 7312345678901234567
+)
+
+// a key ring with one key, k1, active
+func testKeyRing(t *testing.T) *KeyRing {
+	t.Helper()
+	kr := &KeyRing{keys: map[string]*EncryptionKey{}}
+	if err := kr.add("k1", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, masterKeySize))); err != nil {
+		t.Fatal(err)
+	}
+	kr.Active = kr.keys["k1"]
+	return kr
+}
+
+// a finished PG16 segment whose long page header matches its name, the rest is filler that differs per segment
+func testSegment(tli uint32, segNo uint64) (string, []byte) {
+	data := make([]byte, testSegmentSize)
+	le := binary.LittleEndian
+	le.PutUint16(data[xlpMagic:], xlogPageMagic[16])
+	le.PutUint16(data[xlpInfo:], xlpLongHeaderFl)
+	le.PutUint32(data[xlpTli:], tli)
+	le.PutUint64(data[xlpPageAddr:], segNo*testSegmentSize)
+	le.PutUint64(data[xlpSysid:], testSystemID)
+	le.PutUint32(data[xlpSegSize:], testSegmentSize)
+	le.PutUint32(data[xlpXlogBlcksz:], 8192)
+	for i := xlpLongHdrSize; i < len(data); i++ {
+		data[i] = byte(i*int(segNo+1)) ^ byte(tli)
+	}
+	return WalFileName(tli, segNo, testSegmentSize), data
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// a WalManager capturing into a temp dir, archiving into store, with a file catalog
+func newTestWalManager(t *testing.T, store ArchiveStore, keys *KeyRing) *WalManager {
+	t.Helper()
+	dir := t.TempDir()
+	archiveDir := filepath.Join(dir, "wal_archive")
+	spool, err := NewLocalArchiveStore(archiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := OpenFileCatalogStore(filepath.Join(dir, "wal_catalog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { catalog.Close() })
+	return &WalManager{
+		ArchiveDir:       archiveDir,
+		Archive:          SubStore(store, walArchivePrefix),
+		Backups:          SubStore(store, backupsPrefix),
+		Catalog:          catalog,
+		WalSegmentSize:   testSegmentSize,
+		SystemIdentifier: testSystemID,
+		ServerVersion:    16,
+		Keys:             keys,
+		validated:        map[string]walValidation{},
+		catalogued:       map[string]catalogState{},
+		spool:            spool,
+	}
+}
+
+func writeSpoolFile(t *testing.T, wm *WalManager, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(wm.ArchiveDir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncWalFilesIngestsSpoolIntoStore(t *testing.T) {
+	mem := NewMemoryArchiveStore()
+	keys := testKeyRing(t)
+	wm := newTestWalManager(t, mem, keys)
+	wm.Compression = CompressionGzip
+
+	name1, seg1 := testSegment(1, 1)
+	name2, seg2 := testSegment(1, 2)
+	name3, seg3 := testSegment(1, 3)
+	name4, _ := testSegment(1, 4)
+	writeSpoolFile(t, wm, name1, seg1)
+	writeSpoolFile(t, wm, name2, seg2)
+	writeSpoolFile(t, wm, name3+".partial", seg3[:4096]) // still being written
+	writeSpoolFile(t, wm, name4, make([]byte, testSegmentSize))
+	writeSpoolFile(t, wm, "00000002.history", []byte("1\t0/2000000\tno recovery target specified\n"))
+
+	if _, err := wm.SyncWalFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	// finished segments and the history file moved, the .partial stays
+	left, _ := wm.spool.List("")
+	if len(left) != 1 || left[0].Name != name3+".partial" {
+		t.Errorf("left in the capture dir: %v", left)
+	}
+	for _, name := range []string{
+		"wal_archive/" + name1 + ".gz.enc",
+		"wal_archive/" + name2 + ".gz.enc",
+		"wal_archive/" + name4 + ".enc", // bad header, encrypted but not compressed
+		"wal_archive/00000002.history",
+	} {
+		if _, err := mem.Stat(name); err != nil {
+			t.Errorf("%s not in the store: %v", name, err)
+		}
+	}
+
+	var got bytes.Buffer
+	if _, err := ReadWalSegment(wm.Archive, name1+".gz.enc", keys, &got); err != nil || !bytes.Equal(got.Bytes(), seg1) {
+		t.Errorf("%s doesn't read back: %v", name1, err)
+	}
+
+	records, err := wm.Catalog.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]WalSegmentRecord{}
+	for _, rec := range records {
+		byName[rec.FileName] = rec
+	}
+	for name, data := range map[string][]byte{name1: seg1, name2: seg2} {
+		rec := byName[name]
+		if rec.Sha256 != sha256Hex(data) || rec.HeaderValid == nil || !*rec.HeaderValid ||
+			rec.Compression != CompressionGzip || rec.KeyID != "k1" || rec.LogicalSize != testSegmentSize {
+			t.Errorf("catalog record of %s: %+v", name, rec)
+		}
+	}
+	if rec := byName[name4]; rec.HeaderValid == nil || *rec.HeaderValid || rec.Compression != "" || rec.KeyID != "k1" {
+		t.Errorf("catalog record of the zero filled %s: %+v", name4, rec)
+	}
+	if rec := byName[name3]; !rec.IsPartial || rec.HeaderValid != nil {
+		t.Errorf("catalog record of %s.partial: %+v", name3, rec)
+	}
+	timelines, _ := wm.Catalog.Timelines()
+	if len(timelines) != 1 || timelines[0].TLI != 2 || timelines[0].ParentTLI != 1 {
+		t.Errorf("timelines: %+v", timelines)
+	}
+
+	// nothing new, nothing to do
+	if n, err := wm.SyncWalFiles(); err != nil || n != 0 {
+		t.Errorf("second pass = %d, %v", n, err)
+	}
+}
+
+func TestIngestSpoolKeepsRestoreSnapshots(t *testing.T) {
+	mem := NewMemoryArchiveStore()
+	wm := newTestWalManager(t, mem, nil)
+
+	name, seg := testSegment(1, 1)
+	writeSpoolFile(t, wm, name+".partial", seg)
+	writeSpoolFile(t, wm, name, seg) // SnapshotWal's copy for a restore
+	wm.ingestSpool()
+
+	if objs, _ := mem.List(walArchivePrefix); len(objs) != 0 {
+		t.Errorf("snapshot of a .partial ingested: %v", objs)
+	}
+	if _, err := os.Stat(filepath.Join(wm.ArchiveDir, name)); err != nil {
+		t.Errorf("snapshot removed from the capture dir: %v", err)
+	}
+
+	// once pg_receivewal renamed the .partial over it, it's a finished segment
+	os.Remove(filepath.Join(wm.ArchiveDir, name+".partial"))
+	wm.ingestSpool()
+	data, err := readObject(wm.Archive, name)
+	if err != nil || !bytes.Equal(data, seg) {
+		t.Errorf("%s not ingested unchanged: %v", name, err)
+	}
+	if _, err := os.Stat(filepath.Join(wm.ArchiveDir, name)); !os.IsNotExist(err) {
+		t.Errorf("%s still in the capture dir: %v", name, err)
+	}
+}
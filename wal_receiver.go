@@ -0,0 +1,781 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+/*
+- streams WAL from the primary over the replication protocol, the job pg_receivewal does in the wal_capturer container
+- IDENTIFY_SYSTEM, then START_REPLICATION SLOT ... PHYSICAL from wherever the archive ends
+- segments are written as <name>.partial and renamed once they're full, so the archive looks the same as with pg_receivewal
+- the primary only hears a flush position once the data is fsynced, the slot keeps everything after it
+- on a timeline switch the old timeline's last segment stays .partial, the new .history file is fetched and
+  streaming carries on on the new timeline
+- resumes from the LSN saved in offsets_path (see capture_offsets.go), or from the archive's contents without one
+- if the slot's restart_lsn is past where we'd resume, the primary already threw that WAL away. that's a hole
+  in the archive, so it's raised as an alert and streaming carries on from the slot
+- runs inside the CLI (wal_capture=go in app.env) or on its own with `go run . capture`
+*/
+
+const (
+	WalCaptureReceiveWal = "receivewal" // pg_receivewal in the wal_capturer container (default)
+	WalCaptureGo         = "go"         // WalReceiver inside this program
+
+	defaultSlotName       = "pitr_slot" // same default as Run_Wal_Capturer.sh
+	defaultStatusInterval = 10 * time.Second
+)
+
+// timestamps in the replication protocol are microseconds since 2000-01-01
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// what the receiver has done so far, see WalReceiver.Stats
+type WalReceiverStats struct {
+	Streaming         bool
+	Timeline          uint32
+	ReceivedLsn       uint64 // end of the last WAL written to the archive
+	FlushedLsn        uint64 // fsynced and reported to the primary
+	ServerWalEnd      uint64 // the primary's WAL end as of its last message
+	BytesReceived     uint64
+	SegmentsCompleted int
+	Reconnects        int
+	LastMessageAt     time.Time
+	LastError         string
+	Alert             string // WAL was lost, stays until the program restarts
+}
+
+type WalReceiver struct {
+	ArchiveDir     string
+	Dsn            string
+	SlotName       string
+	StatusInterval time.Duration
+	OffsetsPath    string // crash safe resume position, see capture_offsets.go
+	retry          RetryPolicy
+
+	systemID uint64
+	saved    *CaptureOffset // what's in OffsetsPath right now
+
+	mu    sync.Mutex
+	stats WalReceiverStats
+}
+
+// wal_capture from app.env, empty is pg_receivewal
+func ValidateWalCapture(mode string) error {
+	switch mode {
+	case "", WalCaptureReceiveWal, WalCaptureGo:
+		return nil
+	}
+	return fmt.Errorf("unknown wal_capture %q: must be %s or %s", mode, WalCaptureReceiveWal, WalCaptureGo)
+}
+
+func NewWalReceiver(appConfig *AppConfig, archiveDir string) *WalReceiver {
+	r := &WalReceiver{
+		ArchiveDir:     archiveDir,
+		Dsn:            appConfig.Primary.Dsn,
+		SlotName:       appConfig.SlotName,
+		StatusInterval: defaultStatusInterval,
+		OffsetsPath:    appConfig.OffsetsPath,
+		retry:          NewRetryPolicy(appConfig),
+	}
+	if r.OffsetsPath == "" {
+		r.OffsetsPath = DefaultOffsetsPath(archiveDir)
+	}
+	if r.SlotName == "" {
+		r.SlotName = defaultSlotName
+	}
+	if appConfig.StatusIntervalSeconds > 0 {
+		r.StatusInterval = time.Duration(appConfig.StatusIntervalSeconds * float64(time.Second))
+	}
+	return r
+}
+
+func (r *WalReceiver) Stats() WalReceiverStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+func (r *WalReceiver) updateStats(fn func(s *WalReceiverStats)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.stats)
+}
+
+func (s WalReceiverStats) Print() {
+	state := "disconnected"
+	if s.Streaming {
+		state = fmt.Sprintf("streaming timeline %d", s.Timeline)
+	}
+	fmt.Printf("WAL receiver: %s\n", state)
+	if s.Alert != "" {
+		fmt.Printf("  !!! %s\n", s.Alert)
+	}
+	fmt.Printf("  Received up to:     %s\n", FormatLsn(s.ReceivedLsn))
+	fmt.Printf("  Flushed up to:      %s\n", FormatLsn(s.FlushedLsn))
+	if s.ServerWalEnd != 0 {
+		fmt.Printf("  Primary WAL end:    %s (%d bytes behind)\n", FormatLsn(s.ServerWalEnd), max(int64(s.ServerWalEnd-s.ReceivedLsn), 0))
+	}
+	fmt.Printf("  Bytes received:     %d\n", s.BytesReceived)
+	fmt.Printf("  Segments completed: %d\n", s.SegmentsCompleted)
+	fmt.Printf("  Reconnects:         %d\n", s.Reconnects)
+	if !s.LastMessageAt.IsZero() {
+		fmt.Printf("  Last message:       %s ago\n", time.Since(s.LastMessageAt).Round(time.Second))
+	}
+	if s.LastError != "" {
+		fmt.Printf("  Last error:         %s\n", s.LastError)
+	}
+}
+
+// streams until ctx is cancelled, reconnecting with backoff whenever the connection drops
+func (r *WalReceiver) Run(ctx context.Context) {
+	fmt.Printf("Starting WAL receiver: slot %s -> %s\n", r.SlotName, r.ArchiveDir)
+
+	attempt := 0
+	for {
+		before := r.Stats().BytesReceived
+		err := r.stream(ctx)
+		if ctx.Err() != nil {
+			r.updateStats(func(s *WalReceiverStats) { s.Streaming = false })
+			fmt.Println("WAL receiver stopped.")
+			return
+		}
+
+		// a session that got WAL through starts the backoff over
+		if r.Stats().BytesReceived > before {
+			attempt = 0
+		}
+		wait := r.retry.delay(attempt)
+		attempt++
+		log.Printf("WAL receiver: %v, reconnecting in %s", err, wait)
+		r.updateStats(func(s *WalReceiverStats) {
+			s.Streaming = false
+			s.LastError = err.Error()
+			s.Reconnects++
+		})
+
+		select {
+		case <-ctx.Done():
+			fmt.Println("WAL receiver stopped.")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// one replication connection, from connecting until it fails or ctx is cancelled
+func (r *WalReceiver) stream(ctx context.Context) error {
+	config, err := pgconn.ParseConfig(r.Dsn)
+	if err != nil {
+		return err
+	}
+	config.RuntimeParams["replication"] = "true"
+	config.RuntimeParams["application_name"] = "pg_restore_wal_receiver"
+
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	system, err := identifySystem(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("IDENTIFY_SYSTEM: %w", err)
+	}
+	segSize, err := showWalSegmentSize(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if err := r.checkArchiveInfo(system.SystemID, segSize, conn.ParameterStatus("server_version")); err != nil {
+		return err
+	}
+	if err := createReplicationSlot(ctx, conn, r.SlotName); err != nil {
+		return fmt.Errorf("creating slot %s: %w", r.SlotName, err)
+	}
+
+	r.systemID = system.SystemID
+
+	tli, startLsn, found, err := r.resumePosition(segSize)
+	if err != nil {
+		return err
+	}
+	if found {
+		if tli, startLsn, err = r.checkSlotPosition(ctx, conn, tli, startLsn, segSize); err != nil {
+			return err
+		}
+	} else {
+		tli, startLsn = system.Timeline, system.XLogPos-system.XLogPos%segSize
+	}
+
+	w := &walSegmentWriter{dir: r.ArchiveDir, segSize: segSize}
+	defer w.Close()
+
+	for {
+		if tli > 1 {
+			if err := fetchTimelineHistory(ctx, conn, r.ArchiveDir, tli); err != nil {
+				return fmt.Errorf("TIMELINE_HISTORY %d: %w", tli, err)
+			}
+		}
+
+		next, nextLsn, err := r.streamTimeline(ctx, conn, w, tli, startLsn)
+		if err != nil {
+			return err
+		}
+
+		// the old timeline's last segment stays .partial, the new timeline rewrites it under its own name
+		if err := w.Close(); err != nil {
+			return err
+		}
+		log.Printf("WAL receiver: timeline %d ended at %s, following timeline %d", tli, FormatLsn(nextLsn), next)
+		tli, startLsn = next, nextLsn-nextLsn%segSize
+	}
+}
+
+// streams one timeline until the primary ends it, returns the next timeline and where it starts
+func (r *WalReceiver) streamTimeline(ctx context.Context, conn *pgconn.PgConn, w *walSegmentWriter, tli uint32, startLsn uint64) (uint32, uint64, error) {
+	if err := startReplication(ctx, conn, r.SlotName, tli, startLsn); err != nil {
+		return 0, 0, fmt.Errorf("START_REPLICATION on timeline %d at %s: %w", tli, FormatLsn(startLsn), err)
+	}
+	w.timeline, w.written, w.flushed = tli, startLsn, startLsn
+	r.updateStats(func(s *WalReceiverStats) {
+		s.Streaming = true
+		s.Timeline = tli
+		s.LastError = ""
+	})
+	log.Printf("WAL receiver: streaming timeline %d from %s", tli, FormatLsn(startLsn))
+
+	nextStatus := time.Now()
+	for {
+		if !time.Now().Before(nextStatus) {
+			if err := r.sendStatus(conn, w); err != nil {
+				return 0, 0, err
+			}
+			nextStatus = time.Now().Add(r.StatusInterval)
+		}
+
+		recvCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(recvCtx)
+		cancel()
+		if ctx.Err() != nil {
+			// tell the primary how far we got before going away, best effort
+			r.sendStatus(conn, w)
+			return 0, 0, ctx.Err()
+		}
+		if err != nil {
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return 0, 0, err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			replyNow, err := r.handleCopyData(w, msg.Data)
+			if err != nil {
+				return 0, 0, err
+			}
+			if replyNow {
+				nextStatus = time.Now()
+			}
+		case *pgproto3.CopyDone:
+			return endTimeline(ctx, conn)
+		case *pgproto3.ErrorResponse:
+			return 0, 0, pgconn.ErrorResponseToPgError(msg)
+		}
+	}
+}
+
+// XLogData ('w') goes to the archive, a keepalive ('k') can ask for a status update right away
+func (r *WalReceiver) handleCopyData(w *walSegmentWriter, data []byte) (bool, error) {
+	if len(data) == 0 {
+		return false, nil
+	}
+
+	switch data[0] {
+	case 'w':
+		if len(data) < 25 {
+			return false, fmt.Errorf("XLogData message too short (%d bytes)", len(data))
+		}
+		walStart := binary.BigEndian.Uint64(data[1:9])
+		serverWalEnd := binary.BigEndian.Uint64(data[9:17])
+		payload := data[25:]
+
+		completed, err := w.Write(walStart, payload)
+		if err != nil {
+			return false, err
+		}
+		r.updateStats(func(s *WalReceiverStats) {
+			s.ReceivedLsn = w.written
+			s.ServerWalEnd = serverWalEnd
+			s.BytesReceived += uint64(len(payload))
+			s.SegmentsCompleted += completed
+			s.LastMessageAt = time.Now()
+		})
+		return false, nil
+
+	case 'k':
+		if len(data) < 18 {
+			return false, fmt.Errorf("keepalive message too short (%d bytes)", len(data))
+		}
+		serverWalEnd := binary.BigEndian.Uint64(data[1:9])
+		r.updateStats(func(s *WalReceiverStats) {
+			s.ServerWalEnd = serverWalEnd
+			s.LastMessageAt = time.Now()
+		})
+		return data[17] == 1, nil
+	}
+	return false, nil
+}
+
+// standby status update. the flush position is only ever what's been fsynced, the slot lets go of WAL up to it
+func (r *WalReceiver) sendStatus(conn *pgconn.PgConn, w *walSegmentWriter) error {
+	if err := w.Sync(); err != nil {
+		return err
+	}
+	// saved first: if we crash in between, the slot is behind our offset, never ahead of it
+	if err := r.saveOffset(w.timeline, w.flushed); err != nil {
+		return fmt.Errorf("saving capture offset: %w", err)
+	}
+
+	buf := make([]byte, 34)
+	buf[0] = 'r'
+	binary.BigEndian.PutUint64(buf[1:], w.written)
+	binary.BigEndian.PutUint64(buf[9:], w.flushed)
+	binary.BigEndian.PutUint64(buf[17:], 0) // apply position, nothing is applied in an archive
+	binary.BigEndian.PutUint64(buf[25:], uint64(time.Since(pgEpoch).Microseconds()))
+	buf[33] = 0 // no reply wanted
+
+	conn.Frontend().Send(&pgproto3.CopyData{Data: buf})
+	if err := conn.Frontend().Flush(); err != nil {
+		return fmt.Errorf("sending status update: %w", err)
+	}
+	r.updateStats(func(s *WalReceiverStats) { s.FlushedLsn = w.flushed })
+	return nil
+}
+
+func (r *WalReceiver) saveOffset(tli uint32, flushed uint64) error {
+	if r.saved != nil && r.saved.Timeline == tli && r.saved.FlushedLsn == flushed {
+		return nil
+	}
+	offset := &CaptureOffset{
+		SystemIdentifier: r.systemID,
+		SlotName:         r.SlotName,
+		Timeline:         tli,
+		FlushedLsn:       flushed,
+		UpdatedAt:        time.Now(),
+	}
+	if err := SaveCaptureOffset(r.OffsetsPath, offset); err != nil {
+		return err
+	}
+	r.saved = offset
+	return nil
+}
+
+// the saved offset wins, it's exactly what was flushed. without one the archive's newest segment decides
+// streaming always starts at a segment boundary, the segment holding the offset is written again
+func (r *WalReceiver) resumePosition(segSize uint64) (uint32, uint64, bool, error) {
+	offset, err := LoadCaptureOffset(r.OffsetsPath)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if offset != nil && offset.SystemIdentifier != 0 && offset.SystemIdentifier != r.systemID {
+		return 0, 0, false, fmt.Errorf("%s belongs to system %d but the primary is %d, delete it after rebuilding the servers",
+			r.OffsetsPath, offset.SystemIdentifier, r.systemID)
+	}
+	r.saved = offset
+
+	if offset != nil && offset.Timeline != 0 {
+		return offset.Timeline, offset.FlushedLsn - offset.FlushedLsn%segSize, true, nil
+	}
+	return findStreamingStart(r.ArchiveDir, segSize)
+}
+
+// the slot keeps WAL from its restart_lsn's segment on. if that segment is past the one we resume from,
+// the WAL in between is gone from the primary and the archive will have a hole there
+// READ_REPLICATION_SLOT needs PostgreSQL 15, older servers skip the check
+func (r *WalReceiver) checkSlotPosition(ctx context.Context, conn *pgconn.PgConn, tli uint32, startLsn uint64, segSize uint64) (uint32, uint64, error) {
+	rows, err := replicationQuery(ctx, conn, "READ_REPLICATION_SLOT "+r.SlotName)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42601" { // syntax_error, the command doesn't exist yet
+		log.Printf("WAL receiver: the primary can't report the slot's restart_lsn (PostgreSQL < 15), lost WAL won't be detected")
+		return tli, startLsn, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("READ_REPLICATION_SLOT %s: %w", r.SlotName, err)
+	}
+	if len(rows) != 1 || len(rows[0]) < 3 || rows[0][1] == nil {
+		return tli, startLsn, nil // no slot or it never reserved WAL
+	}
+
+	restartLsn, err := ParseLsn(string(rows[0][1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	restartSegStart := restartLsn - restartLsn%segSize
+	if restartSegStart <= startLsn {
+		return tli, startLsn, nil
+	}
+
+	restartTli := tli
+	if rows[0][2] != nil {
+		if parsed, err := strconv.ParseUint(string(rows[0][2]), 10, 32); err == nil {
+			restartTli = uint32(parsed)
+		}
+	}
+
+	alert := fmt.Sprintf("WAL LOST: slot %s restarts at %s but capture resumes at %s, WAL %s - %s is gone from the primary. "+
+		"restores can't replay across it, take a new base backup", r.SlotName, FormatLsn(restartLsn), FormatLsn(startLsn),
+		FormatLsn(startLsn), FormatLsn(restartSegStart))
+	log.Printf("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+	log.Printf("!!! %s", alert)
+	log.Printf("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+	r.updateStats(func(s *WalReceiverStats) { s.Alert = alert })
+
+	return restartTli, restartSegStart, nil
+}
+
+// refuses to mix another cluster's WAL into the archive, and records the cluster when the archive is new
+func (r *WalReceiver) checkArchiveInfo(systemID uint64, segSize uint64, serverVersion string) error {
+	info, err := LoadArchiveInfo(r.ArchiveDir)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		info = &ArchiveInfo{}
+	}
+	saved := *info
+
+	if info.SystemIdentifier != 0 && info.SystemIdentifier != systemID {
+		return fmt.Errorf("primary has system identifier %d but the archive belongs to %d", systemID, info.SystemIdentifier)
+	}
+	if info.WalSegmentSize != 0 && info.WalSegmentSize != segSize {
+		return fmt.Errorf("primary uses %d byte WAL segments but the archive holds %d byte segments", segSize, info.WalSegmentSize)
+	}
+	info.SystemIdentifier = systemID
+	info.WalSegmentSize = segSize
+	if info.ServerVersion == 0 {
+		major, _ := strconv.Atoi(strings.SplitN(serverVersion, ".", 2)[0])
+		info.ServerVersion = major
+	}
+
+	if *info != saved {
+		return SaveArchiveInfo(r.ArchiveDir, info)
+	}
+	return nil
+}
+
+// where to pick up: the start of the newest .partial segment, or the segment after the newest finished one
+// found is false for an empty archive
+func findStreamingStart(archiveDir string, segSize uint64) (uint32, uint64, bool, error) {
+	entries, err := os.ReadDir(archiveDir)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	var bestTli uint32
+	var bestSeg uint64
+	bestPartial, found := false, false
+	for _, entry := range entries {
+		file, ok := ParseArchivedWalName(entry.Name())
+		if !ok {
+			continue
+		}
+		partial := file.Partial
+		tli, segNo, err := ParseWalSegmentNumber(file.Segment, segSize)
+		if err != nil {
+			continue
+		}
+
+		// highest segment wins, then highest timeline, then the .partial (a finished copy next to it is a restore snapshot)
+		better := !found || segNo > bestSeg ||
+			(segNo == bestSeg && (tli > bestTli || (tli == bestTli && partial && !bestPartial)))
+		if better {
+			bestTli, bestSeg, bestPartial, found = tli, segNo, partial, true
+		}
+	}
+	if !found {
+		return 0, 0, false, nil
+	}
+	if bestPartial {
+		return bestTli, bestSeg * segSize, true, nil
+	}
+	return bestTli, (bestSeg + 1) * segSize, true, nil
+}
+
+// writes streamed WAL into segment files, one open .partial at a time
+type walSegmentWriter struct {
+	dir      string
+	segSize  uint64
+	timeline uint32
+
+	f       *os.File
+	written uint64 // LSN after the last byte written
+	flushed uint64 // everything before this LSN is fsynced
+}
+
+// writes data starting at lsn, returns how many segments got finished
+func (w *walSegmentWriter) Write(lsn uint64, data []byte) (int, error) {
+	if lsn != w.written {
+		return 0, fmt.Errorf("WAL jumped from %s to %s", FormatLsn(w.written), FormatLsn(lsn))
+	}
+
+	completed := 0
+	for len(data) > 0 {
+		offset := lsn % w.segSize
+		if w.f == nil {
+			if err := w.open(lsn/w.segSize, offset); err != nil {
+				return completed, err
+			}
+		}
+
+		n := min(uint64(len(data)), w.segSize-offset)
+		if _, err := w.f.WriteAt(data[:n], int64(offset)); err != nil {
+			return completed, err
+		}
+		lsn += n
+		data = data[n:]
+		w.written = lsn
+
+		if offset+n == w.segSize {
+			if err := w.finish(); err != nil {
+				return completed, err
+			}
+			completed++
+		}
+	}
+	return completed, nil
+}
+
+// a segment is always streamed from its start, the file is sized to a full segment right away
+// (same as pg_receivewal) so a restore can use the .partial as it is
+func (w *walSegmentWriter) open(segNo uint64, offset uint64) error {
+	if offset != 0 {
+		return fmt.Errorf("received WAL at offset %d of a segment that isn't open", offset)
+	}
+	name := WalFileName(w.timeline, segNo, w.segSize) + ".partial"
+	f, err := os.OpenFile(filepath.Join(w.dir, name), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(int64(w.segSize)); err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	return nil
+}
+
+// fsync, close and rename the full segment to its final name
+func (w *walSegmentWriter) finish() error {
+	partialPath := w.f.Name()
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partialPath, strings.TrimSuffix(partialPath, ".partial")); err != nil {
+		return err
+	}
+	return syncDir(w.dir)
+}
+
+func (w *walSegmentWriter) Sync() error {
+	if w.f != nil {
+		if err := w.f.Sync(); err != nil {
+			return err
+		}
+	}
+	w.flushed = w.written
+	return nil
+}
+
+// closes the open segment, it keeps its .partial name
+func (w *walSegmentWriter) Close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.Sync()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	w.f = nil
+	return err
+}
+
+// runs a replication command that returns a single result set, returns its rows as text
+func replicationQuery(ctx context.Context, conn *pgconn.PgConn, sql string) ([][][]byte, error) {
+	results, err := conn.Exec(ctx, sql).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("%s returned %d result sets", sql, len(results))
+	}
+	return results[0].Rows, nil
+}
+
+type identifySystemResult struct {
+	SystemID uint64
+	Timeline uint32
+	XLogPos  uint64
+}
+
+func identifySystem(ctx context.Context, conn *pgconn.PgConn) (identifySystemResult, error) {
+	var result identifySystemResult
+	rows, err := replicationQuery(ctx, conn, "IDENTIFY_SYSTEM")
+	if err != nil {
+		return result, err
+	}
+	if len(rows) != 1 || len(rows[0]) < 3 {
+		return result, fmt.Errorf("unexpected result shape")
+	}
+
+	if result.SystemID, err = strconv.ParseUint(string(rows[0][0]), 10, 64); err != nil {
+		return result, fmt.Errorf("system identifier: %w", err)
+	}
+	tli, err := strconv.ParseUint(string(rows[0][1]), 10, 32)
+	if err != nil {
+		return result, fmt.Errorf("timeline: %w", err)
+	}
+	result.Timeline = uint32(tli)
+	if result.XLogPos, err = ParseLsn(string(rows[0][2])); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// SHOW works on replication connections, but reports the size with a unit (16MB)
+func showWalSegmentSize(ctx context.Context, conn *pgconn.PgConn) (uint64, error) {
+	rows, err := replicationQuery(ctx, conn, "SHOW wal_segment_size")
+	if err != nil {
+		return 0, fmt.Errorf("SHOW wal_segment_size: %w", err)
+	}
+	if len(rows) != 1 || len(rows[0]) != 1 {
+		return 0, fmt.Errorf("SHOW wal_segment_size: unexpected result shape")
+	}
+
+	value := string(rows[0][0])
+	units := map[string]uint64{"GB": 1 << 30, "MB": 1 << 20, "kB": 1 << 10, "B": 1}
+	for _, suffix := range []string{"GB", "MB", "kB", "B"} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			n, err := strconv.ParseUint(number, 10, 64)
+			if err != nil {
+				break
+			}
+			size := n * units[suffix]
+			if !IsValidWalSegmentSize(size) {
+				return 0, fmt.Errorf("invalid WAL segment size %s", value)
+			}
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("unexpected wal_segment_size %q", value)
+}
+
+// the slot makes the primary keep WAL we haven't flushed yet, an existing slot is fine
+func createReplicationSlot(ctx context.Context, conn *pgconn.PgConn, slotName string) error {
+	_, err := conn.Exec(ctx, fmt.Sprintf("CREATE_REPLICATION_SLOT %s PHYSICAL RESERVE_WAL", slotName)).ReadAll()
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42710" { // duplicate_object
+		return nil
+	}
+	return err
+}
+
+// saves timeline tli's .history file in the archive if it isn't there yet, restores need it to follow the switch
+func fetchTimelineHistory(ctx context.Context, conn *pgconn.PgConn, archiveDir string, tli uint32) error {
+	name := TimelineHistoryFileName(tli)
+	path := filepath.Join(archiveDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	rows, err := replicationQuery(ctx, conn, fmt.Sprintf("TIMELINE_HISTORY %d", tli))
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 || len(rows[0]) != 2 {
+		return fmt.Errorf("unexpected result shape")
+	}
+	if got := string(rows[0][0]); got != name {
+		return fmt.Errorf("primary sent %s, expected %s", got, name)
+	}
+
+	if err := writeFileAtomic(path, rows[0][1], 0644); err != nil {
+		return err
+	}
+	log.Printf("WAL receiver: saved %s", name)
+	return syncDir(archiveDir)
+}
+
+// sends START_REPLICATION and waits for the primary to switch to copy both mode
+func startReplication(ctx context.Context, conn *pgconn.PgConn, slotName string, tli uint32, startLsn uint64) error {
+	sql := fmt.Sprintf("START_REPLICATION SLOT %s PHYSICAL %s TIMELINE %d", slotName, FormatLsn(startLsn), tli)
+	conn.Frontend().Send(&pgproto3.Query{String: sql})
+	if err := conn.Frontend().Flush(); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.NoticeResponse, *pgproto3.ParameterStatus:
+		default:
+			return fmt.Errorf("unexpected %T", msg)
+		}
+	}
+}
+
+// the primary ended the stream. after our CopyDone it sends the next timeline and where it branched off
+func endTimeline(ctx context.Context, conn *pgconn.PgConn) (uint32, uint64, error) {
+	conn.Frontend().Send(&pgproto3.CopyDone{})
+	if err := conn.Frontend().Flush(); err != nil {
+		return 0, 0, err
+	}
+
+	var next uint32
+	var nextLsn uint64
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			if len(msg.Values) < 2 {
+				return 0, 0, fmt.Errorf("unexpected end of timeline result")
+			}
+			tli, err := strconv.ParseUint(string(msg.Values[0]), 10, 32)
+			if err != nil {
+				return 0, 0, fmt.Errorf("next timeline: %w", err)
+			}
+			if nextLsn, err = ParseLsn(string(msg.Values[1])); err != nil {
+				return 0, 0, err
+			}
+			next = uint32(tli)
+		case *pgproto3.ErrorResponse:
+			return 0, 0, pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.ReadyForQuery:
+			if next == 0 {
+				return 0, 0, fmt.Errorf("primary ended the stream without a next timeline (shutting down?)")
+			}
+			return next, nextLsn, nil
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// a replication connection to a fake primary that answers every query with answer's rows (as text),
+// nil rows answers with a syntax error
+func fakeReplicationConn(t *testing.T, answer func(sql string) [][]string) *pgconn.PgConn {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		backend := pgproto3.NewBackend(server, server)
+		if _, err := backend.ReceiveStartupMessage(); err != nil {
+			return
+		}
+		backend.Send(&pgproto3.AuthenticationOk{})
+		backend.Send(&pgproto3.ParameterStatus{Name: "server_version", Value: "16.4"})
+		backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+		backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		if backend.Flush() != nil {
+			return
+		}
+		for {
+			msg, err := backend.Receive()
+			if err != nil {
+				return
+			}
+			query, ok := msg.(*pgproto3.Query)
+			if !ok {
+				return // Terminate
+			}
+			rows := answer(query.String)
+			if rows == nil {
+				backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "syntax error"})
+			} else {
+				var fields []pgproto3.FieldDescription
+				if len(rows) > 0 {
+					for i := range rows[0] {
+						fields = append(fields, pgproto3.FieldDescription{Name: []byte(fmt.Sprintf("col%d", i)), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1})
+					}
+				}
+				backend.Send(&pgproto3.RowDescription{Fields: fields})
+				for _, row := range rows {
+					values := make([][]byte, len(row))
+					for i, v := range row {
+						values[i] = []byte(v)
+					}
+					backend.Send(&pgproto3.DataRow{Values: values})
+				}
+				backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT")})
+			}
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			if backend.Flush() != nil {
+				return
+			}
+		}
+	}()
+
+	config, err := pgconn.ParseConfig("host=primary port=5432 user=replicator sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.LookupFunc = func(ctx context.Context, host string) ([]string, error) { return []string{"127.0.0.1"}, nil }
+	config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) { return client, nil }
+	conn, err := pgconn.ConnectConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(context.Background()) })
+	return conn
+}
+
+func TestShowWalSegmentSize(t *testing.T) {
+	for value, want := range map[string]uint64{
+		"16MB":   16 << 20,
+		"1GB":    1 << 30,
+		"64MB":   64 << 20,
+		"1024kB": 1 << 20,
+		"3MB":    0, // not a power of two
+		"512kB":  0, // too small
+		"16 MB":  0,
+		"lots":   0,
+	} {
+		conn := fakeReplicationConn(t, func(sql string) [][]string {
+			if sql != "SHOW wal_segment_size" {
+				return nil
+			}
+			return [][]string{{value}}
+		})
+		got, err := showWalSegmentSize(context.Background(), conn)
+		if want == 0 {
+			if err == nil {
+				t.Errorf("%q: got %d, want an error", value, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("%q: got %d, %v, want %d", value, got, err, want)
+		}
+	}
+}
+
+func TestIdentifySystem(t *testing.T) {
+	conn := fakeReplicationConn(t, func(sql string) [][]string {
+		return [][]string{{"7312345678901234567", "3", "0/5000148", ""}}
+	})
+	got, err := identifySystem(context.Background(), conn)
+	want := identifySystemResult{SystemID: 7312345678901234567, Timeline: 3, XLogPos: 0x5000148}
+	if err != nil || got != want {
+		t.Errorf("identifySystem = %+v, %v, want %+v", got, err, want)
+	}
+}
+
+func TestCheckSlotPosition(t *testing.T) {
+	const segSize = 16 << 20
+	r := &WalReceiver{SlotName: "pitr_slot"}
+
+	// the slot still has what we need
+	conn := fakeReplicationConn(t, func(sql string) [][]string { return [][]string{{"physical", "0/3000060", "1"}} })
+	tli, lsn, err := r.checkSlotPosition(context.Background(), conn, 1, 3*segSize, segSize)
+	if err != nil || tli != 1 || lsn != 3*segSize || r.Stats().Alert != "" {
+		t.Errorf("slot at the resume segment: %d %s %v, alert %q", tli, FormatLsn(lsn), err, r.Stats().Alert)
+	}
+
+	// PostgreSQL < 15 has no READ_REPLICATION_SLOT
+	conn = fakeReplicationConn(t, func(sql string) [][]string { return nil })
+	if tli, lsn, err = r.checkSlotPosition(context.Background(), conn, 1, 3*segSize, segSize); err != nil || lsn != 3*segSize {
+		t.Errorf("old server: %d %s %v", tli, FormatLsn(lsn), err)
+	}
+
+	// the primary recycled WAL we never got: alert, and carry on from the slot
+	conn = fakeReplicationConn(t, func(sql string) [][]string { return [][]string{{"physical", "0/7000028", "2"}} })
+	tli, lsn, err = r.checkSlotPosition(context.Background(), conn, 1, 3*segSize, segSize)
+	if err != nil || tli != 2 || lsn != 7*segSize {
+		t.Errorf("lost WAL: %d %s %v, want timeline 2 at 0/7000000", tli, FormatLsn(lsn), err)
+	}
+	if alert := r.Stats().Alert; !strings.Contains(alert, "WAL LOST") || !strings.Contains(alert, "0/3000000 - 0/7000000") {
+		t.Errorf("alert = %q", alert)
+	}
+}
+
+const receiverSegSize = 1 << 20
+
+func newTestSegmentWriter(t *testing.T, startLsn uint64) *walSegmentWriter {
+	w := &walSegmentWriter{dir: t.TempDir(), segSize: receiverSegSize, timeline: 1, written: startLsn, flushed: startLsn}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func TestWalSegmentWriterAcrossSegments(t *testing.T) {
+	w := newTestSegmentWriter(t, receiverSegSize)
+	seg1 := WalFileName(1, 1, receiverSegSize)
+	seg2 := WalFileName(1, 2, receiverSegSize)
+
+	data := make([]byte, receiverSegSize+receiverSegSize/4)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	first, second := data[:600<<10], data[600<<10:]
+
+	n, err := w.Write(receiverSegSize, first)
+	if err != nil || n != 0 {
+		t.Fatalf("first write: %d, %v", n, err)
+	}
+	// the .partial is a full segment from the start, like pg_receivewal's
+	if fi, err := os.Stat(filepath.Join(w.dir, seg1+".partial")); err != nil || fi.Size() != receiverSegSize {
+		t.Fatalf("%s.partial: %v", seg1, err)
+	}
+
+	n, err = w.Write(receiverSegSize+uint64(len(first)), second)
+	if err != nil || n != 1 {
+		t.Fatalf("write across the boundary: %d segments finished, %v", n, err)
+	}
+	if w.written != receiverSegSize+uint64(len(data)) {
+		t.Errorf("written = %s", FormatLsn(w.written))
+	}
+
+	// the finished segment was renamed, the next one is open as .partial
+	got, err := os.ReadFile(filepath.Join(w.dir, seg1))
+	if err != nil || !bytes.Equal(got, data[:receiverSegSize]) {
+		t.Errorf("%s: %v", seg1, err)
+	}
+	if _, err := os.Stat(filepath.Join(w.dir, seg1+".partial")); !os.IsNotExist(err) {
+		t.Errorf("%s.partial still there: %v", seg1, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.flushed != w.written {
+		t.Errorf("flushed %s after Close, written %s", FormatLsn(w.flushed), FormatLsn(w.written))
+	}
+	got, err = os.ReadFile(filepath.Join(w.dir, seg2+".partial"))
+	if err != nil || len(got) != receiverSegSize || !bytes.Equal(got[:len(data)-receiverSegSize], data[receiverSegSize:]) {
+		t.Errorf("%s.partial: %v", seg2, err)
+	}
+}
+
+func TestWalSegmentWriterExactSegment(t *testing.T) {
+	w := newTestSegmentWriter(t, 0)
+	n, err := w.Write(0, make([]byte, 2*receiverSegSize))
+	if err != nil || n != 2 {
+		t.Fatalf("two full segments: %d finished, %v", n, err)
+	}
+	for segNo := uint64(0); segNo < 2; segNo++ {
+		if _, err := os.Stat(filepath.Join(w.dir, WalFileName(1, segNo, receiverSegSize))); err != nil {
+			t.Error(err)
+		}
+	}
+	if w.f != nil {
+		t.Error("a segment is open although nothing was written past the boundary")
+	}
+}
+
+func TestWalSegmentWriterRejectsGaps(t *testing.T) {
+	w := newTestSegmentWriter(t, receiverSegSize)
+	if _, err := w.Write(receiverSegSize, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := w.Write(receiverSegSize+100, []byte("def"))
+	if err == nil || !strings.Contains(err.Error(), "WAL jumped from 0/100003 to 0/100064") {
+		t.Errorf("write past the end = %v, want WAL jumped", err)
+	}
+
+	// a segment can only be started from its beginning
+	w = newTestSegmentWriter(t, receiverSegSize+100)
+	if _, err := w.Write(receiverSegSize+100, []byte("x")); err == nil || !strings.Contains(err.Error(), "isn't open") {
+		t.Errorf("write into the middle of an unopened segment = %v", err)
+	}
+}
+
+func xLogData(walStart, walEnd uint64, payload []byte) []byte {
+	msg := make([]byte, 25, 25+len(payload))
+	msg[0] = 'w'
+	binary.BigEndian.PutUint64(msg[1:], walStart)
+	binary.BigEndian.PutUint64(msg[9:], walEnd)
+	binary.BigEndian.PutUint64(msg[17:], uint64(time.Since(pgEpoch).Microseconds()))
+	return append(msg, payload...)
+}
+
+func keepalive(walEnd uint64, replyRequested bool) []byte {
+	msg := make([]byte, 18)
+	msg[0] = 'k'
+	binary.BigEndian.PutUint64(msg[1:], walEnd)
+	binary.BigEndian.PutUint64(msg[9:], uint64(time.Since(pgEpoch).Microseconds()))
+	if replyRequested {
+		msg[17] = 1
+	}
+	return msg
+}
+
+func TestHandleCopyData(t *testing.T) {
+	r := &WalReceiver{}
+	w := newTestSegmentWriter(t, receiverSegSize)
+
+	reply, err := r.handleCopyData(w, xLogData(receiverSegSize, 0x1800000, []byte("hello wal")))
+	if err != nil || reply {
+		t.Fatalf("XLogData: %v, %v", reply, err)
+	}
+	stats := r.Stats()
+	if stats.ReceivedLsn != receiverSegSize+9 || stats.ServerWalEnd != 0x1800000 || stats.BytesReceived != 9 || stats.LastMessageAt.IsZero() {
+		t.Errorf("stats after XLogData: %+v", stats)
+	}
+	data, _ := os.ReadFile(filepath.Join(w.dir, WalFileName(1, 1, receiverSegSize)+".partial"))
+	if !bytes.HasPrefix(data, []byte("hello wal")) {
+		t.Error("payload not written to the segment")
+	}
+
+	if reply, err := r.handleCopyData(w, keepalive(0x1900000, false)); err != nil || reply {
+		t.Errorf("keepalive: %v, %v", reply, err)
+	}
+	if r.Stats().ServerWalEnd != 0x1900000 {
+		t.Errorf("keepalive didn't update the server's WAL end")
+	}
+	if reply, err := r.handleCopyData(w, keepalive(0x1900000, true)); err != nil || !reply {
+		t.Errorf("keepalive asking for a reply: %v, %v", reply, err)
+	}
+
+	// XLogData that doesn't continue where the last one ended
+	if _, err := r.handleCopyData(w, xLogData(receiverSegSize+100, 0, []byte("x"))); err == nil {
+		t.Error("out of order XLogData accepted")
+	}
+	for _, msg := range [][]byte{xLogData(0, 0, nil)[:24], keepalive(0, false)[:17]} {
+		if _, err := r.handleCopyData(w, msg); err == nil {
+			t.Errorf("short %c message accepted", msg[0])
+		}
+	}
+	for _, msg := range [][]byte{nil, {'?', 1, 2}} {
+		if reply, err := r.handleCopyData(w, msg); err != nil || reply {
+			t.Errorf("%q: %v, %v", msg, reply, err)
+		}
+	}
+}
+
+func TestFindStreamingStart(t *testing.T) {
+	const segSize = 16 << 20
+	for _, tc := range []struct {
+		files   []string
+		tli     uint32
+		segNo   uint64
+		noStart bool
+	}{
+		{files: nil, noStart: true},
+		{files: []string{"archive_info.json", "00000002.history"}, noStart: true},
+		// after the newest finished segment
+		{files: []string{"000000010000000000000001", "000000010000000000000002"}, tli: 1, segNo: 3},
+		// at the start of the .partial
+		{files: []string{"000000010000000000000002", "000000010000000000000003.partial"}, tli: 1, segNo: 3},
+		// a finished copy next to its .partial is a restore snapshot
+		{files: []string{"000000010000000000000003", "000000010000000000000003.partial"}, tli: 1, segNo: 3},
+		// compressed and encrypted segments count
+		{files: []string{"000000010000000000000004", "000000010000000000000005.gz.enc"}, tli: 1, segNo: 6},
+		{files: []string{"000000010000000000000005.zst.partial"}, tli: 1, segNo: 5},
+		// the newest timeline wins on the same segment, a higher segment wins over the timeline
+		{files: []string{"000000010000000000000006.partial", "000000020000000000000006.partial"}, tli: 2, segNo: 6},
+		{files: []string{"000000010000000000000007", "000000020000000000000006.partial"}, tli: 1, segNo: 8},
+		// log id 1, segment 0
+		{files: []string{"0000000100000000000000FF"}, tli: 1, segNo: 0x100},
+	} {
+		dir := t.TempDir()
+		for _, name := range tc.files {
+			os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		}
+		tli, lsn, found, err := findStreamingStart(dir, segSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.noStart {
+			if found {
+				t.Errorf("%v: start at %d %s, want none", tc.files, tli, FormatLsn(lsn))
+			}
+			continue
+		}
+		if !found || tli != tc.tli || lsn != tc.segNo*segSize {
+			t.Errorf("%v: start %v at %d %s, want %d %s", tc.files, found, tli, FormatLsn(lsn), tc.tli, FormatLsn(tc.segNo*segSize))
+		}
+	}
+}
+
+// against a real server: initdb + pg_ctl a throwaway cluster, stream a switched segment into the archive
+func TestWalReceiverAgainstPostgres(t *testing.T) {
+	if testing.Short() {
+		t.Skip("short mode")
+	}
+	if _, err := exec.LookPath("pg_ctl"); err != nil {
+		t.Skip("pg_ctl not on PATH")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("initdb refuses to run as root")
+	}
+
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	archiveDir := filepath.Join(dir, "wal_archive")
+	os.Mkdir(archiveDir, 0755)
+	if out, err := exec.Command("initdb", "-D", dataDir, "-U", "postgres", "--auth=trust", "--wal-segsize=1").CombinedOutput(); err != nil {
+		t.Fatalf("initdb: %v\n%s", err, out)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	opts := fmt.Sprintf("-c port=%d -c listen_addresses='' -c unix_socket_directories=%s -c wal_level=replica -c max_wal_senders=4", port, dir)
+	if out, err := exec.Command("pg_ctl", "-D", dataDir, "-o", opts, "-w", "-l", filepath.Join(dir, "server.log"), "start").CombinedOutput(); err != nil {
+		t.Fatalf("pg_ctl start: %v\n%s", err, out)
+	}
+	t.Cleanup(func() { exec.Command("pg_ctl", "-D", dataDir, "-m", "immediate", "stop").Run() })
+
+	dsn := fmt.Sprintf("host=%s port=%d user=postgres dbname=postgres sslmode=disable", dir, port)
+	r := &WalReceiver{
+		ArchiveDir:     archiveDir,
+		Dsn:            dsn,
+		SlotName:       "test_slot",
+		StatusInterval: 200 * time.Millisecond,
+		OffsetsPath:    filepath.Join(dir, captureOffsetsFile),
+		retry:          RetryPolicy{MaxRetries: 3, Backoff: 100 * time.Millisecond},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := pgx.Connect(context.Background(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+	deadline := time.Now().Add(30 * time.Second)
+	for !r.Stats().Streaming {
+		if time.Now().After(deadline) {
+			t.Fatalf("receiver never started streaming: %+v", r.Stats())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	var switchLsn string
+	if err := conn.QueryRow(context.Background(), "SELECT pg_switch_wal()::text FROM (SELECT txid_current()) x").Scan(&switchLsn); err != nil {
+		t.Fatal(err)
+	}
+	lsn, _ := ParseLsn(switchLsn)
+	segName := WalFileName(1, lsn/receiverSegSize, receiverSegSize)
+
+	for {
+		if _, err := os.Stat(filepath.Join(archiveDir, segName)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never finished: %+v", segName, r.Stats())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	spool, _ := NewLocalArchiveStore(archiveDir)
+	content, err := ReadWalSegment(spool, segName, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateWalSegment(content, segName, WalHeaderExpectation{SegmentSize: receiverSegSize}); err != nil {
+		t.Errorf("%s: %v", segName, err)
+	}
+
+	cancel()
+	<-done
+	offset, err := LoadCaptureOffset(r.OffsetsPath)
+	if err != nil || offset == nil || offset.Timeline != 1 || offset.FlushedLsn < lsn {
+		t.Errorf("saved offset %+v, %v, want at least %s", offset, err, switchLsn)
+	}
+	info, _ := LoadArchiveInfo(archiveDir)
+	if info == nil || info.WalSegmentSize != receiverSegSize || info.SystemIdentifier == 0 {
+		t.Errorf("archive info %+v", info)
+	}
+}
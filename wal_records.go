@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"slices"
+	"time"
+)
+
+/*
+- walks the records of archived WAL just far enough to find when transactions committed or aborted
+- recovery_target_time is only ever compared against those times, so the newest one in the archive is the
+  latest time a restore can actually stop at. file mtimes say when a copy was made, not what's in it
+- records are followed through page headers, the CRC and the back link of every record are checked,
+  the walk stops at the first one that doesn't check out (the zero filled end of a .partial)
+*/
+
+// XLogRecord and page header layout, same for 13-17
+const (
+	xlogRecordHeaderSize = 24 // xl_tot_len, xl_xid, xl_prev, xl_info, xl_rmid, 2 padding, xl_crc
+	xlrTotLen            = 0
+	xlrPrev              = 8
+	xlrInfo              = 16
+	xlrRmid              = 17
+	xlrCrc               = 20
+
+	xlpShortHdrSize      = 24 // XLogPageHeaderData MAXALIGNed
+	xlpRemLen            = 16
+	xlpFirstIsContRecord = 0x0001
+
+	// block ids of the record headers that come before the data
+	xlrBlockIDDataShort   = 255
+	xlrBlockIDDataLong    = 254
+	xlrBlockIDOrigin      = 253
+	xlrBlockIDTopLevelXid = 252
+
+	rmXlogID         = 0
+	xlogSwitch       = 0x40
+	rmXactID         = 1
+	xactOpMask       = 0x70
+	xactCommit       = 0x00
+	xactAbort        = 0x20
+	xactCommitPrep   = 0x30
+	xactAbortPrep    = 0x40
+	walRecordAlign   = 8
+	walMinPageSize   = 1024
+	walMaxRecordSize = 1 << 30
+)
+
+// reads record bytes out of WAL pages, skipping the page header at the start of every page
+type walPageReader struct {
+	data     []byte
+	pageSize int
+}
+
+func (r walPageReader) headerSize(page int) int {
+	if binary.LittleEndian.Uint16(r.data[page+xlpInfo:])&xlpLongHeaderFl != 0 {
+		return xlpLongHdrSize
+	}
+	return xlpShortHdrSize
+}
+
+// n bytes of record data starting at pos, and where the data after them starts. false if data ends first
+func (r walPageReader) read(pos, n int) ([]byte, int, bool) {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if pos%r.pageSize == 0 {
+			if pos+xlpShortHdrSize > len(r.data) {
+				return nil, pos, false
+			}
+			pos += r.headerSize(pos)
+		}
+		take := min(n-len(out), r.pageSize-pos%r.pageSize)
+		if pos+take > len(r.data) {
+			return nil, pos, false
+		}
+		out = append(out, r.data[pos:pos+take]...)
+		pos += take
+	}
+	return out, pos, true
+}
+
+// calls fn with the LSN and the bytes of every record that starts in the segment at data[:segSize].
+// data may go on with the next segment, a record that continues into it is then read whole
+func walkWalRecords(data []byte, segStart uint64, segSize int, fn func(lsn uint64, rec []byte)) {
+	if len(data) < xlpLongHdrSize {
+		return
+	}
+	pageSize := int(binary.LittleEndian.Uint32(data[xlpXlogBlcksz:]))
+	if pageSize < walMinPageSize || pageSize&(pageSize-1) != 0 || segSize%pageSize != 0 {
+		return
+	}
+	r := walPageReader{data: data, pageSize: pageSize}
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+
+	// the first page may start with the end of a record from the previous segment
+	pos := r.headerSize(0)
+	if binary.LittleEndian.Uint16(data[xlpInfo:])&xlpFirstIsContRecord != 0 {
+		remLen := int(binary.LittleEndian.Uint32(data[xlpRemLen:]))
+		var ok bool
+		if _, pos, ok = r.read(pos, remLen); !ok {
+			return
+		}
+	}
+
+	var prevLsn uint64
+	for {
+		pos = (pos + walRecordAlign - 1) &^ (walRecordAlign - 1)
+		if pos%pageSize == 0 && pos+xlpShortHdrSize <= len(data) {
+			pos += r.headerSize(pos)
+		}
+		if pos >= segSize {
+			return
+		}
+		lsn := segStart + uint64(pos)
+
+		header, _, ok := r.read(pos, xlogRecordHeaderSize)
+		if !ok {
+			return
+		}
+		totLen := int(binary.LittleEndian.Uint32(header[xlrTotLen:]))
+		if totLen < xlogRecordHeaderSize || totLen > walMaxRecordSize {
+			return
+		}
+		if prevLsn != 0 && binary.LittleEndian.Uint64(header[xlrPrev:]) != prevLsn {
+			return
+		}
+		rec, end, ok := r.read(pos, totLen)
+		if !ok {
+			return
+		}
+		crc := crc32.Checksum(rec[xlogRecordHeaderSize:], castagnoli)
+		crc = crc32.Update(crc, castagnoli, rec[:xlrCrc])
+		if crc != binary.LittleEndian.Uint32(rec[xlrCrc:]) {
+			return
+		}
+
+		fn(lsn, rec)
+		prevLsn = lsn
+		pos = end
+
+		// the rest of the segment after a switch is padding
+		if rec[xlrRmid] == rmXlogID && rec[xlrInfo]&0xF0 == xlogSwitch {
+			return
+		}
+	}
+}
+
+// the commit or abort time of a transaction end record, false for every other record
+func walRecordXactTime(rec []byte) (time.Time, bool) {
+	if rec[xlrRmid] != rmXactID {
+		return time.Time{}, false
+	}
+	switch rec[xlrInfo] & xactOpMask {
+	case xactCommit, xactAbort, xactCommitPrep, xactAbortPrep:
+	default:
+		return time.Time{}, false
+	}
+
+	// transaction end records have no block references, only the origin/top level xid headers and the main data,
+	// which starts with xact_time
+	for p := xlogRecordHeaderSize; p < len(rec); {
+		switch rec[p] {
+		case xlrBlockIDOrigin:
+			p += 1 + 2
+		case xlrBlockIDTopLevelXid:
+			p += 1 + 4
+		case xlrBlockIDDataShort, xlrBlockIDDataLong:
+			if rec[p] == xlrBlockIDDataShort {
+				p += 1 + 1
+			} else {
+				p += 1 + 4
+			}
+			if p+8 > len(rec) {
+				return time.Time{}, false
+			}
+			usec := int64(binary.LittleEndian.Uint64(rec[p:]))
+			return pgEpoch.Add(time.Duration(usec) * time.Microsecond), true
+		default:
+			return time.Time{}, false
+		}
+	}
+	return time.Time{}, false
+}
+
+// when the newest transaction in the archived WAL from fromLsn on committed or aborted, and the LSN of that record.
+// segments are read newest first (the newest timeline of each), until one has a transaction end in it
+func (wm *WalManager) LastTransactionTime(fromLsn uint64) (time.Time, uint64, error) {
+	segments, _, err := wm.scanArchive()
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	segSize := wm.WalSegmentSize
+	type candidate struct {
+		seg archivedSegment
+		tli uint32
+	}
+	newest := map[uint64]candidate{}
+	for _, seg := range segments {
+		tli, segNo, err := ParseWalSegmentNumber(seg.file.Segment, segSize)
+		if err != nil || (segNo+1)*segSize <= fromLsn {
+			continue
+		}
+		if have, ok := newest[segNo]; !ok || tli > have.tli {
+			newest[segNo] = candidate{seg, tli}
+		}
+	}
+
+	var next []byte
+	nextSegNo := uint64(0)
+	for _, segNo := range slices.Backward(slices.Sorted(maps.Keys(newest))) {
+		seg := newest[segNo].seg
+		var buf bytes.Buffer
+		if _, err := ReadWalSegment(wm.storeFor(seg.name), seg.name, wm.Keys, &buf); err != nil {
+			return time.Time{}, 0, fmt.Errorf("reading %s: %w", seg.name, err)
+		}
+		data := buf.Bytes()
+		if next != nil && nextSegNo == segNo+1 {
+			data = append(data[:len(data):len(data)], next...)
+		}
+
+		// commit times follow the LSN order only roughly, concurrent commits can land in either order
+		var last time.Time
+		var lastLsn uint64
+		walkWalRecords(data, segNo*segSize, int(segSize), func(lsn uint64, rec []byte) {
+			if t, ok := walRecordXactTime(rec); ok && lsn >= fromLsn && t.After(last) {
+				last, lastLsn = t, lsn
+			}
+		})
+		if !last.IsZero() {
+			return last, lastLsn, nil
+		}
+		next, nextSegNo = buf.Bytes(), segNo
+	}
+	return time.Time{}, 0, fmt.Errorf("no transaction committed in the archived WAL since %s", FormatLsn(fromLsn))
+}
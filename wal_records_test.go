@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testWalPageSize = 8192
+
+// writes WAL the way the server lays it out: records 8 byte aligned, a page header on every page,
+// records that don't fit continue on the next page (or segment) behind a XLP_FIRST_IS_CONTRECORD header
+type testWalBuilder struct {
+	tli      uint32
+	startSeg uint64
+	buf      []byte
+	prevLsn  uint64
+	lsns     []uint64 // every record added
+}
+
+func newTestWalBuilder(tli uint32, startSeg uint64) *testWalBuilder {
+	return &testWalBuilder{tli: tli, startSeg: startSeg}
+}
+
+func (b *testWalBuilder) lsn() uint64 { return b.startSeg*testSegmentSize + uint64(len(b.buf)) }
+
+// the page header when the next byte starts a page, remLen is what's left of a record continuing on it
+func (b *testWalBuilder) pageHeader(remLen int) {
+	if len(b.buf)%testWalPageSize != 0 {
+		return
+	}
+	le := binary.LittleEndian
+	size, info := xlpShortHdrSize, uint16(0)
+	if len(b.buf)%testSegmentSize == 0 {
+		size, info = xlpLongHdrSize, xlpLongHeaderFl
+	}
+	if remLen > 0 {
+		info |= xlpFirstIsContRecord
+	}
+	h := make([]byte, size)
+	le.PutUint16(h[xlpMagic:], xlogPageMagic[16])
+	le.PutUint16(h[xlpInfo:], info)
+	le.PutUint32(h[xlpTli:], b.tli)
+	le.PutUint64(h[xlpPageAddr:], b.lsn())
+	le.PutUint32(h[xlpRemLen:], uint32(remLen))
+	if size == xlpLongHdrSize {
+		le.PutUint64(h[xlpSysid:], testSystemID)
+		le.PutUint32(h[xlpSegSize:], testSegmentSize)
+		le.PutUint32(h[xlpXlogBlcksz:], testWalPageSize)
+	}
+	b.buf = append(b.buf, h...)
+}
+
+// appends a record with main data only, returns its LSN
+func (b *testWalBuilder) add(rmid, info byte, main []byte) uint64 {
+	rec := make([]byte, xlogRecordHeaderSize)
+	rec[xlrInfo], rec[xlrRmid] = info, rmid
+	if len(main) < 256 {
+		rec = append(rec, xlrBlockIDDataShort, byte(len(main)))
+	} else {
+		rec = append(rec, xlrBlockIDDataLong)
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(len(main)))
+	}
+	rec = append(rec, main...)
+
+	for len(b.buf)%walRecordAlign != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	b.pageHeader(0)
+	lsn := b.lsn()
+	le := binary.LittleEndian
+	le.PutUint32(rec[xlrTotLen:], uint32(len(rec)))
+	le.PutUint64(rec[xlrPrev:], b.prevLsn)
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+	crc := crc32.Update(crc32.Checksum(rec[xlogRecordHeaderSize:], castagnoli), castagnoli, rec[:xlrCrc])
+	le.PutUint32(rec[xlrCrc:], crc)
+
+	for len(rec) > 0 {
+		b.pageHeader(len(rec))
+		n := min(len(rec), testWalPageSize-len(b.buf)%testWalPageSize)
+		b.buf = append(b.buf, rec[:n]...)
+		rec = rec[n:]
+	}
+	b.prevLsn = lsn
+	b.lsns = append(b.lsns, lsn)
+	return lsn
+}
+
+func (b *testWalBuilder) commit(at time.Time, extra int) uint64 {
+	main := binary.LittleEndian.AppendUint64(nil, uint64(at.Sub(pgEpoch).Microseconds()))
+	return b.add(rmXactID, xactCommit, append(main, make([]byte, extra)...))
+}
+
+// a heap record that isn't a transaction end
+func (b *testWalBuilder) other(size int) uint64 {
+	return b.add(10, 0, bytes.Repeat([]byte{0x5a}, size))
+}
+
+// an XLOG_SWITCH, the rest of the segment stays empty
+func (b *testWalBuilder) switchSegment() uint64 {
+	lsn := b.add(rmXlogID, xlogSwitch, nil)
+	for len(b.buf)%testSegmentSize != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	return lsn
+}
+
+// the WAL as segment files, the last one zero filled like a .partial
+func (b *testWalBuilder) segments() map[string][]byte {
+	data := slices.Clone(b.buf)
+	for len(data)%testSegmentSize != 0 {
+		data = append(data, 0)
+	}
+	segs := map[string][]byte{}
+	for i := 0; i < len(data); i += testSegmentSize {
+		segs[WalFileName(b.tli, b.startSeg+uint64(i/testSegmentSize), testSegmentSize)] = data[i : i+testSegmentSize]
+	}
+	return segs
+}
+
+var testCommitBase = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestWalkWalRecords(t *testing.T) {
+	b := newTestWalBuilder(1, 1)
+	var commits []uint64
+	for i := range 40 {
+		b.other(100 + i*37)
+		if i%10 == 9 {
+			commits = append(commits, b.commit(testCommitBase.Add(time.Duration(i)*time.Second), 0))
+		}
+	}
+	commits = append(commits, b.commit(testCommitBase.Add(time.Minute), 3*testWalPageSize)) // spans pages
+	for b.lsn() < 2*testSegmentSize-10000 {
+		b.other(4000)
+	}
+	for b.lsn() < 2*testSegmentSize-500 {
+		b.other(100)
+	}
+	crossing := b.commit(testCommitBase.Add(2*time.Minute), 1000) // starts in segment 1, ends in segment 2
+	after := b.commit(testCommitBase.Add(3*time.Minute), 0)
+	b.switchSegment()
+	b.commit(testCommitBase.Add(4*time.Minute), 0) // first record of segment 3
+	segs := b.segments()
+	seg1 := segs[WalFileName(1, 1, testSegmentSize)]
+	seg2 := segs[WalFileName(1, 2, testSegmentSize)]
+	if crossing/testSegmentSize != 1 || after/testSegmentSize != 2 {
+		t.Fatalf("test WAL isn't laid out as intended: %s, %s", FormatLsn(crossing), FormatLsn(after))
+	}
+
+	walk := func(data []byte, segNo uint64) (lsns []uint64, xacts map[uint64]time.Time) {
+		xacts = map[uint64]time.Time{}
+		walkWalRecords(data, segNo*testSegmentSize, testSegmentSize, func(lsn uint64, rec []byte) {
+			lsns = append(lsns, lsn)
+			if at, ok := walRecordXactTime(rec); ok {
+				xacts[lsn] = at
+			}
+		})
+		return lsns, xacts
+	}
+
+	// every record that starts in segment 1, the one crossing into segment 2 only when that's there
+	var want []uint64
+	for _, lsn := range b.lsns {
+		if lsn/testSegmentSize == 1 {
+			want = append(want, lsn)
+		}
+	}
+	lsns, xacts := walk(append(slices.Clone(seg1), seg2...), 1)
+	if !slices.Equal(lsns, want) {
+		t.Errorf("segment 1: %d records, want %d", len(lsns), len(want))
+	}
+	for i, lsn := range commits {
+		if !xacts[lsn].Equal(testCommitBase.Add([]time.Duration{9 * time.Second, 19 * time.Second, 29 * time.Second, 39 * time.Second, time.Minute}[i])) {
+			t.Errorf("commit at %s: %v", FormatLsn(lsn), xacts[lsn])
+		}
+	}
+	if !xacts[crossing].Equal(testCommitBase.Add(2 * time.Minute)) {
+		t.Errorf("commit crossing into segment 2: %v", xacts[crossing])
+	}
+	if lsns, _ := walk(seg1, 1); !slices.Equal(lsns, want[:len(want)-1]) {
+		t.Errorf("segment 1 alone: %d records, want all but the crossing one", len(lsns))
+	}
+
+	// segment 2 starts with the rest of the crossing record and ends with the switch
+	lsns, xacts = walk(seg2, 2)
+	if len(lsns) != 2 || lsns[0] != after || !xacts[after].Equal(testCommitBase.Add(3*time.Minute)) {
+		t.Errorf("segment 2: records %v, transactions %v", lsns, xacts)
+	}
+	if _, xacts := walk(segs[WalFileName(1, 3, testSegmentSize)], 3); len(xacts) != 1 {
+		t.Errorf("segment 3: %v", xacts)
+	}
+}
+
+func TestWalkWalRecordsStopsAtDamage(t *testing.T) {
+	b := newTestWalBuilder(1, 1)
+	b.commit(testCommitBase, 0)
+	damaged := b.commit(testCommitBase.Add(time.Second), 0)
+	b.commit(testCommitBase.Add(2*time.Second), 0)
+	seg := b.segments()[WalFileName(1, 1, testSegmentSize)]
+
+	for what, change := range map[string]func(data []byte){
+		"data":      func(data []byte) { data[damaged%testSegmentSize+xlogRecordHeaderSize+3] ^= 1 },
+		"back link": func(data []byte) { data[damaged%testSegmentSize+xlrPrev] ^= 1 },
+		"length":    func(data []byte) { binary.LittleEndian.PutUint32(data[damaged%testSegmentSize:], 10) },
+	} {
+		data := slices.Clone(seg)
+		change(data)
+		var n int
+		walkWalRecords(data, testSegmentSize, testSegmentSize, func(uint64, []byte) { n++ })
+		if n != 1 {
+			t.Errorf("changed %s: walked %d records, want only the one before it", what, n)
+		}
+	}
+}
+
+func TestWalRecordXactTime(t *testing.T) {
+	at := testCommitBase.Add(1234567 * time.Microsecond)
+	usec := binary.LittleEndian.AppendUint64(nil, uint64(at.Sub(pgEpoch).Microseconds()))
+	record := func(rmid, info byte, headers ...byte) []byte {
+		rec := make([]byte, xlogRecordHeaderSize)
+		rec[xlrInfo], rec[xlrRmid] = info, rmid
+		rec = append(rec, headers...)
+		rec = append(rec, xlrBlockIDDataShort, 8)
+		return append(rec, usec...)
+	}
+	for what, tc := range map[string]struct {
+		rec  []byte
+		want bool
+	}{
+		"commit":              {record(rmXactID, xactCommit), true},
+		"commit with info":    {record(rmXactID, xactCommit|0x80), true},
+		"abort":               {record(rmXactID, xactAbort), true},
+		"commit prepared":     {record(rmXactID, xactCommitPrep), true},
+		"abort prepared":      {record(rmXactID, xactAbortPrep), true},
+		"prepare":             {record(rmXactID, 0x10), false},
+		"assignment":          {record(rmXactID, 0x50), false},
+		"heap":                {record(10, xactCommit), false},
+		"with origin":         {record(rmXactID, xactCommit, xlrBlockIDOrigin, 1, 0), true},
+		"with top level xid":  {record(rmXactID, xactAbort, xlrBlockIDTopLevelXid, 1, 2, 3, 4), true},
+		"with a block ref":    {record(rmXactID, xactCommit, 0, 0, 0, 0), false},
+		"main data too short": {record(rmXactID, xactCommit)[:xlogRecordHeaderSize+2+4], false},
+	} {
+		got, ok := walRecordXactTime(tc.rec)
+		if ok != tc.want || (ok && !got.Equal(at)) {
+			t.Errorf("%s: %v, %v", what, got, ok)
+		}
+	}
+}
+
+// the builder's segments spooled and synced into wm's archive, partial is written as a .partial
+func writeTestWal(t *testing.T, wm *WalManager, b *testWalBuilder, partial string) {
+	t.Helper()
+	for name, data := range b.segments() {
+		if name == partial {
+			name += ".partial"
+		}
+		writeSpoolFile(t, wm, name, data)
+	}
+	if _, err := wm.SyncWalFiles(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLastTransactionTime(t *testing.T) {
+	wm := newTestWalManager(t, NewMemoryArchiveStore(), testKeyRing(t))
+	wm.Compression = CompressionGzip
+
+	b := newTestWalBuilder(1, 1)
+	b.commit(testCommitBase, 0)
+	newest := b.commit(testCommitBase.Add(2*time.Minute), 0)
+	b.commit(testCommitBase.Add(time.Minute), 0) // committed earlier, logged later
+	b.other(100)
+	b.switchSegment()
+	for b.lsn() < 3*testSegmentSize+1000 {
+		b.other(3000) // segment 2 and a .partial segment 3 without transactions
+	}
+	writeTestWal(t, wm, b, WalFileName(1, 3, testSegmentSize))
+
+	at, lsn, err := wm.LastTransactionTime(testSegmentSize)
+	if err != nil || !at.Equal(testCommitBase.Add(2*time.Minute)) || lsn != newest {
+		t.Errorf("LastTransactionTime = %v at %s, %v", at, FormatLsn(lsn), err)
+	}
+
+	// nothing since the backup started
+	if _, _, err := wm.LastTransactionTime(2 * testSegmentSize); err == nil {
+		t.Error("found a transaction after the last one")
+	}
+
+	// a newer timeline wins over the same segment of the old one
+	b2 := newTestWalBuilder(2, 3)
+	b2.commit(testCommitBase.Add(time.Hour), 0)
+	writeTestWal(t, wm, b2, "")
+	if at, _, err := wm.LastTransactionTime(testSegmentSize); err != nil || !at.Equal(testCommitBase.Add(time.Hour)) {
+		t.Errorf("with timeline 2: %v, %v", at, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+- WAL segment size math. initdb --wal-segsize can make segments any power of two from 1MB to 1GB,
+  and the size changes both how file names map to LSNs and how many segments fit in one "log id"
+- the size is learned once (primary, archive_info.json or the base backup's pg_control) and stored next to the archive,
+  together with the cluster's system identifier and major version so segment headers can be checked against them
+*/
+
+const (
+	minWalSegmentSize = 1 << 20 // 1MB
+	maxWalSegmentSize = 1 << 30 // 1GB
+
+	// an LSN's high 32 bits are the "log id" in segment file names
+	walBytesPerXLogId = 0x100000000
+
+	archiveInfoFile = "archive_info.json"
+)
+
+// facts about the cluster the archive belongs to, saved as archive_info.json in the archive dir
+type ArchiveInfo struct {
+	WalSegmentSize   uint64 `json:"wal_segment_size"`
+	SystemIdentifier uint64 `json:"system_identifier"`
+	ServerVersion    int    `json:"server_version"` // major version, decides the expected XLOG page magic
+}
+
+// segment sizes postgres accepts: a power of two between 1MB and 1GB
+func IsValidWalSegmentSize(size uint64) bool {
+	return size >= minWalSegmentSize && size <= maxWalSegmentSize && size&(size-1) == 0
+}
+
+// how many segments make up one log id (4GB of WAL)
+func SegmentsPerXLogId(segSize uint64) uint64 {
+	return walBytesPerXLogId / segSize
+}
+
+// turns a WAL file name into its timeline and absolute segment number
+// e.g. 000000010000000200000003 with 16MB segments is timeline 1, segment 2*256 + 3
+func ParseWalSegmentNumber(filename string, segSize uint64) (uint32, uint64, error) {
+	if !IsValidWalSegmentSize(segSize) {
+		return 0, 0, fmt.Errorf("invalid WAL segment size %d", segSize)
+	}
+	if _, _, valid := ParseWalFilename(filename); !valid {
+		return 0, 0, fmt.Errorf("not a WAL segment file name: %s", filename)
+	}
+
+	tli, _ := strconv.ParseUint(filename[:8], 16, 32)
+	logId, _ := strconv.ParseUint(filename[8:16], 16, 32)
+	segId, _ := strconv.ParseUint(filename[16:24], 16, 32)
+
+	perId := SegmentsPerXLogId(segSize)
+	if segId >= perId {
+		return 0, 0, fmt.Errorf("%s is not a valid name for %dMB segments (segment part must be below %X)", filename, segSize>>20, perId)
+	}
+
+	return uint32(tli), logId*perId + segId, nil
+}
+
+// builds a WAL file name, the inverse of ParseWalSegmentNumber
+func WalFileName(tli uint32, segNo uint64, segSize uint64) string {
+	perId := SegmentsPerXLogId(segSize)
+	return fmt.Sprintf("%08X%08X%08X", tli, uint32(segNo/perId), uint32(segNo%perId))
+}
+
+// first LSN in a segment and the first LSN after it
+func WalSegmentLsnRange(filename string, segSize uint64) (uint64, uint64, error) {
+	_, segNo, err := ParseWalSegmentNumber(filename, segSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := segNo * segSize
+	return start, start + segSize, nil
+}
+
+// reads archive_info.json, a missing file returns nil and no error
+func LoadArchiveInfo(archiveDir string) (*ArchiveInfo, error) {
+	data, err := os.ReadFile(filepath.Join(archiveDir, archiveInfoFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ArchiveInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", archiveInfoFile, err)
+	}
+	return info, nil
+}
+
+// writes archive_info.json atomically (temp file + rename)
+func SaveArchiveInfo(archiveDir string, info *ArchiveInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(archiveDir, archiveInfoFile), data, 0644)
+}
+
+// write to a temp file in the same dir, fsync, then rename over the target
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// asks the server for its segment size (pg_settings reports it in bytes), system identifier and major version
+func QueryArchiveInfo(ctx context.Context, conn *pgx.Conn) (*ArchiveInfo, error) {
+	var segSize string
+	var sysid int64
+	var versionNum int
+	err := conn.QueryRow(ctx, `
+		SELECT (SELECT setting FROM pg_settings WHERE name = 'wal_segment_size'),
+		       (SELECT system_identifier FROM pg_control_system()),
+		       current_setting('server_version_num')::int
+	`).Scan(&segSize, &sysid, &versionNum)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.ParseUint(segSize, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected wal_segment_size %q: %w", segSize, err)
+	}
+	return &ArchiveInfo{WalSegmentSize: size, SystemIdentifier: uint64(sysid), ServerVersion: versionNum / 10000}, nil
+}
+
+// works out which cluster the archive belongs to and makes sure every source agrees
+// archive_info.json wins, gaps are filled from the live primary, then from the latest base backup's pg_control
+// (backups is where the base backups are, keys is for an encrypted one)
+func ResolveArchiveInfo(ctx context.Context, archiveDir string, conn *pgx.Conn, backups ArchiveStore, keys *KeyRing) (*ArchiveInfo, error) {
+	info, err := LoadArchiveInfo(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		info = &ArchiveInfo{}
+	}
+	saved := *info
+
+	var fromPrimary *ArchiveInfo
+	if conn != nil {
+		if fromPrimary, err = QueryArchiveInfo(ctx, conn); err != nil {
+			fmt.Printf("Warning: could not read cluster info from primary: %v\n", err)
+		}
+	}
+
+	if fromPrimary != nil {
+		if info.WalSegmentSize != 0 && info.WalSegmentSize != fromPrimary.WalSegmentSize {
+			return nil, fmt.Errorf("primary uses %d byte WAL segments but the archive holds %d byte segments, the archive belongs to another cluster",
+				fromPrimary.WalSegmentSize, info.WalSegmentSize)
+		}
+		if info.SystemIdentifier != 0 && info.SystemIdentifier != fromPrimary.SystemIdentifier {
+			return nil, fmt.Errorf("primary has system identifier %d but the archive belongs to %d, clear the archive after rebuilding the servers",
+				fromPrimary.SystemIdentifier, info.SystemIdentifier)
+		}
+		if info.ServerVersion != 0 && info.ServerVersion != fromPrimary.ServerVersion {
+			return nil, fmt.Errorf("primary runs PostgreSQL %d but the archive was written by %d", fromPrimary.ServerVersion, info.ServerVersion)
+		}
+		info = fromPrimary
+	} else if info.WalSegmentSize == 0 || info.SystemIdentifier == 0 || info.ServerVersion == 0 {
+		// primary is down and we never recorded everything, the base backup knows it
+		backup, err := LoadLatestBackupInfo(backups, keys)
+		if err != nil {
+			return nil, fmt.Errorf("archive info unknown: primary unreachable and no base backup to read it from: %w", err)
+		}
+		if info.WalSegmentSize == 0 {
+			info.WalSegmentSize = backup.Control.WalSegmentSize
+		}
+		if info.SystemIdentifier == 0 {
+			info.SystemIdentifier = backup.Control.SystemIdentifier
+		}
+		if info.ServerVersion == 0 {
+			info.ServerVersion = backup.Control.MajorVersion()
+		}
+	}
+
+	if !IsValidWalSegmentSize(info.WalSegmentSize) {
+		return nil, fmt.Errorf("invalid WAL segment size %d", info.WalSegmentSize)
+	}
+	if *info != saved {
+		if err := SaveArchiveInfo(archiveDir, info); err != nil {
+			return nil, fmt.Errorf("failed to save %s: %w", archiveInfoFile, err)
+		}
+	}
+	return info, nil
+}
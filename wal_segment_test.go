@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestIsValidWalSegmentSize(t *testing.T) {
+	for size, want := range map[uint64]bool{
+		1 << 20:    true,
+		2 << 20:    true,
+		16 << 20:   true,
+		64 << 20:   true,
+		1 << 30:    true,
+		0:          false,
+		1 << 19:    false,
+		2 << 30:    false,
+		48 << 20:   false,
+		16<<20 + 1: false,
+	} {
+		if IsValidWalSegmentSize(size) != want {
+			t.Errorf("%d: want %v", size, want)
+		}
+	}
+}
+
+func TestWalSegmentLsnRange(t *testing.T) {
+	for _, tc := range []struct {
+		segSize    uint64
+		name       string
+		tli        uint32
+		segNo      uint64
+		start, end string
+	}{
+		// 1MB: 4096 segments per log id
+		{1 << 20, "000000010000000000000000", 1, 0, "0/0", "0/100000"},
+		{1 << 20, "000000010000000000000FFF", 1, 0xFFF, "0/FFF00000", "1/0"},
+		{1 << 20, "000000020000000100000000", 2, 0x1000, "1/0", "1/100000"},
+		{1 << 20, "0000000100000003000000A5", 1, 3*0x1000 + 0xA5, "3/A500000", "3/A600000"},
+
+		// 16MB, the default: 256 per log id
+		{16 << 20, "000000010000000000000001", 1, 1, "0/1000000", "0/2000000"},
+		{16 << 20, "0000000100000000000000FF", 1, 0xFF, "0/FF000000", "1/0"},
+		{16 << 20, "00000003000000160000003B", 3, 0x16*0x100 + 0x3B, "16/3B000000", "16/3C000000"},
+
+		// 64MB: 64 per log id
+		{64 << 20, "000000010000000000000001", 1, 1, "0/4000000", "0/8000000"},
+		{64 << 20, "00000001000000000000003F", 1, 0x3F, "0/FC000000", "1/0"},
+		{64 << 20, "000000010000000500000020", 1, 5*64 + 0x20, "5/80000000", "5/84000000"},
+
+		// 1GB: 4 per log id
+		{1 << 30, "000000010000000000000003", 1, 3, "0/C0000000", "1/0"},
+		{1 << 30, "000000010000000100000000", 1, 4, "1/0", "1/40000000"},
+		{1 << 30, "0000000A000000FF00000002", 10, 0xFF*4 + 2, "FF/80000000", "FF/C0000000"},
+	} {
+		tli, segNo, err := ParseWalSegmentNumber(tc.name, tc.segSize)
+		if err != nil || tli != tc.tli || segNo != tc.segNo {
+			t.Errorf("%dMB %s: timeline %d segment %X, %v", tc.segSize>>20, tc.name, tli, segNo, err)
+			continue
+		}
+		if got := WalFileName(tc.tli, tc.segNo, tc.segSize); got != tc.name {
+			t.Errorf("%dMB: WalFileName(%d, %X) = %s, want %s", tc.segSize>>20, tc.tli, tc.segNo, got, tc.name)
+		}
+		start, end, err := WalSegmentLsnRange(tc.name, tc.segSize)
+		if err != nil || FormatLsn(start) != tc.start || FormatLsn(end) != tc.end {
+			t.Errorf("%dMB %s: %s - %s, %v, want %s - %s", tc.segSize>>20, tc.name, FormatLsn(start), FormatLsn(end), err, tc.start, tc.end)
+		}
+	}
+}
+
+func TestWalSegmentLsnRangeRejects(t *testing.T) {
+	for _, tc := range []struct {
+		segSize uint64
+		name    string
+	}{
+		{1 << 20, "000000010000000000001000"},  // segment part must stay below 4096
+		{16 << 20, "000000010000000000000100"}, // and below 256
+		{64 << 20, "000000010000000000000040"}, // and below 64
+		{1 << 30, "000000010000000000000004"},  // and below 4
+		{16 << 20, "00000001000000000000001"},
+		{16 << 20, "0000000100000000000000010"},
+		{16 << 20, "00000001000000000000000G"},
+		{16 << 20, "000000010000000000000001.partial"},
+		{16 << 20, "00000002.history"},
+		{48 << 20, "000000010000000000000001"}, // not a power of two
+		{0, "000000010000000000000001"},
+	} {
+		if start, end, err := WalSegmentLsnRange(tc.name, tc.segSize); err == nil {
+			t.Errorf("%d %s: %s - %s, want an error", tc.segSize, tc.name, FormatLsn(start), FormatLsn(end))
+		}
+	}
+}
+
+// every segment of a size round trips through its name, across log id boundaries
+func TestWalFileNameRoundTrip(t *testing.T) {
+	for _, segSize := range []uint64{1 << 20, 16 << 20, 64 << 20, 1 << 30} {
+		perId := SegmentsPerXLogId(segSize)
+		for _, segNo := range []uint64{0, 1, perId - 1, perId, perId + 1, 7*perId - 1, 0xFFFFFFFF * perId} {
+			name := WalFileName(7, segNo, segSize)
+			tli, got, err := ParseWalSegmentNumber(name, segSize)
+			if err != nil || tli != 7 || got != segNo {
+				t.Errorf("%dMB segment %X: %s parses as %d %X, %v", segSize>>20, segNo, name, tli, got, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+- checks the long page header at the start of every finished WAL segment
+- a good name isn't enough: truncated copies, zero filled files and segments from another cluster
+  all look fine from the file name and size alone, and we'd only find out during a restore
+*/
+
+// XLOG_PAGE_MAGIC changes with every major version that changes the WAL format
+var xlogPageMagic = map[int]uint16{
+	13: 0xD106,
+	14: 0xD10D,
+	15: 0xD110,
+	16: 0xD113,
+	17: 0xD116,
+}
+
+// XLogLongPageHeaderData layout, written in the server's byte order (little endian on everything we run)
+const (
+	xlpMagic        = 0
+	xlpInfo         = 2
+	xlpTli          = 4
+	xlpPageAddr     = 8
+	xlpSysid        = 24
+	xlpSegSize      = 32
+	xlpXlogBlcksz   = 36
+	xlpLongHdrSize  = 40
+	xlpLongHeaderFl = 0x0002 // XLP_LONG_HEADER in xlp_info
+)
+
+// what the header of a segment should say
+type WalHeaderExpectation struct {
+	SegmentSize      uint64
+	SystemIdentifier uint64
+	ServerVersion    int
+}
+
+// checks a finished segment's first page header (see ReadWalSegment) against the file name and the cluster
+// filename is the plain segment name, compressed segments are checked on their decompressed content
+func ValidateWalSegment(content WalSegmentContent, filename string, expect WalHeaderExpectation) error {
+	if uint64(content.Size) != expect.SegmentSize {
+		return fmt.Errorf("size is %d bytes, a finished segment is %d (truncated or padded file)", content.Size, expect.SegmentSize)
+	}
+
+	header := content.Header
+	if len(header) < xlpLongHdrSize {
+		return fmt.Errorf("could not read page header: %w", io.ErrUnexpectedEOF)
+	}
+	if bytes.Equal(header, make([]byte, xlpLongHdrSize)) {
+		return fmt.Errorf("page header is all zeros (zero filled or preallocated file)")
+	}
+
+	le := binary.LittleEndian
+	magic := le.Uint16(header[xlpMagic:])
+	if want, ok := xlogPageMagic[expect.ServerVersion]; ok && magic != want {
+		return fmt.Errorf("XLOG page magic is %04X, PostgreSQL %d writes %04X", magic, expect.ServerVersion, want)
+	} else if !ok {
+		known := false
+		for _, m := range xlogPageMagic {
+			known = known || m == magic
+		}
+		if !known {
+			return fmt.Errorf("XLOG page magic %04X is not a known PostgreSQL WAL format", magic)
+		}
+	}
+
+	if le.Uint16(header[xlpInfo:])&xlpLongHeaderFl == 0 {
+		return fmt.Errorf("first page has no long header")
+	}
+
+	// after a timeline switch the first segment of the new timeline starts with pages of the old one,
+	// so the header may name an older timeline but never a newer one
+	nameTli, segNo, err := ParseWalSegmentNumber(filename, expect.SegmentSize)
+	if err != nil {
+		return err
+	}
+	if tli := le.Uint32(header[xlpTli:]); tli == 0 || tli > nameTli {
+		return fmt.Errorf("page header timeline %d does not match file name timeline %d", tli, nameTli)
+	}
+
+	if addr, want := le.Uint64(header[xlpPageAddr:]), segNo*expect.SegmentSize; addr != want {
+		return fmt.Errorf("page address %s does not match file name (expected %s)", FormatLsn(addr), FormatLsn(want))
+	}
+
+	if sysid := le.Uint64(header[xlpSysid:]); expect.SystemIdentifier != 0 && sysid != expect.SystemIdentifier {
+		return fmt.Errorf("system identifier %d does not match the cluster (%d), segment belongs to another database system", sysid, expect.SystemIdentifier)
+	}
+
+	if segSize := uint64(le.Uint32(header[xlpSegSize:])); segSize != expect.SegmentSize {
+		return fmt.Errorf("header says %d byte segments, archive uses %d", segSize, expect.SegmentSize)
+	}
+
+	if blcksz := le.Uint32(header[xlpXlogBlcksz:]); blcksz == 0 || blcksz&(blcksz-1) != 0 {
+		return fmt.Errorf("invalid WAL block size %d in header", blcksz)
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// the long page header a server of the given major version writes at the start of segment segNo
+func testLongPageHeader(version int, tli uint32, segNo uint64, segSize uint64) []byte {
+	le := binary.LittleEndian
+	h := make([]byte, xlpLongHdrSize)
+	le.PutUint16(h[xlpMagic:], xlogPageMagic[version])
+	le.PutUint16(h[xlpInfo:], xlpLongHeaderFl)
+	le.PutUint32(h[xlpTli:], tli)
+	le.PutUint64(h[xlpPageAddr:], segNo*segSize)
+	le.PutUint64(h[xlpSysid:], testSystemID)
+	le.PutUint32(h[xlpSegSize:], uint32(segSize))
+	le.PutUint32(h[xlpXlogBlcksz:], 8192)
+	return h
+}
+
+func TestValidateWalSegmentAcceptsEveryVersion(t *testing.T) {
+	for version := 13; version <= 17; version++ {
+		for _, segSize := range []uint64{1 << 20, 16 << 20, 1 << 30} {
+			segNo := SegmentsPerXLogId(segSize) + 2 // past the first log id
+			name := WalFileName(3, segNo, segSize)
+			content := WalSegmentContent{Header: testLongPageHeader(version, 3, segNo, segSize), Size: int64(segSize)}
+			expect := WalHeaderExpectation{SegmentSize: segSize, SystemIdentifier: testSystemID, ServerVersion: version}
+			if err := ValidateWalSegment(content, name, expect); err != nil {
+				t.Errorf("PostgreSQL %d, %dMB %s: %v", version, segSize>>20, name, err)
+			}
+
+			// without a known version or system identifier any known magic and sysid is fine
+			if err := ValidateWalSegment(content, name, WalHeaderExpectation{SegmentSize: segSize}); err != nil {
+				t.Errorf("PostgreSQL %d, %dMB %s without expectations: %v", version, segSize>>20, name, err)
+			}
+		}
+	}
+}
+
+func TestValidateWalSegmentRejects(t *testing.T) {
+	const segSize = 16 << 20
+	name := "000000030000000100000002"
+	segNo := uint64(0x102)
+	expect := WalHeaderExpectation{SegmentSize: segSize, SystemIdentifier: testSystemID, ServerVersion: 16}
+	le := binary.LittleEndian
+
+	for _, tc := range []struct {
+		what    string
+		change  func(c *WalSegmentContent)
+		expect  func(e *WalHeaderExpectation)
+		wantErr string
+	}{
+		{"magic of another version", func(c *WalSegmentContent) { le.PutUint16(c.Header[xlpMagic:], xlogPageMagic[15]) }, nil, "magic is D110, PostgreSQL 16 writes D113"},
+		{"garbage magic", func(c *WalSegmentContent) { le.PutUint16(c.Header[xlpMagic:], 0x1234) }, nil, "magic is 1234"},
+		{"garbage magic, version unknown", func(c *WalSegmentContent) { le.PutUint16(c.Header[xlpMagic:], 0x1234) },
+			func(e *WalHeaderExpectation) { e.ServerVersion = 0 }, "1234 is not a known PostgreSQL WAL format"},
+		{"big endian magic", func(c *WalSegmentContent) { binary.BigEndian.PutUint16(c.Header[xlpMagic:], xlogPageMagic[16]) }, nil, "magic is 13D1"},
+		{"another cluster", func(c *WalSegmentContent) { le.PutUint64(c.Header[xlpSysid:], testSystemID+1) }, nil, "segment belongs to another database system"},
+		{"other segment size in header", func(c *WalSegmentContent) { le.PutUint32(c.Header[xlpSegSize:], 64<<20) }, nil, "header says 67108864 byte segments, archive uses 16777216"},
+		{"archive expects other size", nil, func(e *WalHeaderExpectation) { e.SegmentSize = 1 << 30 }, "a finished segment is 1073741824"},
+		{"truncated", func(c *WalSegmentContent) { c.Size = segSize - 8192 }, nil, "truncated or padded"},
+		{"padded", func(c *WalSegmentContent) { c.Size = segSize + 1 }, nil, "truncated or padded"},
+		{"short header", func(c *WalSegmentContent) { c.Header = c.Header[:24] }, nil, "could not read page header"},
+		{"zero filled", func(c *WalSegmentContent) { c.Header = make([]byte, xlpLongHdrSize) }, nil, "all zeros"},
+		{"short page header flag", func(c *WalSegmentContent) { le.PutUint16(c.Header[xlpInfo:], 0) }, nil, "no long header"},
+		{"newer timeline in header", func(c *WalSegmentContent) { le.PutUint32(c.Header[xlpTli:], 4) }, nil, "timeline 4 does not match file name timeline 3"},
+		{"timeline 0", func(c *WalSegmentContent) { le.PutUint32(c.Header[xlpTli:], 0) }, nil, "timeline 0"},
+		{"page address of another segment", func(c *WalSegmentContent) { le.PutUint64(c.Header[xlpPageAddr:], 0x101*segSize) }, nil, "page address 1/1000000 does not match file name (expected 1/2000000)"},
+		{"block size", func(c *WalSegmentContent) { le.PutUint32(c.Header[xlpXlogBlcksz:], 8000) }, nil, "invalid WAL block size 8000"},
+	} {
+		content := WalSegmentContent{Header: testLongPageHeader(16, 3, segNo, segSize), Size: segSize}
+		e := expect
+		if tc.change != nil {
+			tc.change(&content)
+		}
+		if tc.expect != nil {
+			tc.expect(&e)
+		}
+		err := ValidateWalSegment(content, name, e)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: %v, want %q", tc.what, err, tc.wantErr)
+		}
+	}
+}
+
+// the first segment of a new timeline starts with the parent's pages
+func TestValidateWalSegmentOlderTimelineInHeader(t *testing.T) {
+	const segSize = 16 << 20
+	content := WalSegmentContent{Header: testLongPageHeader(17, 1, 3, segSize), Size: segSize}
+	expect := WalHeaderExpectation{SegmentSize: segSize, SystemIdentifier: testSystemID, ServerVersion: 17}
+	if err := ValidateWalSegment(content, "000000020000000000000003", expect); err != nil {
+		t.Error(err)
+	}
+}